@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const redacted = "[redacted]"
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	// coordinatePattern matches fractional numbers, coordinates are hardly ever whole.
+	coordinatePattern = regexp.MustCompile(`-?[0-9]+\.[0-9]+`)
+	// tokenPattern matches JWTs like share tokens and download links.
+	tokenPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+// Query parameters and path parameters that are locations or credentials whatever their
+// value looks like.
+var (
+	redactedParams = map[string]bool{
+		"lat": true, "lon": true, "lng": true, "latitude": true, "longitude": true,
+		"bbox": true, "near": true, "point": true, "center": true, "polygon": true, "area": true,
+		"token": true, "access_token": true, "key": true, "api_key": true, "signature": true,
+		"password": true, "email": true,
+	}
+	redactedPathParams = map[string]bool{"token": true, "x": true, "y": true}
+	redactedHeaders    = map[string]bool{
+		"Authorization": true, "Proxy-Authorization": true, "Cookie": true, "Set-Cookie": true,
+		"X-Api-Key": true, "X-Auth-Token": true,
+	}
+)
+
+// AccessLogEntry is the JSON line logged for a request. Locations, emails and
+// credentials are redacted and remote addresses truncated to their network, a log of
+// where users look at the map is a privacy problem of its own.
+type AccessLogEntry struct {
+	Time     string            `json:"time"`
+	ID       string            `json:"id,omitempty"`
+	RemoteIP string            `json:"remote_ip,omitempty"`
+	Host     string            `json:"host"`
+	Method   string            `json:"method"`
+	Route    string            `json:"route,omitempty"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query,omitempty"`
+	Status   int               `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Latency  string            `json:"latency"`
+	BytesIn  int64             `json:"bytes_in"`
+	BytesOut int64             `json:"bytes_out"`
+	UserID   string            `json:"user_id,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Sampled  bool              `json:"sampled,omitempty"`
+}
+
+var accessLogFiles = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: map[string]*os.File{}}
+
+// accessLogOutput opens the log file once, tenants share it.
+func accessLogOutput(name string) (io.Writer, error) {
+	if name == "stdout" {
+		return os.Stdout, nil
+	}
+
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+
+	if f, ok := accessLogFiles.files[name]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("can't open access log: %w", err)
+	}
+
+	accessLogFiles.files[name] = f
+	return f, nil
+}
+
+// accessLog logs requests to ACCESS_LOG. Successful requests are logged at the sample
+// rate, requests failing with a status of 400 or more always are. Sampled entries are
+// marked, so counts can be scaled back up.
+func accessLog(cfg Config) (echo.MiddlewareFunc, error) {
+	if cfg.AccessLog == "off" {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}, nil
+	}
+
+	out, err := accessLogOutput(cfg.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	rate := cfg.AccessLogSampleRate
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			if status < http.StatusBadRequest && rate < 1 && rand.Float64() >= rate {
+				return nil
+			}
+
+			entry := accessLogEntry(c, cfg.AccessLogHeaders, start, err)
+			entry.Sampled = status < http.StatusBadRequest && rate < 1
+
+			// Query strings stay readable without & escaped for HTML.
+			var line bytes.Buffer
+			enc := json.NewEncoder(&line)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(entry); err != nil {
+				c.Logger().Error(err)
+				return nil
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if _, err := out.Write(line.Bytes()); err != nil {
+				c.Logger().Error(err)
+			}
+
+			return nil
+		}
+	}, nil
+}
+
+func accessLogEntry(c echo.Context, headers []string, start time.Time, err error) AccessLogEntry {
+	req, res := c.Request(), c.Response()
+	entry := AccessLogEntry{
+		Time:     start.UTC().Format(time.RFC3339Nano),
+		ID:       res.Header().Get(echo.HeaderXRequestID),
+		RemoteIP: truncateIP(c.RealIP()),
+		Host:     req.Host,
+		Method:   req.Method,
+		Route:    redactText(c.Path()),
+		Path:     redactPath(c),
+		Query:    redactQuery(req.URL.Query()),
+		Status:   res.Status,
+		Latency:  time.Since(start).String(),
+		BytesIn:  req.ContentLength,
+		BytesOut: res.Size,
+	}
+
+	if err != nil {
+		entry.Error = redactText(err.Error())
+	}
+
+	if user, ok := currentUser(c); ok {
+		entry.UserID = user.ID
+	}
+
+	for _, name := range headers {
+		name = http.CanonicalHeaderKey(name)
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		if entry.Headers == nil {
+			entry.Headers = map[string]string{}
+		}
+
+		switch {
+		case redactedHeaders[name]:
+			entry.Headers[name] = redacted
+		case name == "Referer":
+			entry.Headers[name] = redactURL(value)
+		default:
+			entry.Headers[name] = redactText(value)
+		}
+	}
+
+	return entry
+}
+
+// redactPath returns the request path with the values of location and credential path
+// parameters left out, e.g. /tiles/15/:x/:y.
+func redactPath(c echo.Context) string {
+	route := c.Path()
+	if route == "" || !strings.Contains(route, ":") && !strings.Contains(route, "*") {
+		return redactText(c.Request().URL.Path)
+	}
+
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":") && !redactedPathParams[segment[1:]]:
+			segments[i] = redactText(c.Param(segment[1:]))
+		case segment == "*":
+			segments[i] = redactText(c.Param("*"))
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func redactQuery(query url.Values) string {
+	for key, values := range query {
+		for i, value := range values {
+			if redactedParams[strings.ToLower(key)] {
+				values[i] = redacted
+			} else {
+				values[i] = redactText(value)
+			}
+		}
+	}
+
+	// Encoded brackets would make the redacted values hard to read.
+	return strings.ReplaceAll(query.Encode(), url.QueryEscape(redacted), redacted)
+}
+
+func redactURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return redacted
+	}
+
+	u.User = nil
+	u.Path = redactText(u.Path)
+	u.RawPath = ""
+	u.RawQuery = redactQuery(u.Query())
+	u.Fragment = ""
+	return u.String()
+}
+
+// redactText replaces emails, tokens and coordinates in free text.
+func redactText(s string) string {
+	s = emailPattern.ReplaceAllString(s, redacted)
+	s = tokenPattern.ReplaceAllString(s, redacted)
+	return coordinatePattern.ReplaceAllString(s, redacted)
+}
+
+// truncateIP keeps the network of the address, /24 for IPv4 and /48 for IPv6.
+func truncateIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultUsersLimit = 50
+	maxUsersLimit     = 500
+)
+
+type UserDetails struct {
+	UserRecord `bson:",inline"`
+	Usage      Usage `json:"usage"`
+}
+
+// deleteUserContent removes everything a user created and their reactions to other
+// users' content. The user record itself stays so the account can still be disabled.
+func deleteUserContent(ctx context.Context, db *mongo.Database, id string) (int, error) {
+	cursor, err := db.Collection("markers").Find(ctx, bson.M{"ownerId": id}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+
+	var markers []Marker
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return 0, err
+	}
+
+	for _, marker := range markers {
+		if err := deleteMarker(ctx, db, marker.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	cursor, err = db.Collection("likes").Find(ctx, bson.M{"userId": id})
+	if err != nil {
+		return 0, err
+	}
+
+	var likes []Like
+	if err := cursor.All(context.Background(), &likes); err != nil {
+		return 0, err
+	}
+
+	for _, like := range likes {
+		if _, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": like.MarkerID}, bson.M{"$inc": bson.M{"likeCount": -1}}); err != nil {
+			return 0, err
+		}
+	}
+
+	for name, field := range map[string]string{
+		"likes":       "userId",
+		"favorites":   "userId",
+		"comments":    "authorId",
+		"collections": "ownerId",
+		"routes":      "ownerId",
+		"devices":     "userId",
+		"geofences":   "userId",
+	} {
+		if _, err := db.Collection(name).DeleteMany(ctx, bson.M{field: id}); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(markers), nil
+}
+
+func registerAdminRoutes(group *echo.Group, db *mongo.Database, users *userDirectory) {
+	group.GET("/users", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultUsersLimit, maxUsersLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter := bson.M{}
+		if q := c.QueryParam("q"); q != "" {
+			pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+			filter = bson.M{"$or": bson.A{
+				bson.M{"_id": pattern},
+				bson.M{"name": pattern},
+				bson.M{"email": pattern},
+			}}
+		}
+
+		cursor, err := db.Collection("users").Find(c.Request().Context(), filter, options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []UserRecord{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.GET("/users/:id", func(c echo.Context) error {
+		var details UserDetails
+		if err := db.Collection("users").FindOne(c.Request().Context(), bson.M{"_id": c.Param("id")}).Decode(&details.UserRecord); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "user not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		usage, err := userUsage(c.Request().Context(), db, details.ID, "")
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		details.Usage = usage
+		return c.JSON(http.StatusOK, details)
+	})
+	setDisabled := func(disabled bool) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id := c.Param("id")
+			res, err := db.Collection("users").UpdateOne(c.Request().Context(), bson.M{"_id": id}, bson.M{"$set": bson.M{"disabled": disabled}})
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if res.MatchedCount == 0 {
+				s := "user not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			users.forget(id)
+
+			action := "users.enable"
+			if disabled {
+				action = "users.disable"
+			}
+
+			admin, _ := currentUser(c)
+			if err := recordAudit(c.Request().Context(), db, admin.ID, action, nil, bson.M{"userId": id}); err != nil {
+				c.Logger().Error(err)
+			}
+
+			return c.NoContent(http.StatusOK)
+		}
+	}
+	group.POST("/users/:id/disable", setDisabled(true))
+	group.POST("/users/:id/enable", setDisabled(false))
+	group.DELETE("/users/:id/content", func(c echo.Context) error {
+		id := c.Param("id")
+		markers, err := deleteUserContent(c.Request().Context(), db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		admin, _ := currentUser(c)
+		if err := recordAudit(c.Request().Context(), db, admin.ID, "users.delete-content", nil, bson.M{"userId": id, "markers": markers}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
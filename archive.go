@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// archiveCollection keeps markers nobody changed for a long time, so the markers
+// collection and its indexes stay small. Archived markers are read-only until restored.
+const archiveCollection = "markers_archive"
+
+// includeArchived reads ?include=archived.
+func includeArchived(c echo.Context) (bool, error) {
+	param := c.QueryParam("include")
+	if param == "" {
+		return false, nil
+	}
+
+	archived := false
+	for _, item := range strings.Split(param, ",") {
+		switch strings.TrimSpace(item) {
+		case "archived":
+			archived = true
+		default:
+			return false, fmt.Errorf("invalid include %q, expected archived", item)
+		}
+	}
+
+	return archived, nil
+}
+
+// findMarkers queries markers, optionally together with archived ones. A limit of 0
+// returns all of them.
+func findMarkers(ctx context.Context, db *mongo.Database, archived bool, filter bson.M, sort bson.D, projection bson.M, limit int64) (*mongo.Cursor, error) {
+	if !archived {
+		opts := options.Find().SetProjection(projection).SetBatchSize(1000)
+		if sort != nil {
+			opts.SetSort(sort)
+		}
+
+		if limit > 0 {
+			opts.SetLimit(limit)
+		}
+
+		return db.Collection("markers").Find(ctx, filter, opts)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$unionWith", Value: bson.M{
+			"coll":     archiveCollection,
+			"pipeline": bson.A{bson.M{"$match": filter}},
+		}}},
+	}
+	if sort != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sort}})
+	}
+
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	if projection != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+
+	return db.Collection("markers").Aggregate(ctx, pipeline, options.Aggregate().SetBatchSize(1000))
+}
+
+// archiveCold moves markers that weren't updated since the cutoff to the archive, it runs
+// as the archive-markers job.
+func archiveCold(ctx context.Context, db *mongo.Database, logger echo.Logger, cutoff time.Time) error {
+	cursor, err := db.Collection("markers").Find(ctx, bson.M{"updatedAt": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	archived := 0
+	defer func() {
+		if archived > 0 {
+			logger.Infof("archived %d markers not updated since %s", archived, cutoff.Format(time.RFC3339))
+		}
+	}()
+
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		ok, err := archiveMarker(ctx, db, marker)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			archived++
+		}
+	}
+
+	return cursor.Err()
+}
+
+// archiveMarker copies the marker to the archive and removes it from markers in one
+// transaction unless it was updated in the meantime. Comments and likes stay so
+// restoring loses nothing.
+func archiveMarker(ctx context.Context, db *mongo.Database, marker Marker) (bool, error) {
+	now := time.Now().UTC()
+	marker.ArchivedAt = &now
+
+	archived := false
+	err := inTransaction(ctx, db, func(ctx context.Context) error {
+		archived = false
+		if _, err := db.Collection(archiveCollection).ReplaceOne(ctx, bson.M{"_id": marker.ID}, marker, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+
+		res, err := db.Collection("markers").DeleteOne(ctx, bson.M{"_id": marker.ID, "updatedAt": marker.UpdatedAt})
+		if err != nil {
+			return err
+		}
+
+		// The copy is removed again rather than rolled back, standalone servers run
+		// this without a transaction.
+		if res.DeletedCount == 0 {
+			_, err := db.Collection(archiveCollection).DeleteOne(ctx, bson.M{"_id": marker.ID})
+			return err
+		}
+
+		// Archived markers are gone for sync clients until they are restored.
+		if err := recordTombstone(ctx, db, marker.ID); err != nil {
+			return err
+		}
+
+		archived = true
+		return appendEvent(ctx, db, EventMarkerArchived, marker.ID, &marker)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return archived, nil
+}
+
+// registerArchiveRoutes lets owners bring archived markers back.
+func registerArchiveRoutes(group *echo.Group, db *mongo.Database) {
+	group.POST("/:id/restore", func(c echo.Context) error {
+		id := c.Param("id")
+		ctx := c.Request().Context()
+
+		var marker Marker
+		if err := db.Collection(archiveCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&marker); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "archived marker not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !canModify(c, marker.OwnerID) {
+			s := "only the owner can restore this marker"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+
+		marker.ArchivedAt = nil
+		marker.UpdatedAt = time.Now().UTC()
+		marker.Revision++
+		err := inTransaction(ctx, db, func(ctx context.Context) error {
+			if err := insertMarker(ctx, db, marker); err != nil {
+				return err
+			}
+
+			_, err := db.Collection(archiveCollection).DeleteOne(ctx, bson.M{"_id": id})
+			return err
+		})
+		if err != nil {
+			var mongoErr mongo.WriteException
+			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+				s := "a marker with this id exists"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusConflict, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
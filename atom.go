@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	atomContentType = "application/atom+xml; charset=utf-8"
+	maxAtomEntries  = 50
+	// atomMaxAge lets feed readers and proxies poll without reaching the server.
+	atomMaxAge = 10 * time.Minute
+)
+
+// AtomFeed is an Atom feed of markers, see RFC 4287. Locations are GeoRSS points.
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	GeoRSS  string      `xml:"xmlns:georss,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  AtomAuthor  `xml:"author"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type AtomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type AtomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Links      []AtomLink     `xml:"link"`
+	Categories []AtomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+	Point      string         `xml:"georss:point"`
+}
+
+// atomEntry describes the marker, its images are enclosures.
+func atomEntry(base string, m Marker) AtomEntry {
+	link := base + "/markers/" + m.ID
+	entry := AtomEntry{
+		ID:        link,
+		Title:     m.Name,
+		Published: m.CreatedAt.UTC().Format(time.RFC3339),
+		Updated:   m.UpdatedAt.UTC().Format(time.RFC3339),
+		Links:     []AtomLink{{Rel: "alternate", Href: link}},
+		Summary:   m.Description,
+		Point:     fmt.Sprintf("%g %g", m.Location.Latitude, m.Location.Longitude),
+	}
+	if m.LocalizedName != "" {
+		entry.Title = m.LocalizedName
+	}
+
+	for _, image := range m.Images {
+		entry.Links = append(entry.Links, AtomLink{
+			Rel:    "enclosure",
+			Href:   image.URI,
+			Type:   mime.TypeByExtension(path.Ext(image.URI)),
+			Length: image.Size,
+		})
+	}
+
+	for _, tag := range m.Tags {
+		entry.Categories = append(entry.Categories, AtomCategory{Term: tag})
+	}
+
+	return entry
+}
+
+// registerAtomRoutes serves GET /feeds/markers.atom with the newest public markers.
+// Listing filters such as ?bbox= and ?tags= narrow the feed down.
+func registerAtomRoutes(e *echo.Echo, db *mongo.Database, cfg Config, privacy *markerPrivacy, cache *responseCache) {
+	e.GET("/feeds/markers.atom", func(c echo.Context) error {
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		// Feeds are public whoever fetches them.
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), and(filter, visibilityFor(User{}, false)), options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(maxAtomEntries))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if markers, err = privacy.view(c).redact(c.Request().Context(), markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		base := publicURL(c, cfg)
+		self := base + c.Request().URL.RequestURI()
+		feed := AtomFeed{
+			GeoRSS:  "http://www.georss.org/georss",
+			ID:      self,
+			Title:   "New markers",
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			Author:  AtomAuthor{Name: providerName},
+			Links:   []AtomLink{{Rel: "self", Href: self}, {Rel: "alternate", Href: base}},
+		}
+
+		var updated time.Time
+		for _, marker := range markers {
+			feed.Entries = append(feed.Entries, atomEntry(base, marker.Normalize()))
+			if marker.UpdatedAt.After(updated) {
+				updated = marker.UpdatedAt
+			}
+		}
+
+		if !updated.IsZero() {
+			feed.Updated = updated.UTC().Format(time.RFC3339)
+		}
+
+		body, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(atomMaxAge.Seconds())))
+		return c.Blob(http.StatusOK, atomContentType, append([]byte(xml.Header), body...))
+	}, cache.middleware())
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AuditEntry records a destructive or administrative action for later review.
+type AuditEntry struct {
+	ID        string    `json:"id" bson:"_id"`
+	Action    string    `json:"action" bson:"action"`
+	ActorID   string    `json:"actorId" bson:"actorId"`
+	MarkerIDs []string  `json:"markerIds" bson:"markerIds"`
+	Details   bson.M    `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// recordAudit stores an audit entry. Actions taken by the server itself have no actor.
+func recordAudit(ctx context.Context, db *mongo.Database, actorID, action string, markerIDs []string, details bson.M) error {
+	_, err := db.Collection("audit").InsertOne(ctx, AuditEntry{
+		ID:        primitive.NewObjectID().Hex(),
+		Action:    action,
+		ActorID:   actorID,
+		MarkerIDs: markerIDs,
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	})
+	return err
+}
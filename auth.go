@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// User is the identity carried by a bearer token. Tokens are issued by an external
+// identity provider and signed with the shared AUTH_JWT_SECRET.
+type User struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Claims struct {
+	jwt.StandardClaims
+	Name  string   `json:"name"`
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+
+	// Tenant limits the token to a single tenant. Tokens without one are accepted by
+	// every tenant, so roles in them apply to the whole deployment.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+const userContextKey = "user"
+
+// authenticate parses an optional bearer token and stores the user in the context.
+// Requests without a token proceed anonymously, requests with an invalid one or one
+// issued for another tenant are rejected.
+func authenticate(secret, tenant string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if header == "" {
+				return next(c)
+			}
+
+			token := strings.TrimPrefix(header, "Bearer ")
+			if token == header || secret == "" {
+				s := "invalid authorization header"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			var claims Claims
+			if _, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+				}
+
+				return []byte(secret), nil
+			}); err != nil {
+				c.Logger().Info(err)
+				return c.JSON(http.StatusUnauthorized, ErrorString{"invalid token"})
+			}
+
+			if claims.Audience == shareAudience {
+				s := "share tokens can't be used for authentication"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			if claims.Tenant != "" && claims.Tenant != tenant {
+				s := "token was issued for another tenant"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			if claims.Subject == "" {
+				s := "token has no subject"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			c.Set(userContextKey, User{
+				ID:    claims.Subject,
+				Name:  claims.Name,
+				Email: claims.Email,
+				Roles: claims.Roles,
+			})
+
+			return next(c)
+		}
+	}
+}
+
+// currentUser returns the authenticated user, if any.
+func currentUser(c echo.Context) (User, bool) {
+	user, ok := c.Get(userContextKey).(User)
+	return user, ok
+}
+
+func requireUser() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := currentUser(c); !ok {
+				s := "authentication required"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// requireRole lets through users that have any of the given roles.
+func requireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, ok := currentUser(c)
+			if !ok {
+				s := "authentication required"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			for _, role := range roles {
+				if user.HasRole(role) {
+					return next(c)
+				}
+			}
+
+			s := fmt.Sprintf("role %s required", strings.Join(roles, " or "))
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAutocompleteLimit = 10
+	maxAutocompleteLimit     = 50
+)
+
+// MarkerSuggestion is a marker whose name starts with the typed prefix.
+type MarkerSuggestion struct {
+	ID   string `json:"id" bson:"_id"`
+	Name string `json:"name" bson:"name"`
+}
+
+// foldName returns the form of a name used for case-insensitive prefix matching.
+func foldName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// backfillNameLower stores folded names of the markers created before they were added.
+// Mongo's $toLower only lowers ASCII letters, so names are folded here instead.
+func backfillNameLower(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		collection := db.Collection(name)
+		cursor, err := collection.Find(ctx, bson.M{"nameLower": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"name": 1}))
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": marker.ID}, bson.M{"$set": bson.M{"nameLower": foldName(marker.Name)}}); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+	}
+
+	return nil
+}
+
+func registerAutocompleteRoutes(group *echo.Group, db *mongo.Database, cache *responseCache) {
+	group.GET("/autocomplete", func(c echo.Context) error {
+		q := foldName(c.QueryParam("q"))
+		if q == "" {
+			s := "empty query"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		limit, err := parseLimit(c, defaultAutocompleteLimit, maxAutocompleteLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		// An anchored regex without options is answered from the nameLower index.
+		query := and(bson.M{"nameLower": bson.M{"$regex": "^" + regexp.QuoteMeta(q)}}, filter)
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), query, options.Find().
+			SetProjection(bson.M{"_id": 1, "name": 1}).
+			SetSort(bson.D{{Key: "nameLower", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		suggestions := []MarkerSuggestion{}
+		if err := cursor.All(context.Background(), &suggestions); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, suggestions)
+	}, cache.middleware())
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A backup contains the documents of every collection as extended JSON, one file per
+// collection, and the images of live and archived markers under images/, fetched from
+// their URIs. Images that can't be fetched are listed in the manifest with the error.
+
+const (
+	backupManifest  = "manifest.json"
+	restoreBatch    = 500
+	maxBackupRecord = 16 << 20 // MongoDB's document size limit
+)
+
+// BackupManifest describes the contents of a backup archive.
+type BackupManifest struct {
+	CreatedAt     time.Time        `json:"createdAt"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Collections   map[string]int64 `json:"collections"`
+	Images        []BackupImage    `json:"images,omitempty"`
+}
+
+// BackupImage is an image of a marker in a backup. File is its entry in the archive,
+// it's empty and Error tells why if the image couldn't be fetched.
+type BackupImage struct {
+	MarkerID    string `json:"markerId"`
+	ImageID     string `json:"imageId"`
+	URI         string `json:"uri"`
+	File        string `json:"file,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RestoredCollection counts the documents read from a backup, duplicates are documents
+// whose id was already taken. Images are counted as the "images" collection.
+type RestoredCollection struct {
+	Restored   int64 `json:"restored"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+type BackupError struct {
+	msg string
+}
+
+func (e BackupError) Error() string {
+	return e.msg
+}
+
+// backupCollections lists the collections included in backups. Migration state and feed
+// positions belong to the database, a restore brings old documents up to date instead.
+func backupCollections() []string {
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		// Locks and positions of background work, the outbox, the maintenance mode,
+		// feature flags, rate limits and migration reports describe the running servers,
+		// not the data.
+		// Offline bundles and tilesets are rebuilt from the data.
+		switch name {
+		case "migrations", "locks", "feeds", "jobs", "events", "settings", "features", "rateLimits", "migrationReports", "bundles", "tilesets":
+		default:
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// writeBackup streams a zip archive of all collections and images to w.
+func writeBackup(ctx context.Context, db *mongo.Database, client *http.Client, publicURL string, w io.Writer) (BackupManifest, error) {
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	manifest := BackupManifest{
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: version,
+		Collections:   map[string]int64{},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, name := range backupCollections() {
+		f, err := archive.Create(name + ".jsonl")
+		if err != nil {
+			return manifest, err
+		}
+
+		cursor, err := db.Collection(name).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return manifest, err
+		}
+
+		buffered := bufio.NewWriter(f)
+		for cursor.Next(ctx) {
+			line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+			if err != nil {
+				cursor.Close(context.Background())
+				return manifest, err
+			}
+
+			buffered.Write(line)
+			if err := buffered.WriteByte('\n'); err != nil {
+				cursor.Close(context.Background())
+				return manifest, err
+			}
+
+			manifest.Collections[name]++
+		}
+
+		if err := cursor.Err(); err != nil {
+			return manifest, err
+		}
+		cursor.Close(context.Background())
+
+		if err := buffered.Flush(); err != nil {
+			return manifest, err
+		}
+	}
+
+	if err := writeBackupImages(ctx, db, client, publicURL, archive, &manifest); err != nil {
+		return manifest, err
+	}
+
+	f, err := archive.Create(backupManifest)
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := json.NewEncoder(f).Encode(manifest); err != nil {
+		return manifest, err
+	}
+
+	return manifest, archive.Close()
+}
+
+// writeBackupImages adds the images of the markers to the archive. Images are stored
+// as they are, they're compressed already.
+func writeBackupImages(ctx context.Context, db *mongo.Database, client *http.Client, publicURL string, archive *zip.Writer, manifest *BackupManifest) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		cursor, err := db.Collection(name).Find(ctx, bson.M{"images.0": bson.M{"$exists": true}}, options.Find().
+			SetProjection(bson.M{"images._id": 1, "images.uri": 1}).
+			SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			for _, img := range marker.Images {
+				entry := BackupImage{MarkerID: marker.ID, ImageID: img.ID, URI: img.URI}
+				data, contentType, err := readImage(ctx, db, client, publicURL, img.URI)
+				if err != nil {
+					entry.Error = err.Error()
+					manifest.Images = append(manifest.Images, entry)
+					continue
+				}
+
+				entry.File = "images/" + url.PathEscape(marker.ID) + "/" + url.PathEscape(img.ID)
+				entry.ContentType = contentType
+				f, err := archive.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Store, Modified: manifest.CreatedAt})
+				if err != nil {
+					cursor.Close(context.Background())
+					return err
+				}
+
+				if _, err := f.Write(data); err != nil {
+					cursor.Close(context.Background())
+					return err
+				}
+
+				manifest.Images = append(manifest.Images, entry)
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+	}
+
+	return nil
+}
+
+// restoreBackup restores the documents of a backup archive. They are inserted into
+// staging collections first, so an archive that can't be read or a failing insert leaves
+// the database as it was. Each collection is then swapped in with a single $out, which
+// keeps its indexes: with replace the staged documents take its place, otherwise they
+// are added and documents whose ids are already taken stay as they are. Images in the
+// archive are stored in GridFS and the staged markers linked to them. Writes made
+// while a collection is swapped are lost, restores are meant to run in maintenance
+// mode. Documents from an older schema are migrated after the restore.
+func restoreBackup(ctx context.Context, db *mongo.Database, publicURL string, archive *zip.Reader, replace bool) (results map[string]RestoredCollection, err error) {
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	manifest, err := readManifest(files[backupManifest])
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.SchemaVersion > current {
+		return nil, BackupError{fmt.Sprintf("backup has schema version %d, newer than the database (%d)", manifest.SchemaVersion, current)}
+	}
+
+	prefix := "restore-" + primitive.NewObjectID().Hex() + "."
+	var staged []string
+	// Staging collections of a server that died mid-restore are left behind, they are
+	// named restore-<id>.<collection> and can be dropped by hand.
+	defer func() {
+		for _, name := range staged {
+			db.Collection(prefix + name).Drop(context.Background())
+		}
+	}()
+
+	results = map[string]RestoredCollection{}
+	for _, name := range backupCollections() {
+		f, ok := files[name+".jsonl"]
+		if !ok {
+			continue
+		}
+
+		staged = append(staged, name)
+		result, err := restoreCollection(ctx, db, prefix+name, f)
+		results[name] = result
+		if err != nil {
+			return results, err
+		}
+	}
+
+	// Blobs of a restore that failed before its markers were swapped in are removed,
+	// nothing links to them.
+	var blobs []primitive.ObjectID
+	swapped := false
+	defer func() {
+		if !swapped {
+			deleteImageBlobs(db, blobs)
+		}
+	}()
+
+	blobs, err = restoreImages(ctx, db, publicURL, files, manifest, prefix)
+	results[imageBlobBucket] = RestoredCollection{Restored: int64(len(blobs))}
+	if err != nil {
+		return results, err
+	}
+
+	for _, name := range staged {
+		result, err := swapCollection(ctx, db, prefix+name, name, replace, results[name])
+		if err != nil {
+			return results, fmt.Errorf("can't restore %s: %w", name, err)
+		}
+		results[name] = result
+		swapped = swapped || name == "markers" || name == archiveCollection
+	}
+
+	// Collections the backup created have no indexes yet, and $out may drop the
+	// validator of the marker collections, which migration 6 added.
+	if err := ensureCollections(ctx, db); err != nil {
+		return results, err
+	}
+
+	if current >= 6 {
+		if err := applyMarkerSchema(ctx, db); err != nil {
+			return results, err
+		}
+	}
+
+	// Restored markers replace their tombstones like markers created through the API.
+	if _, ok := results["markers"]; ok {
+		if err := clearTombstones(ctx, db, prefix+"markers"); err != nil {
+			return results, err
+		}
+	}
+
+	// Restored markers keep their update times, feed consumers start over to pick them up.
+	if _, err := db.Collection("feeds").DeleteMany(ctx, bson.M{}); err != nil {
+		return results, err
+	}
+
+	for _, m := range migrations {
+		if m.Version > manifest.SchemaVersion && m.Version <= current {
+			if err := m.Up(ctx, db); err != nil {
+				return results, fmt.Errorf("migration %d failed on restored documents: %w", m.Version, err)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// restoreImages stores the images of the archive as blobs and links the images of the
+// staged markers to them. It returns the blobs stored.
+func restoreImages(ctx context.Context, db *mongo.Database, publicURL string, files map[string]*zip.File, manifest BackupManifest, prefix string) ([]primitive.ObjectID, error) {
+	var blobs []primitive.ObjectID
+	for _, img := range manifest.Images {
+		f, ok := files[img.File]
+		if img.File == "" || !ok {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return blobs, BackupError{fmt.Sprintf("can't read %s: %v", f.Name, err)}
+		}
+
+		id, err := storeImageBlob(db, img.File, img.ContentType, r)
+		r.Close()
+		if err != nil {
+			return blobs, err
+		}
+		blobs = append(blobs, id)
+
+		filter := bson.M{"_id": img.MarkerID, "images": bson.M{"$elemMatch": bson.M{"_id": img.ImageID, "uri": img.URI}}}
+		update := bson.M{"$set": bson.M{"images.$.uri": imageBlobURI(publicURL, id)}}
+		for _, name := range []string{"markers", archiveCollection} {
+			res, err := db.Collection(prefix+name).UpdateOne(ctx, filter, update)
+			if err != nil {
+				return blobs, err
+			}
+
+			if res.MatchedCount > 0 {
+				break
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
+// swapCollection moves the documents of the staging collection into the collection in
+// one $out, so readers see either the documents before or after the restore. Without
+// replace, the documents already stored win over staged ones with the same id.
+func swapCollection(ctx context.Context, db *mongo.Database, staging, name string, replace bool, result RestoredCollection) (RestoredCollection, error) {
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	if replace {
+		cursor, err := db.Collection(staging).Aggregate(ctx, mongo.Pipeline{{{Key: "$out", Value: name}}}, opts)
+		if err != nil {
+			return result, err
+		}
+
+		return result, cursor.Close(context.Background())
+	}
+
+	before, err := db.Collection(name).CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return result, err
+	}
+
+	cursor, err := db.Collection(name).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unionWith", Value: staging}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id", "doc": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceWith", Value: "$doc"}},
+		{{Key: "$out", Value: name}},
+	}, opts)
+	if err != nil {
+		return result, err
+	}
+
+	if err := cursor.Close(context.Background()); err != nil {
+		return result, err
+	}
+
+	after, err := db.Collection(name).CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return result, err
+	}
+
+	restored := after - before
+	result.Duplicates += result.Restored - restored
+	result.Restored = restored
+	return result, nil
+}
+
+// clearTombstones removes the tombstones of the markers in the staging collection.
+func clearTombstones(ctx context.Context, db *mongo.Database, staging string) error {
+	cursor, err := db.Collection(staging).Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	ids := make(bson.A, 0, restoreBatch)
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+
+		_, err := db.Collection("tombstones").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		ids = ids[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		ids = append(ids, cursor.Current.Lookup("_id"))
+		if len(ids) == restoreBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func readManifest(f *zip.File) (BackupManifest, error) {
+	if f == nil {
+		return BackupManifest{}, BackupError{"not a backup archive, " + backupManifest + " is missing"}
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return BackupManifest{}, BackupError{fmt.Sprintf("can't read %s: %v", backupManifest, err)}
+	}
+	defer r.Close()
+
+	var manifest BackupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return BackupManifest{}, BackupError{fmt.Sprintf("invalid %s: %v", backupManifest, err)}
+	}
+
+	return manifest, nil
+}
+
+func restoreCollection(ctx context.Context, db *mongo.Database, name string, f *zip.File) (RestoredCollection, error) {
+	result := RestoredCollection{}
+
+	r, err := f.Open()
+	if err != nil {
+		return result, BackupError{fmt.Sprintf("can't read %s: %v", f.Name, err)}
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBackupRecord)
+
+	batch := make([]interface{}, 0, restoreBatch)
+	insert := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		inserted, duplicates, err := insertDocuments(ctx, db, name, batch)
+		result.Restored += inserted
+		result.Duplicates += duplicates
+		batch = batch[:0]
+		return err
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return result, BackupError{fmt.Sprintf("%s:%d: %v", f.Name, line, err)}
+		}
+
+		batch = append(batch, doc)
+		if len(batch) == restoreBatch {
+			if err := insert(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, BackupError{fmt.Sprintf("can't read %s: %v", f.Name, err)}
+	}
+
+	return result, insert()
+}
+
+// insertDocuments inserts a batch, skipping documents whose id is taken.
+func insertDocuments(ctx context.Context, db *mongo.Database, name string, docs []interface{}) (inserted, duplicates int64, err error) {
+	_, err = db.Collection(name).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code != 11000 {
+				return 0, 0, err
+			}
+		}
+
+		duplicates, err = int64(len(bulkErr.WriteErrors)), nil
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int64(len(docs)) - duplicates, duplicates, nil
+}
+
+func registerBackupRoutes(group *echo.Group, db *mongo.Database, cfg Config) {
+	client := publicHTTPClient(cfg.BackupImageTimeout)
+
+	group.POST("/backup", func(c echo.Context) error {
+		name := fmt.Sprintf("images-on-map-%s.zip", time.Now().UTC().Format("20060102-150405"))
+		c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+		c.Response().WriteHeader(http.StatusOK)
+
+		manifest, err := writeBackup(c.Request().Context(), db, client, cfg.PublicURL, c.Response())
+		if err != nil {
+			// The archive is cut short, clients see it fail to open.
+			c.Logger().Error(err)
+			return nil
+		}
+
+		admin, _ := currentUser(c)
+		failed := 0
+		for _, img := range manifest.Images {
+			if img.Error != "" {
+				failed++
+			}
+		}
+
+		if err := recordAudit(c.Request().Context(), db, admin.ID, "backup", nil, bson.M{"collections": manifest.Collections, "imagesFailed": failed}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return nil
+	})
+	group.POST("/restore", func(c echo.Context) error {
+		replace := false
+		if param := c.QueryParam("replace"); param != "" {
+			var err error
+			if replace, err = strconv.ParseBool(param); err != nil {
+				s := "replace must be true or false"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusBadRequest, ErrorString{s})
+			}
+		}
+
+		// zip archives are read from the end, so the upload is spooled to disk first.
+		f, err := os.CreateTemp("", "restore-*.zip")
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		size, err := io.Copy(f, c.Request().Body)
+		if err != nil {
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				return httpErr
+			}
+
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		archive, err := zip.NewReader(f, size)
+		if err != nil {
+			s := "not a zip archive"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		results, err := restoreBackup(c.Request().Context(), db, cfg.PublicURL, archive, replace)
+
+		admin, _ := currentUser(c)
+		if err := recordAudit(c.Request().Context(), db, admin.ID, "restore", nil, bson.M{"replace": replace, "collections": results}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		var backupErr BackupError
+		if errors.As(err, &backupErr) {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxBatchMarkers = 500
+
+const (
+	BatchCreated = "created"
+	BatchUpdated = "updated"
+	BatchFailed  = "error"
+	// BatchRolledBack marks markers of atomic batches that weren't stored because
+	// another marker failed.
+	BatchRolledBack = "rolled-back"
+)
+
+// BatchItemResult is the outcome of upserting one marker of a batch. Revision is the
+// revision of the stored marker, Fields lists the failing fields of invalid markers.
+type BatchItemResult struct {
+	ID       string           `json:"id"`
+	Status   string           `json:"status"`
+	Revision int64            `json:"revision,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Fields   ValidationErrors `json:"fields,omitempty"`
+}
+
+// batchUpserter creates or replaces markers one by one. Database errors abort the
+// batch, everything else only fails the marker that caused it.
+type batchUpserter struct {
+	c             echo.Context
+	db            *mongo.Database
+	quotas        Quotas
+	geocoding     *geocodingWorker
+	notifications *notifier
+
+	// created and moved are geocoded and announced once the batch is stored.
+	created []Marker
+	moved   []string
+}
+
+func batchFailed(id string, err error) BatchItemResult {
+	result := BatchItemResult{ID: id, Status: BatchFailed, Error: err.Error()}
+	errors.As(err, &result.Fields)
+	return result
+}
+
+func (u *batchUpserter) upsert(ctx context.Context, body Marker) (BatchItemResult, error) {
+	if err := body.Validate(); err != nil {
+		return batchFailed(body.ID, err), nil
+	}
+
+	stored, found, err := storedMarker(ctx, u.db, body.ID)
+	if err != nil {
+		return BatchItemResult{}, err
+	}
+
+	if found && !canModify(u.c, stored.OwnerID) {
+		return batchFailed(body.ID, errors.New("only the owner can modify this marker")), nil
+	}
+
+	marker := body.Normalize()
+	ownerID := stored.OwnerID
+	if !found {
+		user, _ := currentUser(u.c)
+		ownerID = user.ID
+	}
+
+	if marker.Private && ownerID == "" {
+		return batchFailed(body.ID, errors.New("markers without an owner can't be private")), nil
+	}
+
+	if err := checkQuotas(ctx, u.db, u.quotas, ownerID, marker); err != nil {
+		var quotaErr QuotaError
+		if errors.As(err, &quotaErr) {
+			return batchFailed(body.ID, err), nil
+		}
+
+		return BatchItemResult{}, err
+	}
+
+	if !found {
+		marker = marker.created(ownerID)
+		if err := insertMarker(ctx, u.db, marker); err != nil {
+			var mongoErr mongo.WriteException
+			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+				return batchFailed(body.ID, errors.New("marker was created concurrently, try again")), nil
+			}
+
+			return BatchItemResult{}, err
+		}
+
+		u.created = append(u.created, marker)
+		return BatchItemResult{ID: marker.ID, Status: BatchCreated, Revision: marker.Revision}, nil
+	}
+
+	matched, moved, err := updateMarker(ctx, u.db, bson.M{"_id": body.ID, "revision": revisionIs(stored.Revision)}, stored, marker)
+	if err != nil {
+		return BatchItemResult{}, err
+	}
+
+	if !matched {
+		return batchFailed(body.ID, errors.New("marker was changed concurrently, try again")), nil
+	}
+
+	if moved {
+		u.moved = append(u.moved, body.ID)
+	}
+
+	return BatchItemResult{ID: body.ID, Status: BatchUpdated, Revision: stored.Revision + 1}, nil
+}
+
+// upsertAll stores the markers and returns the result for each of them in order.
+func (u *batchUpserter) upsertAll(ctx context.Context, markers []Marker) ([]BatchItemResult, error) {
+	u.created, u.moved = nil, nil
+
+	results := make([]BatchItemResult, 0, len(markers))
+	seen := make(map[string]bool, len(markers))
+	for _, marker := range markers {
+		if marker.ID != "" && seen[marker.ID] {
+			results = append(results, batchFailed(marker.ID, errors.New("repeated id")))
+			continue
+		}
+
+		seen[marker.ID] = true
+		result, err := u.upsert(ctx, marker)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// stored geocodes and announces the markers of a batch once it's stored.
+func (u *batchUpserter) stored() {
+	for _, marker := range u.created {
+		u.geocoding.enqueue(marker.ID)
+		u.notifications.markerCreated(marker)
+	}
+
+	for _, id := range u.moved {
+		u.geocoding.enqueue(id)
+	}
+}
+
+func registerBatchRoutes(group *echo.Group, db *mongo.Database, quotas Quotas, geocoding *geocodingWorker, notifications *notifier) {
+	group.PUT("/batch", func(c echo.Context) error {
+		var body []Marker
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if len(body) == 0 || len(body) > maxBatchMarkers {
+			err := fmt.Errorf("expected 1 to %d markers", maxBatchMarkers)
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		atomic, err := parseAtomic(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		u := &batchUpserter{c: c, db: db, quotas: quotas, geocoding: geocoding, notifications: notifications}
+		ctx := c.Request().Context()
+
+		if !atomic {
+			results, err := u.upsertAll(ctx, body)
+			// Markers stored before a database error are kept.
+			u.stored()
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			return c.JSON(http.StatusOK, results)
+		}
+
+		// Atomic batches store all markers or none, any failing marker rolls back the rest.
+		var results []BatchItemResult
+		err = inRequiredTransaction(ctx, db, func(ctx context.Context) error {
+			var err error
+			if results, err = u.upsertAll(ctx, body); err != nil {
+				return err
+			}
+
+			for _, result := range results {
+				if result.Status == BatchFailed {
+					return errRolledBack
+				}
+			}
+
+			return nil
+		})
+		if errors.Is(err, errRolledBack) {
+			for i := range results {
+				if results[i].Status != BatchFailed {
+					results[i] = BatchItemResult{ID: results[i].ID, Status: BatchRolledBack}
+				}
+			}
+
+			c.Logger().Info("atomic batch rolled back")
+			return c.JSON(http.StatusUnprocessableEntity, results)
+		}
+
+		if errors.Is(err, errNoTransactions) {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusNotImplemented, ErrorString{"atomic batches need a replica set or a sharded cluster"})
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		u.stored()
+		return c.JSON(http.StatusOK, results)
+	})
+}
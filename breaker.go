@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// dbBreakers keeps the breaker of every client, tenants share the one of the default
+// server.
+var dbBreakers sync.Map
+
+// dbBreaker fails requests right away while MongoDB is unreachable. Otherwise every
+// request waits for server selection to time out and holds on to its slot meanwhile, so
+// the server stays clogged for a while after the database is back. The breaker opens
+// when most of the driver's heartbeats and connection checkouts in a window fail, and a
+// probe pinging the deployment closes it once it answers again.
+type dbBreaker struct {
+	threshold     int
+	window        time.Duration
+	probeInterval time.Duration
+
+	open int32
+
+	mu          sync.Mutex
+	client      *mongo.Client
+	windowStart time.Time
+	failures    int
+	successes   int
+}
+
+// newDBBreaker returns the breaker configured in cfg, nil if it's disabled.
+func newDBBreaker(cfg Config) *dbBreaker {
+	if cfg.MongoBreakerThreshold == 0 {
+		return nil
+	}
+
+	return &dbBreaker{
+		threshold:     cfg.MongoBreakerThreshold,
+		window:        cfg.MongoBreakerWindow,
+		probeInterval: cfg.MongoBreakerProbeInterval,
+	}
+}
+
+// monitor makes the client report the health of the deployment to the breaker.
+func (b *dbBreaker) monitor(opts *options.ClientOptions) {
+	opts.SetPoolMonitor(&event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch {
+			case e.Type == event.GetSucceeded:
+				b.record(true)
+			case e.Type == event.GetFailed && e.Reason != event.ReasonPoolClosed,
+				e.Type == event.ConnectionClosed && e.Reason == event.ReasonConnectionErrored:
+				b.record(false)
+			}
+		},
+	})
+	opts.SetServerMonitor(&event.ServerMonitor{
+		ServerHeartbeatSucceeded: func(*event.ServerHeartbeatSucceededEvent) { b.record(true) },
+		ServerHeartbeatFailed:    func(*event.ServerHeartbeatFailedEvent) { b.record(false) },
+	})
+}
+
+// attach gives the breaker the client to probe once it's connected.
+func (b *dbBreaker) attach(client *mongo.Client) {
+	b.mu.Lock()
+	b.client = client
+	b.mu.Unlock()
+
+	dbBreakers.Store(client, b)
+}
+
+func (b *dbBreaker) isOpen() bool {
+	return atomic.LoadInt32(&b.open) == 1
+}
+
+// record counts the outcome of talking to the deployment and opens the breaker when the
+// window has at least threshold failures and no more successes than failures.
+func (b *dbBreaker) record(ok bool) {
+	if b.isOpen() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart, b.failures, b.successes = now, 0, 0
+	}
+
+	if ok {
+		b.successes++
+		return
+	}
+
+	b.failures++
+	if b.failures < b.threshold || b.successes > b.failures {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&b.open, 0, 1) {
+		log.Warnj(log.JSON{
+			"message":   "database is unavailable, failing requests until it answers",
+			"failures":  b.failures,
+			"successes": b.successes,
+		})
+		go b.probe()
+	}
+}
+
+// probe pings the deployment until it answers and closes the breaker.
+func (b *dbBreaker) probe() {
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.mu.Lock()
+		client := b.client
+		b.mu.Unlock()
+
+		if client == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.probeInterval)
+		err := client.Ping(ctx, readpref.PrimaryPreferred())
+		cancel()
+
+		if err == nil {
+			b.mu.Lock()
+			b.windowStart, b.failures, b.successes = time.Now(), 0, 0
+			b.mu.Unlock()
+
+			atomic.StoreInt32(&b.open, 0)
+			log.Infoj(log.JSON{"message": "database is available again"})
+			return
+		}
+	}
+}
+
+// failFast rejects requests with 503 while the breaker of the client is open.
+func failFast(client *mongo.Client) echo.MiddlewareFunc {
+	var b *dbBreaker
+	if v, ok := dbBreakers.Load(client); ok {
+		b = v.(*dbBreaker)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if b == nil || !b.isOpen() {
+				return next(c)
+			}
+
+			s := "database is unavailable, retry later"
+			c.Logger().Warn(s)
+			setRetryAfter(c, b.probeInterval)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBulkUpdateMarkers bounds the events and audit entry a single bulk update writes.
+const maxBulkUpdateMarkers = 5000
+
+// BulkUpdateRequest changes every marker matching the filter the same way. Users other
+// than admins only update their own markers.
+type BulkUpdateRequest struct {
+	Filter BulkUpdateFilter `json:"filter"`
+	Update BulkUpdate       `json:"update"`
+}
+
+// BulkUpdateFilter selects markers like the listing parameters of the same names.
+type BulkUpdateFilter struct {
+	// BBox is minLon,minLat,maxLon,maxLat.
+	BBox     string   `json:"bbox"`
+	Tags     []string `json:"tags"`
+	TagsMode string   `json:"tagsMode"`
+	OwnerID  string   `json:"ownerId"`
+}
+
+// BulkUpdate lists the changes, missing fields are left as they are. Tags replaces the
+// tags before AddTags and RemoveTags apply, Properties replaces all custom properties and
+// empty strings clear the icon, color and emoji.
+type BulkUpdate struct {
+	Tags       *[]string              `json:"tags"`
+	AddTags    []string               `json:"addTags"`
+	RemoveTags []string               `json:"removeTags"`
+	Icon       *string                `json:"icon"`
+	Color      *string                `json:"color"`
+	Emoji      *string                `json:"emoji"`
+	Private    *bool                  `json:"private"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// BulkUpdateResult counts the markers of a bulk update. Skipped markers match the filter
+// but the update doesn't apply to them, e.g. because they'd end up with more than
+// maxTags tags or are made private without an owner.
+type BulkUpdateResult struct {
+	DryRun  bool  `json:"dryRun"`
+	Matched int64 `json:"matched"`
+	Skipped int64 `json:"skipped"`
+	Updated int64 `json:"updated"`
+}
+
+// Validate checks the changes against the rules of the marker fields they set.
+func (u BulkUpdate) Validate() error {
+	var fields ValidationErrors
+	check := func(m Marker, field string, names ...string) error {
+		err := validatePartial(m, names...)
+
+		var invalid ValidationErrors
+		if err != nil && !errors.As(err, &invalid) {
+			return err
+		}
+
+		// Added and removed tags are checked as tags and reported under their own names.
+		for _, f := range invalid {
+			if field != "" {
+				f.Field = field + strings.TrimPrefix(f.Field, "tags")
+			}
+
+			f.Field = "update." + f.Field
+			fields = append(fields, f)
+		}
+
+		return nil
+	}
+
+	var probe Marker
+	var names []string
+	if u.Tags != nil {
+		probe.Tags, names = *u.Tags, append(names, "Tags")
+	}
+
+	if u.Icon != nil {
+		probe.Icon, names = *u.Icon, append(names, "Icon")
+	}
+
+	if u.Color != nil {
+		probe.Color, names = *u.Color, append(names, "Color")
+	}
+
+	if u.Emoji != nil {
+		probe.Emoji, names = *u.Emoji, append(names, "Emoji")
+	}
+
+	if len(names) > 0 {
+		if err := check(probe, "", names...); err != nil {
+			return err
+		}
+	}
+
+	if len(u.AddTags) > 0 {
+		if err := check(Marker{Tags: u.AddTags}, "addTags", "Tags"); err != nil {
+			return err
+		}
+	}
+
+	if len(u.RemoveTags) > 0 {
+		if err := check(Marker{Tags: u.RemoveTags}, "removeTags", "Tags"); err != nil {
+			return err
+		}
+	}
+
+	if u.Tags != nil && len(normalizeTags(append(append([]string{}, *u.Tags...), u.AddTags...))) > maxTags {
+		fields = append(fields, FieldError{Field: "update.addTags", Code: "max", Message: fmt.Sprintf("must leave at most %d tags", maxTags)})
+	}
+
+	if u.Properties != nil {
+		for _, f := range validateProperties(u.Properties) {
+			f.Field = "update." + f.Field
+			fields = append(fields, f)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
+
+// empty reports whether the update changes nothing.
+func (u BulkUpdate) empty() bool {
+	return u.Tags == nil && len(u.AddTags) == 0 && len(u.RemoveTags) == 0 && u.Icon == nil && u.Color == nil && u.Emoji == nil && u.Private == nil && u.Properties == nil
+}
+
+// filter returns the query selecting the markers of the request for the user.
+func (f BulkUpdateFilter) filter(c echo.Context) (bson.M, error) {
+	var conditions []bson.M
+	if f.BBox != "" {
+		bbox, err := parseBounds(f.BBox)
+		if err != nil {
+			return nil, err
+		}
+
+		conditions = append(conditions, bbox.filter())
+	}
+
+	if len(f.Tags) > 0 {
+		tags := normalizeTags(f.Tags)
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("empty tags filter")
+		}
+
+		switch f.TagsMode {
+		case "", "any":
+			conditions = append(conditions, bson.M{"tags": bson.M{"$in": tags}})
+		case "all":
+			conditions = append(conditions, bson.M{"tags": bson.M{"$all": tags}})
+		default:
+			return nil, fmt.Errorf("invalid tags mode %q, expected any or all", f.TagsMode)
+		}
+	}
+
+	if f.OwnerID != "" {
+		conditions = append(conditions, bson.M{"ownerId": f.OwnerID})
+	}
+
+	// An empty filter would change every marker at once, which is what restores are for.
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("expected a filter, e.g. bbox, tags or ownerId")
+	}
+
+	if user, _ := currentUser(c); !user.HasRole(RoleAdmin) {
+		conditions = append(conditions, bson.M{"ownerId": user.ID})
+	}
+
+	return and(conditions...), nil
+}
+
+// pipeline returns the update of the markers and the condition for markers it applies to.
+// It's an aggregation pipeline, so tags can be added and removed in one go. Values are
+// literals, tags starting with $ aren't taken for fields.
+func (u BulkUpdate) pipeline(at time.Time) (mongo.Pipeline, bson.M) {
+	set := bson.M{
+		"updatedAt": at,
+		"revision":  bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$revision", 0}}, 1}},
+	}
+	var conditions []bson.M
+
+	if u.Tags != nil || len(u.AddTags) > 0 || len(u.RemoveTags) > 0 {
+		var tags interface{} = bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}
+		if u.Tags != nil {
+			tags = bson.M{"$literal": normalizeTags(*u.Tags)}
+		}
+
+		if remove := normalizeTags(u.RemoveTags); len(remove) > 0 {
+			tags = bson.M{"$filter": bson.M{
+				"input": tags,
+				"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", bson.M{"$literal": remove}}}}},
+			}}
+		}
+
+		if add := normalizeTags(u.AddTags); len(add) > 0 {
+			tags = bson.M{"$concatArrays": bson.A{tags, bson.M{"$filter": bson.M{
+				"input": bson.M{"$literal": add},
+				"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", tags}}}},
+			}}}}
+			conditions = append(conditions, bson.M{"$expr": bson.M{"$lte": bson.A{bson.M{"$size": tags}, maxTags}}})
+		}
+
+		set["tags"] = tags
+	}
+
+	for field, value := range map[string]*string{"icon": u.Icon, "color": u.Color, "emoji": u.Emoji} {
+		if value != nil {
+			set[field] = bson.M{"$literal": *value}
+		}
+	}
+
+	if u.Private != nil {
+		set["private"] = *u.Private
+		if *u.Private {
+			conditions = append(conditions, bson.M{"ownerId": bson.M{"$nin": bson.A{nil, ""}}})
+		}
+	}
+
+	if u.Properties != nil {
+		set["properties"] = bson.M{"$literal": u.Properties}
+	}
+
+	return mongo.Pipeline{{{Key: "$set", Value: set}}}, and(conditions...)
+}
+
+func registerBulkUpdateRoutes(group *echo.Group, db *mongo.Database) {
+	group.POST("/bulk-update", func(c echo.Context) error {
+		var body BulkUpdateRequest
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := body.Filter.filter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if body.Update.empty() {
+			s := "nothing to update"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		if err := body.Update.Validate(); err != nil {
+			return validationFailed(c, err)
+		}
+
+		// Stored times have millisecond precision, updated markers are found by theirs.
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		update, applies := body.Update.pipeline(now)
+		ctx := c.Request().Context()
+
+		matched, err := db.Collection("markers").CountDocuments(ctx, filter)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// One marker past the cap tells whether there are too many.
+		cursor, err := db.Collection("markers").Find(ctx, and(filter, applies), options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(maxBulkUpdateMarkers+1))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(markers) > maxBulkUpdateMarkers {
+			err := fmt.Errorf("the filter matches more than %d markers, narrow it down", maxBulkUpdateMarkers)
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		ids := make([]string, 0, len(markers))
+		for _, marker := range markers {
+			ids = append(ids, marker.ID)
+		}
+
+		if dryRun {
+			return c.JSON(http.StatusOK, BulkUpdateResult{DryRun: true, Matched: matched, Skipped: matched - int64(len(ids)), Updated: int64(len(ids))})
+		}
+
+		// Markers changed since they were picked are only updated if the update still
+		// applies.
+		var updated int64
+		err = inTransaction(ctx, db, func(ctx context.Context) error {
+			res, err := db.Collection("markers").UpdateMany(ctx, and(bson.M{"_id": bson.M{"$in": ids}}, filter, applies), update)
+			if err != nil {
+				return err
+			}
+
+			updated = res.ModifiedCount
+
+			cursor, err := db.Collection("markers").Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "updatedAt": now})
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(context.Background())
+
+			for cursor.Next(ctx) {
+				var marker Marker
+				if err := cursor.Decode(&marker); err != nil {
+					return err
+				}
+
+				if err := appendEvent(ctx, db, EventMarkerUpdated, marker.ID, &marker); err != nil {
+					return err
+				}
+			}
+
+			return cursor.Err()
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if err := recordAudit(ctx, db, user.ID, "markers.bulk-update", ids, bson.M{"filter": body.Filter, "update": body.Update}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.JSON(http.StatusOK, BulkUpdateResult{Matched: matched, Skipped: matched - int64(len(ids)), Updated: updated})
+	}, requireUser())
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	bundleBatchSize = 100
+	// maxBundleImageBytes skips images too large to be worth a thumbnail.
+	maxBundleImageBytes = 20 << 20
+	bundleFormat        = 1
+)
+
+// Bundle is an archive of the public markers of an area for the mobile app to use
+// offline: markers as GeoJSON, thumbnails of their images and a manifest. Bundles are
+// shared by everybody asking for the same area and rebuilt once older than
+// BUNDLE_MAX_AGE.
+type Bundle struct {
+	ID string `json:"id" bson:"_id"`
+	// BBox is the area covered as minLon,minLat,maxLon,maxLat, empty for everywhere.
+	BBox   string `json:"bbox,omitempty" bson:"bbox"`
+	Status string `json:"status" bson:"status"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+
+	// Cursor is the last marker whose thumbnails are on disk, an interrupted build
+	// resumes after it.
+	Cursor     string `json:"-" bson:"cursor,omitempty"`
+	Markers    int    `json:"markers" bson:"markers"`
+	Thumbnails int    `json:"thumbnails" bson:"thumbnails"`
+	// Skipped counts images no thumbnail could be made of, the manifest keeps their
+	// URIs.
+	Skipped int   `json:"skipped" bson:"skipped"`
+	Size    int64 `json:"size,omitempty" bson:"size,omitempty"`
+
+	// URL downloads the archive of a completed bundle, it supports range requests so
+	// interrupted downloads can continue.
+	URL string `json:"url,omitempty" bson:"-"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	// ExpiresAt is when the archive of a completed bundle is removed.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// BundleManifest describes the content of a bundle archive.
+type BundleManifest struct {
+	Format      int           `json:"format"`
+	ID          string        `json:"id"`
+	BBox        string        `json:"bbox,omitempty"`
+	GeneratedAt time.Time     `json:"generatedAt"`
+	Markers     int           `json:"markers"`
+	Images      []BundleImage `json:"images"`
+}
+
+// BundleImage maps an image of a marker to its thumbnail in the archive, Thumbnail is
+// empty for skipped images.
+type BundleImage struct {
+	MarkerID  string `json:"markerId"`
+	ImageID   string `json:"imageId"`
+	URI       string `json:"uri"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// offlineBundles builds bundles one at a time. Thumbnails are kept in a work directory
+// next to the archives while a bundle is built, so a build interrupted by a restart
+// picks up where it stopped.
+type offlineBundles struct {
+	db            *mongo.Database
+	dir           string
+	retention     time.Duration
+	thumbnailSize int
+	client        *http.Client
+	privacy       *markerPrivacy
+	logger        echo.Logger
+	queue         chan string
+}
+
+func newOfflineBundles(db *mongo.Database, cfg Config, privacy *markerPrivacy, logger echo.Logger) *offlineBundles {
+	return &offlineBundles{
+		db:            db,
+		dir:           filepath.Join(cfg.ExportDir, db.Name(), "bundles"),
+		retention:     cfg.ExportRetention,
+		thumbnailSize: cfg.BundleThumbnailSize,
+		client:        publicHTTPClient(cfg.BundleImageTimeout),
+		privacy:       privacy,
+		logger:        logger,
+		queue:         make(chan string, 100),
+	}
+}
+
+// publicHTTPClient fetches user supplied URLs. It refuses to connect to loopback,
+// private and link-local addresses, so URLs can't reach services inside the network.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func (b *offlineBundles) path(id string) string {
+	return filepath.Join(b.dir, id+".zip")
+}
+
+func (b *offlineBundles) workDir(id string) string {
+	return filepath.Join(b.dir, id)
+}
+
+// enqueue schedules the bundle. When the queue is full the bundle is picked up on the
+// next resume pass.
+func (b *offlineBundles) enqueue(id string) {
+	select {
+	case b.queue <- id:
+	default:
+		b.logger.Warnf("bundle queue is full, bundle %s will run later", id)
+	}
+}
+
+func (b *offlineBundles) run(ctx context.Context) {
+	resume := time.NewTicker(10 * time.Minute)
+	defer resume.Stop()
+
+	b.resume(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resume.C:
+			b.resume(ctx)
+		case id := <-b.queue:
+			b.process(ctx, id)
+		}
+	}
+}
+
+// resume queues bundles that didn't finish, e.g. because the server was restarted.
+func (b *offlineBundles) resume(ctx context.Context) {
+	cursor, err := b.db.Collection("bundles").Find(ctx, bson.M{"status": bson.M{"$in": bson.A{ExportQueued, ExportRunning}}})
+	if err != nil {
+		b.logger.Error(err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var bundle Bundle
+		if err := cursor.Decode(&bundle); err != nil {
+			b.logger.Error(err)
+			return
+		}
+
+		select {
+		case b.queue <- bundle.ID:
+		default:
+			return
+		}
+	}
+}
+
+// expire removes archives past their retention, it runs as the expire-bundles job.
+func (b *offlineBundles) expire(ctx context.Context) error {
+	cursor, err := b.db.Collection("bundles").Find(ctx, bson.M{"status": ExportCompleted, "expiresAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+
+	var expired []Bundle
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		return err
+	}
+
+	for _, bundle := range expired {
+		if err := os.Remove(b.path(bundle.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			b.logger.Error(err)
+			continue
+		}
+
+		if err := b.update(ctx, bundle.ID, bson.M{"status": ExportExpired}); err != nil {
+			b.logger.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (b *offlineBundles) update(ctx context.Context, id string, set bson.M) error {
+	set["updatedAt"] = time.Now().UTC()
+	_, err := b.db.Collection("bundles").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (b *offlineBundles) process(ctx context.Context, id string) {
+	var bundle Bundle
+	if err := b.db.Collection("bundles").FindOne(ctx, bson.M{"_id": id}).Decode(&bundle); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			b.logger.Error(err)
+		}
+
+		return
+	}
+
+	if bundle.Status != ExportQueued && bundle.Status != ExportRunning {
+		return
+	}
+
+	if err := b.update(ctx, id, bson.M{"status": ExportRunning}); err != nil {
+		b.logger.Error(err)
+		return
+	}
+
+	size, err := b.build(ctx, &bundle)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		b.logger.Warnf("bundle %s failed: %v", id, err)
+		if err := b.update(ctx, id, bson.M{"status": ExportFailed, "error": err.Error()}); err != nil {
+			b.logger.Error(err)
+		}
+
+		os.RemoveAll(b.workDir(id))
+		return
+	}
+
+	if err := b.update(ctx, id, bson.M{
+		"status":     ExportCompleted,
+		"size":       size,
+		"markers":    bundle.Markers,
+		"thumbnails": bundle.Thumbnails,
+		"skipped":    bundle.Skipped,
+		"expiresAt":  time.Now().UTC().Add(b.retention),
+	}); err != nil {
+		b.logger.Error(err)
+	}
+
+	os.RemoveAll(b.workDir(id))
+}
+
+// filter matches the public markers of the bundle's area.
+func (b *offlineBundles) filter(bundle *Bundle) (bson.M, error) {
+	filter := visibilityFor(User{}, false)
+	if bundle.BBox == "" {
+		return filter, nil
+	}
+
+	bbox, err := parseBounds(bundle.BBox)
+	if err != nil {
+		return nil, err
+	}
+
+	return and(filter, bbox.filter(), outsideZonesFor(User{}, false)), nil
+}
+
+// build makes the thumbnails the bundle still lacks, recording progress after every
+// batch, then writes the archive and returns its size.
+func (b *offlineBundles) build(ctx context.Context, bundle *Bundle) (int64, error) {
+	filter, err := b.filter(bundle)
+	if err != nil {
+		return 0, err
+	}
+
+	work := b.workDir(bundle.ID)
+	if err := os.MkdirAll(work, 0o700); err != nil {
+		return 0, err
+	}
+
+	for {
+		batchFilter := filter
+		if bundle.Cursor != "" {
+			batchFilter = and(filter, bson.M{"_id": bson.M{"$gt": bundle.Cursor}})
+		}
+
+		markers, last, err := b.batch(ctx, batchFilter)
+		if err != nil {
+			return 0, err
+		}
+
+		if last == "" {
+			break
+		}
+
+		for _, marker := range markers {
+			for _, img := range marker.Images {
+				path := filepath.Join(work, thumbnailName(marker.ID, img.ID))
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+
+				if err := b.thumbnail(ctx, img.URI, path); err != nil {
+					if ctx.Err() != nil {
+						return 0, ctx.Err()
+					}
+
+					b.logger.Infof("bundle %s skips image %s of marker %s: %v", bundle.ID, img.ID, marker.ID, err)
+					bundle.Skipped++
+					continue
+				}
+
+				bundle.Thumbnails++
+			}
+		}
+
+		bundle.Cursor = last
+		if err := b.update(ctx, bundle.ID, bson.M{"cursor": bundle.Cursor, "thumbnails": bundle.Thumbnails, "skipped": bundle.Skipped}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(b.dir, "bundle-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := b.write(ctx, bundle, filter, f); err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(f.Name(), b.path(bundle.ID))
+}
+
+// batch reads the next markers of the bundle redacted for the public. last is the id of
+// the last marker read, including hidden ones, empty when there are no more.
+func (b *offlineBundles) batch(ctx context.Context, filter bson.M) (markers []Marker, last string, err error) {
+	cursor, err := b.db.Collection("markers").Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(bundleBatchSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return nil, "", err
+	}
+
+	if len(markers) == 0 {
+		return nil, "", nil
+	}
+
+	last = markers[len(markers)-1].ID
+	markers, err = b.privacy.anonymous().redact(ctx, markers)
+	return markers, last, err
+}
+
+// write streams the archive: the markers as GeoJSON, the thumbnails made so far and a
+// manifest listing every image with its thumbnail.
+func (b *offlineBundles) write(ctx context.Context, bundle *Bundle, filter bson.M, f io.Writer) error {
+	archive := zip.NewWriter(f)
+	manifest := BundleManifest{
+		Format:      bundleFormat,
+		ID:          bundle.ID,
+		BBox:        bundle.BBox,
+		GeneratedAt: time.Now().UTC(),
+		Images:      []BundleImage{},
+	}
+
+	w, err := archive.Create("markers.geojson")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return err
+	}
+
+	work := b.workDir(bundle.ID)
+	cursorID := ""
+	for {
+		batchFilter := filter
+		if cursorID != "" {
+			batchFilter = and(filter, bson.M{"_id": bson.M{"$gt": cursorID}})
+		}
+
+		markers, last, err := b.batch(ctx, batchFilter)
+		if err != nil {
+			return err
+		}
+
+		if last == "" {
+			break
+		}
+
+		cursorID = last
+		for _, marker := range markers {
+			marker = marker.Normalize()
+			feat, err := feature(marker)
+			if err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(feat)
+			if err != nil {
+				return err
+			}
+
+			if manifest.Markers > 0 {
+				data = append([]byte{','}, data...)
+			}
+
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return err
+			}
+
+			manifest.Markers++
+			for _, img := range marker.Images {
+				entry := BundleImage{MarkerID: marker.ID, ImageID: img.ID, URI: img.URI}
+				name := thumbnailName(marker.ID, img.ID)
+				if _, err := os.Stat(filepath.Join(work, name)); err == nil {
+					entry.Thumbnail = name
+				}
+
+				manifest.Images = append(manifest.Images, entry)
+			}
+		}
+	}
+
+	if _, err := io.WriteString(w, "]}\n"); err != nil {
+		return err
+	}
+
+	for _, img := range manifest.Images {
+		if img.Thumbnail == "" {
+			continue
+		}
+
+		if err := copyToArchive(archive, filepath.Join(work, img.Thumbnail), img.Thumbnail); err != nil {
+			return err
+		}
+	}
+
+	bundle.Markers = manifest.Markers
+	w, err = archive.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func copyToArchive(archive *zip.Writer, path, name string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// JPEGs don't get smaller by compressing them again.
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// thumbnailName is where the thumbnail of an image is kept, in the work directory and
+// in the archive.
+func thumbnailName(markerID, imageID string) string {
+	return "thumbnails/" + url.PathEscape(markerID) + "/" + url.PathEscape(imageID) + ".jpg"
+}
+
+// thumbnail downloads the image and writes a JPEG fitting into the thumbnail size.
+func (b *offlineBundles) thumbnail(ctx context.Context, uri, path string) error {
+	src, err := fetchImage(ctx, b.client, uri, maxBundleImageBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	// Thumbnails are written next to path first, so a partial file is never taken for
+	// a finished one.
+	f, err := os.CreateTemp(filepath.Dir(path), "thumbnail-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := jpeg.Encode(f, scaleDown(src, b.thumbnailSize), &jpeg.Options{Quality: 75}); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// scaleDown fits the image into a size by size square keeping its aspect ratio. Every
+// pixel averages a grid of samples of the area it covers, which is good enough for
+// thumbnails.
+func scaleDown(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+
+	if dw < 1 {
+		dw = 1
+	}
+
+	if dh < 1 {
+		dh = 1
+	}
+
+	const samples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, bl, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := bounds.Min.X + (x*samples+sx)*w/(dw*samples)
+					py := bounds.Min.Y + (y*samples+sy)*h/(dh*samples)
+					pr, pg, pb, pa := src.At(px, py).RGBA()
+					r, g, bl, a = r+pr, g+pg, bl+pb, a+pa
+				}
+			}
+
+			n := uint32(samples * samples)
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// registerBundleRoutes lets the mobile app ask for the bundle of an area and download it
+// once it's built.
+func registerBundleRoutes(group *echo.Group, db *mongo.Database, bundles *offlineBundles, cfg Config) {
+	group.GET("/bundle", func(c echo.Context) error {
+		area := ""
+		if bbox, ok, err := parseBBox(c); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		} else if ok {
+			area = bbox.String()
+		}
+
+		ctx := c.Request().Context()
+		location := "/api/v1/export/bundle"
+		if area != "" {
+			location += "?bbox=" + url.QueryEscape(area)
+		}
+
+		// Recent bundles of the area are shared, a new one is only built when there is
+		// none or the last one is too old.
+		var bundle Bundle
+		err := db.Collection("bundles").FindOne(ctx, bson.M{
+			"bbox":      area,
+			"status":    bson.M{"$in": bson.A{ExportQueued, ExportRunning, ExportCompleted}},
+			"createdAt": bson.M{"$gt": time.Now().UTC().Add(-cfg.BundleMaxAge)},
+		}, options.FindOne().SetSort(bson.M{"createdAt": -1})).Decode(&bundle)
+		if err == nil {
+			if bundle.Status != ExportCompleted {
+				c.Response().Header().Set(echo.HeaderLocation, location)
+				return c.JSON(http.StatusAccepted, bundle)
+			}
+
+			bundle.URL = publicURL(c, cfg) + "/api/v1/export/bundles/" + bundle.ID + "/archive"
+			return c.JSON(http.StatusOK, bundle)
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		now := time.Now().UTC()
+		bundle = Bundle{
+			ID:        primitive.NewObjectID().Hex(),
+			BBox:      area,
+			Status:    ExportQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		if _, err := db.Collection("bundles").InsertOne(ctx, bundle); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		bundles.enqueue(bundle.ID)
+
+		c.Response().Header().Set(echo.HeaderLocation, location)
+		return c.JSON(http.StatusAccepted, bundle)
+	})
+	group.GET("/bundles/:id/archive", func(c echo.Context) error {
+		var bundle Bundle
+		if err := db.Collection("bundles").FindOne(c.Request().Context(), bson.M{"_id": c.Param("id"), "status": ExportCompleted}).Decode(&bundle); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "bundle not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		name := fmt.Sprintf("images-on-map-bundle-%s.zip", bundle.CreatedAt.Format("20060102"))
+		return c.Attachment(bundles.path(bundle.ID), name)
+	})
+}
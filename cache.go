@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// responseCache keeps rendered responses of read endpoints in memory. Every change to a
+// marker recorded with appendEvent and any successful write through invalidate() drops
+// everything; other replicas rely on the TTL.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu         sync.Mutex
+	generation uint64
+	entries    map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	status      int
+	contentType string
+	headers     map[string]string
+	body        []byte
+	expires     time.Time
+}
+
+// cachedHeaders are the headers describing the body that are kept with cached responses.
+var cachedHeaders = []string{"X-Total-Count", "X-Truncated"}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]cacheEntry{},
+	}
+}
+
+// middleware serves cached responses for GET requests and stores successful ones.
+func (rc *responseCache) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if rc.ttl == 0 || c.Request().Method != http.MethodGet {
+				return next(c)
+			}
+
+			key := cacheKey(c)
+
+			entry, generation, ok := rc.get(key)
+			if ok {
+				c.Response().Header().Set("X-Cache", "HIT")
+				for name, value := range entry.headers {
+					c.Response().Header().Set(name, value)
+				}
+
+				return c.Blob(entry.status, entry.contentType, entry.body)
+			}
+
+			c.Response().Header().Set("X-Cache", "MISS")
+
+			rec := &recordingWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+			if err := next(c); err != nil {
+				return err
+			}
+
+			if c.Response().Status == http.StatusOK {
+				headers := map[string]string{}
+				for _, name := range cachedHeaders {
+					if value := c.Response().Header().Get(name); value != "" {
+						headers[name] = value
+					}
+				}
+
+				rc.put(key, generation, cacheEntry{
+					status:      http.StatusOK,
+					contentType: c.Response().Header().Get(echo.HeaderContentType),
+					headers:     headers,
+					body:        rec.body.Bytes(),
+					expires:     time.Now().Add(rc.ttl),
+				})
+			}
+
+			return nil
+		}
+	}
+}
+
+// cacheKey keeps responses apart per user and, as markers carry their names in the
+// languages of the viewer, per accepted languages. Every segment is labelled and always
+// present, anonymous requests have an empty user, so no user id, language list and URI
+// can add up to the key of another request.
+func cacheKey(c echo.Context) string {
+	user, _ := currentUser(c)
+	return "u=" + strconv.Quote(user.ID) + "|l=" + strconv.Quote(strings.Join(acceptedLanguages(c), ",")) + "|" + c.Request().URL.RequestURI()
+}
+
+// invalidate clears the cache after every successful mutating request.
+func (rc *responseCache) invalidate() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+
+			err := next(c)
+			if err == nil && c.Response().Status < http.StatusBadRequest {
+				rc.clear()
+			}
+
+			return err
+		}
+	}
+}
+
+func (rc *responseCache) get(key string) (cacheEntry, uint64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entry, ok := rc.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(rc.entries, key)
+		ok = false
+	}
+
+	return entry, rc.generation, ok
+}
+
+// put stores the entry unless the cache was cleared since the response started rendering.
+func (rc *responseCache) put(key string, generation uint64, entry cacheEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if generation != rc.generation {
+		return
+	}
+
+	if len(rc.entries) >= rc.maxEntries {
+		now := time.Now()
+		for k, e := range rc.entries {
+			if now.After(e.expires) {
+				delete(rc.entries, k)
+			}
+		}
+
+		for k := range rc.entries {
+			if len(rc.entries) < rc.maxEntries {
+				break
+			}
+
+			delete(rc.entries, k)
+		}
+	}
+
+	if rc.maxEntries > 0 {
+		rc.entries[key] = entry
+	}
+}
+
+// writeCaches are the caches cleared by changes to the markers of each database, tenant
+// servers have caches of their own.
+var writeCaches = struct {
+	sync.Mutex
+	caches map[string]map[*responseCache]bool
+}{caches: map[string]map[*responseCache]bool{}}
+
+// clearOnWrites has changes to the markers of db clear the cache until ctx is done,
+// whichever job or endpoint makes them.
+func (rc *responseCache) clearOnWrites(ctx context.Context, db *mongo.Database) {
+	writeCaches.Lock()
+	defer writeCaches.Unlock()
+
+	if writeCaches.caches[db.Name()] == nil {
+		writeCaches.caches[db.Name()] = map[*responseCache]bool{}
+	}
+	writeCaches.caches[db.Name()][rc] = true
+
+	go func() {
+		<-ctx.Done()
+
+		writeCaches.Lock()
+		defer writeCaches.Unlock()
+
+		delete(writeCaches.caches[db.Name()], rc)
+		if len(writeCaches.caches[db.Name()]) == 0 {
+			delete(writeCaches.caches, db.Name())
+		}
+	}()
+}
+
+// clearCaches drops the cached responses of db once the write of ctx is committed, so
+// responses rendered in the meantime aren't kept either.
+func clearCaches(ctx context.Context, db *mongo.Database) {
+	afterCommit(ctx, func() {
+		writeCaches.Lock()
+		defer writeCaches.Unlock()
+
+		for rc := range writeCaches.caches[db.Name()] {
+			rc.clear()
+		}
+	})
+}
+
+func (rc *responseCache) clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.generation++
+	rc.entries = map[string]cacheEntry{}
+}
+
+// recordingWriter passes the response through while keeping a copy of the body.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
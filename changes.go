@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+
+	// changesCounter is the counter document handing out change sequence numbers.
+	changesCounter = "changes"
+)
+
+// Change is an entry of the changes feed. Seq increases with every change, clients
+// resume the feed from the last one they saw. Deleted is set for deletions and markers
+// the viewer can't see (anymore), Marker is the current marker with ?includeMarkers=.
+type Change struct {
+	Seq       int64     `json:"seq" bson:"_id"`
+	Type      string    `json:"type" bson:"type"`
+	MarkerID  string    `json:"markerId" bson:"markerId"`
+	Deleted   bool      `json:"deleted,omitempty" bson:"-"`
+	Marker    *Marker   `json:"marker,omitempty" bson:"-"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	Seeded    bool      `json:"-" bson:"seeded,omitempty"`
+}
+
+// ChangesResponse is a page of the changes feed. More is set if there are changes past
+// LastSeq already, the next page starts at ?since=LastSeq.
+type ChangesResponse struct {
+	Results []Change `json:"results"`
+	LastSeq int64    `json:"lastSeq"`
+	More    bool     `json:"more"`
+}
+
+// changesState is the counter document of the feed. ExpiredThrough is the newest
+// deletion dropped from the feed, clients behind it would miss it.
+type changesState struct {
+	Seq            int64 `bson:"seq"`
+	ExpiredThrough int64 `bson:"expiredThrough"`
+}
+
+// reserveSequence hands out n consecutive sequence numbers of the feed and returns the
+// last one.
+func reserveSequence(ctx context.Context, db *mongo.Database, n int64) (int64, error) {
+	var state changesState
+	err := db.Collection("counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": changesCounter},
+		bson.M{"$inc": bson.M{"seq": n}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&state)
+	return state.Seq, err
+}
+
+// sequenceChanges numbers the outbox events written since the last run and adds them to
+// the changes feed, it runs as the sequence-changes job. Marker writes only append their
+// event, the job is the one writer of the counter. A batch commits all of its changes at
+// once after the previous one, so readers never see a number before an earlier one.
+func sequenceChanges(ctx context.Context, db *mongo.Database) error {
+	for {
+		n, err := sequenceBatch(ctx, db)
+		if err != nil || n < eventBatchSize {
+			return err
+		}
+	}
+}
+
+func sequenceBatch(ctx context.Context, db *mongo.Database) (int, error) {
+	var n int
+	err := inTransaction(ctx, db, func(ctx context.Context) error {
+		cursor, err := db.Collection("events").Find(ctx, bson.M{"seq": nil}, options.Find().
+			SetProjection(bson.M{"marker": 0}).
+			SetSort(bson.D{{Key: "seq", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(eventBatchSize))
+		if err != nil {
+			return err
+		}
+
+		var events []Event
+		if err := cursor.All(ctx, &events); err != nil {
+			return err
+		}
+
+		n = len(events)
+		if n == 0 {
+			return nil
+		}
+
+		last, err := reserveSequence(ctx, db, int64(n))
+		if err != nil {
+			return err
+		}
+
+		changes := make([]interface{}, 0, n)
+		numbered := make([]mongo.WriteModel, 0, n)
+		for i, event := range events {
+			seq := last - int64(n-1-i)
+			changes = append(changes, Change{Seq: seq, Type: event.Type, MarkerID: event.MarkerID, CreatedAt: event.CreatedAt})
+			numbered = append(numbered, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": event.ID}).
+				SetUpdate(bson.M{"$set": bson.M{"seq": seq}}))
+		}
+
+		// Without transactions a failure in between repeats changes instead of losing them.
+		if _, err := db.Collection("changes").InsertMany(ctx, changes); err != nil {
+			return err
+		}
+
+		_, err = db.Collection("events").BulkWrite(ctx, numbered)
+		return err
+	})
+	return n, err
+}
+
+// seedChanges starts the feed with a change for every live marker, so clients reading it
+// from the start get markers created before there was a feed. Events so far are
+// covered by them and left out of the feed with a seq of 0.
+func seedChanges(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("events").UpdateMany(ctx, bson.M{"seq": nil}, bson.M{"$set": bson.M{"seq": 0}}); err != nil {
+		return err
+	}
+
+	cursor, err := db.Collection("markers").Find(ctx, bson.M{}, options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var ids []string
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+
+		// Like sequenceChanges, so the numbers become visible in order next to it.
+		err := inTransaction(ctx, db, func(ctx context.Context) error {
+			last, err := reserveSequence(ctx, db, int64(len(ids)))
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().UTC()
+			batch := make([]interface{}, 0, len(ids))
+			for i, id := range ids {
+				batch = append(batch, Change{Seq: last - int64(len(ids)-1-i), Type: EventMarkerCreated, MarkerID: id, CreatedAt: now, Seeded: true})
+			}
+
+			_, err = db.Collection("changes").InsertMany(ctx, batch)
+			return err
+		})
+
+		ids = ids[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		ids = append(ids, marker.ID)
+		if len(ids) == 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func unseedChanges(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("events").UpdateMany(ctx, bson.M{"seq": 0}, bson.M{"$unset": bson.M{"seq": ""}}); err != nil {
+		return err
+	}
+
+	_, err := db.Collection("changes").DeleteMany(ctx, bson.M{"seeded": true})
+	return err
+}
+
+// expireChanges compacts changes older than tombstoneRetention to the newest one of each
+// marker, deletions are dropped altogether. It runs as the expire-changes job.
+func expireChanges(ctx context.Context, db *mongo.Database) error {
+	cutoff := time.Now().UTC().Add(-tombstoneRetention)
+	cursor, err := db.Collection("changes").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"createdAt": bson.M{"$lt": cutoff}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "markerId", Value: 1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$markerId", "type": bson.M{"$first": "$type"}, "changes": bson.M{"$push": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"type": EventMarkerDeleted},
+			bson.M{"changes.1": bson.M{"$exists": true}},
+		}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var marker struct {
+			Type    string  `bson:"type"`
+			Changes []int64 `bson:"changes"`
+		}
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		expired := marker.Changes
+		if marker.Type != EventMarkerDeleted {
+			expired = expired[1:]
+		} else if _, err := db.Collection("counters").UpdateOne(ctx,
+			bson.M{"_id": changesCounter},
+			bson.M{"$max": bson.M{"expiredThrough": marker.Changes[0]}},
+		); err != nil {
+			// The deletion is only dropped once clients behind it are told to start over.
+			return err
+		}
+
+		if _, err := db.Collection("changes").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": expired}}); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// parseSince reads ?since=, the sequence number to continue the feed after.
+func parseSince(c echo.Context) (int64, error) {
+	param := c.QueryParam("since")
+	if param == "" {
+		return 0, nil
+	}
+
+	since, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("invalid since, expected a sequence number")
+	}
+
+	return since, nil
+}
+
+// registerChangeRoutes serves GET /changes, every change to markers in order. Markers are
+// checked against the viewer as they are now, so clients keeping the ones that aren't
+// deleted end up with the markers they may see.
+func registerChangeRoutes(group *echo.Group, db *mongo.Database, privacy *markerPrivacy) {
+	group.GET("/changes", func(c echo.Context) error {
+		since, err := parseSince(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		limit, err := parseLimit(c, defaultChangesLimit, maxChangesLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		includeMarkers := false
+		if param := c.QueryParam("includeMarkers"); param != "" {
+			if includeMarkers, err = strconv.ParseBool(param); err != nil {
+				s := "includeMarkers must be true or false"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusBadRequest, ErrorString{s})
+			}
+		}
+
+		ctx := c.Request().Context()
+		if since > 0 {
+			var state changesState
+			err := db.Collection("counters").FindOne(ctx, bson.M{"_id": changesCounter}).Decode(&state)
+			if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if since < state.ExpiredThrough {
+				s := "since is too old, read the feed again from the start"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusGone, ErrorString{s})
+			}
+		}
+
+		cursor, err := db.Collection("changes").Find(ctx,
+			bson.M{"_id": bson.M{"$gt": since}},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit+1)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		response := ChangesResponse{Results: []Change{}, LastSeq: since}
+		if err := cursor.All(context.Background(), &response.Results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(response.Results) > limit {
+			response.Results, response.More = response.Results[:limit], true
+		}
+
+		if len(response.Results) == 0 {
+			return c.JSON(http.StatusOK, response)
+		}
+
+		response.LastSeq = response.Results[len(response.Results)-1].Seq
+
+		ids := make([]string, 0, len(response.Results))
+		for _, change := range response.Results {
+			ids = append(ids, change.MarkerID)
+		}
+
+		// Owner settings need the owner and location even without the markers.
+		opts := options.Find()
+		if !includeMarkers {
+			opts.SetProjection(bson.M{"_id": 1, "ownerId": 1, "location": 1})
+		}
+
+		cursor, err = db.Collection("markers").Find(ctx, and(bson.M{"_id": bson.M{"$in": ids}}, visibilityFilter(c)), opts)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if markers, err = privacy.view(c).redact(ctx, markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		visible := make(map[string]Marker, len(markers))
+		for _, marker := range markers {
+			visible[marker.ID] = marker.Normalize()
+		}
+
+		for i, change := range response.Results {
+			marker, ok := visible[change.MarkerID]
+			if !ok {
+				response.Results[i].Deleted = true
+				continue
+			}
+
+			if includeMarkers {
+				response.Results[i].Marker = &marker
+			}
+		}
+
+		return c.JSON(http.StatusOK, response)
+	})
+}
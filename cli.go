@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// command is a subcommand of the server binary. Commands parse their own flags and then
+// read the same environment variables as the server.
+type command struct {
+	usage string
+	// flags registers the flags of the command and returns the function running it.
+	flags func(*flag.FlagSet) func(cfg Config, client *mongo.Client, db *mongo.Database) error
+}
+
+var commands = map[string]command{
+	"serve": {
+		usage: "run the HTTP server (default)",
+		flags: func(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+			seed := flags.Bool("seed", false, "load the demo landmarks into an empty database, same as SEED_DATA=true")
+
+			return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+				cfg.SeedData = cfg.SeedData || *seed
+				return serve(cfg, client, db)
+			}
+		},
+	},
+	"migrate": {
+		usage: "apply or revert schema migrations, then exit",
+		flags: migrateCommand,
+	},
+	"export": {
+		usage: "write markers as GeoJSON or CSV",
+		flags: exportCommand,
+	},
+	"import": {
+		usage: "load markers from GeoJSON, CSV or a Google Takeout file",
+		flags: importCommand,
+	},
+	"seed": {
+		usage: "load demo or fixture markers into an empty database",
+		flags: seedCommand,
+	},
+	"loadgen": {
+		usage: "generate random markers and replay traffic, reporting latencies",
+		flags: loadgenCommand,
+	},
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+// runCommand runs the subcommand named by the first argument, serve if there is none.
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage(os.Stdout)
+		return nil
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	run := cmd.flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	client, db, err := connectDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	return run(cfg, client, db)
+}
+
+// openInput opens the file or stdin for "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	return os.Open(path)
+}
+
+// openOutput creates the file or returns stdout for "-".
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	return os.Create(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func exportCommand(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+	format := flags.String("format", "geojson", "output format, geojson or csv")
+	out := flags.String("out", "-", "output file, - for stdout")
+
+	return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+		w, err := openOutput(*out)
+		if err != nil {
+			return err
+		}
+
+		count, err := exportMarkers(context.Background(), db.Collection("markers"), bson.M{}, *format, w)
+		if err != nil {
+			w.Close()
+			return err
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "exported %d markers\n", count)
+		return nil
+	}
+}
+
+func importCommand(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+	format := flags.String("format", "geojson", "input format, geojson, csv or google-takeout")
+	in := flags.String("in", "-", "input file, - for stdin")
+	owner := flags.String("owner", "", "owner of the imported markers, keeps owners from the file if empty")
+
+	return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+		r, err := openInput(*in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		ctx := context.Background()
+		summary := ImportSummary{}
+		if *format == "google-takeout" {
+			candidates, err := parseTakeout(r)
+			if err != nil {
+				return err
+			}
+
+			// Addresses are resolved by the server's geocoding backfill.
+			importer := newMarkerImporter(db, cfg.Quotas, newGeocodingWorker(nil, db, echo.New().Logger))
+			if err := importer.importMarkers(ctx, nil, *owner, candidates, &summary); err != nil {
+				return err
+			}
+		} else {
+			markers, err := decodeMarkers(*format, r)
+			if err != nil {
+				return err
+			}
+
+			if summary, err = restoreMarkers(ctx, db, markers, *owner); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "%d entries: %d created, %d duplicates, %d invalid, %d over quota\n",
+			summary.Total, summary.Created, summary.Duplicates, summary.Invalid, summary.QuotaExceeded)
+		for _, e := range summary.Errors {
+			fmt.Fprintln(os.Stderr, e)
+		}
+
+		return nil
+	}
+}
+
+func readGeoJSON(path string) ([]Marker, error) {
+	r, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return decodeMarkers("geojson", r)
+}
+
+func seedCommand(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+	in := flags.String("in", "", "GeoJSON file with fixture markers, the bundled demo landmarks if empty")
+
+	return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+		markers, err := demoMarkers()
+		if *in != "" {
+			markers, err = readGeoJSON(*in)
+		}
+		if err != nil {
+			return err
+		}
+
+		summary, seeded, err := seedMarkers(context.Background(), db, markers)
+		if err != nil {
+			return err
+		}
+
+		if !seeded {
+			fmt.Fprintln(os.Stderr, "database already has markers, nothing to seed")
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "seeded %d markers\n", summary.Created)
+		return nil
+	}
+}
+
+func migrateCommand(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+	to := flags.Int("to", latestMigration(), "schema version to migrate to, lower versions revert migrations")
+	status := flags.Bool("status", false, "print the schema version of every database instead of migrating")
+
+	return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+		if *to < 0 || *to > latestMigration() {
+			return fmt.Errorf("-to must be between 0 and %d", latestMigration())
+		}
+
+		ctx := context.Background()
+		databases := []*mongo.Database{db}
+		if cfg.MultiTenancy {
+			tenants, err := listTenants(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			for _, tenant := range tenants {
+				databases = append(databases, client.Database(tenant.Database))
+			}
+		}
+
+		for _, db := range databases {
+			if *status {
+				version, err := schemaVersion(ctx, db)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("%s: version %d of %d\n", db.Name(), version, latestMigration())
+				continue
+			}
+
+			if err := ensureCollections(ctx, db); err != nil {
+				return err
+			}
+
+			if err := migrate(ctx, db, *to, func(msg string) { fmt.Fprintln(os.Stderr, msg) }); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxCollectionNameLength = 100
+	maxCollectionMarkers    = 10000
+
+	defaultCollectionsLimit = 50
+	maxCollectionsLimit     = 200
+
+	defaultCollectionMarkersLimit = 100
+	maxCollectionMarkersLimit     = 500
+)
+
+// Collection is a named group of markers, such as an album of a trip.
+type Collection struct {
+	ID          string    `json:"id" bson:"_id"`
+	OwnerID     string    `json:"ownerId" bson:"ownerId"`
+	Name        string    `json:"name" bson:"name"`
+	Description string    `json:"description" bson:"description"`
+	Public      bool      `json:"public" bson:"public"`
+	MarkerIDs   []string  `json:"markerIds" bson:"markerIds"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (c Collection) Normalize() Collection {
+	if c.MarkerIDs == nil {
+		c.MarkerIDs = []string{}
+	}
+
+	c.Description = sanitizeText(c.Description)
+
+	return c
+}
+
+func (c Collection) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("empty name")
+	}
+
+	if utf8.RuneCountInString(c.Name) > maxCollectionNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxCollectionNameLength)
+	}
+
+	if utf8.RuneCountInString(c.Description) > maxDescriptionLength {
+		return fmt.Errorf("description is longer than %d characters", maxDescriptionLength)
+	}
+
+	if len(c.MarkerIDs) > maxCollectionMarkers {
+		return fmt.Errorf("too many markers, at most %d allowed", maxCollectionMarkers)
+	}
+
+	return nil
+}
+
+func registerCollectionRoutes(group *echo.Group, db *mongo.Database, privacy *markerPrivacy) {
+	group.GET("/", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultCollectionsLimit, maxCollectionsLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter := publicOrOwned(c)
+		if c.QueryParam("owner") == "me" {
+			user, ok := currentUser(c)
+			if !ok {
+				s := "authentication required"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			filter = bson.M{"ownerId": user.ID}
+		}
+
+		cursor, err := db.Collection("collections").Find(c.Request().Context(), and(filter), options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Collection{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("/", func(c echo.Context) error {
+		var body Collection
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		user, _ := currentUser(c)
+		now := time.Now().UTC()
+		collection := body.Normalize()
+		collection.ID = primitive.NewObjectID().Hex()
+		collection.OwnerID = user.ID
+		collection.CreatedAt = now
+		collection.UpdatedAt = now
+
+		if err := collection.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if _, err := db.Collection("collections").InsertOne(c.Request().Context(), collection); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusCreated, collection)
+	}, requireUser())
+	group.GET("/:id", func(c echo.Context) error {
+		var collection Collection
+		if err := db.Collection("collections").FindOne(c.Request().Context(), and(bson.M{"_id": c.Param("id")}, publicOrOwned(c))).Decode(&collection); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "collection not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, collection.Normalize())
+	})
+	group.PUT("/:id", func(c echo.Context) error {
+		var body Collection
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		// Membership is only replaced when the body lists markers explicitly.
+		replaceMarkers := body.MarkerIDs != nil
+		body = body.Normalize()
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		update := bson.M{
+			"name":        body.Name,
+			"description": body.Description,
+			"public":      body.Public,
+			"updatedAt":   time.Now().UTC(),
+		}
+		if replaceMarkers {
+			update["markerIds"] = body.MarkerIDs
+		}
+
+		res, err := db.Collection("collections").UpdateOne(c.Request().Context(), ownedDocument(c, c.Param("id")), bson.M{"$set": update})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := "collection not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+	group.DELETE("/:id", func(c echo.Context) error {
+		res, err := db.Collection("collections").DeleteOne(c.Request().Context(), ownedDocument(c, c.Param("id")))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "collection not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+	group.GET("/:id/markers", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultCollectionMarkersLimit, maxCollectionMarkersLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		var collection Collection
+		if err := db.Collection("collections").FindOne(c.Request().Context(),
+			and(bson.M{"_id": c.Param("id")}, publicOrOwned(c)),
+			options.FindOne().SetProjection(bson.M{"markerIds": bson.M{"$slice": bson.A{offset, limit}}}),
+		).Decode(&collection); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "collection not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results, err := markersByIDs(c, db, collection.MarkerIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if results, err = privacy.view(c).redact(c.Request().Context(), results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.PUT("/:id/markers/:markerID", func(c echo.Context) error {
+		markerID := c.Param("markerID")
+		visible, err := markerVisible(c, db, markerID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		filter := and(ownedDocument(c, c.Param("id")), bson.M{fmt.Sprintf("markerIds.%d", maxCollectionMarkers-1): bson.M{"$exists": false}})
+		res, err := db.Collection("collections").UpdateOne(c.Request().Context(), filter, bson.M{
+			"$addToSet": bson.M{"markerIds": markerID},
+			"$set":      bson.M{"updatedAt": time.Now().UTC()},
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := fmt.Sprintf("collection not found or already has %d markers", maxCollectionMarkers)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+	group.DELETE("/:id/markers/:markerID", func(c echo.Context) error {
+		res, err := db.Collection("collections").UpdateOne(c.Request().Context(), ownedDocument(c, c.Param("id")), bson.M{
+			"$pull": bson.M{"markerIds": c.Param("markerID")},
+			"$set":  bson.M{"updatedAt": time.Now().UTC()},
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := "collection not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxCommentLength = 2000
+
+	defaultCommentsLimit = 50
+	maxCommentsLimit     = 200
+)
+
+type Comment struct {
+	ID         string    `json:"id" bson:"_id"`
+	MarkerID   string    `json:"markerId" bson:"markerId"`
+	AuthorID   string    `json:"authorId" bson:"authorId"`
+	AuthorName string    `json:"authorName" bson:"authorName"`
+	Text       string    `json:"text" bson:"text"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func (c Comment) Validate() error {
+	if c.Text == "" {
+		return fmt.Errorf("empty text")
+	}
+
+	if utf8.RuneCountInString(c.Text) > maxCommentLength {
+		return fmt.Errorf("text is longer than %d characters", maxCommentLength)
+	}
+
+	return nil
+}
+
+func registerCommentRoutes(group *echo.Group, db *mongo.Database, cache *responseCache) {
+	group.GET("/:id/comments", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultCommentsLimit, maxCommentsLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		visible, err := markerVisible(c, db, c.Param("id"))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		filter := bson.M{"markerId": c.Param("id")}
+		total, err := db.Collection("comments").CountDocuments(c.Request().Context(), filter)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		cursor, err := db.Collection("comments").Find(c.Request().Context(), filter, options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Comment{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		c.Response().Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+		return c.JSON(http.StatusOK, results)
+	}, cache.middleware())
+	group.POST("/:id/comments", func(c echo.Context) error {
+		var body Comment
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		user, _ := currentUser(c)
+		comment := Comment{
+			ID:         primitive.NewObjectID().Hex(),
+			MarkerID:   c.Param("id"),
+			AuthorID:   user.ID,
+			AuthorName: user.Name,
+			Text:       sanitizeText(body.Text),
+			CreatedAt:  time.Now().UTC(),
+		}
+
+		if err := comment.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		visible, err := markerVisible(c, db, comment.MarkerID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if _, err := db.Collection("comments").InsertOne(c.Request().Context(), comment); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusCreated, comment)
+	}, requireUser())
+	group.DELETE("/:id/comments/:commentID", func(c echo.Context) error {
+		var comment Comment
+		filter := bson.M{"_id": c.Param("commentID"), "markerId": c.Param("id")}
+		if err := db.Collection("comments").FindOne(c.Request().Context(), filter).Decode(&comment); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "comment not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if comment.AuthorID != user.ID && !user.HasRole(RoleModerator) && !user.HasRole(RoleAdmin) {
+			s := "only the author or a moderator can delete a comment"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+
+		if _, err := db.Collection("comments").DeleteOne(c.Request().Context(), filter); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+}
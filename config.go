@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/bytes"
+)
+
+// Config holds server settings read from the environment.
+type Config struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// TransferTimeout replaces ReadTimeout and WriteTimeout for routes moving large
+	// bodies: backups, restores and imports. Streamed exports get WriteTimeout for every
+	// batch instead. Zero leaves transfers without deadlines.
+	TransferTimeout time.Duration
+
+	// The server speaks TLS with TLSCertFile and TLSKeyFile. HTTP/2 is offered over TLS
+	// unless HTTP2 is off, H2C speaks it without TLS to clients and proxies that know to.
+	// HTTP3 adds HTTP/3 over QUIC on the same port over UDP.
+	TLSCertFile               string
+	TLSKeyFile                string
+	HTTP2                     bool
+	H2C                       bool
+	HTTP2MaxConcurrentStreams int
+	HTTP3                     bool
+
+	// AccessLog is stdout, off or a file requests are logged to as JSON lines. Successful
+	// requests are sampled at AccessLogSampleRate, failed ones always logged. Only the
+	// AccessLogHeaders are logged, with credentials redacted.
+	AccessLog           string
+	AccessLogSampleRate float64
+	AccessLogHeaders    []string
+
+	JSONBodyLimit    string
+	UploadBodyLimit  string // applied to file upload routes instead of JSONBodyLimit
+	RestoreBodyLimit string // applied to backup restores
+	// BackupImageTimeout limits fetching each image included in a backup.
+	BackupImageTimeout time.Duration
+
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+
+	// RateLimits maps plan names to their limits, the default plan always exists.
+	RateLimits map[string]Plan
+
+	MaxInFlight  int
+	MaxQueued    int
+	QueueTimeout time.Duration
+	RetryAfter   time.Duration
+
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+
+	GeocoderProvider  string
+	GeocoderURL       string
+	GeocoderUserAgent string
+	GeocoderTimeout   time.Duration
+	GeocoderInterval  time.Duration
+	GeocoderCacheTTL  time.Duration
+	GeocodeRateLimit  float64
+
+	TileUpstreamURL string
+	TileUserAgent   string
+	TileCacheDir    string
+	TileCacheTTL    time.Duration
+	TileMaxAge      time.Duration
+	TileTimeout     time.Duration
+
+	MarkerTileMaxAge time.Duration
+
+	FlagHideThreshold int
+
+	// MaxListMarkers caps the markers returned by a single unpaginated listing.
+	MaxListMarkers int
+
+	ExpiryInterval  time.Duration
+	PublishInterval time.Duration
+
+	ArchiveAfter    time.Duration // 0 disables archiving
+	ArchiveInterval time.Duration
+
+	// HistoryRetention limits how far back ?asOf= reaches, 0 keeps the history forever.
+	HistoryRetention time.Duration
+
+	// JobSchedules replaces the schedules of background jobs by name.
+	JobSchedules map[string]string
+
+	WebhookURLs           []string
+	WebhookSecret         string
+	WebhookTimeout        time.Duration
+	EventMaxAttempts      int
+	EventDispatchInterval time.Duration
+
+	// EventBus is nats or kafka, empty to publish no events to a message bus.
+	EventBus        string
+	EventBusURL     string
+	EventBusTopic   string
+	EventBusTimeout time.Duration
+
+	// MigrationTarget is mongodb or postgrest, empty unless markers are being migrated
+	// to another backend.
+	MigrationTarget      string
+	MigrationTargetURL   string
+	MigrationTargetTable string
+	MigrationTargetToken string
+	MigrationTimeout     time.Duration
+	// MigrationRepair makes verification copy divergent markers to the target.
+	MigrationRepair bool
+	// MigrationShadowReads is the share of marker reads compared with the target.
+	MigrationShadowReads float64
+
+	FCMCredentialsFile string
+	APNsKeyFile        string
+	APNsKeyID          string
+	APNsTeamID         string
+	APNsTopic          string
+	APNsSandbox        bool
+	PushTimeout        time.Duration
+
+	FlickrAPIKey  string
+	FlickrTimeout time.Duration
+
+	// ImageModerationURL is an HTTP image classifier, empty to disable automatic moderation.
+	ImageModerationURL       string
+	ImageModerationThreshold float64
+	ImageModerationTimeout   time.Duration
+	ImageModerationInterval  time.Duration
+
+	// Images of markers are downloaded to compute the perceptual hashes searching by
+	// image compares.
+	ImageHashTimeout  time.Duration
+	ImageHashInterval time.Duration
+
+	// StripImageMetadata hides EXIF data and image locations of every marker from users
+	// other than the owner. Users can opt into it on their own otherwise.
+	StripImageMetadata bool
+
+	// PrivacyGridSize is the cell size in degrees markers in fuzzing privacy zones snap to.
+	PrivacyGridSize float64
+
+	// ClamdAddress is a clamd unix socket or host:port, empty to accept uploads unscanned.
+	ClamdAddress string
+	ClamdTimeout time.Duration
+
+	// SearchBackend is meilisearch or elasticsearch, empty to use MongoDB text search.
+	SearchBackend      string
+	SearchURL          string
+	SearchAPIKey       string
+	SearchIndex        string // prefix of the index names, one index per database
+	SearchTimeout      time.Duration
+	SearchSyncInterval time.Duration
+
+	Quotas Quotas
+
+	MultiTenancy bool
+	TenantDomain string
+
+	MongoURI            string
+	MongoDatabase       string
+	MongoStartupTimeout time.Duration
+
+	// Client tuning, zero values keep the settings of the connection string or the
+	// driver defaults.
+	MongoReadPreference         string
+	MongoMaxStaleness           time.Duration
+	MongoReadConcern            string
+	MongoWriteConcern           string
+	MongoWriteTimeout           time.Duration
+	MongoMaxPoolSize            uint64
+	MongoServerSelectionTimeout time.Duration
+	// MongoSlowCommandThreshold logs commands taking longer, 0 only logs failed ones.
+	MongoSlowCommandThreshold time.Duration
+	// MongoBreakerThreshold is the number of failed heartbeats and connection checkouts
+	// in MongoBreakerWindow that make requests fail fast, 0 disables the breaker.
+	MongoBreakerThreshold     int
+	MongoBreakerWindow        time.Duration
+	MongoBreakerProbeInterval time.Duration
+	// MongoListingReadPreference applies to listings, search and map overviews, which
+	// can tolerate slightly stale data.
+	MongoListingReadPreference string
+
+	MigrateOnStartup bool
+	SeedData         bool
+
+	// FeatureFlags are turned on for every tenant unless admins stored other settings.
+	FeatureFlags []string
+
+	// MaintenanceMode makes every tenant read-only, admins can't turn it off.
+	MaintenanceMode    bool
+	MaintenanceMessage string
+
+	AuthJWTSecret string
+
+	ShareTokenSecret string
+	PublicURL        string
+
+	// ExportDir keeps user data exports for ExportRetention, download links are valid
+	// for ExportLinkTTL.
+	ExportDir       string
+	ExportRetention time.Duration
+	ExportLinkTTL   time.Duration
+
+	// Offline bundles are kept in EXPORT_DIR like exports, a new bundle of an area is
+	// built once the last one is older than BundleMaxAge.
+	BundleMaxAge        time.Duration
+	BundleThumbnailSize int
+	BundleImageTimeout  time.Duration
+
+	// Tilesets are kept in EXPORT_DIR too, a new tileset of an area is built once the
+	// last one is older than TilesetMaxAge. Tiles go from zoom 0 to TilesetMaxZoom.
+	TilesetMaxAge  time.Duration
+	TilesetMaxZoom int
+
+	// Sitemaps of public markers are kept in EXPORT_DIR as well and rebuilt every
+	// SitemapInterval, they need PUBLIC_URL.
+	SitemapInterval time.Duration
+
+	// FrontendDir is a built single page app served at /, it takes the place of the one
+	// embedded by the frontend build tag.
+	FrontendDir string
+
+	// ErasureGracePeriod is how long deleted accounts can still be restored.
+	ErasureGracePeriod time.Duration
+
+	DebugEndpoints bool
+}
+
+func LoadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	cfg.Addr = envString("LISTEN_ADDR", "")
+	if cfg.Addr == "" {
+		cfg.Addr = ":" + envString("PORT", "8080")
+	}
+
+	if cfg.ReadHeaderTimeout, err = envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ReadTimeout, err = envDuration("HTTP_READ_TIMEOUT", 15*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.WriteTimeout, err = envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.IdleTimeout, err = envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TransferTimeout, err = envDuration("HTTP_TRANSFER_TIMEOUT", time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MaxHeaderBytes, err = envInt("HTTP_MAX_HEADER_BYTES", 1<<20); err != nil {
+		return Config{}, err
+	}
+
+	cfg.TLSCertFile = envString("TLS_CERT_FILE", "")
+	cfg.TLSKeyFile = envString("TLS_KEY_FILE", "")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return Config{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if cfg.HTTP2, err = envBool("HTTP2", true); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.H2C, err = envBool("H2C", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.H2C && (!cfg.HTTP2 || cfg.TLSCertFile != "") {
+		return Config{}, fmt.Errorf("H2C needs HTTP2 and a listener without TLS")
+	}
+
+	if cfg.HTTP2MaxConcurrentStreams, err = envInt("HTTP2_MAX_CONCURRENT_STREAMS", 250); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.HTTP2MaxConcurrentStreams <= 0 {
+		return Config{}, fmt.Errorf("HTTP2_MAX_CONCURRENT_STREAMS must be positive")
+	}
+
+	if cfg.HTTP3, err = envBool("HTTP3", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.HTTP3 && cfg.TLSCertFile == "" {
+		return Config{}, fmt.Errorf("HTTP3 needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	cfg.AccessLog = envString("ACCESS_LOG", "stdout")
+
+	if cfg.AccessLogSampleRate, err = envFloat("ACCESS_LOG_SAMPLE_RATE", 1); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.AccessLogSampleRate > 1 {
+		return Config{}, fmt.Errorf("ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+
+	cfg.AccessLogHeaders = envList("ACCESS_LOG_HEADERS", []string{"User-Agent", "Referer"})
+
+	if cfg.JSONBodyLimit, err = envByteSize("JSON_BODY_LIMIT", "1M"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.UploadBodyLimit, err = envByteSize("UPLOAD_BODY_LIMIT", "25M"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.RestoreBodyLimit, err = envByteSize("RESTORE_BODY_LIMIT", "2G"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.BackupImageTimeout, err = envDuration("BACKUP_IMAGE_TIMEOUT", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.BackupImageTimeout == 0 {
+		return Config{}, fmt.Errorf("BACKUP_IMAGE_TIMEOUT must be positive")
+	}
+
+	cfg.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS", nil)
+	cfg.CORSAllowedMethods = envList("CORS_ALLOWED_METHODS", []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"})
+	cfg.CORSAllowedHeaders = envList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "X-Tenant", "X-Dry-Run", "X-Envelope"})
+	// Browsers only let scripts read a few headers of cross-origin responses, clients need
+	// these for pagination, retries and revisions.
+	cfg.CORSExposedHeaders = envList("CORS_EXPOSED_HEADERS", []string{"X-Request-ID", "X-Total-Count", "X-Truncated", "X-Revision", "Retry-After", "ETag", "Location"})
+
+	if cfg.CORSAllowCredentials, err = envBool("CORS_ALLOW_CREDENTIALS", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.CORSMaxAge, err = envDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if origin == "*" && cfg.CORSAllowCredentials {
+			return Config{}, fmt.Errorf("CORS_ALLOW_CREDENTIALS can't be combined with the * origin, list the allowed origins explicitly")
+		}
+	}
+
+	cfg.RateLimits = map[string]Plan{}
+	if v := envString("RATE_LIMITS", ""); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.RateLimits); err != nil {
+			return Config{}, fmt.Errorf("invalid RATE_LIMITS: %w", err)
+		}
+	}
+
+	if _, ok := cfg.RateLimits[defaultPlan]; !ok {
+		cfg.RateLimits[defaultPlan] = Plan{
+			RateRead:   {Rate: 20, Burst: 20},
+			RateWrite:  {Rate: 20, Burst: 20},
+			RateUpload: {Rate: 20, Burst: 20},
+		}
+	}
+
+	for name, plan := range cfg.RateLimits {
+		if err := plan.Validate(); err != nil {
+			return Config{}, fmt.Errorf("invalid RATE_LIMITS plan %s: %w", name, err)
+		}
+	}
+
+	if cfg.MaxInFlight, err = envInt("MAX_IN_FLIGHT_REQUESTS", 100); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MaxQueued, err = envInt("MAX_QUEUED_REQUESTS", 200); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.QueueTimeout, err = envDuration("REQUEST_QUEUE_TIMEOUT", 2*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.RetryAfter, err = envDuration("OVERLOAD_RETRY_AFTER", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.CacheTTL, err = envDuration("CACHE_TTL", time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.CacheMaxEntries, err = envInt("CACHE_MAX_ENTRIES", 1000); err != nil {
+		return Config{}, err
+	}
+
+	cfg.GeocoderProvider = envString("GEOCODER_PROVIDER", "")
+	cfg.GeocoderURL = envString("GEOCODER_URL", "")
+	if cfg.GeocoderURL == "" {
+		switch cfg.GeocoderProvider {
+		case "nominatim":
+			cfg.GeocoderURL = "https://nominatim.openstreetmap.org"
+		case "photon":
+			cfg.GeocoderURL = "https://photon.komoot.io"
+		}
+	}
+
+	cfg.GeocoderUserAgent = envString("GEOCODER_USER_AGENT", "images-on-map-server")
+
+	if cfg.GeocoderTimeout, err = envDuration("GEOCODER_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.GeocoderInterval, err = envDuration("GEOCODER_INTERVAL", time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.GeocoderInterval == 0 {
+		return Config{}, fmt.Errorf("GEOCODER_INTERVAL must be positive")
+	}
+
+	if cfg.GeocoderCacheTTL, err = envDuration("GEOCODER_CACHE_TTL", 24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.GeocodeRateLimit, err = envFloat("GEOCODE_RATE_LIMIT", 1); err != nil {
+		return Config{}, err
+	}
+
+	cfg.TileUpstreamURL = envString("TILE_UPSTREAM_URL", "")
+	cfg.TileUserAgent = envString("TILE_USER_AGENT", "images-on-map-server")
+	cfg.TileCacheDir = envString("TILE_CACHE_DIR", filepath.Join(os.TempDir(), "images-on-map-tiles"))
+
+	if cfg.TileCacheTTL, err = envDuration("TILE_CACHE_TTL", 7*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TileMaxAge, err = envDuration("TILE_MAX_AGE", 7*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TileTimeout, err = envDuration("TILE_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MarkerTileMaxAge, err = envDuration("MARKER_TILE_MAX_AGE", 5*time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.FlagHideThreshold, err = envInt("FLAG_HIDE_THRESHOLD", 3); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.FlagHideThreshold == 0 {
+		return Config{}, fmt.Errorf("FLAG_HIDE_THRESHOLD must be at least 1")
+	}
+
+	if cfg.MaxListMarkers, err = envInt("MAX_LIST_MARKERS", 1000); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MaxListMarkers < 1 {
+		return Config{}, fmt.Errorf("MAX_LIST_MARKERS must be at least 1")
+	}
+
+	if cfg.ExpiryInterval, err = envDuration("MARKER_EXPIRY_INTERVAL", time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ExpiryInterval == 0 {
+		return Config{}, fmt.Errorf("MARKER_EXPIRY_INTERVAL must be positive")
+	}
+
+	if cfg.PublishInterval, err = envDuration("MARKER_PUBLISH_INTERVAL", time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.PublishInterval == 0 {
+		return Config{}, fmt.Errorf("MARKER_PUBLISH_INTERVAL must be positive")
+	}
+
+	archiveDays, err := envInt("ARCHIVE_AFTER_DAYS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.ArchiveAfter = time.Duration(archiveDays) * 24 * time.Hour
+
+	if cfg.ArchiveInterval, err = envDuration("ARCHIVE_INTERVAL", time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ArchiveAfter > 0 && cfg.ArchiveInterval == 0 {
+		return Config{}, fmt.Errorf("ARCHIVE_INTERVAL must be positive")
+	}
+
+	if cfg.HistoryRetention, err = envDuration("MARKER_HISTORY_RETENTION", 0); err != nil {
+		return Config{}, err
+	}
+
+	// Schedules are separated by semicolons, cron expressions contain commas.
+	for _, item := range strings.Split(envString("JOB_SCHEDULES", ""), ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return Config{}, fmt.Errorf("JOB_SCHEDULES: expected name=schedule, got %q", item)
+		}
+
+		if _, err := parseSchedule(spec); err != nil {
+			return Config{}, fmt.Errorf("JOB_SCHEDULES: %s: %w", strings.TrimSpace(name), err)
+		}
+
+		if cfg.JobSchedules == nil {
+			cfg.JobSchedules = map[string]string{}
+		}
+
+		cfg.JobSchedules[strings.TrimSpace(name)] = spec
+	}
+
+	cfg.WebhookURLs = envList("WEBHOOK_URLS", nil)
+	cfg.WebhookSecret = envString("WEBHOOK_SECRET", "")
+
+	if cfg.WebhookTimeout, err = envDuration("WEBHOOK_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.WebhookTimeout == 0 {
+		return Config{}, fmt.Errorf("WEBHOOK_TIMEOUT must be positive")
+	}
+
+	if cfg.EventMaxAttempts, err = envInt("EVENT_MAX_ATTEMPTS", 10); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.EventMaxAttempts < 1 {
+		return Config{}, fmt.Errorf("EVENT_MAX_ATTEMPTS must be at least 1")
+	}
+
+	if cfg.EventDispatchInterval, err = envDuration("EVENT_DISPATCH_INTERVAL", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.EventDispatchInterval == 0 {
+		return Config{}, fmt.Errorf("EVENT_DISPATCH_INTERVAL must be positive")
+	}
+
+	cfg.EventBus = envString("EVENT_BUS", "")
+	if cfg.EventBus != "" && cfg.EventBus != BusNATS && cfg.EventBus != BusKafka {
+		return Config{}, fmt.Errorf("EVENT_BUS must be nats or kafka")
+	}
+
+	// Kafka is reached through its REST proxy, at e.g. http://kafka-rest:8082.
+	cfg.EventBusURL = envString("EVENT_BUS_URL", "")
+	if cfg.EventBus != "" && cfg.EventBusURL == "" {
+		return Config{}, fmt.Errorf("EVENT_BUS_URL is required with EVENT_BUS")
+	}
+
+	cfg.EventBusTopic = envString("EVENT_BUS_TOPIC", "markers")
+	if cfg.EventBusTopic == "" || strings.ContainsAny(cfg.EventBusTopic, " \t\r\n") {
+		return Config{}, fmt.Errorf("EVENT_BUS_TOPIC must be a non-empty name without spaces")
+	}
+
+	if cfg.EventBusTimeout, err = envDuration("EVENT_BUS_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.EventBusTimeout == 0 {
+		return Config{}, fmt.Errorf("EVENT_BUS_TIMEOUT must be positive")
+	}
+
+	cfg.MigrationTarget = envString("MIGRATION_TARGET", "")
+	if cfg.MigrationTarget != "" && cfg.MigrationTarget != MigrationMongoDB && cfg.MigrationTarget != MigrationPostgREST {
+		return Config{}, fmt.Errorf("MIGRATION_TARGET must be mongodb or postgrest")
+	}
+
+	cfg.MigrationTargetURL = envString("MIGRATION_TARGET_URL", "")
+	if cfg.MigrationTarget != "" && cfg.MigrationTargetURL == "" {
+		return Config{}, fmt.Errorf("MIGRATION_TARGET_URL is required with MIGRATION_TARGET")
+	}
+
+	cfg.MigrationTargetTable = envString("MIGRATION_TARGET_TABLE", "markers")
+	if cfg.MigrationTargetTable == "" {
+		return Config{}, fmt.Errorf("MIGRATION_TARGET_TABLE can't be empty")
+	}
+
+	cfg.MigrationTargetToken = envString("MIGRATION_TARGET_TOKEN", "")
+
+	if cfg.MigrationTimeout, err = envDuration("MIGRATION_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MigrationTimeout == 0 {
+		return Config{}, fmt.Errorf("MIGRATION_TIMEOUT must be positive")
+	}
+
+	if cfg.MigrationRepair, err = envBool("MIGRATION_REPAIR", true); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MigrationShadowReads, err = envFloat("MIGRATION_SHADOW_READS", 0); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MigrationShadowReads > 1 {
+		return Config{}, fmt.Errorf("MIGRATION_SHADOW_READS must be between 0 and 1")
+	}
+
+	cfg.FCMCredentialsFile = envString("PUSH_FCM_CREDENTIALS_FILE", "")
+	cfg.APNsKeyFile = envString("PUSH_APNS_KEY_FILE", "")
+	cfg.APNsKeyID = envString("PUSH_APNS_KEY_ID", "")
+	cfg.APNsTeamID = envString("PUSH_APNS_TEAM_ID", "")
+	cfg.APNsTopic = envString("PUSH_APNS_TOPIC", "")
+
+	if cfg.APNsKeyFile != "" && (cfg.APNsKeyID == "" || cfg.APNsTeamID == "" || cfg.APNsTopic == "") {
+		return Config{}, fmt.Errorf("PUSH_APNS_KEY_FILE requires PUSH_APNS_KEY_ID, PUSH_APNS_TEAM_ID and PUSH_APNS_TOPIC to be set")
+	}
+
+	if cfg.APNsSandbox, err = envBool("PUSH_APNS_SANDBOX", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.PushTimeout, err = envDuration("PUSH_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	cfg.FlickrAPIKey = envString("FLICKR_API_KEY", "")
+
+	if cfg.FlickrTimeout, err = envDuration("FLICKR_TIMEOUT", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	cfg.ImageModerationURL = envString("IMAGE_MODERATION_URL", "")
+
+	if cfg.ImageModerationThreshold, err = envFloat("IMAGE_MODERATION_THRESHOLD", 0.8); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImageModerationThreshold <= 0 || cfg.ImageModerationThreshold > 1 {
+		return Config{}, fmt.Errorf("IMAGE_MODERATION_THRESHOLD must be above 0 and at most 1")
+	}
+
+	if cfg.ImageModerationTimeout, err = envDuration("IMAGE_MODERATION_TIMEOUT", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImageModerationInterval, err = envDuration("IMAGE_MODERATION_INTERVAL", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImageModerationInterval == 0 {
+		return Config{}, fmt.Errorf("IMAGE_MODERATION_INTERVAL must be positive")
+	}
+
+	if cfg.ImageHashTimeout, err = envDuration("IMAGE_HASH_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImageHashInterval, err = envDuration("IMAGE_HASH_INTERVAL", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ImageHashInterval == 0 {
+		return Config{}, fmt.Errorf("IMAGE_HASH_INTERVAL must be positive")
+	}
+
+	if cfg.StripImageMetadata, err = envBool("STRIP_IMAGE_METADATA", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.PrivacyGridSize, err = envFloat("PRIVACY_GRID_SIZE", 0.01); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.PrivacyGridSize <= 0 || cfg.PrivacyGridSize > 1 {
+		return Config{}, fmt.Errorf("PRIVACY_GRID_SIZE must be above 0 and at most 1")
+	}
+
+	cfg.ClamdAddress = envString("CLAMD_ADDRESS", "")
+
+	if cfg.ClamdTimeout, err = envDuration("CLAMD_TIMEOUT", time.Minute); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ClamdTimeout == 0 {
+		return Config{}, fmt.Errorf("CLAMD_TIMEOUT must be positive")
+	}
+
+	cfg.SearchBackend = envString("SEARCH_BACKEND", "")
+	cfg.SearchURL = envString("SEARCH_URL", "")
+	if cfg.SearchBackend != "" && cfg.SearchURL == "" {
+		return Config{}, fmt.Errorf("SEARCH_URL is required with SEARCH_BACKEND")
+	}
+
+	cfg.SearchAPIKey = envString("SEARCH_API_KEY", "")
+	cfg.SearchIndex = envString("SEARCH_INDEX", "markers")
+
+	if cfg.SearchTimeout, err = envDuration("SEARCH_TIMEOUT", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SearchSyncInterval, err = envDuration("SEARCH_SYNC_INTERVAL", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SearchSyncInterval == 0 {
+		return Config{}, fmt.Errorf("SEARCH_SYNC_INTERVAL must be positive")
+	}
+
+	if cfg.Quotas.MaxMarkers, err = envInt64("QUOTA_MAX_MARKERS", 0); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Quotas.MaxImages, err = envInt64("QUOTA_MAX_IMAGES", 0); err != nil {
+		return Config{}, err
+	}
+
+	maxStorage, err := envByteSize("QUOTA_MAX_STORAGE", "0")
+	if err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Quotas.MaxStorageBytes, err = bytes.Parse(maxStorage); err != nil {
+		return Config{}, fmt.Errorf("invalid QUOTA_MAX_STORAGE: %w", err)
+	}
+
+	cfg.MongoURI = envString("MONGODB_CONN_STRING", "")
+	if cfg.MongoURI == "" {
+		return Config{}, fmt.Errorf("MONGODB_CONN_STRING is not set: set it to a MongoDB connection string, e.g. mongodb://localhost:27017")
+	}
+
+	cfg.MongoDatabase = envString("MONGODB_DATABASE", "images-on-map")
+	if cfg.MongoDatabase == "" {
+		return Config{}, fmt.Errorf("MONGODB_DATABASE is empty: unset it to use the default database or provide a name")
+	}
+
+	if cfg.MongoStartupTimeout, err = envDuration("MONGODB_STARTUP_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoMaxStaleness, err = envDuration("MONGODB_MAX_STALENESS", 0); err != nil {
+		return Config{}, err
+	}
+
+	cfg.MongoReadPreference = envString("MONGODB_READ_PREFERENCE", "")
+	if _, err := parseReadPreference(cfg.MongoReadPreference, cfg.MongoMaxStaleness); err != nil {
+		return Config{}, fmt.Errorf("invalid MONGODB_READ_PREFERENCE: %w", err)
+	}
+
+	cfg.MongoListingReadPreference = envString("MONGODB_LISTING_READ_PREFERENCE", "secondaryPreferred")
+	if _, err := parseReadPreference(cfg.MongoListingReadPreference, cfg.MongoMaxStaleness); err != nil {
+		return Config{}, fmt.Errorf("invalid MONGODB_LISTING_READ_PREFERENCE: %w", err)
+	}
+
+	cfg.MongoReadConcern = envString("MONGODB_READ_CONCERN", "")
+	if _, err := parseReadConcern(cfg.MongoReadConcern); err != nil {
+		return Config{}, fmt.Errorf("invalid MONGODB_READ_CONCERN: %w", err)
+	}
+
+	if cfg.MongoWriteTimeout, err = envDuration("MONGODB_WRITE_TIMEOUT", 0); err != nil {
+		return Config{}, err
+	}
+
+	cfg.MongoWriteConcern = envString("MONGODB_WRITE_CONCERN", "")
+	if _, err := parseWriteConcern(cfg.MongoWriteConcern, cfg.MongoWriteTimeout); err != nil {
+		return Config{}, fmt.Errorf("invalid MONGODB_WRITE_CONCERN: %w", err)
+	}
+
+	maxPoolSize, err := envInt("MONGODB_MAX_POOL_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if maxPoolSize < 0 {
+		return Config{}, fmt.Errorf("MONGODB_MAX_POOL_SIZE can't be negative")
+	}
+
+	cfg.MongoMaxPoolSize = uint64(maxPoolSize)
+
+	if cfg.MongoServerSelectionTimeout, err = envDuration("MONGODB_SERVER_SELECTION_TIMEOUT", 0); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoSlowCommandThreshold, err = envDuration("MONGODB_SLOW_COMMAND_THRESHOLD", time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoBreakerThreshold, err = envInt("MONGODB_BREAKER_THRESHOLD", 5); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoBreakerThreshold < 0 {
+		return Config{}, fmt.Errorf("MONGODB_BREAKER_THRESHOLD can't be negative")
+	}
+
+	if cfg.MongoBreakerWindow, err = envDuration("MONGODB_BREAKER_WINDOW", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoBreakerWindow <= 0 {
+		return Config{}, fmt.Errorf("MONGODB_BREAKER_WINDOW must be positive")
+	}
+
+	if cfg.MongoBreakerProbeInterval, err = envDuration("MONGODB_BREAKER_PROBE_INTERVAL", 5*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.MongoBreakerProbeInterval <= 0 {
+		return Config{}, fmt.Errorf("MONGODB_BREAKER_PROBE_INTERVAL must be positive")
+	}
+
+	if cfg.MigrateOnStartup, err = envBool("MIGRATE_ON_STARTUP", true); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SeedData, err = envBool("SEED_DATA", false); err != nil {
+		return Config{}, err
+	}
+
+	cfg.FeatureFlags = envList("FEATURE_FLAGS", nil)
+	for _, name := range cfg.FeatureFlags {
+		if !featureNamePattern.MatchString(name) {
+			return Config{}, fmt.Errorf("invalid feature flag %q in FEATURE_FLAGS", name)
+		}
+	}
+
+	if cfg.MaintenanceMode, err = envBool("MAINTENANCE_MODE", false); err != nil {
+		return Config{}, err
+	}
+
+	cfg.MaintenanceMessage = envString("MAINTENANCE_MESSAGE", defaultMaintenanceMessage)
+	if cfg.MaintenanceMessage == "" {
+		return Config{}, fmt.Errorf("MAINTENANCE_MESSAGE can't be empty")
+	}
+
+	if cfg.MultiTenancy, err = envBool("MULTI_TENANCY", false); err != nil {
+		return Config{}, err
+	}
+
+	cfg.TenantDomain = strings.ToLower(strings.Trim(envString("TENANT_DOMAIN", ""), "."))
+
+	cfg.AuthJWTSecret = envString("AUTH_JWT_SECRET", "")
+
+	cfg.ShareTokenSecret = envString("SHARE_TOKEN_SECRET", "")
+	cfg.PublicURL = envString("PUBLIC_URL", "")
+
+	cfg.ExportDir = envString("EXPORT_DIR", filepath.Join(os.TempDir(), "images-on-map-exports"))
+
+	if cfg.ExportRetention, err = envDuration("EXPORT_RETENTION", 7*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ExportRetention == 0 {
+		return Config{}, fmt.Errorf("EXPORT_RETENTION must be positive")
+	}
+
+	if cfg.ExportLinkTTL, err = envDuration("EXPORT_LINK_TTL", time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.ExportLinkTTL == 0 {
+		return Config{}, fmt.Errorf("EXPORT_LINK_TTL must be positive")
+	}
+
+	if cfg.BundleMaxAge, err = envDuration("BUNDLE_MAX_AGE", 24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.BundleMaxAge == 0 {
+		return Config{}, fmt.Errorf("BUNDLE_MAX_AGE must be positive")
+	}
+
+	if cfg.BundleThumbnailSize, err = envInt("BUNDLE_THUMBNAIL_SIZE", 256); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.BundleThumbnailSize < 16 || cfg.BundleThumbnailSize > 2048 {
+		return Config{}, fmt.Errorf("BUNDLE_THUMBNAIL_SIZE must be between 16 and 2048")
+	}
+
+	if cfg.BundleImageTimeout, err = envDuration("BUNDLE_IMAGE_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.BundleImageTimeout == 0 {
+		return Config{}, fmt.Errorf("BUNDLE_IMAGE_TIMEOUT must be positive")
+	}
+
+	if cfg.TilesetMaxAge, err = envDuration("TILESET_MAX_AGE", 24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TilesetMaxAge == 0 {
+		return Config{}, fmt.Errorf("TILESET_MAX_AGE must be positive")
+	}
+
+	if cfg.TilesetMaxZoom, err = envInt("TILESET_MAX_ZOOM", markerTileClusterZoom); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TilesetMaxZoom < 0 || cfg.TilesetMaxZoom > maxTileZoom {
+		return Config{}, fmt.Errorf("TILESET_MAX_ZOOM must be between 0 and %d", maxTileZoom)
+	}
+
+	if cfg.SitemapInterval, err = envDuration("SITEMAP_INTERVAL", 6*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.SitemapInterval == 0 {
+		return Config{}, fmt.Errorf("SITEMAP_INTERVAL must be positive")
+	}
+
+	cfg.FrontendDir = envString("FRONTEND_DIR", "")
+
+	if cfg.ErasureGracePeriod, err = envDuration("ERASURE_GRACE_PERIOD", 30*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.DebugEndpoints, err = envBool("DEBUG_ENDPOINTS", false); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.DebugEndpoints && cfg.AuthJWTSecret == "" {
+		return Config{}, fmt.Errorf("DEBUG_ENDPOINTS requires AUTH_JWT_SECRET to be set, otherwise nobody can authenticate as admin")
+	}
+
+	return cfg, nil
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
+
+// envList reads a comma-separated list, ignoring empty items.
+func envList(key string, fallback []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s: negative duration", key)
+	}
+
+	return d, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("invalid %s: negative value", key)
+	}
+
+	return n, nil
+}
+
+func envInt64(key string, fallback int64) (int64, error) {
+	n, err := envInt(key, int(fallback))
+	return int64(n), err
+}
+
+// envByteSize reads a size such as 512K or 25M in the format accepted by middleware.BodyLimit.
+func envByteSize(key string, fallback string) (string, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+
+	if _, err := bytes.Parse(v); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return v, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if f < 0 {
+		return 0, fmt.Errorf("invalid %s: negative value", key)
+	}
+
+	return f, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return b, nil
+}
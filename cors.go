@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// corsMiddleware allows cross-origin requests only from the configured origins.
+// An origin of "*" allows everyone, and "https://*.example.com" allows any subdomain
+// of example.com (but not example.com itself) over https.
+func corsMiddleware(cfg Config) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			for _, pattern := range cfg.CORSAllowedOrigins {
+				if matchOrigin(pattern, origin) {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		},
+		AllowMethods:     cfg.CORSAllowedMethods,
+		AllowHeaders:     cfg.CORSAllowedHeaders,
+		ExposeHeaders:    cfg.CORSExposedHeaders,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           int(cfg.CORSMaxAge.Seconds()),
+	})
+}
+
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+
+	i := strings.Index(pattern, "://*.")
+	if i == -1 {
+		return false
+	}
+
+	scheme, suffix := pattern[:i+len("://")], strings.ToLower(pattern[i+len("://*"):])
+	if !strings.HasPrefix(strings.ToLower(origin), strings.ToLower(scheme)) {
+		return false
+	}
+
+	host := strings.ToLower(origin[len(scheme):])
+	if !strings.HasSuffix(host, suffix) {
+		return false
+	}
+
+	subdomain := host[:len(host)-len(suffix)]
+	if subdomain == "" || strings.HasPrefix(subdomain, ".") {
+		return false
+	}
+
+	for _, r := range subdomain {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"any origin", "*", "https://example.com", true},
+		{"exact", "https://example.com", "https://example.com", true},
+		{"exact ignores case", "https://Example.com", "https://example.COM", true},
+		{"exact with port", "http://localhost:3000", "http://localhost:3000", true},
+		{"other port", "http://localhost:3000", "http://localhost:8080", false},
+		{"other host", "https://example.com", "https://example.org", false},
+		{"subdomain of an exact origin", "https://example.com", "https://app.example.com", false},
+		{"wildcard subdomain", "https://*.example.com", "https://app.example.com", true},
+		{"wildcard nested subdomain", "https://*.example.com", "https://a.b.example.com", true},
+		{"wildcard ignores case", "https://*.Example.com", "HTTPS://App.EXAMPLE.com", true},
+		{"wildcard with dashes and digits", "https://*.example.com", "https://pr-42.example.com", true},
+		{"wildcard with port", "http://*.example.com:8080", "http://app.example.com:8080", true},
+		{"wildcard other port", "http://*.example.com:8080", "http://app.example.com:9090", false},
+		{"wildcard needs a subdomain", "https://*.example.com", "https://example.com", false},
+		{"wildcard empty label", "https://*.example.com", "https://.example.com", false},
+		{"wildcard other scheme", "https://*.example.com", "http://app.example.com", false},
+		{"wildcard suffix only", "https://*.example.com", "https://evilexample.com", false},
+		{"wildcard as a prefix", "https://*.example.com", "https://app.example.com.evil.com", false},
+		{"wildcard with credentials", "https://*.example.com", "https://user@evil.com/.example.com", false},
+		{"wildcard with invalid characters", "https://*.example.com", "https://a_b.example.com", false},
+		{"wildcard not a subdomain", "https://app*.example.com", "https://app1.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchOrigin(tt.pattern, tt.origin); got != tt.want {
+				t.Errorf("matchOrigin(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ExportQueued    = "queued"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+	// ExportExpired exports are past their retention, the archive is gone.
+	ExportExpired = "expired"
+
+	exportAudience = "export"
+)
+
+// userDocument names a collection holding documents that belong to a user and the field
+// naming the user. Documents others depend on are kept on erasure with the user removed.
+type userDocument struct {
+	collection string
+	field      string
+	keep       bool
+}
+
+// userDocuments lists the documents of a user, markers are handled on their own.
+var userDocuments = []userDocument{
+	{"users", "_id", false},
+	{"comments", "authorId", false},
+	{"likes", "userId", false},
+	{"favorites", "userId", false},
+	{"collections", "ownerId", false},
+	{"routes", "ownerId", false},
+	{"devices", "userId", false},
+	{"geofences", "userId", false},
+	{"flags", "reporterId", true},
+	{"imports", "ownerId", false},
+	{"exports", "ownerId", false},
+	{"audit", "actorId", true},
+	{"shares", "createdBy", true},
+}
+
+// DataExport is an archive of everything stored about a user, built in the background.
+type DataExport struct {
+	ID      string `json:"id" bson:"_id"`
+	OwnerID string `json:"ownerId" bson:"ownerId"`
+	Status  string `json:"status" bson:"status"`
+	Error   string `json:"error,omitempty" bson:"error,omitempty"`
+	Size    int64  `json:"size,omitempty" bson:"size,omitempty"`
+
+	// URL downloads the archive of a completed export until LinkExpiresAt. Every status
+	// request returns a fresh link.
+	URL           string     `json:"url,omitempty" bson:"-"`
+	LinkExpiresAt *time.Time `json:"linkExpiresAt,omitempty" bson:"-"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	// ExpiresAt is when the archive of a completed export is removed.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// exportSecret returns the key used to sign download links, derived from AUTH_JWT_SECRET
+// like share tokens.
+func exportSecret(cfg Config) []byte {
+	return deriveSecret(cfg, "export-tokens")
+}
+
+// dataExports builds export archives one at a time and removes them after retention.
+// Archives are kept on the local disk, deployments with several servers need EXPORT_DIR
+// on a shared volume.
+type dataExports struct {
+	db        *mongo.Database
+	dir       string
+	retention time.Duration
+	logger    echo.Logger
+	queue     chan string
+}
+
+func newDataExports(db *mongo.Database, cfg Config, logger echo.Logger) *dataExports {
+	return &dataExports{
+		db:        db,
+		dir:       filepath.Join(cfg.ExportDir, db.Name()),
+		retention: cfg.ExportRetention,
+		logger:    logger,
+		queue:     make(chan string, 100),
+	}
+}
+
+func (x *dataExports) path(id string) string {
+	return filepath.Join(x.dir, id+".zip")
+}
+
+// enqueue schedules the export. When the queue is full the export is picked up on the
+// next resume pass.
+func (x *dataExports) enqueue(id string) {
+	select {
+	case x.queue <- id:
+	default:
+		x.logger.Warnf("export queue is full, export %s will run later", id)
+	}
+}
+
+func (x *dataExports) run(ctx context.Context) {
+	resume := time.NewTicker(10 * time.Minute)
+	defer resume.Stop()
+
+	x.resume(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resume.C:
+			x.resume(ctx)
+		case id := <-x.queue:
+			x.process(ctx, id)
+		}
+	}
+}
+
+// resume queues exports that didn't finish, e.g. because the server was restarted.
+func (x *dataExports) resume(ctx context.Context) {
+	cursor, err := x.db.Collection("exports").Find(ctx, bson.M{"status": bson.M{"$in": bson.A{ExportQueued, ExportRunning}}})
+	if err != nil {
+		x.logger.Error(err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var export DataExport
+		if err := cursor.Decode(&export); err != nil {
+			x.logger.Error(err)
+			return
+		}
+
+		select {
+		case x.queue <- export.ID:
+		default:
+			return
+		}
+	}
+}
+
+// expire removes archives past their retention, it runs as the expire-exports job.
+func (x *dataExports) expire(ctx context.Context) error {
+	cursor, err := x.db.Collection("exports").Find(ctx, bson.M{"status": ExportCompleted, "expiresAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+
+	var expired []DataExport
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		return err
+	}
+
+	for _, export := range expired {
+		if err := os.Remove(x.path(export.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			x.logger.Error(err)
+			continue
+		}
+
+		if err := x.update(ctx, export.ID, bson.M{"status": ExportExpired}); err != nil {
+			x.logger.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (x *dataExports) update(ctx context.Context, id string, set bson.M) error {
+	set["updatedAt"] = time.Now().UTC()
+	_, err := x.db.Collection("exports").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (x *dataExports) process(ctx context.Context, id string) {
+	var export DataExport
+	if err := x.db.Collection("exports").FindOne(ctx, bson.M{"_id": id}).Decode(&export); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			x.logger.Error(err)
+		}
+
+		return
+	}
+
+	if export.Status != ExportQueued && export.Status != ExportRunning {
+		return
+	}
+
+	if err := x.update(ctx, id, bson.M{"status": ExportRunning}); err != nil {
+		x.logger.Error(err)
+		return
+	}
+
+	size, err := x.build(ctx, export.OwnerID, x.path(id))
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		x.logger.Warnf("export %s failed: %v", id, err)
+		if err := x.update(ctx, id, bson.M{"status": ExportFailed, "error": err.Error()}); err != nil {
+			x.logger.Error(err)
+		}
+
+		return
+	}
+
+	if err := x.update(ctx, id, bson.M{"status": ExportCompleted, "size": size, "expiresAt": time.Now().UTC().Add(x.retention)}); err != nil {
+		x.logger.Error(err)
+	}
+}
+
+// build writes the archive of the user to path and returns its size. It's written next
+// to path first, so a partial archive is never downloaded.
+func (x *dataExports) build(ctx context.Context, userID, path string) (int64, error) {
+	if err := os.MkdirAll(x.dir, 0o700); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(x.dir, "export-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := x.write(ctx, userID, f); err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(f.Name(), path)
+}
+
+// write streams the archive: live and archived markers as GeoJSON, their images, and
+// the other documents of the user as extended JSON, one file per collection.
+func (x *dataExports) write(ctx context.Context, userID string, f io.Writer) error {
+	archive := zip.NewWriter(f)
+	owned := bson.M{"ownerId": userID}
+
+	for _, collection := range []string{"markers", archiveCollection} {
+		w, err := archive.Create(collection + ".geojson")
+		if err != nil {
+			return err
+		}
+
+		if _, err := exportMarkers(ctx, x.db.Collection(collection), owned, "geojson", w); err != nil {
+			return fmt.Errorf("can't export %s: %w", collection, err)
+		}
+	}
+
+	w, err := archive.Create("images.jsonl")
+	if err != nil {
+		return err
+	}
+
+	if err := x.writeImages(ctx, owned, w); err != nil {
+		return fmt.Errorf("can't export images: %w", err)
+	}
+
+	for _, documents := range userDocuments {
+		w, err := archive.Create(documents.collection + ".jsonl")
+		if err != nil {
+			return err
+		}
+
+		cursor, err := x.db.Collection(documents.collection).Find(ctx, bson.M{documents.field: userID}, options.Find().SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+
+		buffered := bufio.NewWriter(w)
+		for cursor.Next(ctx) {
+			line, err := bson.MarshalExtJSON(cursor.Current, false, false)
+			if err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			buffered.Write(line)
+			if err := buffered.WriteByte('\n'); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// ExportedImage is an image of one of the user's markers. Images are stored by URI, the
+// files themselves are fetched from there.
+type ExportedImage struct {
+	MarkerID string `json:"markerId"`
+	Image
+}
+
+func (x *dataExports) writeImages(ctx context.Context, owned bson.M, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, collection := range []string{"markers", archiveCollection} {
+		cursor, err := x.db.Collection(collection).Find(ctx, and(owned, bson.M{"images.0": bson.M{"$exists": true}}), options.Find().
+			SetProjection(bson.M{"images": 1}).
+			SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			for _, image := range normalizeImages(marker.Images) {
+				if err := enc.Encode(ExportedImage{marker.ID, image}); err != nil {
+					cursor.Close(context.Background())
+					return err
+				}
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+	}
+
+	return nil
+}
+
+// registerDataExportRoutes lets users export their data under /users/me and download the
+// archives through signed, expiring links.
+func registerDataExportRoutes(e *echo.Echo, group *echo.Group, db *mongo.Database, exports *dataExports, cfg Config) {
+	secret := exportSecret(cfg)
+
+	// link adds a download link valid for EXPORT_LINK_TTL, at most until the archive is removed.
+	link := func(c echo.Context, export *DataExport) error {
+		if export.Status != ExportCompleted || export.ExpiresAt == nil || secret == nil {
+			return nil
+		}
+
+		expiresAt := time.Now().UTC().Add(cfg.ExportLinkTTL)
+		if export.ExpiresAt.Before(expiresAt) {
+			expiresAt = *export.ExpiresAt
+		}
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+			Subject:   export.ID,
+			Audience:  exportAudience,
+			ExpiresAt: expiresAt.Unix(),
+		}).SignedString(secret)
+		if err != nil {
+			return err
+		}
+
+		export.URL = publicURL(c, cfg) + "/exports/" + token
+		export.LinkExpiresAt = &expiresAt
+		return nil
+	}
+
+	group.POST("/me/export", func(c echo.Context) error {
+		user, _ := currentUser(c)
+
+		// Users wait for the export they already started instead of piling up new ones.
+		var export DataExport
+		err := db.Collection("exports").FindOne(c.Request().Context(), bson.M{
+			"ownerId": user.ID,
+			"status":  bson.M{"$in": bson.A{ExportQueued, ExportRunning}},
+		}).Decode(&export)
+		if err == nil {
+			c.Response().Header().Set(echo.HeaderLocation, "/api/v1/users/me/export")
+			return c.JSON(http.StatusAccepted, export)
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		now := time.Now().UTC()
+		export = DataExport{
+			ID:        primitive.NewObjectID().Hex(),
+			OwnerID:   user.ID,
+			Status:    ExportQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		if _, err := db.Collection("exports").InsertOne(c.Request().Context(), export); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		exports.enqueue(export.ID)
+
+		c.Response().Header().Set(echo.HeaderLocation, "/api/v1/users/me/export")
+		return c.JSON(http.StatusAccepted, export)
+	})
+	group.GET("/me/export", func(c echo.Context) error {
+		user, _ := currentUser(c)
+
+		var export DataExport
+		if err := db.Collection("exports").FindOne(c.Request().Context(), bson.M{"ownerId": user.ID}, options.FindOne().SetSort(bson.M{"createdAt": -1})).Decode(&export); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "no export, start one with POST"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if err := link(c, &export); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, export)
+	})
+
+	e.GET("/exports/:token", func(c echo.Context) error {
+		if secret == nil {
+			s := "exports are not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		var claims jwt.StandardClaims
+		if _, err := jwt.ParseWithClaims(c.Param("token"), &claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+			}
+
+			return secret, nil
+		}); err != nil || !claims.VerifyAudience(exportAudience, true) {
+			s := "invalid or expired download link"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		var export DataExport
+		if err := db.Collection("exports").FindOne(c.Request().Context(), bson.M{"_id": claims.Subject, "status": ExportCompleted}).Decode(&export); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "export not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		name := fmt.Sprintf("images-on-map-export-%s.zip", export.CreatedAt.Format("20060102"))
+		return c.Attachment(exports.path(export.ID), name)
+	})
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// collections lists the collections the server relies on together with their secondary indexes.
+var collections = map[string][]mongo.IndexModel{
+	"markers": {
+		{Keys: bson.D{{Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "location.longitude", Value: 1}, {Key: "location.latitude", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "name", Value: "text"}, {Key: "localNames", Value: "text"}, {Key: "description", Value: "text"}, {Key: "tags", Value: "text"}},
+			Options: options.Index().
+				SetName("markers_text").
+				SetWeights(bson.M{"name": 10, "localNames": 10, "tags": 5, "description": 1}),
+		},
+		{Keys: bson.D{{Key: "nameLower", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "likeCount", Value: -1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "updatedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "address.countryCode", Value: 1}, {Key: "address.city", Value: 1}}},
+		{Keys: bson.D{{Key: "address.country", Value: 1}, {Key: "address.city", Value: 1}}},
+		{Keys: bson.D{{Key: "moderation", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}}},
+		{Keys: bson.D{{Key: "images.uri", Value: 1}}},
+		{Keys: bson.D{{Key: "images.location.longitude", Value: 1}, {Key: "images.location.latitude", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "publishAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		// Custom properties are arbitrary, a wildcard index covers filters on any of them.
+		{Keys: bson.D{{Key: "properties.$**", Value: 1}}},
+	},
+	"comments": {
+		{Keys: bson.D{{Key: "markerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "authorId", Value: 1}}},
+	},
+	"likes": {
+		{Keys: bson.D{{Key: "markerId", Value: 1}, {Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	},
+	"favorites": {
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "markerId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "markerId", Value: 1}}},
+	},
+	"collections": {
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "public", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "markerIds", Value: 1}}},
+	},
+	"audit": {
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "markerIds", Value: 1}}},
+		{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+	"flags": {
+		{Keys: bson.D{{Key: "markerId", Value: 1}, {Key: "imageId", Value: 1}, {Key: "reporterId", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+	"users": {
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+	},
+	"imports": {
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	},
+	"erasures": {
+		{Keys: bson.D{{Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": ErasureScheduled})},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "eraseAt", Value: 1}}},
+	},
+	"exports": {
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	},
+	"bundles": {
+		{Keys: bson.D{{Key: "bbox", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	},
+	"tilesets": {
+		{Keys: bson.D{{Key: "bbox", Value: 1}, {Key: "maxZoom", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	},
+	"tombstones": {
+		{Keys: bson.D{{Key: "deletedAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "deletedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(tombstoneRetention.Seconds()))},
+	},
+	"devices": {
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	},
+	"geofences": {
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "bounds.minLatitude", Value: 1}, {Key: "bounds.maxLatitude", Value: 1}}},
+	},
+	archiveCollection: {
+		{Keys: bson.D{{Key: "ownerId", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	},
+	"history": {
+		{Keys: bson.D{{Key: "markerId", Value: 1}, {Key: "recordedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "recordedAt", Value: 1}}},
+		{Keys: bson.D{{Key: "seeded", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"changes": {
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "seeded", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"shares": {
+		{Keys: bson.D{{Key: "markerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"counters":    {},
+	"tenants":     {},
+	"migrations":  {},
+	"locks":       {},
+	"feeds":       {},
+	"imageChecks": {},
+	"imageHashes": {},
+	"jobs":        {},
+	"settings":    {},
+	"features":    {},
+	"rateLimits":  {},
+	"events": {
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(eventRetention.Seconds()))},
+		{Keys: bson.D{{Key: "seq", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+	},
+	"migrationReports": {
+		{Keys: bson.D{{Key: "startedAt", Value: -1}}},
+	},
+	"deadLetters": {
+		{Keys: bson.D{{Key: "sink", Value: 1}, {Key: "failedAt", Value: -1}}},
+	},
+	"routes": {
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "public", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+}
+
+// connectDatabase connects to MongoDB and makes sure the database is reachable and has
+// the expected collections and indexes, so configuration problems surface at startup.
+func connectDatabase(cfg Config) (*mongo.Client, *mongo.Database, error) {
+	opts := options.Client().ApplyURI(cfg.MongoURI)
+	if err := opts.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid MONGODB_CONN_STRING: %w", err)
+	}
+
+	// The settings are validated by LoadConfig.
+	if rp, _ := parseReadPreference(cfg.MongoReadPreference, cfg.MongoMaxStaleness); rp != nil {
+		opts.SetReadPreference(rp)
+	}
+
+	if rc, _ := parseReadConcern(cfg.MongoReadConcern); rc != nil {
+		opts.SetReadConcern(rc)
+	}
+
+	if wc, _ := parseWriteConcern(cfg.MongoWriteConcern, cfg.MongoWriteTimeout); wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+
+	if cfg.MongoMaxPoolSize > 0 {
+		opts.SetMaxPoolSize(cfg.MongoMaxPoolSize)
+	}
+
+	if cfg.MongoServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(cfg.MongoServerSelectionTimeout)
+	}
+
+	// The app name shows up in the server's logs and currentOp.
+	if opts.AppName == nil {
+		opts.SetAppName("images-on-map-server")
+	}
+
+	opts.SetMonitor(commandMonitor(cfg.MongoSlowCommandThreshold))
+
+	breaker := newDBBreaker(cfg)
+	if breaker != nil {
+		breaker.monitor(opts)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MongoStartupTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't connect to MongoDB: %w", err)
+	}
+
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, nil, fmt.Errorf("MongoDB is unreachable after %s, check MONGODB_CONN_STRING and that the server is running: %w", cfg.MongoStartupTimeout, err)
+	}
+
+	if breaker != nil {
+		breaker.attach(client)
+	}
+
+	db := client.Database(cfg.MongoDatabase)
+	if err := ensureCollections(ctx, db); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, nil, err
+	}
+
+	return client, db, nil
+}
+
+// listingDatabase returns a handle on db reading with the listing read preference, for
+// endpoints that serve many reads and don't need to see the latest writes.
+func listingDatabase(db *mongo.Database, cfg Config) *mongo.Database {
+	rp, _ := parseReadPreference(cfg.MongoListingReadPreference, cfg.MongoMaxStaleness)
+	if rp == nil {
+		return db
+	}
+
+	return db.Client().Database(db.Name(), options.Database().SetReadPreference(rp))
+}
+
+// parseReadPreference reads a mode such as secondaryPreferred, nil if it's empty. The
+// max staleness doesn't apply to primary.
+func parseReadPreference(mode string, maxStaleness time.Duration) (*readpref.ReadPref, error) {
+	if mode == "" {
+		return nil, nil
+	}
+
+	m, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxStaleness > 0 && m != readpref.PrimaryMode {
+		return readpref.New(m, readpref.WithMaxStaleness(maxStaleness))
+	}
+
+	return readpref.New(m)
+}
+
+// parseReadConcern reads a level such as majority, nil if it's empty.
+func parseReadConcern(level string) (*readconcern.ReadConcern, error) {
+	switch level {
+	case "":
+		return nil, nil
+	case "local", "majority", "available", "linearizable", "snapshot":
+		return readconcern.New(readconcern.Level(level)), nil
+	default:
+		return nil, fmt.Errorf("unknown read concern %s", level)
+	}
+}
+
+// parseWriteConcern reads majority or a number of nodes, nil if it's empty.
+func parseWriteConcern(w string, timeout time.Duration) (*writeconcern.WriteConcern, error) {
+	var opts []writeconcern.Option
+	switch w {
+	case "":
+		return nil, nil
+	case "majority":
+		opts = append(opts, writeconcern.WMajority())
+	default:
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("write concern must be majority or a number of nodes, got %s", w)
+		}
+
+		opts = append(opts, writeconcern.W(n))
+	}
+
+	if timeout > 0 {
+		opts = append(opts, writeconcern.WTimeout(timeout))
+	}
+
+	return writeconcern.New(opts...), nil
+}
+
+func ensureCollections(ctx context.Context, db *mongo.Database) error {
+	existing, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("can't list collections in database %s, check that the user has read access: %w", db.Name(), err)
+	}
+
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[name] = true
+	}
+
+	for name, indexes := range collections {
+		if !found[name] {
+			if err := db.CreateCollection(ctx, name); err != nil {
+				return fmt.Errorf("can't create collection %s, check that the user has write access: %w", name, err)
+			}
+		}
+
+		if len(indexes) == 0 {
+			continue
+		}
+
+		_, err := db.Collection(name).Indexes().CreateMany(ctx, indexes)
+		if indexConflict(err) {
+			// Named indexes whose fields changed, such as the text index, are built again.
+			if err := dropNamedIndexes(ctx, db.Collection(name), indexes); err != nil {
+				return fmt.Errorf("can't replace indexes on collection %s: %w", name, err)
+			}
+
+			_, err = db.Collection(name).Indexes().CreateMany(ctx, indexes)
+		}
+
+		if err != nil {
+			return fmt.Errorf("can't create indexes on collection %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// indexConflict reports whether an index exists under the name or with the keys of
+// another one.
+func indexConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86)
+}
+
+func dropNamedIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) error {
+	for _, index := range indexes {
+		if index.Options == nil || index.Options.Name == nil {
+			continue
+		}
+
+		_, err := collection.Indexes().DropOne(ctx, *index.Options.Name)
+		var cmdErr mongo.CommandError
+		if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == 27) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertMarker stores a new marker. Its id may have been used by a deleted marker, so
+// the tombstone is dropped for sync clients to pick the new marker up.
+func insertMarker(ctx context.Context, db *mongo.Database, m Marker) error {
+	m.Geo = m.Location.point()
+	m.Geohash = encodeGeohash(m.Location, geohashPrecision)
+	m.NameLower = foldName(m.Name)
+	m.LocalNames = localNames(m)
+
+	zone, err := ownerZone(ctx, db, m.OwnerID, m.Location)
+	if err != nil {
+		return err
+	}
+	m.PrivacyZone = zone
+
+	return inTransaction(ctx, db, func(ctx context.Context) error {
+		if _, err := db.Collection("markers").InsertOne(ctx, m); err != nil {
+			return err
+		}
+
+		if _, err := db.Collection("tombstones").DeleteOne(ctx, bson.M{"_id": m.ID}); err != nil {
+			return err
+		}
+
+		return appendEvent(ctx, db, EventMarkerCreated, m.ID, &m)
+	})
+}
+
+// updateMarker applies the editable fields of the marker to the stored one matching the
+// filter. Moving the marker clears its address, which is then resolved again in the
+// background, so moved reports whether the marker needs geocoding.
+func updateMarker(ctx context.Context, db *mongo.Database, filter bson.M, stored, m Marker) (matched bool, moved bool, err error) {
+	fields := m.editableFields()
+	fields["updatedAt"] = time.Now().UTC()
+	update := bson.M{"$set": fields, "$inc": bson.M{"revision": 1}}
+
+	moved = stored.ID != "" && !stored.Location.samePlace(m.Location)
+	if moved {
+		update["$unset"] = bson.M{"address": ""}
+	}
+
+	err = inTransaction(ctx, db, func(ctx context.Context) error {
+		var updated Marker
+		if err := db.Collection("markers").FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated); err != nil {
+			return err
+		}
+
+		// Markers moved into or out of a privacy zone are flagged again.
+		zone, err := ownerZone(ctx, db, updated.OwnerID, updated.Location)
+		if err != nil {
+			return err
+		}
+
+		if zone != updated.PrivacyZone {
+			flag := bson.M{"$set": bson.M{"privacyZone": zone}}
+			if zone == "" {
+				flag = bson.M{"$unset": bson.M{"privacyZone": ""}}
+			}
+
+			if _, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": updated.ID}, flag); err != nil {
+				return err
+			}
+			updated.PrivacyZone = zone
+		}
+
+		return appendEvent(ctx, db, EventMarkerUpdated, updated.ID, &updated)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, false, nil
+	}
+
+	if err != nil {
+		return false, false, err
+	}
+
+	return true, moved, nil
+}
+
+// deleteMarker removes the marker together with the comments, likes, favorites and
+// collection memberships referencing it in one transaction. Open flags are closed but
+// kept for the record, and a tombstone tells sync clients about the deletion.
+func deleteMarker(ctx context.Context, db *mongo.Database, id string) error {
+	return inTransaction(ctx, db, func(ctx context.Context) error {
+		res, err := db.Collection("markers").DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			return err
+		}
+
+		if res.DeletedCount > 0 {
+			if err := recordTombstone(ctx, db, id); err != nil {
+				return err
+			}
+
+			if err := appendEvent(ctx, db, EventMarkerDeleted, id, nil); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range []string{"comments", "likes", "favorites", "shares"} {
+			if _, err := db.Collection(name).DeleteMany(ctx, bson.M{"markerId": id}); err != nil {
+				return err
+			}
+		}
+
+		if _, err := db.Collection("collections").UpdateMany(ctx, bson.M{"markerIds": id}, bson.M{"$pull": bson.M{"markerIds": id}}); err != nil {
+			return err
+		}
+
+		_, err = db.Collection("flags").UpdateMany(ctx, bson.M{"markerId": id, "status": FlagOpen}, bson.M{"$set": bson.M{"status": FlagRemoved}})
+		return err
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// setDeadlines moves the read and write deadlines of the request's connection. A zero
+// time removes the deadline. Connections that have no deadlines are left as they are.
+func setDeadlines(c echo.Context, read, write time.Time) error {
+	rc := http.NewResponseController(c.Response().Writer)
+	if err := rc.SetReadDeadline(read); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	if err := rc.SetWriteDeadline(write); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+// deadline returns the time d from now, or the zero time for no deadline if d is zero.
+func deadline(d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(d)
+}
+
+// transferDeadlines gives requests of the group d to be read and answered in place of
+// HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT, which are meant for ordinary requests and
+// would cut uploads and downloads of gigabytes short.
+func transferDeadlines(d time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := setDeadlines(c, deadline(d), deadline(d)); err != nil {
+				c.Logger().Error(err)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// extendWriteDeadline gives the response d more to be written, streaming handlers call
+// it before every batch so only a stalled client runs into the deadline.
+func extendWriteDeadline(c echo.Context, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+
+	err := http.NewResponseController(c.Response().Writer).SetWriteDeadline(time.Now().Add(d))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registerDebugRoutes mounts the pprof and expvar handlers under /debug for admins.
+// CPU profiles are bounded by HTTP_WRITE_TIMEOUT, so pass a shorter ?seconds= if needed.
+func registerDebugRoutes(e *echo.Echo) {
+	group := e.Group("/debug", requireRole(RoleAdmin))
+	group.GET("/vars", echo.WrapHandler(expvar.Handler()))
+	group.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	group.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	group.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	group.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	group.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	group.GET("/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const dryRunHeader = "X-Dry-Run"
+
+// DryRunResult describes what a mutating request would have done. Action is none when
+// the request would have changed nothing, e.g. when deleting a missing marker.
+type DryRunResult struct {
+	DryRun bool    `json:"dryRun"`
+	Action string  `json:"action"`
+	Marker *Marker `json:"marker,omitempty"`
+	// Removed counts the documents deleted together with a marker.
+	Removed map[string]int64 `json:"removed,omitempty"`
+}
+
+// parseDryRun reads the dryRun query parameter, falling back to the X-Dry-Run header.
+func parseDryRun(c echo.Context) (bool, error) {
+	param := c.QueryParam("dryRun")
+	if param == "" {
+		param = c.Request().Header.Get(dryRunHeader)
+	}
+
+	if param == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("dryRun must be true or false")
+	}
+
+	return dryRun, nil
+}
+
+// markerReferences counts the documents deleteMarker would remove together with the marker.
+func markerReferences(ctx context.Context, db *mongo.Database, id string) (map[string]int64, error) {
+	removed := map[string]int64{}
+	for _, name := range []string{"comments", "likes", "favorites", "shares"} {
+		count, err := db.Collection(name).CountDocuments(ctx, bson.M{"markerId": id})
+		if err != nil {
+			return nil, err
+		}
+
+		removed[name] = count
+	}
+
+	return removed, nil
+}
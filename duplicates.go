@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultDuplicateRadius     = 50.0
+	maxDuplicateRadius         = 1000.0
+	defaultDuplicateSimilarity = 0.8
+	maxDuplicateScan           = 20000
+
+	metersPerDegree = 111320.0
+)
+
+type DuplicateGroup struct {
+	Markers []Marker `json:"markers"`
+}
+
+type MergeRequest struct {
+	TargetID  string   `json:"targetId"`
+	SourceIDs []string `json:"sourceIds"`
+}
+
+func (r MergeRequest) Validate() error {
+	if r.TargetID == "" {
+		return fmt.Errorf("empty target id")
+	}
+
+	if len(r.SourceIDs) == 0 {
+		return fmt.Errorf("no markers to merge")
+	}
+
+	seen := map[string]bool{r.TargetID: true}
+	for _, id := range r.SourceIDs {
+		if id == "" || seen[id] {
+			return fmt.Errorf("invalid or repeated source id %q", id)
+		}
+
+		seen[id] = true
+	}
+
+	return nil
+}
+
+// normalizeName lowercases the name and drops everything but letters and digits.
+func normalizeName(name string) []rune {
+	var runes []rune
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes = append(runes, r)
+		}
+	}
+
+	return runes
+}
+
+// nameSimilarity returns 1 for equal names and approaches 0 as the edit distance grows.
+func nameSimilarity(a, b string) float64 {
+	ra, rb := normalizeName(a), normalizeName(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	if strings.Contains(string(ra), string(rb)) || strings.Contains(string(rb), string(ra)) {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+
+		prev, curr = curr, prev
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// findDuplicates groups markers that are within radius meters of each other and have
+// similar names. Markers are swept in latitude order so only nearby pairs are compared.
+func findDuplicates(markers []Marker, radius, similarity float64) [][]Marker {
+	sort.Slice(markers, func(i, j int) bool {
+		return markers[i].Location.Latitude < markers[j].Location.Latitude
+	})
+
+	parent := make([]int, len(markers))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	window := radius / metersPerDegree
+	for i := range markers {
+		for j := i + 1; j < len(markers) && markers[j].Location.Latitude-markers[i].Location.Latitude <= window; j++ {
+			if haversine(markers[i].Location, markers[j].Location) > radius {
+				continue
+			}
+
+			if nameSimilarity(markers[i].Name, markers[j].Name) < similarity {
+				continue
+			}
+
+			parent[find(j)] = find(i)
+		}
+	}
+
+	groups := map[int][]Marker{}
+	for i, marker := range markers {
+		root := find(i)
+		groups[root] = append(groups[root], marker)
+	}
+
+	var results [][]Marker
+	for _, group := range groups {
+		if len(group) > 1 {
+			results = append(results, group)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i][0].ID < results[j][0].ID
+	})
+
+	return results
+}
+
+func parseFloatParam(c echo.Context, name string, fallback, min, max float64) (float64, error) {
+	param := c.QueryParam(name)
+	if param == "" {
+		return fallback, nil
+	}
+
+	v, err := strconv.ParseFloat(param, 64)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid %s, expected a number between %g and %g", name, min, max)
+	}
+
+	return v, nil
+}
+
+func registerDuplicateRoutes(group *echo.Group, db *mongo.Database) {
+	group.GET("/duplicates", func(c echo.Context) error {
+		radius, err := parseFloatParam(c, "radius", defaultDuplicateRadius, 1, maxDuplicateRadius)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		similarity, err := parseFloatParam(c, "similarity", defaultDuplicateSimilarity, 0, 1)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		// Distances between markers would tell where zoned ones are.
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), and(filter, outsideZones(c)), options.Find().
+			SetProjection(bson.M{"name": 1, "location": 1, "ownerId": 1}).
+			SetLimit(maxDuplicateScan))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []DuplicateGroup{}
+		for _, group := range findDuplicates(markers, radius, similarity) {
+			results = append(results, DuplicateGroup{Markers: group})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("/merge", func(c echo.Context) error {
+		var body MergeRequest
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		ids := append([]string{body.TargetID}, body.SourceIDs...)
+		markers, err := markersByIDs(c, db, ids)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(markers) != len(ids) {
+			s := "some markers don't exist"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		for _, marker := range markers {
+			if !canModify(c, marker.OwnerID) {
+				s := fmt.Sprintf("only the owner can merge marker %s", marker.ID)
+				c.Logger().Info(s)
+				return c.JSON(http.StatusForbidden, ErrorString{s})
+			}
+		}
+
+		target := markers[0]
+		seen := map[string]bool{}
+		for _, image := range target.Images {
+			seen[image.ID] = true
+		}
+
+		for _, source := range markers[1:] {
+			for _, image := range source.Images {
+				if !seen[image.ID] {
+					seen[image.ID] = true
+					target.Images = append(target.Images, image)
+				}
+			}
+
+			target.Tags = append(target.Tags, source.Tags...)
+		}
+
+		target.Tags = normalizeTags(target.Tags)
+		if len(target.Tags) > maxTags {
+			target.Tags = target.Tags[:maxTags]
+		}
+
+		// The sources are only deleted together with moving their images and comments.
+		ctx := c.Request().Context()
+		if err := inTransaction(ctx, db, func(ctx context.Context) error {
+			if _, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": target.ID}, bson.M{
+				"$set": bson.M{
+					"images":    target.Images,
+					"tags":      target.Tags,
+					"updatedAt": time.Now().UTC(),
+				},
+				"$inc": bson.M{"revision": 1},
+			}); err != nil {
+				return err
+			}
+
+			if err := appendUpdateEvent(ctx, db, target.ID); err != nil {
+				return err
+			}
+
+			if _, err := db.Collection("comments").UpdateMany(ctx, bson.M{"markerId": bson.M{"$in": body.SourceIDs}}, bson.M{"$set": bson.M{"markerId": target.ID}}); err != nil {
+				return err
+			}
+
+			for _, id := range body.SourceIDs {
+				if err := deleteMarker(ctx, db, id); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if err := recordAudit(ctx, db, user.ID, "markers.merge", ids, bson.M{"targetId": target.ID, "sourceIds": body.SourceIDs}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.JSON(http.StatusOK, target.Normalize())
+	}, requireUser())
+}
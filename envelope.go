@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const envelopeHeader = "X-Envelope"
+
+// Envelope wraps JSON responses for clients asking for it with ?envelope=true or the
+// X-Envelope header. Data is the response as it would be without the envelope, Errors
+// holds the error response instead.
+type Envelope struct {
+	Data   json.RawMessage   `json:"data"`
+	Errors []json.RawMessage `json:"errors,omitempty"`
+	Meta   EnvelopeMeta      `json:"meta"`
+}
+
+type EnvelopeMeta struct {
+	RequestID  string              `json:"requestId,omitempty"`
+	Status     int                 `json:"status"`
+	DurationMS float64             `json:"durationMs"`
+	Pagination *EnvelopePagination `json:"pagination,omitempty"`
+}
+
+// EnvelopePagination describes the page of a listing, taken from the paging parameters
+// of the request and the X-Total-Count and X-Truncated headers of the response.
+type EnvelopePagination struct {
+	Count     int    `json:"count"`
+	Limit     *int   `json:"limit,omitempty"`
+	Offset    *int   `json:"offset,omitempty"`
+	Total     *int64 `json:"total,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// parseEnvelope reads the envelope query parameter, falling back to the X-Envelope header.
+func parseEnvelope(c echo.Context) (bool, error) {
+	param := c.QueryParam("envelope")
+	if param == "" {
+		param = c.Request().Header.Get(envelopeHeader)
+	}
+
+	if param == "" {
+		return false, nil
+	}
+
+	envelope, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("envelope must be true or false")
+	}
+
+	return envelope, nil
+}
+
+// envelopes wraps the JSON responses of every endpoint for clients asking for it. Other
+// responses such as tiles, files and streams pass through as they are.
+func envelopes() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Add(echo.HeaderVary, envelopeHeader)
+
+			enabled, err := parseEnvelope(c)
+			if err != nil {
+				c.Logger().Info(err)
+				return c.JSON(http.StatusBadRequest, Error{err})
+			}
+
+			if !enabled || c.Request().Method == http.MethodHead {
+				return next(c)
+			}
+
+			start := time.Now()
+			res := c.Response()
+			w := &envelopeWriter{ResponseWriter: res.Writer, header: res.Header()}
+			res.Writer = w
+
+			// Errors are rendered now, so they end up in the envelope as well. They're still
+			// returned for the access log, the response is committed by then.
+			handlerErr := next(c)
+			if handlerErr != nil {
+				c.Error(handlerErr)
+			}
+
+			res.Writer = w.ResponseWriter
+			if !w.wrap {
+				return handlerErr
+			}
+
+			body := bytes.TrimSpace(w.body.Bytes())
+			if len(body) == 0 || !json.Valid(body) {
+				w.ResponseWriter.WriteHeader(w.status)
+				if _, err := w.ResponseWriter.Write(w.body.Bytes()); err != nil {
+					return err
+				}
+
+				return handlerErr
+			}
+
+			envelope := Envelope{
+				Data: json.RawMessage("null"),
+				Meta: EnvelopeMeta{
+					RequestID:  res.Header().Get(echo.HeaderXRequestID),
+					Status:     w.status,
+					DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				},
+			}
+
+			if w.status >= http.StatusBadRequest {
+				envelope.Errors = []json.RawMessage{body}
+			} else {
+				envelope.Data = body
+				envelope.Meta.Pagination = envelopePagination(c, body)
+			}
+
+			data, err := json.Marshal(envelope)
+			if err != nil {
+				return err
+			}
+
+			res.Header().Del(echo.HeaderContentLength)
+			w.ResponseWriter.WriteHeader(w.status)
+			if _, err := w.ResponseWriter.Write(append(data, '\n')); err != nil {
+				return err
+			}
+
+			return handlerErr
+		}
+	}
+}
+
+// envelopePagination returns the pagination of listings, responses that aren't arrays
+// have none.
+func envelopePagination(c echo.Context, body []byte) *EnvelopePagination {
+	if body[0] != '[' {
+		return nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil
+	}
+
+	pagination := &EnvelopePagination{
+		Count:     len(items),
+		Truncated: c.Response().Header().Get("X-Truncated") == "true",
+	}
+
+	if limit, err := strconv.Atoi(c.QueryParam("limit")); err == nil {
+		pagination.Limit = &limit
+	}
+
+	if offset, err := strconv.Atoi(c.QueryParam("offset")); err == nil {
+		pagination.Offset = &offset
+	}
+
+	if total, err := strconv.ParseInt(c.Response().Header().Get("X-Total-Count"), 10, 64); err == nil {
+		pagination.Total = &total
+	}
+
+	return pagination
+}
+
+// envelopeWriter holds back JSON responses until they're wrapped and passes other
+// responses through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	header http.Header
+	body   bytes.Buffer
+	status int
+	wrap   bool
+}
+
+func (w *envelopeWriter) WriteHeader(code int) {
+	if strings.HasPrefix(w.header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		w.status, w.wrap = code, true
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *envelopeWriter) Write(b []byte) (int, error) {
+	if w.wrap {
+		return w.body.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *envelopeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush sends streamed responses on, wrapped ones are sent once complete.
+func (w *envelopeWriter) Flush() {
+	if w.wrap {
+		return
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
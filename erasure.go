@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ErasureScheduled = "scheduled"
+	ErasureCompleted = "completed"
+
+	erasureAudience = "erasure"
+	// erasureConfirmationTTL is how long users have to confirm a deletion request.
+	erasureConfirmationTTL = 15 * time.Minute
+)
+
+// ErasureRequest schedules the removal of a user's data. Completed requests are kept as
+// the record of the erasure, they hold nothing but the user id and what was removed.
+type ErasureRequest struct {
+	ID          string           `json:"id" bson:"_id"`
+	UserID      string           `json:"userId" bson:"userId"`
+	Status      string           `json:"status" bson:"status"`
+	RequestedAt time.Time        `json:"requestedAt" bson:"requestedAt"`
+	EraseAt     time.Time        `json:"eraseAt" bson:"eraseAt"`
+	ErasedAt    *time.Time       `json:"erasedAt,omitempty" bson:"erasedAt,omitempty"`
+	Removed     map[string]int64 `json:"removed,omitempty" bson:"removed,omitempty"`
+}
+
+// ErasureConfirmation is returned for deletion requests without a confirmation token.
+type ErasureConfirmation struct {
+	Token     string    `json:"confirmationToken"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// erasures removes the data of users whose grace period is over.
+type erasures struct {
+	db      *mongo.Database
+	exports *dataExports
+	cache   *responseCache
+	logger  echo.Logger
+}
+
+func newErasures(db *mongo.Database, exports *dataExports, cache *responseCache, logger echo.Logger) *erasures {
+	return &erasures{db: db, exports: exports, cache: cache, logger: logger}
+}
+
+// eraseDue carries out the requests past their grace period, it runs as the erase-users
+// job.
+func (r *erasures) eraseDue(ctx context.Context) error {
+	cursor, err := r.db.Collection("erasures").Find(ctx, bson.M{"status": ErasureScheduled, "eraseAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+
+	var due []ErasureRequest
+	if err := cursor.All(context.Background(), &due); err != nil {
+		return err
+	}
+
+	for _, request := range due {
+		removed, err := r.erase(ctx, request.UserID)
+		if err != nil {
+			// Erasing is idempotent, the rest is removed on the next pass.
+			r.logger.Errorf("erasing user %s: %v", request.UserID, err)
+			continue
+		}
+
+		r.cache.clear()
+
+		now := time.Now().UTC()
+		if _, err := r.db.Collection("erasures").UpdateOne(ctx, bson.M{"_id": request.ID}, bson.M{"$set": bson.M{
+			"status":   ErasureCompleted,
+			"erasedAt": now,
+			"removed":  removed,
+		}}); err != nil {
+			r.logger.Error(err)
+		}
+
+		if err := recordAudit(ctx, r.db, "", "user.erase", nil, bson.M{"userId": request.UserID, "removed": removed}); err != nil {
+			r.logger.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// erase removes the markers of the user, everything they left on other markers and their
+// account. Flags and audit entries are kept for moderation and compliance with the user
+// removed from them.
+func (r *erasures) erase(ctx context.Context, userID string) (map[string]int64, error) {
+	removed := map[string]int64{}
+
+	for _, collection := range []string{"markers", archiveCollection} {
+		cursor, err := r.db.Collection(collection).Find(ctx, bson.M{"ownerId": userID}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			return nil, err
+		}
+
+		for _, marker := range markers {
+			if _, err := r.db.Collection(collection).DeleteOne(ctx, bson.M{"_id": marker.ID}); err != nil {
+				return nil, err
+			}
+
+			// Comments, likes and favorites of other users on the marker go with it.
+			if err := deleteMarker(ctx, r.db, marker.ID); err != nil {
+				return nil, fmt.Errorf("can't delete marker %s: %w", marker.ID, err)
+			}
+
+			// Past states would bring the marker back in ?asOf= queries.
+			if _, err := r.db.Collection("history").DeleteMany(ctx, bson.M{"markerId": marker.ID}); err != nil {
+				return nil, err
+			}
+		}
+
+		removed[collection] = int64(len(markers))
+	}
+
+	cursor, err := r.db.Collection("likes").Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return nil, err
+	}
+
+	var likes []Like
+	if err := cursor.All(context.Background(), &likes); err != nil {
+		return nil, err
+	}
+
+	// Likes are taken back one by one, so an interrupted erasure doesn't count any twice.
+	for _, like := range likes {
+		res, err := r.db.Collection("likes").DeleteOne(ctx, bson.M{"markerId": like.MarkerID, "userId": userID})
+		if err != nil {
+			return nil, err
+		}
+
+		if res.DeletedCount == 0 {
+			continue
+		}
+
+		if _, err := r.db.Collection("markers").UpdateOne(ctx, bson.M{"_id": like.MarkerID}, bson.M{"$inc": bson.M{"likeCount": -1}}); err != nil {
+			return nil, err
+		}
+	}
+
+	removed["likes"] = int64(len(likes))
+
+	cursor, err = r.db.Collection("exports").Find(ctx, bson.M{"ownerId": userID}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var exports []DataExport
+	if err := cursor.All(context.Background(), &exports); err != nil {
+		return nil, err
+	}
+
+	for _, export := range exports {
+		if err := os.Remove(r.exports.path(export.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	for _, documents := range userDocuments {
+		filter := bson.M{documents.field: userID}
+		if documents.keep {
+			res, err := r.db.Collection(documents.collection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{documents.field: ""}})
+			if err != nil {
+				return nil, err
+			}
+
+			removed[documents.collection] = res.ModifiedCount
+			continue
+		}
+
+		res, err := r.db.Collection(documents.collection).DeleteMany(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		removed[documents.collection] += res.DeletedCount
+	}
+
+	return removed, nil
+}
+
+// erasureSecret returns the key used to sign confirmation tokens of deletion requests.
+func erasureSecret(cfg Config) []byte {
+	return deriveSecret(cfg, "erasure-tokens")
+}
+
+// registerErasureRoutes lets users delete their account and data under /users/me. A
+// request is confirmed with a token from a first unconfirmed request and can be
+// cancelled until the grace period is over.
+func registerErasureRoutes(group *echo.Group, db *mongo.Database, cfg Config) {
+	secret := erasureSecret(cfg)
+
+	group.DELETE("/me", func(c echo.Context) error {
+		if secret == nil {
+			s := "account deletion is not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		user, _ := currentUser(c)
+		now := time.Now().UTC()
+
+		confirm := c.QueryParam("confirm")
+		if confirm == "" {
+			expiresAt := now.Add(erasureConfirmationTTL)
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+				Subject:   user.ID,
+				Audience:  erasureAudience,
+				ExpiresAt: expiresAt.Unix(),
+			}).SignedString(secret)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusInternalServerError, Error{err})
+			}
+
+			return c.JSON(http.StatusOK, ErasureConfirmation{token, expiresAt})
+		}
+
+		var claims jwt.StandardClaims
+		if _, err := jwt.ParseWithClaims(confirm, &claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+			}
+
+			return secret, nil
+		}); err != nil || !claims.VerifyAudience(erasureAudience, true) || claims.Subject != user.ID {
+			s := "invalid or expired confirmation token"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		request := ErasureRequest{
+			ID:          primitive.NewObjectID().Hex(),
+			UserID:      user.ID,
+			Status:      ErasureScheduled,
+			RequestedAt: now,
+			EraseAt:     now.Add(cfg.ErasureGracePeriod),
+		}
+
+		// Confirming again keeps the original schedule.
+		if err := db.Collection("erasures").FindOneAndUpdate(c.Request().Context(),
+			bson.M{"userId": user.ID, "status": ErasureScheduled},
+			bson.M{"$setOnInsert": request},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&request); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if err := recordAudit(c.Request().Context(), db, user.ID, "user.erasure-request", nil, bson.M{"eraseAt": request.EraseAt}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		c.Response().Header().Set(echo.HeaderLocation, "/api/v1/users/me/erasure")
+		return c.JSON(http.StatusAccepted, request)
+	})
+	group.GET("/me/erasure", func(c echo.Context) error {
+		user, _ := currentUser(c)
+
+		var request ErasureRequest
+		if err := db.Collection("erasures").FindOne(c.Request().Context(), bson.M{"userId": user.ID, "status": ErasureScheduled}).Decode(&request); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "no account deletion is scheduled"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, request)
+	})
+	group.DELETE("/me/erasure", func(c echo.Context) error {
+		user, _ := currentUser(c)
+
+		res, err := db.Collection("erasures").DeleteOne(c.Request().Context(), bson.M{"userId": user.ID, "status": ErasureScheduled})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "no account deletion is scheduled"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if err := recordAudit(c.Request().Context(), db, user.ID, "user.erasure-cancel", nil, nil); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
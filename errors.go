@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// httpErrorHandler renders errors returned by middleware and the router in the same
+// shape as errors returned by handlers.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	code := http.StatusInternalServerError
+	message := strings.ToLower(http.StatusText(code))
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		code = he.Code
+		if s, ok := he.Message.(string); ok {
+			message = strings.ToLower(s)
+		} else {
+			message = fmt.Sprint(he.Message)
+		}
+	}
+
+	if code >= http.StatusInternalServerError {
+		c.Logger().Error(err)
+	} else {
+		c.Logger().Info(err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = c.JSON(code, ErrorString{message})
+	}
+
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// bindFailed responds to a request whose body couldn't be bound.
+func bindFailed(c echo.Context, err error) error {
+	c.Logger().Info(err)
+
+	if errors.Is(err, echo.ErrStatusRequestEntityTooLarge) {
+		return c.JSON(http.StatusRequestEntityTooLarge, ErrorString{"request body too large"})
+	}
+
+	return c.JSON(http.StatusBadRequest, Error{err})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExistsQuery lists marker ids to check.
+type ExistsQuery struct {
+	IDs []string `json:"ids" validate:"required,max=1000,dive,notblank"`
+}
+
+// ExistsResult splits the checked ids into the markers that exist and those that don't,
+// keeping the order of the query. Markers the user can't see are reported missing.
+type ExistsResult struct {
+	Existing []string `json:"existing"`
+	Missing  []string `json:"missing"`
+}
+
+// registerMarkerHeadRoute answers HEAD requests for markers with the status and the
+// revision of the marker, without reading the whole document.
+func registerMarkerHeadRoute(group *echo.Group, db *mongo.Database) {
+	group.HEAD("/:id", func(c echo.Context) error {
+		var marker struct {
+			Revision  int64     `bson:"revision"`
+			UpdatedAt time.Time `bson:"updatedAt"`
+		}
+		projection := options.FindOne().SetProjection(bson.M{"revision": 1, "updatedAt": 1})
+		err := db.Collection("markers").FindOne(c.Request().Context(), visibleMarker(c, c.Param("id")), projection).Decode(&marker)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return c.NoContent(http.StatusNotFound)
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
+
+		c.Response().Header().Set("X-Revision", strconv.FormatInt(marker.Revision, 10))
+		if !marker.UpdatedAt.IsZero() {
+			c.Response().Header().Set(echo.HeaderLastModified, marker.UpdatedAt.UTC().Format(http.TimeFormat))
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+func registerExistsRoutes(group *echo.Group, db *mongo.Database) {
+	group.POST("", func(c echo.Context) error {
+		var body ExistsQuery
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		filter := and(bson.M{"_id": bson.M{"$in": body.IDs}}, visibilityFilter(c))
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), filter, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var found []struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.All(context.Background(), &found); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		exists := make(map[string]bool, len(found))
+		for _, f := range found {
+			exists[f.ID] = true
+		}
+
+		result := ExistsResult{Existing: []string{}, Missing: []string{}}
+		for _, id := range body.IDs {
+			if exists[id] {
+				result.Existing = append(result.Existing, id)
+			} else {
+				result.Missing = append(result.Missing, id)
+			}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deleteExpired deletes markers past their expiresAt, it runs as the expire-markers job.
+// It goes through deleteMarker rather than a TTL index so comments, likes and sync clients
+// are updated too.
+func deleteExpired(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("markers").Find(ctx,
+		bson.M{"expiresAt": bson.M{"$lte": time.Now().UTC()}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		if err := deleteMarker(ctx, db, marker.ID); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultFavoritesLimit = 100
+	maxFavoritesLimit     = 500
+)
+
+type Favorite struct {
+	UserID    string    `bson:"userId"`
+	MarkerID  string    `bson:"markerId"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// registerFavoriteRoutes adds bookmarks of the current user under /users/me/favorites.
+func registerFavoriteRoutes(group *echo.Group, db *mongo.Database, privacy *markerPrivacy) {
+	group.GET("/me/favorites", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultFavoritesLimit, maxFavoritesLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		cursor, err := db.Collection("favorites").Find(c.Request().Context(), bson.M{"userId": user.ID}, options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var favorites []Favorite
+		if err := cursor.All(context.Background(), &favorites); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		ids := make([]string, 0, len(favorites))
+		for _, favorite := range favorites {
+			ids = append(ids, favorite.MarkerID)
+		}
+
+		results, err := markersByIDs(c, db, ids)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if results, err = privacy.view(c).redact(c.Request().Context(), results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.PUT("/me/favorites/:markerID", func(c echo.Context) error {
+		id := c.Param("markerID")
+		visible, err := markerVisible(c, db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		user, _ := currentUser(c)
+		if _, err := db.Collection("favorites").UpdateOne(c.Request().Context(),
+			bson.M{"userId": user.ID, "markerId": id},
+			bson.M{"$setOnInsert": Favorite{UserID: user.ID, MarkerID: id, CreatedAt: time.Now().UTC()}},
+			options.Update().SetUpsert(true)); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+	group.DELETE("/me/favorites/:markerID", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		if _, err := db.Collection("favorites").DeleteOne(c.Request().Context(), bson.M{"userId": user.ID, "markerId": c.Param("markerID")}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// featureFlagsTTL is how long instances take to see changes to flags.
+const featureFlagsTTL = 5 * time.Second
+
+var featureNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,63}$`)
+
+// FeatureFlag turns a capability on for every tenant, the listed ones or a share of
+// them. The default tenant is only covered by Enabled and Percent. Flags are kept in
+// the database of the default tenant and apply to the whole deployment.
+type FeatureFlag struct {
+	Name    string   `json:"name" bson:"_id"`
+	Enabled bool     `json:"enabled" bson:"enabled"`
+	Tenants []string `json:"tenants,omitempty" bson:"tenants,omitempty"`
+	// Percent of the tenants get the flag, picked by a hash of the flag and tenant, so
+	// raising it keeps it on for the tenants that already had it.
+	Percent   int        `json:"percent" bson:"percent" validate:"min=0,max=100"`
+	UpdatedBy string     `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+func (f FeatureFlag) enabledFor(tenantID string) bool {
+	if f.Enabled {
+		return true
+	}
+
+	for _, id := range f.Tenants {
+		if id != "" && id == tenantID {
+			return true
+		}
+	}
+
+	if f.Percent <= 0 {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + ":" + tenantID))
+	return int(h.Sum32()%100) < f.Percent
+}
+
+// featureFlags evaluates flags for tenants. FEATURE_FLAGS turns flags on everywhere,
+// flags stored by admins replace them.
+type featureFlags struct {
+	db       *mongo.Database
+	defaults map[string]FeatureFlag
+
+	mu       sync.Mutex
+	stored   map[string]FeatureFlag
+	loadedAt time.Time
+}
+
+func newFeatureFlags(db *mongo.Database, cfg Config) *featureFlags {
+	defaults := map[string]FeatureFlag{}
+	for _, name := range cfg.FeatureFlags {
+		defaults[name] = FeatureFlag{Name: name, Enabled: true}
+	}
+
+	return &featureFlags{db: db, defaults: defaults}
+}
+
+// all returns the flags in effect, reading stored ones at most once per featureFlagsTTL.
+// When the database can't be read the last known flags apply.
+func (f *featureFlags) all(ctx context.Context) (map[string]FeatureFlag, error) {
+	f.mu.Lock()
+	stored, loadedAt := f.stored, f.loadedAt
+	f.mu.Unlock()
+
+	var err error
+	if time.Since(loadedAt) >= featureFlagsTTL {
+		var loaded map[string]FeatureFlag
+		if loaded, err = f.load(ctx); err == nil {
+			stored = loaded
+			f.mu.Lock()
+			f.stored, f.loadedAt = loaded, time.Now()
+			f.mu.Unlock()
+		}
+	}
+
+	flags := make(map[string]FeatureFlag, len(f.defaults)+len(stored))
+	for name, flag := range f.defaults {
+		flags[name] = flag
+	}
+
+	for name, flag := range stored {
+		flags[name] = flag
+	}
+
+	return flags, err
+}
+
+func (f *featureFlags) load(ctx context.Context) (map[string]FeatureFlag, error) {
+	cursor, err := f.db.Collection("features").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var flags []FeatureFlag
+	if err := cursor.All(context.Background(), &flags); err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]FeatureFlag, len(flags))
+	for _, flag := range flags {
+		stored[flag.Name] = flag
+	}
+
+	return stored, nil
+}
+
+// forget makes the next evaluation read the stored flags.
+func (f *featureFlags) forget() {
+	f.mu.Lock()
+	f.loadedAt = time.Time{}
+	f.mu.Unlock()
+}
+
+// enabled reports whether the flag is on for the tenant, unknown flags are off.
+func (f *featureFlags) enabled(ctx context.Context, name, tenantID string) (bool, error) {
+	flags, err := f.all(ctx)
+	flag, ok := flags[name]
+	return ok && flag.enabledFor(tenantID), err
+}
+
+// require hides routes of a capability from tenants that don't have its flag yet.
+func (f *featureFlags) require(name string, tenant Tenant) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			on, err := f.enabled(c.Request().Context(), name, tenant.ID)
+			if err != nil {
+				c.Logger().Error(err)
+			}
+
+			if !on {
+				return echo.ErrNotFound
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// registerFeatureRoutes tells clients which flags are on for the tenant of the request,
+// so they only offer capabilities the server has.
+func registerFeatureRoutes(e *echo.Echo, flags *featureFlags, tenant Tenant) {
+	e.GET("/api/v1/features", func(c echo.Context) error {
+		all, err := flags.all(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+		}
+
+		names := []string{}
+		for name, flag := range all {
+			if flag.enabledFor(tenant.ID) {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+		return c.JSON(http.StatusOK, map[string][]string{"enabled": names})
+	})
+}
+
+// registerFeatureAdminRoutes lets admins of the deployment roll flags out and back
+// without a redeploy.
+func registerFeatureAdminRoutes(group *echo.Group, db *mongo.Database, flags *featureFlags) {
+	group.GET("", func(c echo.Context) error {
+		all, err := flags.all(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		list := make([]FeatureFlag, 0, len(all))
+		for _, flag := range all {
+			list = append(list, flag)
+		}
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		return c.JSON(http.StatusOK, list)
+	})
+	group.PUT("/:name", func(c echo.Context) error {
+		name := c.Param("name")
+		if !featureNamePattern.MatchString(name) {
+			s := "invalid flag name, expected up to 64 lowercase letters, digits, dots and dashes"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		var body FeatureFlag
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		for _, id := range body.Tenants {
+			if !tenantIDPattern.MatchString(id) {
+				err := fmt.Errorf("invalid tenant id %q", id)
+				c.Logger().Info(err)
+				return c.JSON(http.StatusBadRequest, Error{err})
+			}
+		}
+
+		ctx := c.Request().Context()
+		admin, _ := currentUser(c)
+		now := time.Now().UTC()
+		flag := FeatureFlag{Name: name, Enabled: body.Enabled, Tenants: body.Tenants, Percent: body.Percent, UpdatedBy: admin.ID, UpdatedAt: &now}
+		if _, err := db.Collection("features").ReplaceOne(ctx, bson.M{"_id": name}, flag, options.Replace().SetUpsert(true)); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		flags.forget()
+
+		if err := recordAudit(ctx, db, admin.ID, "feature.update", nil, bson.M{"flag": flag}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.JSON(http.StatusOK, flag)
+	})
+	group.DELETE("/:name", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		name := c.Param("name")
+
+		res, err := db.Collection("features").DeleteOne(ctx, bson.M{"_id": name})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "flag not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		flags.forget()
+
+		admin, _ := currentUser(c)
+		if err := recordAudit(ctx, db, admin.ID, "feature.delete", nil, bson.M{"flag": name}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
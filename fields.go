@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// markerFields maps field names accepted by ?fields= to document paths.
+var markerFields = map[string]string{
+	"id":       "_id",
+	"name":     "name",
+	"names":    "names",
+	"location": "location",
+	"geohash":  "geohash",
+	"images":   "images",
+	"tags":     "tags",
+
+	"description":       "description",
+	"descriptionFormat": "descriptionFormat",
+
+	"icon":  "icon",
+	"color": "color",
+	"emoji": "emoji",
+
+	"properties": "properties",
+
+	"ownerId":    "ownerId",
+	"private":    "private",
+	"likeCount":  "likeCount",
+	"createdAt":  "createdAt",
+	"updatedAt":  "updatedAt",
+	"address":    "address",
+	"expiresAt":  "expiresAt",
+	"publishAt":  "publishAt",
+	"archivedAt": "archivedAt",
+	"revision":   "revision",
+
+	"moderation": "moderation",
+}
+
+// parseFields reads the ?fields= parameter and returns the requested fields with the
+// matching projection. Both are nil when the parameter is absent.
+func parseFields(c echo.Context) ([]string, bson.M, error) {
+	param := c.QueryParam("fields")
+	if param == "" {
+		return nil, nil, nil
+	}
+
+	var fields []string
+	projection := bson.M{"_id": 0}
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		path, ok := markerFields[field]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown field %q", field)
+		}
+
+		fields = append(fields, field)
+		projection[path] = 1
+	}
+
+	// Markers are redacted depending on their owner and location.
+	projection["ownerId"] = 1
+	projection["location"] = 1
+
+	return fields, projection, nil
+}
+
+// selectFields renders v as a JSON object containing only the given fields.
+func selectFields(v interface{}, fields []string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// markerFilter builds the query for marker listings from the request's query parameters.
+func markerFilter(c echo.Context) (bson.M, error) {
+	attributes, err := attributeFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	bbox, err := bboxFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return and(attributes, bbox), nil
+}
+
+// attributeFilter is markerFilter without the ?bbox= condition, for queries matching
+// the bounds against other locations than the marker's.
+func attributeFilter(c echo.Context) (bson.M, error) {
+	conditions := []bson.M{visibilityFilter(c)}
+
+	tags, err := tagsFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := createdFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	geohash, err := geohashFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	accuracy, err := accuracyFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	properties, err := propertyFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return and(append(conditions, tags, created, geohash, accuracy, properties, placeFilter(c))...), nil
+}
+
+// placeFilter handles ?country= (a name or a two-letter code) and ?city= matching the
+// resolved address.
+func placeFilter(c echo.Context) bson.M {
+	filter := bson.M{}
+	if country := strings.TrimSpace(c.QueryParam("country")); country != "" {
+		if len(country) == 2 {
+			filter["address.countryCode"] = strings.ToLower(country)
+		} else {
+			filter["address.country"] = country
+		}
+	}
+
+	if city := strings.TrimSpace(c.QueryParam("city")); city != "" {
+		filter["address.city"] = city
+	}
+
+	if len(filter) == 0 {
+		return nil
+	}
+
+	return filter
+}
+
+// and combines conditions, skipping nil ones.
+func and(conditions ...bson.M) bson.M {
+	var nonEmpty bson.A
+	for _, condition := range conditions {
+		if condition != nil {
+			nonEmpty = append(nonEmpty, condition)
+		}
+	}
+
+	switch len(nonEmpty) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return nonEmpty[0].(bson.M)
+	default:
+		return bson.M{"$and": nonEmpty}
+	}
+}
+
+// tagsFilter handles ?tags=food,viewpoint with ?tagsMode=any (default) or all.
+func tagsFilter(c echo.Context) (bson.M, error) {
+	param := c.QueryParam("tags")
+	if param == "" {
+		return nil, nil
+	}
+
+	tags := normalizeTags(strings.Split(param, ","))
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("empty tags filter")
+	}
+
+	switch mode := c.QueryParam("tagsMode"); mode {
+	case "", "any":
+		return bson.M{"tags": bson.M{"$in": tags}}, nil
+	case "all":
+		return bson.M{"tags": bson.M{"$all": tags}}, nil
+	default:
+		return nil, fmt.Errorf("invalid tags mode %q, expected any or all", mode)
+	}
+}
+
+// bboxFilter handles ?bbox=minLon,minLat,maxLon,maxLat.
+func bboxFilter(c echo.Context) (bson.M, error) {
+	bbox, ok, err := parseBBox(c)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return and(bbox.filter(), outsideZones(c)), nil
+}
+
+// crossesAntimeridian reports whether the bounds span the 180th meridian, in which case
+// MinLongitude is the western edge east of MaxLongitude.
+func (b Bounds) crossesAntimeridian() bool {
+	return b.MinLongitude > b.MaxLongitude
+}
+
+// String formats the bounds like ?bbox= takes them.
+func (b Bounds) String() string {
+	return fmt.Sprintf("%s,%s,%s,%s",
+		strconv.FormatFloat(b.MinLongitude, 'f', -1, 64), strconv.FormatFloat(b.MinLatitude, 'f', -1, 64),
+		strconv.FormatFloat(b.MaxLongitude, 'f', -1, 64), strconv.FormatFloat(b.MaxLatitude, 'f', -1, 64))
+}
+
+// width returns the longitude range of the bounds in degrees.
+func (b Bounds) width() float64 {
+	if b.crossesAntimeridian() {
+		return b.MaxLongitude - b.MinLongitude + 360
+	}
+
+	return b.MaxLongitude - b.MinLongitude
+}
+
+// filter matches markers located within the bounds.
+func (b Bounds) filter() bson.M {
+	return b.within("location")
+}
+
+// within matches documents with the Coords at field located within the bounds. Bounds
+// crossing the antimeridian match the ranges on both sides of it.
+func (b Bounds) within(field string) bson.M {
+	latitude := bson.M{"$gte": b.MinLatitude, "$lte": b.MaxLatitude}
+	if !b.crossesAntimeridian() {
+		return bson.M{
+			field + ".longitude": bson.M{"$gte": b.MinLongitude, "$lte": b.MaxLongitude},
+			field + ".latitude":  latitude,
+		}
+	}
+
+	return bson.M{
+		"$or": bson.A{
+			bson.M{field + ".longitude": bson.M{"$gte": b.MinLongitude, "$lte": 180}},
+			bson.M{field + ".longitude": bson.M{"$gte": -180, "$lte": b.MaxLongitude}},
+		},
+		field + ".latitude": latitude,
+	}
+}
+
+// wrapLongitude brings a longitude of a map panned past the antimeridian back into the
+// -180 to 180 range.
+func wrapLongitude(lon float64) float64 {
+	if lon >= -180 && lon <= 180 {
+		return lon
+	}
+
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+
+	return lon - 180
+}
+
+// parseBBox reads ?bbox=minLon,minLat,maxLon,maxLat, ok is false if there is none.
+// Boxes crossing the antimeridian are accepted both as minLon > maxLon, as in GeoJSON,
+// and with longitudes past 180 as sent by maps panned across it.
+func parseBBox(c echo.Context) (Bounds, bool, error) {
+	param := c.QueryParam("bbox")
+	if param == "" {
+		return Bounds{}, false, nil
+	}
+
+	bbox, err := parseBounds(param)
+	if err != nil {
+		return Bounds{}, false, err
+	}
+
+	return bbox, true, nil
+}
+
+// parseBounds reads minLon,minLat,maxLon,maxLat like parseBBox.
+func parseBounds(param string) (Bounds, error) {
+	parts := strings.Split(param, ",")
+	if len(parts) != 4 {
+		return Bounds{}, fmt.Errorf("invalid bbox, expected minLon,minLat,maxLon,maxLat")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Bounds{}, fmt.Errorf("invalid bbox, expected minLon,minLat,maxLon,maxLat")
+		}
+
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Bounds{}, fmt.Errorf("invalid bbox, expected minLon,minLat,maxLon,maxLat")
+		}
+
+		values[i] = v
+	}
+
+	bbox := Bounds{MinLongitude: values[0], MinLatitude: values[1], MaxLongitude: values[2], MaxLatitude: values[3]}
+	switch {
+	case bbox.MinLongitude > bbox.MaxLongitude:
+		if bbox.MinLongitude > 180 || bbox.MaxLongitude < -180 {
+			return Bounds{}, fmt.Errorf("invalid bbox longitude range")
+		}
+	case bbox.MaxLongitude-bbox.MinLongitude >= 360:
+		bbox.MinLongitude, bbox.MaxLongitude = -180, 180
+	default:
+		width := bbox.MaxLongitude - bbox.MinLongitude
+		bbox.MinLongitude = wrapLongitude(bbox.MinLongitude)
+		if bbox.MaxLongitude = bbox.MinLongitude + width; bbox.MaxLongitude > 180 {
+			bbox.MaxLongitude -= 360
+		}
+	}
+
+	if bbox.MinLatitude < -90 || bbox.MaxLatitude > 90 || bbox.MinLatitude > bbox.MaxLatitude {
+		return Bounds{}, fmt.Errorf("invalid bbox latitude range")
+	}
+
+	return bbox, nil
+}
+
+// markerSort handles ?sort=popular|newest|oldest|updated. Listings keep the natural order by default.
+func markerSort(c echo.Context) (bson.D, error) {
+	switch sort := c.QueryParam("sort"); sort {
+	case "":
+		return nil, nil
+	case "popular":
+		return bson.D{{Key: "likeCount", Value: -1}, {Key: "_id", Value: 1}}, nil
+	case "newest":
+		return bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: 1}}, nil
+	case "oldest":
+		return bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}, nil
+	case "updated":
+		return bson.D{{Key: "updatedAt", Value: -1}, {Key: "_id", Value: 1}}, nil
+	case "accuracy":
+		return bson.D{{Key: "location.accuracy", Value: 1}, {Key: "_id", Value: 1}}, nil
+	default:
+		return nil, fmt.Errorf("invalid sort %q", sort)
+	}
+}
+
+// accuracyFilter handles ?maxAccuracy= and ?minAccuracy= in meters. The latter finds
+// imprecise locations. Markers without a recorded accuracy match neither.
+func accuracyFilter(c echo.Context) (bson.M, error) {
+	accuracy := bson.M{}
+	for param, op := range map[string]string{"maxAccuracy": "$lte", "minAccuracy": "$gte"} {
+		v := c.QueryParam(param)
+		if v == "" {
+			continue
+		}
+
+		meters, err := strconv.ParseFloat(v, 64)
+		if err != nil || meters < 0 {
+			return nil, fmt.Errorf("invalid %s, expected meters", param)
+		}
+
+		accuracy[op] = meters
+	}
+
+	if len(accuracy) == 0 {
+		return nil, nil
+	}
+
+	return bson.M{"location.accuracy": accuracy}, nil
+}
+
+// createdFilter handles ?createdAfter= and ?createdBefore= with RFC 3339 timestamps.
+func createdFilter(c echo.Context) (bson.M, error) {
+	createdAt := bson.M{}
+	for param, op := range map[string]string{"createdAfter": "$gt", "createdBefore": "$lt"} {
+		v := c.QueryParam(param)
+		if v == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s, expected an RFC 3339 timestamp", param)
+		}
+
+		createdAt[op] = t
+	}
+
+	if len(createdAt) == 0 {
+		return nil, nil
+	}
+
+	return bson.M{"createdAt": createdAt}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParseBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    Bounds
+		wantErr bool
+	}{
+		{
+			name:  "plain",
+			param: "10,20,30,40",
+			want:  Bounds{MinLongitude: 10, MinLatitude: 20, MaxLongitude: 30, MaxLatitude: 40},
+		},
+		{
+			name:  "spaces",
+			param: " -10, -20 ,10 , 20",
+			want:  Bounds{MinLongitude: -10, MinLatitude: -20, MaxLongitude: 10, MaxLatitude: 20},
+		},
+		{
+			name:  "crossing the antimeridian",
+			param: "170,-10,-170,10",
+			want:  Bounds{MinLongitude: 170, MinLatitude: -10, MaxLongitude: -170, MaxLatitude: 10},
+		},
+		{
+			name:  "past the antimeridian east",
+			param: "170,-10,190,10",
+			want:  Bounds{MinLongitude: 170, MinLatitude: -10, MaxLongitude: -170, MaxLatitude: 10},
+		},
+		{
+			name:  "past the antimeridian west",
+			param: "-190,-10,-170,10",
+			want:  Bounds{MinLongitude: 170, MinLatitude: -10, MaxLongitude: -170, MaxLatitude: 10},
+		},
+		{
+			name:  "next world east",
+			param: "190,0,200,10",
+			want:  Bounds{MinLongitude: -170, MinLatitude: 0, MaxLongitude: -160, MaxLatitude: 10},
+		},
+		{
+			name:  "next world west",
+			param: "-200,0,-190,10",
+			want:  Bounds{MinLongitude: 160, MinLatitude: 0, MaxLongitude: 170, MaxLatitude: 10},
+		},
+		{
+			name:  "whole world",
+			param: "-180,-90,180,90",
+			want:  Bounds{MinLongitude: -180, MinLatitude: -90, MaxLongitude: 180, MaxLatitude: 90},
+		},
+		{
+			name:  "wider than the world",
+			param: "-300,0,300,10",
+			want:  Bounds{MinLongitude: -180, MinLatitude: 0, MaxLongitude: 180, MaxLatitude: 10},
+		},
+		{name: "crossing from outside the world", param: "190,0,-190,10", wantErr: true},
+		{name: "crossing to outside the world", param: "170,0,-190,10", wantErr: true},
+		{name: "latitudes swapped", param: "0,10,10,0", wantErr: true},
+		{name: "south of the pole", param: "0,-91,10,0", wantErr: true},
+		{name: "north of the pole", param: "0,0,10,91", wantErr: true},
+		{name: "too few values", param: "0,0,10", wantErr: true},
+		{name: "too many values", param: "0,0,10,10,10", wantErr: true},
+		{name: "not a number", param: "a,0,10,10", wantErr: true},
+		{name: "NaN", param: "NaN,0,10,10", wantErr: true},
+		{name: "infinity", param: "-Inf,0,10,10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBounds(tt.param)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBounds(%q) error = %v, wantErr %v", tt.param, err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseBounds(%q) = %+v, want %+v", tt.param, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	flickrAPIURL   = "https://api.flickr.com/services/rest/"
+	flickrPageSize = 250
+	// flickrDateTaken is the layout of the date_taken extra.
+	flickrDateTaken = "2006-01-02 15:04:05"
+)
+
+// flickrNumber accepts numbers Flickr sends either as JSON numbers or as strings.
+type flickrNumber float64
+
+func (n *flickrNumber) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+
+	*n = flickrNumber(f)
+	return nil
+}
+
+type flickrPhoto struct {
+	ID        string       `json:"id"`
+	Title     string       `json:"title"`
+	Latitude  flickrNumber `json:"latitude"`
+	Longitude flickrNumber `json:"longitude"`
+	URLL      string       `json:"url_l"`
+	WidthL    flickrNumber `json:"width_l"`
+	HeightL   flickrNumber `json:"height_l"`
+	URLM      string       `json:"url_m"`
+	WidthM    flickrNumber `json:"width_m"`
+	HeightM   flickrNumber `json:"height_m"`
+	DateTaken string       `json:"datetaken"`
+}
+
+type flickrPage struct {
+	Page   int           `json:"page"`
+	Pages  int           `json:"pages"`
+	Total  flickrNumber  `json:"total"`
+	Photos []flickrPhoto `json:"photo"`
+}
+
+// flickrClient lists geotagged photos of a user with the Flickr REST API.
+type flickrClient struct {
+	client *http.Client
+}
+
+func (f *flickrClient) photos(ctx context.Context, apiKey, userID string, page int) (flickrPage, error) {
+	query := url.Values{
+		"method":         {"flickr.photos.search"},
+		"api_key":        {apiKey},
+		"user_id":        {userID},
+		"has_geo":        {"1"},
+		"extras":         {"geo,url_l,url_m,date_taken"},
+		"per_page":       {strconv.Itoa(flickrPageSize)},
+		"page":           {strconv.Itoa(page)},
+		"format":         {"json"},
+		"nojsoncallback": {"1"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, flickrAPIURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return flickrPage{}, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return flickrPage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return flickrPage{}, fmt.Errorf("flickr responded with %s", resp.Status)
+	}
+
+	var body struct {
+		Stat    string     `json:"stat"`
+		Message string     `json:"message"`
+		Photos  flickrPage `json:"photos"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return flickrPage{}, err
+	}
+
+	if body.Stat != "ok" {
+		return flickrPage{}, fmt.Errorf("flickr: %s", body.Message)
+	}
+
+	return body.Photos, nil
+}
+
+// flickrMarker converts a photo to a candidate marker with the photo as its only image.
+func flickrMarker(photo flickrPhoto) Marker {
+	name := strings.TrimSpace(photo.Title)
+	if name == "" {
+		name = "Flickr photo " + photo.ID
+	}
+
+	image := Image{ID: "flickr-" + photo.ID, URI: photo.URLL, Width: int(photo.WidthL), Height: int(photo.HeightL)}
+	if image.URI == "" {
+		image = Image{ID: "flickr-" + photo.ID, URI: photo.URLM, Width: int(photo.WidthM), Height: int(photo.HeightM)}
+	}
+
+	// Flickr serves its sizes rotated already, only the capture time is kept. The time
+	// is the camera's local time.
+	if taken, err := time.Parse(flickrDateTaken, photo.DateTaken); err == nil {
+		image.Exif = &ImageExif{CapturedAt: &taken}
+	}
+
+	return Marker{
+		Name:     name,
+		Location: Coords{Latitude: float64(photo.Latitude), Longitude: float64(photo.Longitude)},
+		Images:   []Image{image},
+	}
+}
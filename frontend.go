@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// embeddedFrontend is the single page app built into the server, frontend_embed.go sets
+// it for builds with the frontend tag.
+var embeddedFrontend fs.FS
+
+// hashedAsset matches files named after a hash of their content, like app.3f2a9c1d.js,
+// and everything bundlers put in assets/. New builds change their names, so clients
+// cache them for good.
+var hashedAsset = regexp.MustCompile(`(^|/)assets/|[.-][0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// frontendFiles returns the single page app to serve at /: FRONTEND_DIR, or else the
+// embedded app. It's nil if there is neither.
+func frontendFiles(cfg Config) (fs.FS, error) {
+	files := embeddedFrontend
+	if cfg.FrontendDir != "" {
+		files = os.DirFS(cfg.FrontendDir)
+	}
+
+	if files == nil {
+		return nil, nil
+	}
+
+	if _, err := fs.Stat(files, "index.html"); err != nil {
+		return nil, fmt.Errorf("frontend has no index.html: %w", err)
+	}
+
+	return files, nil
+}
+
+// registerFrontendRoutes serves the app at every path no other route takes. Paths that
+// aren't files are client side routes and get index.html, so links such as
+// /markers/<id> open the app. Missing assets and API paths are 404s as usual.
+func registerFrontendRoutes(e *echo.Echo, files fs.FS) {
+	e.GET("/*", func(c echo.Context) error {
+		p := path.Clean(c.Request().URL.Path)
+		if p == "/api" || strings.HasPrefix(p, "/api/") {
+			return echo.ErrNotFound
+		}
+
+		name := strings.TrimPrefix(p, "/")
+		if name == "" {
+			name = "index.html"
+		}
+
+		if info, err := fs.Stat(files, name); err != nil || info.IsDir() {
+			if path.Ext(name) != "" {
+				return echo.ErrNotFound
+			}
+
+			name = "index.html"
+		}
+
+		// index.html links the hashed assets of the current build, clients check it for a
+		// new one every time.
+		cacheControl := "no-cache"
+		if hashedAsset.MatchString(name) {
+			cacheControl = "public, max-age=31536000, immutable"
+		}
+
+		return serveFile(c, files, name, cacheControl)
+	})
+}
+
+func serveFile(c echo.Context, files fs.FS, name, cacheControl string) error {
+	f, err := files.Open(name)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Error{err})
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		err := fmt.Errorf("frontend file %s can't seek", name)
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Error{err})
+	}
+
+	c.Response().Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), content)
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build frontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The app is built into frontend/dist before building the server with -tags frontend.
+//
+//go:embed all:frontend/dist
+var frontendDist embed.FS
+
+func init() {
+	dist, err := fs.Sub(frontendDist, "frontend/dist")
+	if err != nil {
+		panic(err)
+	}
+
+	embeddedFrontend = dist
+}
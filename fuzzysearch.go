@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	searchIndexBatch = 500
+	// searchOverfetch asks the index for more hits than requested, as some of them are
+	// dropped by the filters applied afterwards.
+	searchOverfetch = 3
+
+	searchFeed = "search"
+)
+
+// SearchDocument is the part of a marker kept in the search index.
+type SearchDocument struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Names       []string `json:"names,omitempty"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// SearchIndex is an external full-text index with typo-tolerant, ranked search. The
+// index only finds ids, markers are always read from the database.
+type SearchIndex interface {
+	Upsert(ctx context.Context, docs []SearchDocument) error
+	Delete(ctx context.Context, ids []string) error
+	Search(ctx context.Context, q string, limit int) ([]string, error)
+}
+
+// newSearchIndex returns the index of the database, nil if SEARCH_BACKEND isn't set.
+// Every tenant database has its own index.
+func newSearchIndex(cfg Config, db *mongo.Database) (SearchIndex, error) {
+	h := httpSearch{
+		client:  &http.Client{Timeout: cfg.SearchTimeout},
+		baseURL: strings.TrimSuffix(cfg.SearchURL, "/"),
+		index:   strings.ToLower(cfg.SearchIndex + "-" + db.Name()),
+	}
+
+	switch cfg.SearchBackend {
+	case "":
+		return nil, nil
+	case "meilisearch":
+		if cfg.SearchAPIKey != "" {
+			h.auth = "Bearer " + cfg.SearchAPIKey
+		}
+		return meilisearch{h}, nil
+	case "elasticsearch":
+		if cfg.SearchAPIKey != "" {
+			h.auth = "ApiKey " + cfg.SearchAPIKey
+		}
+		return elasticsearch{h}, nil
+	default:
+		return nil, fmt.Errorf("unknown SEARCH_BACKEND %q, expected meilisearch or elasticsearch", cfg.SearchBackend)
+	}
+}
+
+func searchDocument(m Marker) SearchDocument {
+	return SearchDocument{ID: m.ID, Name: m.Name, Names: localNames(m), Description: m.Description, Tags: m.Tags}
+}
+
+type httpSearch struct {
+	client  *http.Client
+	baseURL string
+	index   string
+	auth    string
+}
+
+func (h httpSearch) do(ctx context.Context, method, path, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if h.auth != "" {
+		req.Header.Set("Authorization", h.auth)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("search backend responded with %s", resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (h httpSearch) doJSON(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return h.do(ctx, method, path, "application/json", bytes.NewReader(data), v)
+}
+
+type meilisearch struct {
+	httpSearch
+}
+
+func (m meilisearch) path(suffix string) string {
+	return "/indexes/" + url.PathEscape(m.index) + suffix
+}
+
+func (m meilisearch) Upsert(ctx context.Context, docs []SearchDocument) error {
+	return m.doJSON(ctx, http.MethodPost, m.path("/documents?primaryKey=id"), docs, nil)
+}
+
+func (m meilisearch) Delete(ctx context.Context, ids []string) error {
+	return m.doJSON(ctx, http.MethodPost, m.path("/documents/delete-batch"), ids, nil)
+}
+
+func (m meilisearch) Search(ctx context.Context, q string, limit int) ([]string, error) {
+	var body struct {
+		Hits []struct {
+			ID string `json:"id"`
+		} `json:"hits"`
+	}
+	query := bson.M{"q": q, "limit": limit, "attributesToRetrieve": []string{"id"}}
+	if err := m.doJSON(ctx, http.MethodPost, m.path("/search"), query, &body); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(body.Hits))
+	for _, hit := range body.Hits {
+		ids = append(ids, hit.ID)
+	}
+
+	return ids, nil
+}
+
+type elasticsearch struct {
+	httpSearch
+}
+
+// bulk sends index or delete actions, one per id, with the documents of index actions.
+func (e elasticsearch) bulk(ctx context.Context, action string, ids []string, docs []SearchDocument) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, id := range ids {
+		enc.Encode(bson.M{action: bson.M{"_index": e.index, "_id": id}})
+		if docs != nil {
+			enc.Encode(docs[i])
+		}
+	}
+
+	var body struct {
+		Errors bool `json:"errors"`
+	}
+	if err := e.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &buf, &body); err != nil {
+		return err
+	}
+
+	if body.Errors {
+		return fmt.Errorf("elasticsearch: bulk %s failed for some documents", action)
+	}
+
+	return nil
+}
+
+func (e elasticsearch) Upsert(ctx context.Context, docs []SearchDocument) error {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+
+	return e.bulk(ctx, "index", ids, docs)
+}
+
+func (e elasticsearch) Delete(ctx context.Context, ids []string) error {
+	return e.bulk(ctx, "delete", ids, nil)
+}
+
+func (e elasticsearch) Search(ctx context.Context, q string, limit int) ([]string, error) {
+	var body struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	query := bson.M{
+		"size":    limit,
+		"_source": false,
+		"query": bson.M{"multi_match": bson.M{
+			"query":     q,
+			"fields":    []string{"name^10", "names^10", "tags^5", "description"},
+			"fuzziness": "AUTO",
+		}},
+	}
+	if err := e.doJSON(ctx, http.MethodPost, "/"+url.PathEscape(e.index)+"/_search", query, &body); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(body.Hits.Hits))
+	for _, hit := range body.Hits.Hits {
+		ids = append(ids, hit.ID)
+	}
+
+	return ids, nil
+}
+
+// searchIndexer keeps the search index up to date. It follows the same feeds of changed
+// markers and tombstones as offline sync, so it catches up after restarts and outages.
+type searchIndexer struct {
+	index SearchIndex
+	db    *mongo.Database
+}
+
+func newSearchIndexer(index SearchIndex, db *mongo.Database) *searchIndexer {
+	return &searchIndexer{index: index, db: db}
+}
+
+// syncAll sends changes to the index until it caught up, it runs as the search-sync job.
+func (s *searchIndexer) syncAll(ctx context.Context) error {
+	for {
+		more, err := s.sync(ctx)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// sync sends one batch of changes to the index, more reports whether there are changes left.
+func (s *searchIndexer) sync(ctx context.Context) (more bool, err error) {
+	position, err := loadFeedPosition(ctx, s.db, searchFeed)
+	if err != nil {
+		return false, err
+	}
+
+	until := time.Now().UTC().Add(-syncSettleTime)
+
+	cursor, err := s.db.Collection("markers").Find(ctx,
+		after("updatedAt", position.UpdatedAt, position.MarkerID, until),
+		options.Find().
+			SetProjection(bson.M{"name": 1, "names": 1, "description": 1, "tags": 1, "updatedAt": 1}).
+			SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(searchIndexBatch))
+	if err != nil {
+		return false, err
+	}
+
+	var markers []Marker
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return false, err
+	}
+
+	// Nothing is deleted from an index that is built from scratch.
+	var deleted []Tombstone
+	if !position.DeletedAt.IsZero() {
+		cursor, err = s.db.Collection("tombstones").Find(ctx,
+			after("deletedAt", position.DeletedAt, position.DeletedID, until),
+			options.Find().
+				SetSort(bson.D{{Key: "deletedAt", Value: 1}, {Key: "_id", Value: 1}}).
+				SetLimit(searchIndexBatch))
+		if err != nil {
+			return false, err
+		}
+
+		if err := cursor.All(context.Background(), &deleted); err != nil {
+			return false, err
+		}
+	}
+
+	if len(markers) > 0 {
+		docs := make([]SearchDocument, 0, len(markers))
+		for _, m := range markers {
+			docs = append(docs, searchDocument(m.Normalize()))
+		}
+
+		if err := s.index.Upsert(ctx, docs); err != nil {
+			return false, fmt.Errorf("can't index markers: %w", err)
+		}
+	}
+
+	if len(deleted) > 0 {
+		ids := make([]string, 0, len(deleted))
+		for _, t := range deleted {
+			ids = append(ids, t.ID)
+		}
+
+		if err := s.index.Delete(ctx, ids); err != nil {
+			return false, fmt.Errorf("can't remove deleted markers from the index: %w", err)
+		}
+	}
+
+	next := syncPosition{UpdatedAt: until, DeletedAt: until}
+	more = len(markers) == searchIndexBatch || len(deleted) == searchIndexBatch
+	if more {
+		next = position
+		if next.DeletedAt.IsZero() {
+			next.DeletedAt = until
+		}
+
+		if n := len(markers); n > 0 {
+			next.UpdatedAt, next.MarkerID = markers[n-1].UpdatedAt, markers[n-1].ID
+		}
+
+		if n := len(deleted); n > 0 {
+			next.DeletedAt, next.DeletedID = deleted[n-1].DeletedAt, deleted[n-1].ID
+		}
+	}
+
+	return more, saveFeedPosition(ctx, s.db, searchFeed, next)
+}
+
+// fuzzySearch finds markers matching the query with the search index, ranked by the
+// index and restricted by the filter.
+func fuzzySearch(ctx context.Context, db *mongo.Database, index SearchIndex, q string, filter bson.M, limit int) ([]Marker, error) {
+	ids, err := index.Search(ctx, q, limit*searchOverfetch)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := db.Collection("markers").Find(ctx, and(bson.M{"_id": bson.M{"$in": ids}}, filter))
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Marker
+	if err := cursor.All(context.Background(), &found); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Marker, len(found))
+	for _, m := range found {
+		byID[m.ID] = m
+	}
+
+	results := []Marker{}
+	for _, id := range ids {
+		if m, ok := byID[id]; ok && len(results) < limit {
+			results = append(results, m)
+		}
+	}
+
+	return results, nil
+}
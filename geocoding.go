@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/time/rate"
+)
+
+// Address is the place a marker's coordinates resolve to.
+type Address struct {
+	Country     string `json:"country" bson:"country"`
+	CountryCode string `json:"countryCode" bson:"countryCode"`
+	City        string `json:"city" bson:"city"`
+	Street      string `json:"street" bson:"street"`
+	DisplayName string `json:"displayName" bson:"displayName"`
+}
+
+// Place is a candidate location found for a search query.
+type Place struct {
+	Name     string  `json:"name"`
+	Location Coords  `json:"location"`
+	Address  Address `json:"address"`
+}
+
+// Geocoder converts between coordinates and place names.
+type Geocoder interface {
+	Reverse(ctx context.Context, at Coords) (Address, error)
+	Search(ctx context.Context, q string, limit int) ([]Place, error)
+}
+
+func newGeocoder(cfg Config) (Geocoder, error) {
+	h := httpGeocoder{
+		client:    &http.Client{Timeout: cfg.GeocoderTimeout},
+		baseURL:   strings.TrimSuffix(cfg.GeocoderURL, "/"),
+		userAgent: cfg.GeocoderUserAgent,
+		limiter:   rate.NewLimiter(rate.Every(cfg.GeocoderInterval), 1),
+	}
+
+	switch cfg.GeocoderProvider {
+	case "":
+		return nil, nil
+	case "nominatim":
+		return nominatim{h}, nil
+	case "photon":
+		return photon{h}, nil
+	default:
+		return nil, fmt.Errorf("unknown GEOCODER_PROVIDER %q, expected nominatim or photon", cfg.GeocoderProvider)
+	}
+}
+
+// httpGeocoder calls an upstream provider no faster than once per GEOCODER_INTERVAL,
+// shared by background geocoding and search, to honor the providers' usage policies.
+type httpGeocoder struct {
+	client    *http.Client
+	baseURL   string
+	userAgent string
+	limiter   *rate.Limiter
+}
+
+func (h httpGeocoder) getJSON(ctx context.Context, path string, q url.Values, v interface{}) error {
+	if err := h.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.baseURL+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", h.userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geocoder responded with %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type nominatim struct {
+	httpGeocoder
+}
+
+type nominatimAddress struct {
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+	City        string `json:"city"`
+	Town        string `json:"town"`
+	Village     string `json:"village"`
+	Road        string `json:"road"`
+}
+
+func (a nominatimAddress) address(displayName string) Address {
+	city := a.City
+	if city == "" {
+		city = a.Town
+	}
+
+	if city == "" {
+		city = a.Village
+	}
+
+	return Address{
+		Country:     a.Country,
+		CountryCode: strings.ToLower(a.CountryCode),
+		City:        city,
+		Street:      a.Road,
+		DisplayName: displayName,
+	}
+}
+
+func (n nominatim) Reverse(ctx context.Context, at Coords) (Address, error) {
+	q := url.Values{
+		"format": {"jsonv2"},
+		"lat":    {formatCoord(at.Latitude)},
+		"lon":    {formatCoord(at.Longitude)},
+	}
+
+	var body struct {
+		DisplayName string           `json:"display_name"`
+		Address     nominatimAddress `json:"address"`
+		Error       string           `json:"error"`
+	}
+	if err := n.getJSON(ctx, "/reverse", q, &body); err != nil {
+		return Address{}, err
+	}
+
+	if body.Error != "" {
+		return Address{}, fmt.Errorf("nominatim: %s", body.Error)
+	}
+
+	return body.Address.address(body.DisplayName), nil
+}
+
+func (n nominatim) Search(ctx context.Context, q string, limit int) ([]Place, error) {
+	params := url.Values{
+		"format":         {"jsonv2"},
+		"q":              {q},
+		"limit":          {strconv.Itoa(limit)},
+		"addressdetails": {"1"},
+	}
+
+	var body []struct {
+		Name        string           `json:"name"`
+		DisplayName string           `json:"display_name"`
+		Lat         string           `json:"lat"`
+		Lon         string           `json:"lon"`
+		Address     nominatimAddress `json:"address"`
+	}
+	if err := n.getJSON(ctx, "/search", params, &body); err != nil {
+		return nil, err
+	}
+
+	places := make([]Place, 0, len(body))
+	for _, item := range body {
+		lat, err := strconv.ParseFloat(item.Lat, 64)
+		if err != nil {
+			return nil, fmt.Errorf("nominatim: invalid latitude %q", item.Lat)
+		}
+
+		lon, err := strconv.ParseFloat(item.Lon, 64)
+		if err != nil {
+			return nil, fmt.Errorf("nominatim: invalid longitude %q", item.Lon)
+		}
+
+		name := item.Name
+		if name == "" {
+			name = item.DisplayName
+		}
+
+		places = append(places, Place{
+			Name:     name,
+			Location: Coords{Latitude: lat, Longitude: lon},
+			Address:  item.Address.address(item.DisplayName),
+		})
+	}
+
+	return places, nil
+}
+
+type photon struct {
+	httpGeocoder
+}
+
+type photonFeature struct {
+	Geometry struct {
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Name        string `json:"name"`
+		Country     string `json:"country"`
+		CountryCode string `json:"countrycode"`
+		City        string `json:"city"`
+		Street      string `json:"street"`
+	} `json:"properties"`
+}
+
+func (f photonFeature) address() Address {
+	props := f.Properties
+	var parts []string
+	for _, part := range []string{props.Name, props.Street, props.City, props.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return Address{
+		Country:     props.Country,
+		CountryCode: strings.ToLower(props.CountryCode),
+		City:        props.City,
+		Street:      props.Street,
+		DisplayName: strings.Join(parts, ", "),
+	}
+}
+
+func (p photon) Reverse(ctx context.Context, at Coords) (Address, error) {
+	q := url.Values{
+		"lat": {formatCoord(at.Latitude)},
+		"lon": {formatCoord(at.Longitude)},
+	}
+
+	var body struct {
+		Features []photonFeature `json:"features"`
+	}
+	if err := p.getJSON(ctx, "/reverse", q, &body); err != nil {
+		return Address{}, err
+	}
+
+	if len(body.Features) == 0 {
+		return Address{}, fmt.Errorf("photon: no results")
+	}
+
+	return body.Features[0].address(), nil
+}
+
+func (p photon) Search(ctx context.Context, q string, limit int) ([]Place, error) {
+	params := url.Values{
+		"q":     {q},
+		"limit": {strconv.Itoa(limit)},
+	}
+
+	var body struct {
+		Features []photonFeature `json:"features"`
+	}
+	if err := p.getJSON(ctx, "/api", params, &body); err != nil {
+		return nil, err
+	}
+
+	places := make([]Place, 0, len(body.Features))
+	for _, feature := range body.Features {
+		if len(feature.Geometry.Coordinates) < 2 {
+			continue
+		}
+
+		address := feature.address()
+		name := feature.Properties.Name
+		if name == "" {
+			name = address.DisplayName
+		}
+
+		places = append(places, Place{
+			Name:     name,
+			Location: Coords{Latitude: feature.Geometry.Coordinates[1], Longitude: feature.Geometry.Coordinates[0]},
+			Address:  address,
+		})
+	}
+
+	return places, nil
+}
+
+// geocodingWorker resolves addresses of markers in the background, one at a time.
+type geocodingWorker struct {
+	geocoder Geocoder
+	db       *mongo.Database
+	logger   echo.Logger
+	queue    chan string
+}
+
+func newGeocodingWorker(geocoder Geocoder, db *mongo.Database, logger echo.Logger) *geocodingWorker {
+	return &geocodingWorker{
+		geocoder: geocoder,
+		db:       db,
+		logger:   logger,
+		queue:    make(chan string, 1000),
+	}
+}
+
+// enqueue schedules the marker for geocoding. When the queue is full the marker is
+// picked up by the next backfill instead.
+func (w *geocodingWorker) enqueue(id string) {
+	if w.geocoder == nil {
+		return
+	}
+
+	select {
+	case w.queue <- id:
+	default:
+		w.logger.Warnf("geocoding queue is full, marker %s will be geocoded later", id)
+	}
+}
+
+func (w *geocodingWorker) run(ctx context.Context) {
+	if w.geocoder == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-w.queue:
+			w.geocode(ctx, id)
+		}
+	}
+}
+
+// backfill queues markers that were never geocoded, e.g. ones created before the
+// geocoder was configured. It runs as the geocoding-backfill job.
+func (w *geocodingWorker) backfill(ctx context.Context) error {
+	cursor, err := w.db.Collection("markers").Find(ctx, bson.M{"address": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		select {
+		case w.queue <- marker.ID:
+		default:
+			return nil
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (w *geocodingWorker) geocode(ctx context.Context, id string) {
+	var marker Marker
+	if err := w.db.Collection("markers").FindOne(ctx, bson.M{"_id": id}).Decode(&marker); err != nil {
+		if err != mongo.ErrNoDocuments {
+			w.logger.Error(err)
+		}
+
+		return
+	}
+
+	address, err := w.geocoder.Reverse(ctx, marker.Location)
+	if err != nil {
+		w.logger.Warnf("can't geocode marker %s: %v", id, err)
+		return
+	}
+
+	// Only store the address if the marker didn't move in the meantime.
+	res, err := w.db.Collection("markers").UpdateOne(ctx,
+		bson.M{"_id": id, "location": marker.Location},
+		bson.M{"$set": bson.M{"address": address}},
+	)
+	if err != nil {
+		w.logger.Error(err)
+		return
+	}
+
+	if res.ModifiedCount > 0 {
+		if err := appendUpdateEvent(ctx, w.db, id); err != nil {
+			w.logger.Error(err)
+		}
+	}
+}
+
+const (
+	defaultGeocodeLimit = 5
+	maxGeocodeLimit     = 20
+)
+
+// registerGeocodeRoutes proxies place search to the configured provider so clients
+// don't need their own geocoder keys.
+func registerGeocodeRoutes(group *echo.Group, geocoder Geocoder) {
+	group.GET("", func(c echo.Context) error {
+		if geocoder == nil {
+			s := "geocoding is not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		q := strings.TrimSpace(c.QueryParam("q"))
+		if q == "" {
+			s := "empty query"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		limit, err := parseLimit(c, defaultGeocodeLimit, maxGeocodeLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		places, err := geocoder.Search(c.Request().Context(), q, limit)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusBadGateway, ErrorString{"geocoding provider is unavailable"})
+		}
+
+		return c.JSON(http.StatusOK, places)
+	})
+}
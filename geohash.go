@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	// geohashPrecision is the length of stored geohashes, a cell of a few centimeters.
+	geohashPrecision = 12
+
+	defaultClusterPrecision = 5
+)
+
+var geohashPattern = regexp.MustCompile("^[" + geohashAlphabet + "]{1,12}$")
+
+// encodeGeohash returns the geohash of the given length containing the location.
+func encodeGeohash(c Coords, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	bits, current, even := 0, 0, true
+	for len(hash) < precision {
+		r, v := &latRange, c.Latitude
+		if even {
+			r, v = &lonRange, c.Longitude
+		}
+
+		mid := (r[0] + r[1]) / 2
+		current <<= 1
+		if v >= mid {
+			current |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[current])
+			bits, current = 0, 0
+		}
+	}
+
+	return string(hash)
+}
+
+// geohashBounds returns the cell covered by a geohash.
+func geohashBounds(hash string) Bounds {
+	b := Bounds{MinLatitude: -90, MaxLatitude: 90, MinLongitude: -180, MaxLongitude: 180}
+
+	even := true
+	for i := 0; i < len(hash); i++ {
+		value := strings.IndexByte(geohashAlphabet, hash[i])
+		for bit := 4; bit >= 0; bit-- {
+			set := value&(1<<bit) != 0
+			if even {
+				mid := (b.MinLongitude + b.MaxLongitude) / 2
+				if set {
+					b.MinLongitude = mid
+				} else {
+					b.MaxLongitude = mid
+				}
+			} else {
+				mid := (b.MinLatitude + b.MaxLatitude) / 2
+				if set {
+					b.MinLatitude = mid
+				} else {
+					b.MaxLatitude = mid
+				}
+			}
+
+			even = !even
+		}
+	}
+
+	return b
+}
+
+// geohashFilter handles ?geohash=u33d matching markers in the cell, i.e. markers whose
+// geohash starts with the given one.
+func geohashFilter(c echo.Context) (bson.M, error) {
+	param := strings.ToLower(strings.TrimSpace(c.QueryParam("geohash")))
+	if param == "" {
+		return nil, nil
+	}
+
+	if !geohashPattern.MatchString(param) {
+		return nil, fmt.Errorf("invalid geohash %q", param)
+	}
+
+	return and(bson.M{"geohash": bson.M{"$regex": "^" + param}}, outsideZones(c)), nil
+}
+
+// backfillGeohashes computes geohashes of the markers stored before they were added.
+func backfillGeohashes(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		collection := db.Collection(name)
+		cursor, err := collection.Find(ctx, bson.M{
+			"geohash":            bson.M{"$exists": false},
+			"location.latitude":  bson.M{"$gte": -90, "$lte": 90},
+			"location.longitude": bson.M{"$gte": -180, "$lte": 180},
+		})
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			hash := encodeGeohash(marker.Location, geohashPrecision)
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": marker.ID}, bson.M{"$set": bson.M{"geohash": hash}}); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+	}
+
+	return nil
+}
+
+// GeohashCluster groups the markers sharing a geohash prefix. The location is the
+// average of the markers' locations, Bounds the cell.
+type GeohashCluster struct {
+	Geohash  string `json:"geohash"`
+	Count    int    `json:"count"`
+	Location Coords `json:"location"`
+	Bounds   Bounds `json:"bounds"`
+}
+
+func parsePrecision(c echo.Context) (int, error) {
+	param := c.QueryParam("precision")
+	if param == "" {
+		return defaultClusterPrecision, nil
+	}
+
+	precision, err := strconv.Atoi(param)
+	if err != nil || precision <= 0 || precision > geohashPrecision {
+		return 0, fmt.Errorf("invalid precision, expected a number between 1 and %d", geohashPrecision)
+	}
+
+	return precision, nil
+}
+
+// geohashClusters groups the markers matching the filter by the first precision
+// characters of their geohashes.
+func geohashClusters(ctx context.Context, db *mongo.Database, filter bson.M, precision int) ([]GeohashCluster, error) {
+	cursor, err := db.Collection("markers").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: and(filter, bson.M{"geohash": bson.M{"$exists": true}})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       bson.M{"$substrBytes": bson.A{"$geohash", 0, precision}},
+			"count":     bson.M{"$sum": 1},
+			"latitude":  bson.M{"$avg": "$location.latitude"},
+			"longitude": bson.M{"$avg": "$location.longitude"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []struct {
+		Geohash   string  `bson:"_id"`
+		Count     int     `bson:"count"`
+		Latitude  float64 `bson:"latitude"`
+		Longitude float64 `bson:"longitude"`
+	}
+	if err := cursor.All(context.Background(), &groups); err != nil {
+		return nil, err
+	}
+
+	clusters := make([]GeohashCluster, 0, len(groups))
+	for _, g := range groups {
+		clusters = append(clusters, GeohashCluster{
+			Geohash:  g.Geohash,
+			Count:    g.Count,
+			Location: Coords{Latitude: g.Latitude, Longitude: g.Longitude},
+			Bounds:   geohashBounds(g.Geohash),
+		})
+	}
+
+	return clusters, nil
+}
+
+func registerGeohashRoutes(group *echo.Group, db *mongo.Database, cache *responseCache) {
+	group.GET("/clusters", func(c echo.Context) error {
+		precision, err := parsePrecision(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		clusters, err := geohashClusters(c.Request().Context(), db, and(filter, outsideZones(c)), precision)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, clusters)
+	}, cache.middleware())
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		name      string
+		at        Coords
+		precision int
+		want      string
+	}{
+		{"origin", Coords{}, 5, "s0000"},
+		{"south west corner", Coords{Latitude: -90, Longitude: -180}, 5, "00000"},
+		{"north east corner", Coords{Latitude: 90, Longitude: 180}, 5, "zzzzz"},
+		{"Jutland", Coords{Latitude: 57.64911, Longitude: 10.40744}, 11, "u4pruydqqvj"},
+		{"stored precision", Coords{Latitude: 57.64911, Longitude: 10.40744}, geohashPrecision, "u4pruydqqvj8"},
+		{"western hemisphere", Coords{Latitude: 40.6892, Longitude: -74.0445}, 6, "dr5r7p"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeGeohash(tt.at, tt.precision); got != tt.want {
+				t.Errorf("encodeGeohash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeohashBounds(t *testing.T) {
+	tests := []struct {
+		hash string
+		want Bounds
+	}{
+		{"", Bounds{MinLatitude: -90, MaxLatitude: 90, MinLongitude: -180, MaxLongitude: 180}},
+		{"s", Bounds{MinLatitude: 0, MaxLatitude: 45, MinLongitude: 0, MaxLongitude: 45}},
+		{"0", Bounds{MinLatitude: -90, MaxLatitude: -45, MinLongitude: -180, MaxLongitude: -135}},
+		{"z", Bounds{MinLatitude: 45, MaxLatitude: 90, MinLongitude: 135, MaxLongitude: 180}},
+		{"s0", Bounds{MinLatitude: 0, MaxLatitude: 5.625, MinLongitude: 0, MaxLongitude: 11.25}},
+	}
+
+	for _, tt := range tests {
+		if got := geohashBounds(tt.hash); got != tt.want {
+			t.Errorf("geohashBounds(%q) = %+v, want %+v", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestGeohashRoundTrip(t *testing.T) {
+	locations := []Coords{
+		{},
+		{Latitude: 57.64911, Longitude: 10.40744},
+		{Latitude: -33.8688, Longitude: 151.2093},
+		{Latitude: 40.6892, Longitude: -74.0445},
+		{Latitude: -89.9999, Longitude: 179.9999},
+		{Latitude: 64.1466, Longitude: -21.9426},
+	}
+
+	for _, at := range locations {
+		for precision := 1; precision <= geohashPrecision; precision++ {
+			hash := encodeGeohash(at, precision)
+			if !geohashPattern.MatchString(hash) {
+				t.Fatalf("encodeGeohash(%+v, %d) = %q, not a geohash", at, precision, hash)
+			}
+
+			b := geohashBounds(hash)
+			if at.Latitude < b.MinLatitude || at.Latitude > b.MaxLatitude || at.Longitude < b.MinLongitude || at.Longitude > b.MaxLongitude {
+				t.Errorf("geohashBounds(%q) = %+v, doesn't contain %+v", hash, b, at)
+			}
+
+			center := Coords{Latitude: (b.MinLatitude + b.MaxLatitude) / 2, Longitude: (b.MinLongitude + b.MaxLongitude) / 2}
+			if got := encodeGeohash(center, precision); got != hash {
+				t.Errorf("encodeGeohash(center of %q) = %q", hash, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultHeatmapResolution = 64
+	maxHeatmapResolution     = 256
+)
+
+// HeatmapCell is a grid cell with at least one marker, located at the cell center.
+type HeatmapCell struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+	Weight    float64 `json:"weight"`
+}
+
+// Heatmap is the marker density over the requested area. The area is split into
+// resolution by resolution cells, MaxWeight helps clients scale the intensity.
+type Heatmap struct {
+	Resolution    int           `json:"resolution"`
+	CellLatitude  float64       `json:"cellLatitude"`
+	CellLongitude float64       `json:"cellLongitude"`
+	MaxWeight     float64       `json:"maxWeight"`
+	Cells         []HeatmapCell `json:"cells"`
+}
+
+func parseResolution(c echo.Context) (int, error) {
+	param := c.QueryParam("resolution")
+	if param == "" {
+		return defaultHeatmapResolution, nil
+	}
+
+	resolution, err := strconv.Atoi(param)
+	if err != nil || resolution <= 0 || resolution > maxHeatmapResolution {
+		return 0, fmt.Errorf("invalid resolution, expected a number between 1 and %d", maxHeatmapResolution)
+	}
+
+	return resolution, nil
+}
+
+// heatmapWeight handles ?weight=count (default), where every marker counts once, or
+// likes, where markers count once more for every like.
+func heatmapWeight(c echo.Context) (interface{}, error) {
+	switch c.QueryParam("weight") {
+	case "", "count":
+		return 1, nil
+	case "likes":
+		return bson.M{"$add": bson.A{1, bson.M{"$ifNull": bson.A{"$likeCount", 0}}}}, nil
+	default:
+		return nil, fmt.Errorf("invalid weight, expected count or likes")
+	}
+}
+
+// cellIndex computes the grid column or row of a coordinate, keeping markers on the
+// upper edge of the area in the last cell.
+func cellIndex(value interface{}, min, size float64, resolution int) bson.M {
+	return bson.M{"$min": bson.A{
+		resolution - 1,
+		bson.M{"$floor": bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{value, min}}, size}}},
+	}}
+}
+
+// gridLongitude is the longitude of markers counted from the western edge of the
+// bounds. Past the antimeridian the grid continues east of 180.
+func gridLongitude(bbox Bounds) interface{} {
+	if !bbox.crossesAntimeridian() {
+		return "$location.longitude"
+	}
+
+	return bson.M{"$cond": bson.A{
+		bson.M{"$lt": bson.A{"$location.longitude", bbox.MinLongitude}},
+		bson.M{"$add": bson.A{"$location.longitude", 360}},
+		"$location.longitude",
+	}}
+}
+
+func registerHeatmapRoutes(group *echo.Group, db *mongo.Database, cache *responseCache) {
+	group.GET("/heatmap", func(c echo.Context) error {
+		resolution, err := parseResolution(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		weight, err := heatmapWeight(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		bbox, ok, err := parseBBox(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if !ok {
+			// Locations outside of the valid ranges were accepted before, the filter below
+			// leaves them out.
+			bbox = Bounds{MinLatitude: -90, MaxLatitude: 90, MinLongitude: -180, MaxLongitude: 180}
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		heatmap := Heatmap{
+			Resolution:    resolution,
+			CellLatitude:  (bbox.MaxLatitude - bbox.MinLatitude) / float64(resolution),
+			CellLongitude: bbox.width() / float64(resolution),
+			Cells:         []HeatmapCell{},
+		}
+
+		if heatmap.CellLatitude == 0 || heatmap.CellLongitude == 0 {
+			s := "bbox must not be empty"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		cursor, err := db.Collection("markers").Aggregate(c.Request().Context(), mongo.Pipeline{
+			{{Key: "$match", Value: and(filter, bbox.filter(), outsideZones(c))}},
+			{{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"x": cellIndex(gridLongitude(bbox), bbox.MinLongitude, heatmap.CellLongitude, resolution),
+					"y": cellIndex("$location.latitude", bbox.MinLatitude, heatmap.CellLatitude, resolution),
+				},
+				"count":  bson.M{"$sum": 1},
+				"weight": bson.M{"$sum": weight},
+			}}},
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var groups []struct {
+			Cell struct {
+				X float64 `bson:"x"`
+				Y float64 `bson:"y"`
+			} `bson:"_id"`
+			Count  int     `bson:"count"`
+			Weight float64 `bson:"weight"`
+		}
+		if err := cursor.All(context.Background(), &groups); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		for _, g := range groups {
+			heatmap.Cells = append(heatmap.Cells, HeatmapCell{
+				Latitude:  bbox.MinLatitude + (g.Cell.Y+0.5)*heatmap.CellLatitude,
+				Longitude: wrapLongitude(bbox.MinLongitude + (g.Cell.X+0.5)*heatmap.CellLongitude),
+				Count:     g.Count,
+				Weight:    g.Weight,
+			})
+
+			if g.Weight > heatmap.MaxWeight {
+				heatmap.MaxWeight = g.Weight
+			}
+		}
+
+		return c.JSON(http.StatusOK, heatmap)
+	}, cache.middleware())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MarkerState is a marker as it was from RecordedAt until the next state of the marker.
+// States are recorded with the events of the outbox, Marker is missing for deletions.
+type MarkerState struct {
+	ID         string    `json:"id" bson:"_id"`
+	MarkerID   string    `json:"markerId" bson:"markerId"`
+	Type       string    `json:"type" bson:"type"`
+	Marker     *Marker   `json:"marker,omitempty" bson:"marker,omitempty"`
+	RecordedAt time.Time `json:"recordedAt" bson:"recordedAt"`
+	// Seeded states were taken from the markers when the history was started.
+	Seeded bool `json:"seeded,omitempty" bson:"seeded,omitempty"`
+}
+
+// recordState adds the marker after a change to its history.
+func recordState(ctx context.Context, db *mongo.Database, eventType, markerID string, marker *Marker, at time.Time) error {
+	_, err := db.Collection("history").InsertOne(ctx, MarkerState{
+		ID:         primitive.NewObjectID().Hex(),
+		MarkerID:   markerID,
+		Type:       eventType,
+		Marker:     marker,
+		RecordedAt: at,
+	})
+	return err
+}
+
+// seedHistory records the current state of every marker, so markers that don't change
+// afterwards have a past. Markers are taken as they are since their last update.
+func seedHistory(ctx context.Context, db *mongo.Database) error {
+	for _, source := range []struct{ collection, eventType string }{{"markers", EventMarkerUpdated}, {archiveCollection, EventMarkerArchived}} {
+		cursor, err := db.Collection(source.collection).Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+
+		var batch []interface{}
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+
+			_, err := db.Collection("history").InsertMany(ctx, batch)
+			batch = batch[:0]
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			// Archived markers are recorded as archived when they were, so they stay out of asOf
+			// results after that.
+			state := MarkerState{ID: primitive.NewObjectID().Hex(), MarkerID: marker.ID, Type: source.eventType, Marker: &marker, RecordedAt: marker.UpdatedAt, Seeded: true}
+			if source.eventType == EventMarkerArchived && marker.ArchivedAt != nil {
+				state.RecordedAt = *marker.ArchivedAt
+			}
+
+			batch = append(batch, state)
+			if len(batch) == 1000 {
+				if err := flush(); err != nil {
+					cursor.Close(context.Background())
+					return err
+				}
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unseedHistory removes the states recorded by seedHistory.
+func unseedHistory(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("history").DeleteMany(ctx, bson.M{"seeded": true})
+	return err
+}
+
+// parseAsOf reads ?asOf=, an RFC 3339 timestamp in the past. ok is false without it.
+func parseAsOf(c echo.Context, retention time.Duration) (asOf time.Time, ok bool, err error) {
+	param := c.QueryParam("asOf")
+	if param == "" {
+		return time.Time{}, false, nil
+	}
+
+	asOf, err = time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid asOf, expected an RFC 3339 timestamp")
+	}
+
+	now := time.Now()
+	if asOf.After(now) {
+		return time.Time{}, false, fmt.Errorf("invalid asOf, expected a time in the past")
+	}
+
+	if retention > 0 && asOf.Before(now.Add(-retention)) {
+		return time.Time{}, false, fmt.Errorf("invalid asOf, history is kept for %s", retention)
+	}
+
+	return asOf.UTC(), true, nil
+}
+
+// findMarkersAsOf is findMarkers over the markers as they were at asOf: the last state
+// of every marker recorded until then, unless it was deleted. scope narrows the markers
+// before their states are picked, filter applies to the states.
+func findMarkersAsOf(ctx context.Context, db *mongo.Database, asOf time.Time, archived bool, scope, filter bson.M, sort bson.D, projection bson.M, limit int64) (*mongo.Cursor, error) {
+	gone := bson.A{EventMarkerDeleted}
+	if !archived {
+		gone = append(gone, EventMarkerArchived)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: and(scope, bson.M{"recordedAt": bson.M{"$lte": asOf}})}},
+		{{Key: "$sort", Value: bson.D{{Key: "markerId", Value: 1}, {Key: "recordedAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$markerId", "type": bson.M{"$first": "$type"}, "marker": bson.M{"$first": "$marker"}}}},
+		{{Key: "$match", Value: bson.M{"type": bson.M{"$nin": gone}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$marker"}}},
+		{{Key: "$match", Value: filter}},
+	}
+	if sort != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sort}})
+	}
+
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	if projection != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+
+	return db.Collection("history").Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true).SetBatchSize(1000))
+}
+
+// markerAsOf returns the marker matching the filter as it was at asOf.
+func markerAsOf(ctx context.Context, db *mongo.Database, asOf time.Time, archived bool, id string, filter bson.M, projection bson.M) (Marker, error) {
+	cursor, err := findMarkersAsOf(ctx, db, asOf, archived, bson.M{"markerId": id}, filter, nil, projection, 1)
+	if err != nil {
+		return Marker{}, err
+	}
+	defer cursor.Close(context.Background())
+
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return Marker{}, err
+		}
+
+		return Marker{}, mongo.ErrNoDocuments
+	}
+
+	var marker Marker
+	err = cursor.Decode(&marker)
+	return marker, err
+}
+
+// expireHistory removes states older than the retention, it runs as the expire-history
+// job. The last state of a marker before the cutoff is kept while the marker exists, as
+// it still describes the marker after the cutoff.
+func expireHistory(ctx context.Context, db *mongo.Database, retention time.Duration) error {
+	cutoff := time.Now().UTC().Add(-retention)
+	cursor, err := db.Collection("history").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"recordedAt": bson.M{"$lt": cutoff}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "markerId", Value: 1}, {Key: "recordedAt", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$markerId", "type": bson.M{"$first": "$type"}, "states": bson.M{"$push": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"type": EventMarkerDeleted},
+			bson.M{"states.1": bson.M{"$exists": true}},
+		}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var marker struct {
+			Type   string   `bson:"type"`
+			States []string `bson:"states"`
+		}
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		expired := marker.States
+		if marker.Type != EventMarkerDeleted {
+			expired = expired[1:]
+		}
+
+		if _, err := db.Collection("history").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": expired}}); err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Images are stored by clients, markers only hold their URIs. Images brought back by a
+// restore are the exception: they are kept in GridFS and served by the server, the
+// restored markers link to them.
+
+const (
+	imageBlobBucket = "images"
+	imageBlobPath   = "/api/v1/images/"
+	// maxImageBlobBytes is the largest image kept in backups.
+	maxImageBlobBytes = 50 << 20
+	// imageBlobGrace keeps blobs of restores still in progress from being swept.
+	imageBlobGrace = time.Hour
+)
+
+func imageBlobs(db *mongo.Database) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db, options.GridFSBucket().SetName(imageBlobBucket))
+}
+
+// imageBlobURI is the URI restored markers link their image to.
+func imageBlobURI(publicURL string, id primitive.ObjectID) string {
+	return strings.TrimSuffix(publicURL, "/") + imageBlobPath + id.Hex()
+}
+
+// imageBlobID returns the blob an image URI links to, ok is false for images stored
+// elsewhere.
+func imageBlobID(publicURL, uri string) (primitive.ObjectID, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasPrefix(u.Path, imageBlobPath) {
+		return primitive.ObjectID{}, false
+	}
+
+	if u.Host != "" {
+		public, err := url.Parse(publicURL)
+		if err != nil || public.Host != u.Host {
+			return primitive.ObjectID{}, false
+		}
+	}
+
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(u.Path, imageBlobPath))
+	return id, err == nil
+}
+
+// readImage returns the bytes and content type of an image, from GridFS for restored
+// images and over HTTP for all others. Images larger than maxImageBlobBytes fail.
+func readImage(ctx context.Context, db *mongo.Database, client *http.Client, publicURL, uri string) ([]byte, string, error) {
+	if id, ok := imageBlobID(publicURL, uri); ok {
+		return readImageBlob(db, id)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, "", fmt.Errorf("unsupported image URI")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("image responded with %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxImageBlobBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(data) > maxImageBlobBytes {
+		return nil, "", fmt.Errorf("image is larger than %d bytes", maxImageBlobBytes)
+	}
+
+	return data, res.Header.Get(echo.HeaderContentType), nil
+}
+
+func readImageBlob(db *mongo.Database, id primitive.ObjectID) ([]byte, string, error) {
+	bucket, err := imageBlobs(db)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stream.Close()
+
+	var data bytes.Buffer
+	if _, err := io.Copy(&data, stream); err != nil {
+		return nil, "", err
+	}
+
+	contentType, _ := stream.GetFile().Metadata.Lookup("contentType").StringValueOK()
+	return data.Bytes(), contentType, nil
+}
+
+// storeImageBlob keeps a restored image in GridFS.
+func storeImageBlob(db *mongo.Database, name, contentType string, r io.Reader) (primitive.ObjectID, error) {
+	bucket, err := imageBlobs(db)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	return bucket.UploadFromStream(name, r, options.GridFSUpload().SetMetadata(bson.M{"contentType": contentType}))
+}
+
+// deleteImageBlobs removes the blobs, those already gone are skipped.
+func deleteImageBlobs(db *mongo.Database, ids []primitive.ObjectID) error {
+	bucket, err := imageBlobs(db)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := bucket.Delete(id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweepImageBlobs removes blobs no live or archived marker links to anymore, e.g. of
+// deleted markers and of markers a restore replaced. Links are matched by path, so a
+// change of PUBLIC_URL doesn't lose blobs. It runs as the sweep-image-blobs job.
+func sweepImageBlobs(ctx context.Context, db *mongo.Database) error {
+	linked := map[string]bool{}
+	for _, name := range []string{"markers", archiveCollection} {
+		cursor, err := db.Collection(name).Find(ctx, bson.M{"images.uri": bson.M{"$regex": regexp.QuoteMeta(imageBlobPath)}}, options.Find().SetProjection(bson.M{"images.uri": 1}))
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+
+			for _, img := range marker.Images {
+				if i := strings.Index(img.URI, imageBlobPath); i >= 0 {
+					linked[img.URI[i+len(imageBlobPath):]] = true
+				}
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		cursor.Close(context.Background())
+	}
+
+	bucket, err := imageBlobs(db)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := bucket.GetFilesCollection().Find(ctx, bson.M{"uploadDate": bson.M{"$lt": time.Now().Add(-imageBlobGrace)}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+
+	var files []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(context.Background(), &files); err != nil {
+		return err
+	}
+
+	var unused []primitive.ObjectID
+	for _, f := range files {
+		if !linked[f.ID.Hex()] {
+			unused = append(unused, f.ID)
+		}
+	}
+
+	return deleteImageBlobs(db, unused)
+}
+
+// registerImageBlobRoutes serves restored images. Blobs never change, their ids are
+// new for every restore.
+func registerImageBlobRoutes(e *echo.Echo, db *mongo.Database) {
+	e.GET(imageBlobPath+":id", func(c echo.Context) error {
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			s := "image not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		data, contentType, err := readImageBlob(db, id)
+		if errors.Is(err, gridfs.ErrFileNotFound) {
+			s := "image not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+
+		c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		return c.Blob(http.StatusOK, contentType, data)
+	})
+}
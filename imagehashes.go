@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	imageHashFeed  = "imageHashes"
+	imageHashBatch = 100
+	// imageHashRetry is how long an image that couldn't be hashed is left alone.
+	imageHashRetry = 24 * time.Hour
+	// maxHashedImageBytes skips images too large to be photos worth comparing.
+	maxHashedImageBytes = 20 << 20
+
+	// Distances count differing bits of 64 bit hashes. Photos of the same image resized
+	// or recompressed are usually within a few bits, unrelated ones around 32 apart.
+	defaultImageDistance = 10
+	maxImageDistance     = 32
+
+	defaultImageMatches = 20
+	maxImageMatches     = 100
+	// maxImageCandidates bounds the markers compared with an uploaded photo.
+	maxImageCandidates = 10000
+)
+
+// ImageHash remembers the perceptual hash of an image, so images used by several markers
+// or kept through edits are downloaded once. Images that couldn't be hashed keep the
+// error instead.
+type ImageHash struct {
+	URI      string    `bson:"_id"`
+	Hash     int64     `bson:"hash"`
+	Error    string    `bson:"error,omitempty"`
+	HashedAt time.Time `bson:"hashedAt"`
+}
+
+// ImageMatch is a marker with an image similar to an uploaded photo, Distance is the
+// number of bits the hashes differ in.
+type ImageMatch struct {
+	Marker   Marker `json:"marker"`
+	ImageID  string `json:"imageId"`
+	Distance int    `json:"distance"`
+}
+
+// perceptualHash returns the pHash of the image: the signs of the lowest 8x8
+// frequencies of the discrete cosine transform of a 32x32 grayscale copy, compared with
+// their median. Scaling, recompression and small color changes barely move it.
+func perceptualHash(src image.Image) uint64 {
+	const size, low = 32, 8
+
+	// Every pixel of the copy averages a grid of samples of the area it covers.
+	const samples = 4
+	bounds := src.Bounds()
+	var pixels [size][size]float64
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sum float64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := bounds.Min.X + (x*samples+sx)*bounds.Dx()/(size*samples)
+					py := bounds.Min.Y + (y*samples+sy)*bounds.Dy()/(size*samples)
+					r, g, b, _ := src.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+
+			pixels[y][x] = sum / (samples * samples)
+		}
+	}
+
+	var cosines [low][size]float64
+	for u := 0; u < low; u++ {
+		for x := 0; x < size; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+
+	var coefficients [low * low]float64
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y][x] * cosines[u][x] * cosines[v][y]
+				}
+			}
+
+			coefficients[v*low+u] = sum
+		}
+	}
+
+	sorted := coefficients
+	sort.Float64s(sorted[:])
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+
+	return hash
+}
+
+// imageDistance counts the bits two hashes differ in.
+func imageDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// fetchImage downloads and decodes an image of a marker.
+func fetchImage(ctx context.Context, client *http.Client, uri string, limit int64) (image.Image, error) {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("unsupported image URI")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image responded with %s", res.Status)
+	}
+
+	src, _, err := image.Decode(io.LimitReader(res.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode image: %w", err)
+	}
+
+	return src, nil
+}
+
+// imageHasher hashes the images of new and changed markers in the background.
+type imageHasher struct {
+	db     *mongo.Database
+	client *http.Client
+	logger echo.Logger
+}
+
+func newImageHasher(db *mongo.Database, cfg Config, logger echo.Logger) *imageHasher {
+	return &imageHasher{
+		db:     db,
+		client: &http.Client{Timeout: cfg.ImageHashTimeout},
+		logger: logger,
+	}
+}
+
+// hashAll hashes the images of changed markers until it caught up, it runs as the
+// image-hashes job.
+func (h *imageHasher) hashAll(ctx context.Context) error {
+	for {
+		more, err := h.hash(ctx)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// hash hashes the images of one batch of changed markers. Images that can't be
+// downloaded or decoded are recorded as failed, only database errors stop the batch.
+func (h *imageHasher) hash(ctx context.Context) (more bool, err error) {
+	position, err := loadFeedPosition(ctx, h.db, imageHashFeed)
+	if err != nil {
+		return false, err
+	}
+
+	until := time.Now().UTC().Add(-syncSettleTime)
+	cursor, err := h.db.Collection("markers").Find(ctx,
+		and(after("updatedAt", position.UpdatedAt, position.MarkerID, until), bson.M{"images.0": bson.M{"$exists": true}}),
+		options.Find().
+			SetProjection(bson.M{"images": 1, "updatedAt": 1}).
+			SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(imageHashBatch))
+	if err != nil {
+		return false, err
+	}
+
+	var markers []Marker
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return false, err
+	}
+
+	for _, marker := range markers {
+		for _, image := range marker.Images {
+			if err := h.hashImage(ctx, image.URI); err != nil {
+				return false, fmt.Errorf("can't hash image %s of marker %s: %w", image.ID, marker.ID, err)
+			}
+		}
+	}
+
+	next := syncPosition{UpdatedAt: until}
+	if more = len(markers) == imageHashBatch; more {
+		last := markers[len(markers)-1]
+		next = syncPosition{UpdatedAt: last.UpdatedAt, MarkerID: last.ID}
+	}
+
+	return more, saveFeedPosition(ctx, h.db, imageHashFeed, next)
+}
+
+func (h *imageHasher) hashImage(ctx context.Context, uri string) error {
+	var stored ImageHash
+	err := h.db.Collection("imageHashes").FindOne(ctx, bson.M{"_id": uri}).Decode(&stored)
+	if err == nil && (stored.Error == "" || time.Since(stored.HashedAt) < imageHashRetry) {
+		return nil
+	}
+
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	hash := ImageHash{URI: uri, HashedAt: time.Now().UTC()}
+	src, err := fetchImage(ctx, h.client, uri, maxHashedImageBytes)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		h.logger.Infof("can't hash image %s: %v", uri, err)
+		hash.Error = err.Error()
+	} else {
+		hash.Hash = int64(perceptualHash(src))
+	}
+
+	_, err = h.db.Collection("imageHashes").ReplaceOne(ctx, bson.M{"_id": uri}, hash, options.Replace().SetUpsert(true))
+	return err
+}
+
+// imageMatches ranks the images of the markers by their distance from the hash, keeping
+// the closest image of every marker within maxDistance.
+func imageMatches(ctx context.Context, db *mongo.Database, markers []Marker, hash uint64, maxDistance int) ([]ImageMatch, error) {
+	var uris []string
+	for _, marker := range markers {
+		for _, image := range marker.Images {
+			uris = append(uris, image.URI)
+		}
+	}
+
+	hashes := make(map[string]uint64, len(uris))
+	for start := 0; start < len(uris); start += 1000 {
+		end := start + 1000
+		if end > len(uris) {
+			end = len(uris)
+		}
+
+		cursor, err := db.Collection("imageHashes").Find(ctx, bson.M{"_id": bson.M{"$in": uris[start:end]}, "error": bson.M{"$exists": false}})
+		if err != nil {
+			return nil, err
+		}
+
+		var stored []ImageHash
+		if err := cursor.All(context.Background(), &stored); err != nil {
+			return nil, err
+		}
+
+		for _, h := range stored {
+			hashes[h.URI] = uint64(h.Hash)
+		}
+	}
+
+	var matches []ImageMatch
+	for _, marker := range markers {
+		best := ImageMatch{Distance: maxDistance + 1}
+		for _, image := range marker.Images {
+			h, ok := hashes[image.URI]
+			if !ok {
+				continue
+			}
+
+			if d := imageDistance(hash, h); d < best.Distance {
+				best = ImageMatch{Marker: marker, ImageID: image.ID, Distance: d}
+			}
+		}
+
+		if best.Distance <= maxDistance {
+			matches = append(matches, best)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+	return matches, nil
+}
+
+// registerImageSearchRoutes serves POST /api/v1/markers/search-by-image taking a photo as
+// the body. Markers are filtered like listings, ?owner=me searches the user's own.
+func registerImageSearchRoutes(group *echo.Group, db *mongo.Database, privacy *markerPrivacy) {
+	group.POST("", func(c echo.Context) error {
+		maxDistance, err := parseIntParam(c, "maxDistance", defaultImageDistance, 0, maxImageDistance)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		limit, err := parseLimit(c, defaultImageMatches, maxImageMatches)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if c.QueryParam("owner") == "me" {
+			user, ok := currentUser(c)
+			if !ok {
+				s := "authentication required"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusUnauthorized, ErrorString{s})
+			}
+
+			filter = and(filter, bson.M{"ownerId": user.ID})
+		}
+
+		src, _, err := image.Decode(io.LimitReader(c.Request().Body, maxHashedImageBytes))
+		if err != nil {
+			err = fmt.Errorf("can't decode image, expected a JPEG, PNG or GIF: %w", err)
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		hash := perceptualHash(src)
+
+		// Recently changed markers are compared first when there are too many.
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), and(filter, bson.M{"images.0": bson.M{"$exists": true}}), options.Find().
+			SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+			SetLimit(maxImageCandidates))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		matches, err := imageMatches(c.Request().Context(), db, markers, hash, maxDistance)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		view := privacy.view(c)
+		results := []ImageMatch{}
+		for _, match := range matches {
+			if len(results) == limit {
+				break
+			}
+
+			ok, err := view.redactMarker(c.Request().Context(), &match.Marker)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if ok {
+				match.Marker = match.Marker.Normalize()
+				results = append(results, match)
+			}
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+}
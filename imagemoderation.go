@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	imageModerationFeed  = "imageModeration"
+	imageModerationBatch = 100
+
+	// imageModerationReporter is the reporter of flags raised by image moderation.
+	imageModerationReporter = "image-moderation"
+)
+
+// ImageVerdict is a moderation provider's opinion of an image. NSFW is a score from 0
+// to 1, images at or above the configured threshold are quarantined.
+type ImageVerdict struct {
+	NSFW   float64  `json:"nsfw" bson:"nsfw"`
+	Labels []string `json:"labels,omitempty" bson:"labels,omitempty"`
+}
+
+// ImageModerator classifies images. Providers such as AWS Rekognition are reached
+// through an HTTP adapter speaking the same protocol as httpImageModerator.
+type ImageModerator interface {
+	Classify(ctx context.Context, uri string) (ImageVerdict, error)
+}
+
+func newImageModerator(cfg Config) ImageModerator {
+	if cfg.ImageModerationURL == "" {
+		return nil
+	}
+
+	return httpImageModerator{
+		client: &http.Client{Timeout: cfg.ImageModerationTimeout},
+		url:    cfg.ImageModerationURL,
+	}
+}
+
+// httpImageModerator posts {"uri": ...} to a classifier and expects an ImageVerdict back.
+type httpImageModerator struct {
+	client *http.Client
+	url    string
+}
+
+func (m httpImageModerator) Classify(ctx context.Context, uri string) (ImageVerdict, error) {
+	payload, err := json.Marshal(bson.M{"uri": uri})
+	if err != nil {
+		return ImageVerdict{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(payload))
+	if err != nil {
+		return ImageVerdict{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ImageVerdict{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ImageVerdict{}, fmt.Errorf("image moderation responded with %s", resp.Status)
+	}
+
+	var verdict ImageVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return ImageVerdict{}, err
+	}
+
+	return verdict, nil
+}
+
+// ImageCheck remembers the verdict on an image, so images used by several markers or
+// kept through edits are classified once.
+type ImageCheck struct {
+	URI       string       `bson:"_id"`
+	Verdict   ImageVerdict `bson:"verdict"`
+	CheckedAt time.Time    `bson:"checkedAt"`
+}
+
+// imageModerationWorker classifies the images of new and changed markers in the
+// background. A marker with an image over the threshold is hidden pending review with
+// a flag on the image, so moderators handle it like reports by users.
+type imageModerationWorker struct {
+	moderator ImageModerator
+	db        *mongo.Database
+	logger    echo.Logger
+	threshold float64
+}
+
+func newImageModerationWorker(moderator ImageModerator, db *mongo.Database, logger echo.Logger, cfg Config) *imageModerationWorker {
+	return &imageModerationWorker{
+		moderator: moderator,
+		db:        db,
+		logger:    logger,
+		threshold: cfg.ImageModerationThreshold,
+	}
+}
+
+// checkAll moderates changed markers until it caught up, it runs as the image-moderation
+// job.
+func (w *imageModerationWorker) checkAll(ctx context.Context) error {
+	for {
+		more, err := w.check(ctx)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// check moderates the images of one batch of changed markers. A failing classifier
+// stops the batch, it's retried from the same marker on the next run.
+func (w *imageModerationWorker) check(ctx context.Context) (more bool, err error) {
+	position, err := loadFeedPosition(ctx, w.db, imageModerationFeed)
+	if err != nil {
+		return false, err
+	}
+
+	until := time.Now().UTC().Add(-syncSettleTime)
+	cursor, err := w.db.Collection("markers").Find(ctx,
+		and(after("updatedAt", position.UpdatedAt, position.MarkerID, until), bson.M{"images.0": bson.M{"$exists": true}}),
+		options.Find().
+			SetProjection(bson.M{"images": 1, "updatedAt": 1}).
+			SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(imageModerationBatch))
+	if err != nil {
+		return false, err
+	}
+
+	var markers []Marker
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return false, err
+	}
+
+	for i, marker := range markers {
+		for _, image := range marker.Images {
+			if err := w.moderate(ctx, marker.ID, image); err != nil {
+				// The markers before this one are done.
+				if i > 0 {
+					done := syncPosition{UpdatedAt: markers[i-1].UpdatedAt, MarkerID: markers[i-1].ID}
+					if err := saveFeedPosition(ctx, w.db, imageModerationFeed, done); err != nil {
+						w.logger.Error(err)
+					}
+				}
+
+				return false, fmt.Errorf("can't moderate image %s of marker %s: %w", image.ID, marker.ID, err)
+			}
+		}
+	}
+
+	next := syncPosition{UpdatedAt: until}
+	if more = len(markers) == imageModerationBatch; more {
+		last := markers[len(markers)-1]
+		next = syncPosition{UpdatedAt: last.UpdatedAt, MarkerID: last.ID}
+	}
+
+	return more, saveFeedPosition(ctx, w.db, imageModerationFeed, next)
+}
+
+// verdict returns the remembered verdict on the image or asks the moderator.
+func (w *imageModerationWorker) verdict(ctx context.Context, uri string) (ImageVerdict, error) {
+	var check ImageCheck
+	err := w.db.Collection("imageChecks").FindOne(ctx, bson.M{"_id": uri}).Decode(&check)
+	if err == nil {
+		return check.Verdict, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return ImageVerdict{}, err
+	}
+
+	verdict, err := w.moderator.Classify(ctx, uri)
+	if err != nil {
+		return ImageVerdict{}, err
+	}
+
+	check = ImageCheck{URI: uri, Verdict: verdict, CheckedAt: time.Now().UTC()}
+	_, err = w.db.Collection("imageChecks").ReplaceOne(ctx, bson.M{"_id": uri}, check, options.Replace().SetUpsert(true))
+	return verdict, err
+}
+
+func (w *imageModerationWorker) moderate(ctx context.Context, markerID string, image Image) error {
+	verdict, err := w.verdict(ctx, image.URI)
+	if err != nil || verdict.NSFW < w.threshold {
+		return err
+	}
+
+	// Images already flagged, or approved by a moderator, are left alone.
+	flags, err := w.db.Collection("flags").CountDocuments(ctx, bson.M{
+		"markerId":   markerID,
+		"imageId":    image.ID,
+		"reporterId": imageModerationReporter,
+		"status":     bson.M{"$in": bson.A{FlagOpen, FlagApproved}},
+	})
+	if err != nil || flags > 0 {
+		return err
+	}
+
+	flag := Flag{
+		ID:         primitive.NewObjectID().Hex(),
+		MarkerID:   markerID,
+		ImageID:    image.ID,
+		Reason:     fmt.Sprintf("automatic image moderation: nsfw score %.2f", verdict.NSFW),
+		ReporterID: imageModerationReporter,
+		Status:     FlagOpen,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if _, err := w.db.Collection("flags").InsertOne(ctx, flag); err != nil {
+		return err
+	}
+
+	// updatedAt is left as it is, the marker isn't changed by its owner.
+	if _, err := w.db.Collection("markers").UpdateOne(ctx, bson.M{"_id": markerID}, bson.M{"$set": bson.M{"moderation": ModerationPending}}); err != nil {
+		return err
+	}
+
+	if err := appendUpdateEvent(ctx, w.db, markerID); err != nil {
+		return err
+	}
+
+	return recordAudit(ctx, w.db, "", "moderation.quarantine-image", []string{markerID}, bson.M{"imageId": image.ID, "nsfw": verdict.NSFW})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultImagePointsLimit = 500
+	maxImagePointsLimit     = 5000
+)
+
+// ImagePoint is an image located on the map on its own. Images without a location of
+// their own are placed at their marker, MarkerLocation tells them apart.
+type ImagePoint struct {
+	MarkerID       string `json:"markerId" bson:"markerId"`
+	ImageID        string `json:"imageId" bson:"imageId"`
+	URI            string `json:"uri" bson:"uri"`
+	Location       Coords `json:"location" bson:"location"`
+	MarkerLocation bool   `json:"markerLocation" bson:"markerLocation"`
+	OwnerID        string `json:"-" bson:"ownerId"`
+	MarkerCoords   Coords `json:"-" bson:"markerCoords"`
+}
+
+func registerImagePointRoutes(group *echo.Group, db *mongo.Database, cache *responseCache, privacy *markerPrivacy) {
+	group.GET("/image-points", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultImagePointsLimit, maxImagePointsLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		bbox, ok, err := parseBBox(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := attributeFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if ok {
+			// Markers outside of the bounds may still have images taken within them.
+			filter = and(filter, bson.M{"$or": bson.A{bbox.filter(), bbox.within("images.location")}}, outsideZones(c))
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$unwind", Value: "$images"}},
+			{{Key: "$project", Value: bson.M{
+				"_id":            0,
+				"markerId":       "$_id",
+				"ownerId":        "$ownerId",
+				"markerCoords":   "$location",
+				"imageId":        "$images._id",
+				"uri":            "$images.uri",
+				"location":       bson.M{"$ifNull": bson.A{"$images.location", "$location"}},
+				"markerLocation": bson.M{"$eq": bson.A{bson.M{"$type": "$images.location"}, "missing"}},
+			}}},
+		}
+
+		if ok {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bbox.filter()}})
+		}
+
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+
+		cursor, err := db.Collection("markers").Aggregate(c.Request().Context(), pipeline)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		points := []ImagePoint{}
+		if err := cursor.All(context.Background(), &points); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// Images whose owner keeps their locations private are still found at their marker
+		// through the marker listings, they aren't placed on their own. Privacy zones of
+		// owners apply to the markers.
+		view := privacy.view(c)
+		owners := make([]string, 0, len(points))
+		for _, point := range points {
+			owners = append(owners, point.OwnerID)
+		}
+
+		if err := view.load(c.Request().Context(), owners); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		public := points[:0]
+		for _, point := range points {
+			if !point.MarkerLocation && view.stripsImageMetadata(point.OwnerID) {
+				continue
+			}
+
+			if zone, ok := view.zone(point.OwnerID, point.MarkerCoords); ok {
+				if zone.Mode == ZoneHide || !point.MarkerLocation {
+					continue
+				}
+
+				point.Location = snapToGrid(point.Location, privacy.gridSize)
+			}
+
+			public = append(public, point)
+		}
+
+		return c.JSON(http.StatusOK, public)
+	}, cache.middleware())
+}
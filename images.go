@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImagePatch changes the metadata of a single image, fields left out stay as they are.
+// Moving an image to another position shifts the images in between.
+type ImagePatch struct {
+	Caption  *string `json:"caption" validate:"omitempty,max=500"`
+	AltText  *string `json:"altText" validate:"omitempty,max=1000"`
+	Position *int    `json:"position" validate:"omitempty,gte=0"`
+}
+
+// apply returns the images with the patch applied to the one at index i.
+func (p ImagePatch) apply(images []Image, i int) []Image {
+	image := images[i]
+	if p.Caption != nil {
+		image.Caption = *p.Caption
+	}
+
+	if p.AltText != nil {
+		image.AltText = *p.AltText
+	}
+
+	rest := append(append([]Image{}, images[:i]...), images[i+1:]...)
+	to := i
+	if p.Position != nil {
+		to = *p.Position
+	}
+
+	if to > len(rest) {
+		to = len(rest)
+	}
+
+	patched := append(append(append([]Image{}, rest[:to]...), image), rest[to:]...)
+	for i := range patched {
+		patched[i].Position = i
+	}
+
+	return normalizeImages(patched)
+}
+
+func registerImageRoutes(group *echo.Group, db *mongo.Database) {
+	group.PATCH("/:id/images/:imageID", func(c echo.Context) error {
+		var body ImagePatch
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		id := c.Param("id")
+		var stored Marker
+		if err := db.Collection("markers").FindOne(c.Request().Context(), visibleMarker(c, id)).Decode(&stored); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "marker not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !canModify(c, stored.OwnerID) {
+			s := "only the owner can modify this marker"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+
+		stored = stored.Normalize()
+		index := -1
+		for i, image := range stored.Images {
+			if image.ID == c.Param("imageID") {
+				index = i
+			}
+		}
+
+		if index < 0 {
+			s := "image not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if body.Position != nil && *body.Position >= len(stored.Images) {
+			s := "position is past the last image"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		marker := stored
+		marker.Images = body.apply(stored.Images, index)
+
+		// Changes made since the marker was read would be lost, so they fail the update.
+		filter := bson.M{"_id": id, "revision": revisionIs(stored.Revision)}
+		matched, _, err := updateMarker(c.Request().Context(), db, filter, stored, marker)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !matched {
+			s := "marker was changed concurrently, try again"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusConflict, ErrorString{s})
+		}
+
+		for _, image := range marker.Images {
+			if image.ID == c.Param("imageID") {
+				return c.JSON(http.StatusOK, image)
+			}
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
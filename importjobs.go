@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+
+	ImportSourceFlickr = "flickr"
+)
+
+// ImportJob is a long running import from a photo service. Progress is saved after
+// every page so an interrupted job continues where it stopped.
+type ImportJob struct {
+	ID      string `json:"id" bson:"_id"`
+	OwnerID string `json:"ownerId" bson:"ownerId"`
+	Source  string `json:"source" bson:"source"`
+
+	FlickrUserID string `json:"flickrUserId" bson:"flickrUserId"`
+	APIKey       string `json:"-" bson:"apiKey"`
+
+	Status string `json:"status" bson:"status"`
+	Error  string `json:"error,omitempty" bson:"error,omitempty"`
+	// DryRun jobs only fill in the summary, the photos are fetched but not stored.
+	DryRun bool `json:"dryRun,omitempty" bson:"dryRun,omitempty"`
+
+	// Page is the last imported page, Pages and Total are known after the first one.
+	Page    int           `json:"page" bson:"page"`
+	Pages   int           `json:"pages" bson:"pages"`
+	Total   int           `json:"total" bson:"total"`
+	Summary ImportSummary `json:"summary" bson:"summary"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+type ImportJobRequest struct {
+	Source       string `json:"source"`
+	FlickrUserID string `json:"flickrUserId"`
+	APIKey       string `json:"apiKey"`
+}
+
+func (r ImportJobRequest) Validate() error {
+	if r.Source != ImportSourceFlickr {
+		return fmt.Errorf("unsupported import source, expected %s", ImportSourceFlickr)
+	}
+
+	if strings.TrimSpace(r.FlickrUserID) == "" {
+		return fmt.Errorf("empty flickr user id")
+	}
+
+	return nil
+}
+
+// importJobs runs import jobs in the background, one at a time.
+type importJobs struct {
+	db       *mongo.Database
+	importer *markerImporter
+	flickr   *flickrClient
+	logger   echo.Logger
+	queue    chan string
+}
+
+func newImportJobs(db *mongo.Database, importer *markerImporter, cfg Config, logger echo.Logger) *importJobs {
+	return &importJobs{
+		db:       db,
+		importer: importer,
+		flickr:   &flickrClient{client: &http.Client{Timeout: cfg.FlickrTimeout}},
+		logger:   logger,
+		queue:    make(chan string, 100),
+	}
+}
+
+// enqueue schedules the job. When the queue is full the job is picked up on the next
+// restart or resume pass.
+func (j *importJobs) enqueue(id string) {
+	select {
+	case j.queue <- id:
+	default:
+		j.logger.Warnf("import queue is full, job %s will run later", id)
+	}
+}
+
+func (j *importJobs) run(ctx context.Context) {
+	resume := time.NewTicker(10 * time.Minute)
+	defer resume.Stop()
+
+	j.resume(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resume.C:
+			j.resume(ctx)
+		case id := <-j.queue:
+			j.process(ctx, id)
+		}
+	}
+}
+
+// resume queues jobs that didn't finish, e.g. because the server was restarted.
+func (j *importJobs) resume(ctx context.Context) {
+	cursor, err := j.db.Collection("imports").Find(ctx, bson.M{"status": bson.M{"$in": bson.A{ImportQueued, ImportRunning}}})
+	if err != nil {
+		j.logger.Error(err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var job ImportJob
+		if err := cursor.Decode(&job); err != nil {
+			j.logger.Error(err)
+			return
+		}
+
+		select {
+		case j.queue <- job.ID:
+		default:
+			return
+		}
+	}
+}
+
+func (j *importJobs) update(ctx context.Context, id string, set bson.M) error {
+	set["updatedAt"] = time.Now().UTC()
+	_, err := j.db.Collection("imports").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (j *importJobs) process(ctx context.Context, id string) {
+	var job ImportJob
+	if err := j.db.Collection("imports").FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		if err != mongo.ErrNoDocuments {
+			j.logger.Error(err)
+		}
+
+		return
+	}
+
+	if job.Status != ImportQueued && job.Status != ImportRunning {
+		return
+	}
+
+	if err := j.update(ctx, id, bson.M{"status": ImportRunning}); err != nil {
+		j.logger.Error(err)
+		return
+	}
+
+	importer := j.importer
+	if job.DryRun {
+		// Pending markers of an interrupted dry run are lost, so later pages may report
+		// fewer duplicates.
+		importer = importer.dryRun()
+	}
+
+	visibility := visibilityFor(User{ID: job.OwnerID}, true)
+	for job.Pages == 0 || job.Page < job.Pages {
+		page, err := j.flickr.photos(ctx, job.APIKey, job.FlickrUserID, job.Page+1)
+		if err != nil {
+			j.fail(ctx, id, err)
+			return
+		}
+
+		candidates := make([]Marker, 0, len(page.Photos))
+		for _, photo := range page.Photos {
+			candidates = append(candidates, flickrMarker(photo))
+		}
+
+		if err := importer.importMarkers(ctx, visibility, job.OwnerID, candidates, &job.Summary); err != nil {
+			j.fail(ctx, id, err)
+			return
+		}
+
+		job.Page, job.Pages, job.Total = job.Page+1, page.Pages, int(page.Total)
+		if err := j.update(ctx, id, bson.M{"page": job.Page, "pages": job.Pages, "total": job.Total, "summary": job.Summary}); err != nil {
+			j.logger.Error(err)
+			return
+		}
+
+		if job.Pages == 0 {
+			break
+		}
+	}
+
+	if err := j.update(ctx, id, bson.M{"status": ImportCompleted, "apiKey": ""}); err != nil {
+		j.logger.Error(err)
+	}
+}
+
+func (j *importJobs) fail(ctx context.Context, id string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	j.logger.Warnf("import job %s failed: %v", id, err)
+	if err := j.update(ctx, id, bson.M{"status": ImportFailed, "error": err.Error(), "apiKey": ""}); err != nil {
+		j.logger.Error(err)
+	}
+}
+
+// registerImportJobRoutes starts imports from photo services and reports their progress.
+func registerImportJobRoutes(group *echo.Group, db *mongo.Database, jobs *importJobs, cfg Config) {
+	group.POST("", func(c echo.Context) error {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		var body ImportJobRequest
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if body.APIKey == "" {
+			body.APIKey = cfg.FlickrAPIKey
+		}
+
+		if body.APIKey == "" {
+			s := "empty api key and no default key is configured"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		user, _ := currentUser(c)
+		now := time.Now().UTC()
+		job := ImportJob{
+			ID:           primitive.NewObjectID().Hex(),
+			OwnerID:      user.ID,
+			Source:       body.Source,
+			FlickrUserID: strings.TrimSpace(body.FlickrUserID),
+			APIKey:       body.APIKey,
+			Status:       ImportQueued,
+			DryRun:       dryRun,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+
+		if _, err := db.Collection("imports").InsertOne(c.Request().Context(), job); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		jobs.enqueue(job.ID)
+
+		c.Response().Header().Set(echo.HeaderLocation, "/api/v1/imports/"+job.ID)
+		return c.JSON(http.StatusAccepted, job)
+	})
+	group.GET("/:jobID", func(c echo.Context) error {
+		var job ImportJob
+		if err := db.Collection("imports").FindOne(c.Request().Context(), ownedDocument(c, c.Param("jobID"))).Decode(&job); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "import job not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, job)
+	})
+}
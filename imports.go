@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxImportMarkers = 10000
+	maxImportErrors  = 20
+
+	importDuplicateRadius     = 50.0
+	importDuplicateSimilarity = 0.8
+)
+
+// ImportSummary reports what happened to each imported entry.
+type ImportSummary struct {
+	DryRun        bool     `json:"dryRun,omitempty"`
+	Total         int      `json:"total"`
+	Created       int      `json:"created"`
+	Duplicates    int      `json:"duplicates"`
+	Invalid       int      `json:"invalid"`
+	QuotaExceeded int      `json:"quotaExceeded"`
+	Errors        []string `json:"errors,omitempty"`
+	// RolledBack is set for atomic imports that stored nothing because of failed entries.
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+func (s *ImportSummary) reject(format string, args ...interface{}) {
+	s.Invalid++
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// markerImporter creates markers from external sources, skipping entries that duplicate
+// markers the owner can already see.
+type markerImporter struct {
+	db        *mongo.Database
+	quotas    Quotas
+	geocoding *geocodingWorker
+
+	// dry importers keep the markers they would have created in pending instead.
+	dry     bool
+	pending []Marker
+
+	// deferred importers collect created markers in created instead of geocoding them,
+	// the import may still be rolled back.
+	deferred bool
+	created  []string
+}
+
+func newMarkerImporter(db *mongo.Database, quotas Quotas, geocoding *geocodingWorker) *markerImporter {
+	return &markerImporter{db: db, quotas: quotas, geocoding: geocoding}
+}
+
+// dryRun returns an importer that checks candidates like this one without storing them.
+func (i *markerImporter) dryRun() *markerImporter {
+	return &markerImporter{db: i.db, quotas: i.quotas, geocoding: i.geocoding, dry: true}
+}
+
+// duplicatesPending reports whether a dry importer would already have created a marker
+// the candidate duplicates.
+func (i *markerImporter) duplicatesPending(candidate Marker) bool {
+	for _, marker := range i.pending {
+		if len(candidate.Images) > 0 {
+			for _, image := range candidate.Images {
+				for _, other := range marker.Images {
+					if image.URI == other.URI {
+						return true
+					}
+				}
+			}
+
+			continue
+		}
+
+		if haversine(marker.Location, candidate.Location) <= importDuplicateRadius &&
+			nameSimilarity(marker.Name, candidate.Name) >= importDuplicateSimilarity {
+			return true
+		}
+	}
+
+	return false
+}
+
+// duplicate looks for a visible marker with the same images or, for candidates without
+// images, a marker with a similar name near the candidate.
+func (i *markerImporter) duplicate(ctx context.Context, visibility bson.M, candidate Marker) (bool, error) {
+	if i.duplicatesPending(candidate) {
+		return true, nil
+	}
+
+	if len(candidate.Images) > 0 {
+		uris := make([]string, 0, len(candidate.Images))
+		for _, image := range candidate.Images {
+			uris = append(uris, image.URI)
+		}
+
+		err := i.db.Collection("markers").FindOne(ctx, and(visibility, bson.M{"images.uri": bson.M{"$in": uris}}), options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	window := importDuplicateRadius / metersPerDegree
+	filter := and(visibility, bson.M{
+		"location.latitude":  bson.M{"$gte": candidate.Location.Latitude - window, "$lte": candidate.Location.Latitude + window},
+		"location.longitude": bson.M{"$gte": candidate.Location.Longitude - window, "$lte": candidate.Location.Longitude + window},
+	})
+
+	cursor, err := i.db.Collection("markers").Find(ctx, filter, options.Find().SetProjection(bson.M{"name": 1, "location": 1}))
+	if err != nil {
+		return false, err
+	}
+
+	var nearby []Marker
+	if err := cursor.All(context.Background(), &nearby); err != nil {
+		return false, err
+	}
+
+	for _, marker := range nearby {
+		if haversine(marker.Location, candidate.Location) <= importDuplicateRadius &&
+			nameSimilarity(marker.Name, candidate.Name) >= importDuplicateSimilarity {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// add validates and stores a single candidate, updating the summary and usage.
+// Visibility restricts which existing markers count as duplicates.
+func (i *markerImporter) add(ctx context.Context, visibility bson.M, ownerID string, candidate Marker, summary *ImportSummary, usage *Usage) error {
+	summary.Total++
+
+	candidate.ID = primitive.NewObjectID().Hex()
+	if err := candidate.Validate(); err != nil {
+		summary.reject("%q: %v", candidate.Name, err)
+		return nil
+	}
+
+	duplicate, err := i.duplicate(ctx, visibility, candidate)
+	if err != nil {
+		return err
+	}
+
+	if duplicate {
+		summary.Duplicates++
+		return nil
+	}
+
+	next := usage.add(markerUsage(candidate))
+	if err := i.quotas.check(next); err != nil {
+		summary.QuotaExceeded++
+		return nil
+	}
+
+	marker := candidate.Normalize().created(ownerID)
+	if i.dry {
+		i.pending = append(i.pending, marker)
+	} else {
+		if err := insertMarker(ctx, i.db, marker); err != nil {
+			return err
+		}
+
+		if i.deferred {
+			i.created = append(i.created, marker.ID)
+		} else {
+			i.geocoding.enqueue(marker.ID)
+		}
+	}
+
+	*usage = next
+	summary.Created++
+
+	return nil
+}
+
+// importMarkers stores all candidates and stops only on database errors. Results are
+// added to the summary so batches of a long import can share one.
+func (i *markerImporter) importMarkers(ctx context.Context, visibility bson.M, ownerID string, candidates []Marker, summary *ImportSummary) error {
+	usage, err := userUsage(ctx, i.db, ownerID, "")
+	if err != nil {
+		return err
+	}
+
+	for _, marker := range i.pending {
+		usage = usage.add(markerUsage(marker))
+	}
+
+	for _, candidate := range candidates {
+		if err := i.add(ctx, visibility, ownerID, candidate, summary, &usage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importAtomically stores all candidates or none of them, invalid entries and exceeded
+// quotas roll the import back. It needs transactions and fails with errNoTransactions
+// without them.
+func (i *markerImporter) importAtomically(ctx context.Context, visibility bson.M, ownerID string, candidates []Marker, summary *ImportSummary) error {
+	run := &markerImporter{db: i.db, quotas: i.quotas, geocoding: i.geocoding, deferred: true}
+	start := *summary
+
+	err := inRequiredTransaction(ctx, i.db, func(ctx context.Context) error {
+		// Retried transactions start over.
+		*summary, run.created = start, nil
+		if err := run.importMarkers(ctx, visibility, ownerID, candidates, summary); err != nil {
+			return err
+		}
+
+		if summary.Invalid > 0 || summary.QuotaExceeded > 0 {
+			return errRolledBack
+		}
+
+		return nil
+	})
+	if errors.Is(err, errRolledBack) {
+		summary.Created, summary.RolledBack = 0, true
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range run.created {
+		i.geocoding.enqueue(id)
+	}
+
+	return nil
+}
+
+// takeoutExport covers the Google Takeout files with places: Saved Places from Google
+// Maps (a GeoJSON feature collection) and Semantic Location History (timeline objects).
+type takeoutExport struct {
+	Features []struct {
+		Geometry struct {
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties struct {
+			Title    string `json:"Title"`
+			Comment  string `json:"Comment"`
+			Location struct {
+				Name    string `json:"name"`
+				Address string `json:"address"`
+			} `json:"location"`
+			// Older exports use capitalized keys.
+			LocationOld struct {
+				BusinessName string `json:"Business Name"`
+				Address      string `json:"Address"`
+			} `json:"Location"`
+		} `json:"properties"`
+	} `json:"features"`
+	TimelineObjects []struct {
+		PlaceVisit *struct {
+			Location struct {
+				LatitudeE7  int64  `json:"latitudeE7"`
+				LongitudeE7 int64  `json:"longitudeE7"`
+				Name        string `json:"name"`
+				Address     string `json:"address"`
+			} `json:"location"`
+		} `json:"placeVisit"`
+	} `json:"timelineObjects"`
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// parseTakeout converts a Google Takeout export to candidate markers.
+func parseTakeout(r io.Reader) ([]Marker, error) {
+	var export takeoutExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("invalid takeout file: %w", err)
+	}
+
+	var markers []Marker
+	for _, feature := range export.Features {
+		p := feature.Properties
+
+		// Places saved without coordinates are exported at 0,0.
+		coords := feature.Geometry.Coordinates
+		if len(coords) < 2 || coords[0] == 0 && coords[1] == 0 {
+			continue
+		}
+
+		address := firstNonEmpty(p.Location.Address, p.LocationOld.Address)
+		markers = append(markers, Marker{
+			Name:        firstNonEmpty(p.Title, p.Location.Name, p.LocationOld.BusinessName, address),
+			Location:    Coords{Latitude: coords[1], Longitude: coords[0]},
+			Description: firstNonEmpty(p.Comment, address),
+		})
+	}
+
+	// The timeline lists every visit, repeated visits of a place are dropped as duplicates.
+	for _, object := range export.TimelineObjects {
+		if object.PlaceVisit == nil {
+			continue
+		}
+
+		l := object.PlaceVisit.Location
+		markers = append(markers, Marker{
+			Name:        firstNonEmpty(l.Name, l.Address),
+			Location:    Coords{Latitude: float64(l.LatitudeE7) / 1e7, Longitude: float64(l.LongitudeE7) / 1e7},
+			Description: l.Address,
+		})
+	}
+
+	if len(markers) > maxImportMarkers {
+		return nil, fmt.Errorf("too many places, at most %d can be imported at once", maxImportMarkers)
+	}
+
+	return markers, nil
+}
+
+var errUnsupportedImportFormat = errors.New("unsupported import format, expected google-takeout")
+
+func registerImportRoutes(group *echo.Group, importer *markerImporter) {
+	group.POST("", func(c echo.Context) error {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		var candidates []Marker
+		switch c.QueryParam("format") {
+		case "google-takeout":
+			candidates, err = parseTakeout(c.Request().Body)
+		default:
+			err = errUnsupportedImportFormat
+		}
+
+		if err != nil {
+			return bindFailed(c, err)
+		}
+
+		atomic, err := parseAtomic(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		summary := ImportSummary{DryRun: dryRun}
+		ctx := c.Request().Context()
+
+		switch {
+		case dryRun:
+			err = importer.dryRun().importMarkers(ctx, visibilityFilter(c), user.ID, candidates, &summary)
+		case atomic:
+			err = importer.importAtomically(ctx, visibilityFilter(c), user.ID, candidates, &summary)
+		default:
+			err = importer.importMarkers(ctx, visibilityFilter(c), user.ID, candidates, &summary)
+		}
+
+		if errors.Is(err, errNoTransactions) {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusNotImplemented, ErrorString{"atomic imports need a replica set or a sharded cluster"})
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if summary.RolledBack {
+			return c.JSON(http.StatusUnprocessableEntity, summary)
+		}
+
+		return c.JSON(http.StatusOK, summary)
+	})
+}
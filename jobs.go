@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// jobLease is how long a replica holds the lock of a job without renewing it. A
+	// replica that dies mid-run gives the job up after the lease.
+	jobLease = 5 * time.Minute
+	// jobPollInterval bounds how long a replica waits before looking at a job again, so
+	// runs triggered by admins or taken over from other replicas are noticed.
+	jobPollInterval = 15 * time.Second
+)
+
+// schedule returns the first time after t a job is due.
+type schedule interface {
+	next(t time.Time) time.Time
+	String() string
+}
+
+// every runs a job at a fixed interval after the previous run finished.
+type every time.Duration
+
+func (e every) next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e every) String() string {
+	return "@every " + time.Duration(e).String()
+}
+
+// cronSchedule is a five field cron expression, evaluated in UTC.
+type cronSchedule struct {
+	spec                             string
+	minutes, hours, days, months, wd []bool
+	// anyDay and anyWeekday record unrestricted fields, cron matches either of the day
+	// fields when both are restricted.
+	anyDay, anyWeekday bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseSchedule reads "@every <duration>", one of @hourly, @daily, @weekly and @monthly
+// or a cron expression with minute, hour, day of month, month and day of week fields.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if v := strings.TrimPrefix(spec, "@every "); v != spec {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be positive", spec)
+		}
+
+		return every(d), nil
+	}
+
+	expr := spec
+	if macro, ok := cronMacros[spec]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", spec)
+	}
+
+	s := &cronSchedule{spec: spec}
+	for i, f := range []struct {
+		set      *[]bool
+		min, max int
+	}{
+		{&s.minutes, 0, 59},
+		{&s.hours, 0, 23},
+		{&s.days, 1, 31},
+		{&s.months, 1, 12},
+		{&s.wd, 0, 7},
+	} {
+		set, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+
+		*f.set = set
+	}
+
+	// Both 0 and 7 are Sunday.
+	s.wd[0] = s.wd[0] || s.wd[7]
+	s.anyDay = fields[2] == "*"
+	s.anyWeekday = fields[4] == "*"
+
+	if s.next(time.Now().UTC()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never due", spec)
+	}
+
+	return s, nil
+}
+
+// parseCronField reads a comma-separated list of *, values and ranges, each optionally
+// followed by a step, e.g. "*/15" or "1-5,10".
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+
+			rng, step = item[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", item)
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+
+	return set, nil
+}
+
+// next returns the first matching minute after t, zero if there's none within 5 years,
+// e.g. for February 30th.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !s.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !s.hours[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.wd[t.Weekday()]
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func (s *cronSchedule) String() string {
+	return s.spec
+}
+
+// JobStatus is the state of a background job shared by all replicas.
+type JobStatus struct {
+	Name     string `json:"name" bson:"_id"`
+	Schedule string `json:"schedule" bson:"-"`
+	// Running is set while a replica holds the lock of the job.
+	Running        bool       `json:"running" bson:"-"`
+	LockedBy       string     `json:"lockedBy,omitempty" bson:"lockedBy,omitempty"`
+	LockedUntil    *time.Time `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	NextRunAt      time.Time  `json:"nextRunAt" bson:"nextRunAt"`
+	LastStartedAt  *time.Time `json:"lastStartedAt,omitempty" bson:"lastStartedAt,omitempty"`
+	LastFinishedAt *time.Time `json:"lastFinishedAt,omitempty" bson:"lastFinishedAt,omitempty"`
+	LastDuration   string     `json:"lastDuration,omitempty" bson:"lastDuration,omitempty"`
+	LastError      string     `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Runs           int64      `json:"runs" bson:"runs"`
+	Failures       int64      `json:"failures" bson:"failures"`
+}
+
+type job struct {
+	name     string
+	schedule schedule
+	run      func(ctx context.Context) error
+}
+
+// jobScheduler runs periodic background jobs. Each job runs on one replica at a time:
+// a replica takes the job's lock in the jobs collection, renews it while the job runs
+// and stores when the job is due next.
+type jobScheduler struct {
+	db     *mongo.Database
+	logger echo.Logger
+	// instance identifies the replica holding a lock.
+	instance  string
+	overrides map[string]string
+	jobs      []*job
+}
+
+// newJobScheduler returns a scheduler using the schedules of JOB_SCHEDULES over the
+// defaults jobs are added with.
+func newJobScheduler(db *mongo.Database, cfg Config, logger echo.Logger) *jobScheduler {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "server"
+	}
+
+	return &jobScheduler{
+		db:        db,
+		logger:    logger,
+		instance:  host + "-" + primitive.NewObjectID().Hex(),
+		overrides: cfg.JobSchedules,
+	}
+}
+
+// add registers a job, it must be called before start.
+func (s *jobScheduler) add(name string, fallback schedule, run func(ctx context.Context) error) {
+	sched := fallback
+	if spec, ok := s.overrides[name]; ok {
+		// JOB_SCHEDULES is validated by LoadConfig.
+		sched, _ = parseSchedule(spec)
+	}
+
+	s.jobs = append(s.jobs, &job{name: name, schedule: sched, run: run})
+}
+
+// start runs the jobs until the context is cancelled. Schedules of unknown jobs are
+// rejected, they're most likely typos.
+func (s *jobScheduler) start(ctx context.Context) error {
+	for name := range s.overrides {
+		if s.find(name) == nil {
+			return fmt.Errorf("JOB_SCHEDULES: unknown job %q", name)
+		}
+	}
+
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+
+	return nil
+}
+
+func (s *jobScheduler) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+
+	return nil
+}
+
+func (s *jobScheduler) loop(ctx context.Context, j *job) {
+	// Jobs with an interval run on startup like they did before they had a schedule, a
+	// schedule changed to an earlier time takes effect right away.
+	first := time.Now().UTC()
+	if _, ok := j.schedule.(every); !ok {
+		first = j.schedule.next(first)
+	}
+
+	for {
+		if _, err := s.db.Collection("jobs").UpdateOne(ctx,
+			bson.M{"_id": j.name},
+			bson.M{"$min": bson.M{"nextRunAt": first}, "$setOnInsert": bson.M{"runs": 0, "failures": 0}},
+			options.Update().SetUpsert(true),
+		); err == nil || mongo.IsDuplicateKeyError(err) {
+			break
+		} else if ctx.Err() == nil {
+			s.logger.Error(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+
+	for {
+		wait, err := s.tick(ctx, j)
+		if err != nil && ctx.Err() == nil {
+			s.logger.Errorf("job %s: %v", j.name, err)
+			wait = jobPollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tick runs the job if it's due and no other replica holds it, and returns how long to
+// wait before looking at it again.
+func (s *jobScheduler) tick(ctx context.Context, j *job) (time.Duration, error) {
+	now := time.Now().UTC()
+
+	res, err := s.db.Collection("jobs").UpdateOne(ctx,
+		bson.M{
+			"_id":       j.name,
+			"nextRunAt": bson.M{"$lte": now},
+			"$or":       bson.A{bson.M{"lockedUntil": bson.M{"$exists": false}}, bson.M{"lockedUntil": bson.M{"$lte": now}}},
+		},
+		bson.M{"$set": bson.M{"lockedBy": s.instance, "lockedUntil": now.Add(jobLease), "lastStartedAt": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.ModifiedCount == 0 {
+		var status JobStatus
+		if err := s.db.Collection("jobs").FindOne(ctx, bson.M{"_id": j.name}).Decode(&status); err != nil {
+			return 0, err
+		}
+
+		wait := time.Until(status.NextRunAt)
+		if status.LockedUntil != nil && status.LockedUntil.After(now) || wait > jobPollInterval {
+			wait = jobPollInterval
+		}
+
+		return wait, nil
+	}
+
+	runErr := s.execute(ctx, j)
+	finished := time.Now().UTC()
+
+	set := bson.M{
+		"nextRunAt":      j.schedule.next(finished),
+		"lastFinishedAt": finished,
+		"lastDuration":   finished.Sub(now).Round(time.Millisecond).String(),
+		"lastError":      "",
+	}
+	inc := bson.M{"runs": 1}
+	if runErr != nil {
+		s.logger.Errorf("job %s: %v", j.name, runErr)
+		set["lastError"] = runErr.Error()
+		inc["failures"] = 1
+	}
+
+	// The context may be cancelled by now, the lock is released anyway so another
+	// replica doesn't wait for the lease.
+	if _, err := s.db.Collection("jobs").UpdateOne(context.Background(),
+		bson.M{"_id": j.name, "lockedBy": s.instance},
+		bson.M{"$set": set, "$inc": inc, "$unset": bson.M{"lockedBy": "", "lockedUntil": ""}},
+	); err != nil {
+		return 0, err
+	}
+
+	return time.Until(j.schedule.next(finished)), nil
+}
+
+// execute runs the job while renewing its lock. The job is cancelled if the lock is lost,
+// e.g. because the database was unreachable for longer than the lease.
+func (s *jobScheduler) execute(ctx context.Context, j *job) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(jobLease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			res, err := s.db.Collection("jobs").UpdateOne(ctx,
+				bson.M{"_id": j.name, "lockedBy": s.instance},
+				bson.M{"$set": bson.M{"lockedUntil": time.Now().UTC().Add(jobLease)}},
+			)
+			if err != nil {
+				s.logger.Error(err)
+				continue
+			}
+
+			if res.MatchedCount == 0 {
+				s.logger.Errorf("job %s: lost the lock, cancelling", j.name)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return j.run(ctx)
+}
+
+// status returns the state of the jobs in the order they were added.
+func (s *jobScheduler) status(ctx context.Context) ([]JobStatus, error) {
+	cursor, err := s.db.Collection("jobs").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []JobStatus
+	if err := cursor.All(context.Background(), &stored); err != nil {
+		return nil, err
+	}
+
+	byName := map[string]JobStatus{}
+	for _, status := range stored {
+		byName[status.Name] = status
+	}
+
+	now := time.Now().UTC()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status, ok := byName[j.name]
+		if !ok {
+			status = JobStatus{Name: j.name}
+		}
+
+		status.Schedule = j.schedule.String()
+		status.Running = status.LockedUntil != nil && status.LockedUntil.After(now)
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// registerJobRoutes lets admins see background jobs and run them ahead of their schedule.
+func registerJobRoutes(group *echo.Group, scheduler *jobScheduler) {
+	group.GET("/jobs", func(c echo.Context) error {
+		statuses, err := scheduler.status(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, statuses)
+	})
+	group.POST("/jobs/:name/run", func(c echo.Context) error {
+		name := c.Param("name")
+		if scheduler.find(name) == nil {
+			s := fmt.Sprintf("unknown job %s", name)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		// A running job isn't interrupted, it runs again once it's done.
+		var status JobStatus
+		err := scheduler.db.Collection("jobs").FindOneAndUpdate(c.Request().Context(),
+			bson.M{"_id": name},
+			bson.M{"$set": bson.M{"nextRunAt": time.Now().UTC()}},
+		).Decode(&status)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			s := fmt.Sprintf("job %s hasn't started yet", name)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusConflict, ErrorString{s})
+		}
+
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		admin, _ := currentUser(c)
+		if err := recordAudit(c.Request().Context(), scheduler.db, admin.ID, "job.run", nil, bson.M{"job": name}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxAcceptedLanguages ignores the tail of overly long Accept-Language headers.
+const maxAcceptedLanguages = 10
+
+// languagePattern matches BCP 47 language tags such as en, de-CH or zh-Hant.
+var languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// acceptedLanguages returns the languages of the Accept-Language header, preferred ones
+// first. The wildcard and languages with a quality of 0 are left out.
+func acceptedLanguages(c echo.Context) []string {
+	header := c.Request().Header.Get("Accept-Language")
+	if header == "" {
+		return nil
+	}
+
+	type accepted struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []accepted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !languagePattern.MatchString(tag) {
+			continue
+		}
+
+		quality := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if quality, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+
+		if quality > 0 {
+			languages = append(languages, accepted{tag, quality})
+		}
+
+		if len(languages) == maxAcceptedLanguages {
+			break
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+
+	tags := make([]string, 0, len(languages))
+	for _, l := range languages {
+		tags = append(tags, l.tag)
+	}
+
+	return tags
+}
+
+// localizedName picks the name of the marker in the first of the languages it has one
+// in. A name in de also serves de-CH and the other way around. Markers without a name in
+// any of the languages keep their primary name.
+func localizedName(m Marker, languages []string) string {
+	if len(m.Names) == 0 {
+		return m.Name
+	}
+
+	tags := nameLanguages(m)
+	for _, language := range languages {
+		base, _, _ := strings.Cut(language, "-")
+		fallback := ""
+		for _, tag := range tags {
+			if strings.EqualFold(tag, language) {
+				return m.Names[tag]
+			}
+
+			if tagBase, _, _ := strings.Cut(tag, "-"); fallback == "" && strings.EqualFold(tagBase, base) {
+				fallback = m.Names[tag]
+			}
+		}
+
+		if fallback != "" {
+			return fallback
+		}
+	}
+
+	return m.Name
+}
+
+// nameLanguages returns the languages the marker has names in, sorted.
+func nameLanguages(m Marker) []string {
+	tags := make([]string, 0, len(m.Names))
+	for tag := range m.Names {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// localNames returns the localized names of the marker for the text index, which can't
+// index the values of a map.
+func localNames(m Marker) []string {
+	names := make([]string, 0, len(m.Names))
+	for _, name := range m.Names {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Like records that a user liked a marker. The unique index on (markerId, userId)
+// makes liking idempotent, and the marker's likeCount only changes when a like is
+// actually added or removed, in the same transaction.
+type Like struct {
+	MarkerID  string    `bson:"markerId"`
+	UserID    string    `bson:"userId"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// errLikedMarkerGone is returned when the marker went away while it was liked.
+var errLikedMarkerGone = errors.New("marker not found")
+
+func registerLikeRoutes(group *echo.Group, db *mongo.Database) {
+	group.POST("/:id/like", func(c echo.Context) error {
+		id := c.Param("id")
+		visible, err := markerVisible(c, db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		user, _ := currentUser(c)
+		like := Like{MarkerID: id, UserID: user.ID, CreatedAt: time.Now().UTC()}
+		err = inTransaction(c.Request().Context(), db, func(ctx context.Context) error {
+			if _, err := db.Collection("likes").InsertOne(ctx, like); err != nil {
+				return err
+			}
+
+			res, err := db.Collection("markers").UpdateOne(ctx, visibleMarker(c, id), bson.M{"$inc": bson.M{"likeCount": 1}})
+			if err != nil {
+				return err
+			}
+
+			if res.MatchedCount == 0 {
+				// Removed explicitly as standalone servers have no transaction to roll back.
+				if _, err := db.Collection("likes").DeleteOne(ctx, bson.M{"markerId": id, "userId": user.ID}); err != nil {
+					return err
+				}
+
+				return errLikedMarkerGone
+			}
+
+			return nil
+		})
+
+		var mongoErr mongo.WriteException
+		switch {
+		case errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000):
+			return c.NoContent(http.StatusOK)
+		case errors.Is(err, errLikedMarkerGone):
+			c.Logger().Info(err)
+			return c.JSON(http.StatusNotFound, Error{err})
+		case err != nil:
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusCreated)
+	}, requireUser())
+	group.DELETE("/:id/like", func(c echo.Context) error {
+		id := c.Param("id")
+		user, _ := currentUser(c)
+		err := inTransaction(c.Request().Context(), db, func(ctx context.Context) error {
+			res, err := db.Collection("likes").DeleteOne(ctx, bson.M{"markerId": id, "userId": user.ID})
+			if err != nil || res.DeletedCount == 0 {
+				return err
+			}
+
+			_, err = db.Collection("markers").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"likeCount": -1}})
+			return err
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+}
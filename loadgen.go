@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// loadgenTag marks generated markers, so traffic can pick them and they're easy to
+// delete again.
+const loadgenTag = "loadgen"
+
+// loadgenCities are the centers generated markers cluster around, most markers of real
+// maps are in and around cities.
+var loadgenCities = []Coords{
+	{Latitude: 40.7128, Longitude: -74.0060},  // New York
+	{Latitude: 34.0522, Longitude: -118.2437}, // Los Angeles
+	{Latitude: 19.4326, Longitude: -99.1332},  // Mexico City
+	{Latitude: -23.5505, Longitude: -46.6333}, // São Paulo
+	{Latitude: -34.6037, Longitude: -58.3816}, // Buenos Aires
+	{Latitude: 51.5074, Longitude: -0.1278},   // London
+	{Latitude: 48.8566, Longitude: 2.3522},    // Paris
+	{Latitude: 52.5200, Longitude: 13.4050},   // Berlin
+	{Latitude: 41.9028, Longitude: 12.4964},   // Rome
+	{Latitude: 55.7558, Longitude: 37.6173},   // Moscow
+	{Latitude: 41.0082, Longitude: 28.9784},   // Istanbul
+	{Latitude: 30.0444, Longitude: 31.2357},   // Cairo
+	{Latitude: -1.2921, Longitude: 36.8219},   // Nairobi
+	{Latitude: -33.9249, Longitude: 18.4241},  // Cape Town
+	{Latitude: 25.2048, Longitude: 55.2708},   // Dubai
+	{Latitude: 19.0760, Longitude: 72.8777},   // Mumbai
+	{Latitude: 13.7563, Longitude: 100.5018},  // Bangkok
+	{Latitude: 1.3521, Longitude: 103.8198},   // Singapore
+	{Latitude: 39.9042, Longitude: 116.4074},  // Beijing
+	{Latitude: 35.6762, Longitude: 139.6503},  // Tokyo
+	{Latitude: 37.5665, Longitude: 126.9780},  // Seoul
+	{Latitude: -33.8688, Longitude: 151.2093}, // Sydney
+}
+
+var (
+	loadgenAdjectives = []string{"Old", "Quiet", "Hidden", "Sunny", "Misty", "Grand", "Little", "Golden", "Green", "Windy", "Northern", "Silent"}
+	loadgenNouns      = []string{"Harbor", "Bridge", "Tower", "Garden", "Market", "Square", "Viewpoint", "Chapel", "Fountain", "Alley", "Park", "Pier"}
+	loadgenTags       = []string{"architecture", "nature", "food", "street", "sunset", "history", "art", "water", "night", "people"}
+	loadgenIcons      = []string{"pin", "camera", "landmark", "building", "food", "cafe", "park", "museum", "viewpoint"}
+)
+
+// loadgenMarker generates a marker near a random city. Most markers are within a few
+// kilometers of the center, some are out in the countryside.
+func loadgenMarker(rng *rand.Rand) Marker {
+	city := loadgenCities[rng.Intn(len(loadgenCities))]
+	spread := 0.03 * (1 + rng.ExpFloat64())
+	location := Coords{
+		Latitude:  math.Max(-90, math.Min(90, city.Latitude+rng.NormFloat64()*spread)),
+		Longitude: math.Max(-180, math.Min(180, city.Longitude+rng.NormFloat64()*spread)),
+	}
+
+	id := fmt.Sprintf("%08x%08x%08x", rng.Uint32(), rng.Uint32(), rng.Uint32())
+	tags := []string{loadgenTag}
+	for i := rng.Intn(4); i > 0; i-- {
+		tags = append(tags, loadgenTags[rng.Intn(len(loadgenTags))])
+	}
+
+	images := make([]Image, rng.Intn(5))
+	for i := range images {
+		width, height := 4032, 3024
+		if rng.Intn(3) == 0 {
+			width, height = height, width
+		}
+
+		images[i] = Image{
+			ID:       fmt.Sprintf("%s-%d", id, i),
+			URI:      fmt.Sprintf("https://images.example.com/loadgen/%s/%d.jpg", id, i),
+			Width:    width,
+			Height:   height,
+			Size:     1<<20 + rng.Int63n(4<<20),
+			Position: i,
+		}
+	}
+
+	createdAt := time.Now().UTC().Add(-time.Duration(rng.Int63n(int64(365 * 24 * time.Hour)))).Truncate(time.Millisecond)
+	return Marker{
+		ID:          id,
+		Name:        loadgenAdjectives[rng.Intn(len(loadgenAdjectives))] + " " + loadgenNouns[rng.Intn(len(loadgenNouns))],
+		Location:    location,
+		Images:      images,
+		Tags:        tags,
+		Description: "Generated by loadgen.",
+		Icon:        loadgenIcons[rng.Intn(len(loadgenIcons))],
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+	}
+}
+
+// loadgenBBox returns a bbox parameter of a map view of a random city, zoomed in to
+// somewhere between the neighbourhood and the region around it.
+func loadgenBBox(rng *rand.Rand) string {
+	city := loadgenCities[rng.Intn(len(loadgenCities))]
+	size := 0.01 * math.Pow(2, float64(rng.Intn(6)))
+	return fmt.Sprintf("%f,%f,%f,%f", city.Longitude-size, city.Latitude-size/2, city.Longitude+size, city.Latitude+size/2)
+}
+
+// loadgenOps are the requests of replayed traffic by name. ids are generated markers
+// already in the database.
+var loadgenOps = map[string]func(rng *rand.Rand, base string, ids []string) (*http.Request, error){
+	"list": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, base+"/api/v1/markers/?bbox="+loadgenBBox(rng), nil)
+	},
+	"clusters": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, base+"/api/v1/markers/clusters?bbox="+loadgenBBox(rng), nil)
+	},
+	"nearest": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		city := loadgenCities[rng.Intn(len(loadgenCities))]
+		return http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/markers/nearest?lat=%f&lon=%f", base, city.Latitude+rng.NormFloat64()*0.05, city.Longitude+rng.NormFloat64()*0.05), nil)
+	},
+	"search": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, base+"/api/v1/markers/search?q="+strings.ToLower(loadgenNouns[rng.Intn(len(loadgenNouns))]), nil)
+	},
+	"get": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, base+"/api/v1/markers/"+ids[rng.Intn(len(ids))], nil)
+	},
+	"changes": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/markers/changes?since=%d&limit=100", base, rng.Intn(len(ids)+1)), nil)
+	},
+	"create": func(rng *rand.Rand, base string, ids []string) (*http.Request, error) {
+		marker := loadgenMarker(rng)
+		marker.CreatedAt, marker.UpdatedAt = time.Time{}, time.Time{}
+
+		body, err := json.Marshal(marker)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, base+"/api/v1/markers/", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		return req, nil
+	},
+}
+
+// parseMix reads name=weight pairs of loadgenOps, such as list=60,create=5.
+func parseMix(param string) (names []string, weights []int, err error) {
+	for _, pair := range strings.Split(param, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid -mix entry %q, expected name=weight", pair)
+		}
+
+		if _, ok := loadgenOps[name]; !ok {
+			return nil, nil, fmt.Errorf("unknown -mix request %q", name)
+		}
+
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, nil, fmt.Errorf("invalid -mix weight of %s, expected a non-negative number", name)
+		}
+
+		if w > 0 {
+			names, weights = append(names, name), append(weights, w)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("-mix has no requests")
+	}
+
+	return names, weights, nil
+}
+
+// loadgenResult collects the latencies of a request of the mix.
+type loadgenResult struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// percentile returns the latency at or below which the share p of the sorted latencies are.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+// generateMarkers inserts n markers like the server creates them, in batches reporting
+// progress. Markers with the ids of an earlier run with the same seed are duplicates.
+func generateMarkers(ctx context.Context, db *mongo.Database, rng *rand.Rand, n int, owner string) (ImportSummary, error) {
+	var total ImportSummary
+	for done := 0; done < n; {
+		batch := make([]Marker, 0, 1000)
+		for ; len(batch) < cap(batch) && done < n; done++ {
+			batch = append(batch, loadgenMarker(rng))
+		}
+
+		summary, err := restoreMarkers(ctx, db, batch, owner)
+		total.Total += summary.Total
+		total.Created += summary.Created
+		total.Duplicates += summary.Duplicates
+		total.Invalid += summary.Invalid
+		total.Errors = append(total.Errors, summary.Errors...)
+		if err != nil {
+			return total, err
+		}
+
+		fmt.Fprintf(os.Stderr, "generated %d of %d markers\n", done, n)
+	}
+
+	return total, nil
+}
+
+// replayTraffic sends the mix of requests to the server with concurrent workers until
+// the duration is over.
+func replayTraffic(base, token string, names []string, weights []int, ids []string, seed int64, concurrency int, duration time.Duration) map[string]*loadgenResult {
+	client := &http.Client{Timeout: 30 * time.Second}
+	results := map[string]*loadgenResult{}
+	for _, name := range names {
+		results[name] = &loadgenResult{}
+	}
+
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(duration)
+
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+
+			for time.Now().Before(deadline) {
+				pick := rng.Intn(sum)
+				name := names[0]
+				for i, w := range weights {
+					if pick < w {
+						name = names[i]
+						break
+					}
+
+					pick -= w
+				}
+
+				failed := false
+				start := time.Now()
+				req, err := loadgenOps[name](rng, base, ids)
+				if err == nil {
+					if token != "" {
+						req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+					}
+
+					var res *http.Response
+					if res, err = client.Do(req); err == nil {
+						_, _ = io.Copy(io.Discard, res.Body)
+						res.Body.Close()
+						failed = res.StatusCode >= http.StatusBadRequest
+					}
+				}
+				latency := time.Since(start)
+
+				mu.Lock()
+				result := results[name]
+				if err != nil || failed {
+					result.errors++
+				} else {
+					result.latencies = append(result.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}(rand.New(rand.NewSource(seed + int64(worker) + 1)))
+	}
+
+	wg.Wait()
+	return results
+}
+
+func loadgenCommand(flags *flag.FlagSet) func(Config, *mongo.Client, *mongo.Database) error {
+	markers := flags.Int("markers", 0, "number of markers to generate, clustered around cities")
+	seed := flags.Int64("seed", 1, "seed of the random generator, the same seed generates the same markers")
+	owner := flags.String("owner", "", "owner of the generated markers, anonymous if empty")
+	target := flags.String("target", "", "base URL of the server to replay traffic against, no traffic if empty")
+	token := flags.String("token", "", "bearer token sent with the replayed requests")
+	mix := flags.String("mix", "list=40,clusters=10,nearest=15,get=15,search=10,changes=5,create=5", "requests to replay as name=weight pairs")
+	concurrency := flags.Int("concurrency", 8, "number of concurrent requests")
+	duration := flags.Duration("duration", 30*time.Second, "how long to replay traffic")
+
+	return func(cfg Config, client *mongo.Client, db *mongo.Database) error {
+		names, weights, err := parseMix(*mix)
+		if err != nil {
+			return err
+		}
+
+		if *markers < 0 || *concurrency < 1 || *duration <= 0 {
+			return fmt.Errorf("-markers must not be negative, -concurrency and -duration must be positive")
+		}
+
+		ctx := context.Background()
+		if *markers > 0 {
+			summary, err := generateMarkers(ctx, db, rand.New(rand.NewSource(*seed)), *markers, *owner)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "%d markers: %d created, %d duplicates, %d invalid\n", summary.Total, summary.Created, summary.Duplicates, summary.Invalid)
+		}
+
+		if *target == "" {
+			return nil
+		}
+
+		cursor, err := db.Collection("markers").Find(ctx, bson.M{"tags": loadgenTag}, options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(10000))
+		if err != nil {
+			return err
+		}
+
+		var generated []Marker
+		if err := cursor.All(context.Background(), &generated); err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(generated))
+		for _, marker := range generated {
+			ids = append(ids, marker.ID)
+		}
+
+		if len(ids) == 0 {
+			for _, name := range names {
+				if name == "get" {
+					return fmt.Errorf("no generated markers to get, run with -markers first")
+				}
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "replaying traffic against %s for %s\n", *target, *duration)
+		results := replayTraffic(strings.TrimSuffix(*target, "/"), *token, names, weights, ids, *seed, *concurrency, *duration)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "request\trequests\terrors\tp50\tp90\tp99\tmax\trps\t")
+		sort.Strings(names)
+		for _, name := range names {
+			result := results[name]
+			sorted := result.latencies
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			requests := len(sorted) + result.errors
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%.1f\t\n", name, requests, result.errors,
+				percentile(sorted, 0.5).Round(time.Microsecond),
+				percentile(sorted, 0.9).Round(time.Microsecond),
+				percentile(sorted, 0.99).Round(time.Microsecond),
+				percentile(sorted, 1).Round(time.Microsecond),
+				float64(requests)/duration.Seconds())
+		}
+
+		return w.Flush()
+	}
+}
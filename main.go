@@ -2,40 +2,406 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/quic-go/quic-go/http3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
 )
 
 func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		echo.New().Logger.Fatal(err)
+	}
+}
+
+// serve runs the HTTP server until it fails.
+func serve(cfg Config, client *mongo.Client, db *mongo.Database) error {
+	limits := newRateLimits(cfg.RateLimits)
+	flags := newFeatureFlags(db, cfg)
+
+	e, err := newServer(context.Background(), cfg, db, limits, flags, Tenant{})
+	if err != nil {
+		return err
+	}
+
+	// Collections exist once the server is set up.
+	if err := limits.load(context.Background(), db); err != nil {
+		return fmt.Errorf("can't load rate limit plans: %w", err)
+	}
+	go limits.watch(context.Background(), db, e.Logger)
+
+	if cfg.SeedData {
+		markers, err := demoMarkers()
+		if err != nil {
+			return err
+		}
+
+		summary, seeded, err := seedMarkers(context.Background(), db, markers)
+		if err != nil {
+			return fmt.Errorf("can't seed demo data: %w", err)
+		}
+
+		if seeded {
+			e.Logger.Infof("seeded %d demo markers", summary.Created)
+		}
+	}
+
+	registerRateLimitRoutes(e.Group("/api/v1/admin/rate-limits",
+		requireRole(RoleAdmin),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	), db, limits)
+
+	registerFeatureAdminRoutes(e.Group("/api/v1/admin/features",
+		requireRole(RoleAdmin),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	), db, flags)
+
+	var handler http.Handler = e
+	if cfg.MultiTenancy {
+		tenants := newTenancy(cfg, client, db, e, limits, flags)
+		registerTenantRoutes(e.Group("/api/v1/tenants",
+			requireRole(RoleAdmin),
+			middleware.BodyLimit(cfg.JSONBodyLimit),
+		), tenants)
+		handler = tenants
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	if err := configureHTTP2(server, cfg); err != nil {
+		return err
+	}
+
+	if cfg.HTTP3 {
+		return serveHTTP3(server, cfg)
+	}
+
+	if cfg.TLSCertFile != "" {
+		return server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+
+	return server.ListenAndServe()
+}
+
+// serveHTTP3 serves HTTP/3 over QUIC on the UDP port of the TLS listener next to it.
+// Responses over TCP announce it with Alt-Svc, so clients switch on their next requests.
+func serveHTTP3(server *http.Server, cfg Config) error {
+	h3 := &http3.Server{
+		Addr:           cfg.Addr,
+		Handler:        server.Handler,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// It fails only until the QUIC listener is up, there's no port to announce yet.
+		_ = h3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- h3.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}()
+	go func() {
+		errs <- server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}()
+
+	// The server is down with either of the listeners, like it is without HTTP/3.
+	err := <-errs
+	_ = h3.Close()
+	_ = server.Close()
+	return err
+}
+
+// configureHTTP2 sets up HTTP/2 on the server as configured. Clients fetching many
+// thumbnails at once get them over a single connection.
+func configureHTTP2(server *http.Server, cfg Config) error {
+	if !cfg.HTTP2 {
+		// A non-nil map keeps net/http from enabling HTTP/2 on its own.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.HTTP2MaxConcurrentStreams),
+		IdleTimeout:          cfg.IdleTimeout,
+	}
+
+	if cfg.H2C {
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+		return nil
+	}
+
+	return http2.ConfigureServer(server, h2)
+}
+
+// newServer registers all routes on top of the database of a single tenant. Background
+// workers of the tenant stop when ctx is done. The default tenant is the zero Tenant.
+func newServer(ctx context.Context, cfg Config, db *mongo.Database, limits *rateLimits, flags *featureFlags, tenant Tenant) (*echo.Echo, error) {
+	access, err := accessLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Validator = structValidator{}
+	e.JSONSerializer = requestIDSerializer{}
+
 	e.Use(
-		middleware.RequestID(),
+		requestIDs(e.Logger),
 		middleware.Recover(),
-		middleware.Logger(),
-		middleware.RateLimiter(middleware.NewRateLimiterMemoryStore(20)),
+		access,
+		envelopes(),
+		failFast(db.Client()),
+		limits.middleware(tenant),
 		middleware.Timeout(),
-		middleware.CORS(),
+		corsMiddleware(cfg),
 		middleware.Secure(),
+		authenticate(cfg.AuthJWTSecret, tenant.ID),
 	)
 
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGODB_CONN_STRING")))
+	if cfg.MigrateOnStartup {
+		if err := migrate(ctx, db, latestMigration(), func(msg string) { e.Logger.Info(msg) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DebugEndpoints {
+		registerDebugRoutes(e)
+	}
+
+	registerFeatureRoutes(e, flags, tenant)
+
+	users := newUserDirectory(db, time.Minute)
+	e.Use(users.rejectDisabled())
+
+	maintenance := newMaintenanceMode(db, cfg)
+	e.Use(maintenance.middleware())
+
+	cache := newResponseCache(cfg.CacheTTL, cfg.CacheMaxEntries)
+	cache.clearOnWrites(ctx, db)
+
+	geocoder, err := newGeocoder(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduler := newJobScheduler(db, cfg, e.Logger)
+
+	geocoding := newGeocodingWorker(geocoder, db, e.Logger)
+	go geocoding.run(ctx)
+	if geocoder != nil {
+		scheduler.add("geocoding-backfill", every(time.Hour), geocoding.backfill)
+	}
+
+	searchIndex, err := newSearchIndex(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if searchIndex != nil {
+		scheduler.add("search-sync", every(cfg.SearchSyncInterval), newSearchIndexer(searchIndex, db).syncAll)
+	}
+
+	if moderator := newImageModerator(cfg); moderator != nil {
+		scheduler.add("image-moderation", every(cfg.ImageModerationInterval), newImageModerationWorker(moderator, db, e.Logger, cfg).checkAll)
+	}
+
+	scheduler.add("image-hashes", every(cfg.ImageHashInterval), newImageHasher(db, cfg, e.Logger).hashAll)
+
+	scheduler.add("expire-markers", every(cfg.ExpiryInterval), func(ctx context.Context) error {
+		return deleteExpired(ctx, db)
+	})
+	if cfg.ArchiveAfter > 0 {
+		scheduler.add("archive-markers", every(cfg.ArchiveInterval), func(ctx context.Context) error {
+			return archiveCold(ctx, db, e.Logger, time.Now().UTC().Add(-cfg.ArchiveAfter))
+		})
+	}
+
+	scheduler.add("sequence-changes", every(time.Second), func(ctx context.Context) error {
+		return sequenceChanges(ctx, db)
+	})
+	scheduler.add("expire-changes", every(time.Hour), func(ctx context.Context) error {
+		return expireChanges(ctx, db)
+	})
+
+	if cfg.HistoryRetention > 0 {
+		scheduler.add("expire-history", every(time.Hour), func(ctx context.Context) error {
+			return expireHistory(ctx, db, cfg.HistoryRetention)
+		})
+	}
+
+	pushers, err := newPushers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := newNotifier(db, pushers, e.Logger)
+	go notifications.run(ctx)
+	scheduler.add("publish-markers", every(cfg.PublishInterval), func(ctx context.Context) error {
+		return publishDue(ctx, db, notifications)
+	})
+
+	markerStore, err := newMarkerStore(ctx, cfg, db)
 	if err != nil {
-		e.Logger.Fatal(err)
+		return nil, err
+	}
+
+	var migration *markerMigration
+	if markerStore != nil {
+		migration = newMarkerMigration(db, markerStore, cfg, e.Logger)
+		scheduler.add("verify-migration", every(6*time.Hour), migration.verify)
 	}
 
-	db := client.Database("images-on-map")
+	group := e.Group("/api/v1/markers",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	privacy := newMarkerPrivacy(db, cfg)
+	// Read-only endpoints serving listings and map overviews go to secondaries.
+	reads := listingDatabase(db, cfg)
+	registerSearchRoutes(group, reads, cache, searchIndex, privacy)
+	registerAutocompleteRoutes(group, reads, cache)
+	registerHeatmapRoutes(group, reads, cache)
+	registerGeohashRoutes(group, reads, cache)
+	registerMarkerTileRoutes(group, reads, cache, cfg.MarkerTileMaxAge, privacy)
+	registerNearestRoutes(group, reads, cache, privacy)
+	registerImagePointRoutes(group, reads, cache, privacy)
+	registerCommentRoutes(group, db, cache)
+	registerLikeRoutes(group, db)
+	registerShareRoutes(e, group, db, cfg, privacy)
+	registerDuplicateRoutes(group, db)
+	registerFlagRoutes(group, db, cfg.FlagHideThreshold)
+	registerArchiveRoutes(group, db)
+	registerImageRoutes(group, db)
+	registerMarkerHeadRoute(group, db)
+	registerBatchRoutes(group, db, cfg.Quotas, geocoding, notifications)
+	registerBulkUpdateRoutes(group, db)
+	registerChangeRoutes(group, db, privacy)
+
+	vectorTiles := e.Group("/api/v1/tiles",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+	)
+	registerVectorTileRoutes(vectorTiles, reads, cache, cfg.MarkerTileMaxAge, privacy)
+
+	query := e.Group("/api/v1/markers/query",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	)
+	registerQueryRoutes(query, reads, privacy)
+
+	exists := e.Group("/api/v1/markers/exists",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	)
+	registerExistsRoutes(exists, db)
+
+	scanner := newClamd(cfg)
+	imports := e.Group("/api/v1/markers/import",
+		requireUser(),
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.UploadBodyLimit),
+		transferDeadlines(cfg.TransferTimeout),
+		scanUploads(scanner, db),
+		cache.invalidate(),
+	)
+	importer := newMarkerImporter(db, cfg.Quotas, geocoding)
+	registerImportRoutes(imports, importer)
+
+	imageSearch := e.Group("/api/v1/markers/search-by-image",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.UploadBodyLimit),
+		scanUploads(scanner, db),
+	)
+	registerImageSearchRoutes(imageSearch, db, privacy)
+
+	importJobs := newImportJobs(db, importer, cfg, e.Logger)
+	go importJobs.run(ctx)
+
+	jobs := e.Group("/api/v1/imports",
+		requireUser(),
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	)
+	registerImportJobRoutes(jobs, db, importJobs, cfg)
 
-	group := e.Group("/api/v1/markers")
 	group.GET("/", func(c echo.Context) error {
-		cursor, err := db.Collection("markers").Find(c.Request().Context(), bson.D{})
+		fields, projection, err := parseFields(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		sort, err := markerSort(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		archived, err := includeArchived(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		origin, annotate, err := parseOrigin(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		asOf, past, err := parseAsOf(c, cfg.HistoryRetention)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if annotate && projection != nil {
+			projection["location"] = 1
+		}
+
+		// One marker past the cap tells whether the listing was cut short.
+		var cursor *mongo.Cursor
+		if past {
+			cursor, err = findMarkersAsOf(c.Request().Context(), reads, asOf, archived, bson.M{}, filter, sort, projection, int64(cfg.MaxListMarkers)+1)
+		} else {
+			cursor, err = findMarkers(c.Request().Context(), reads, archived, filter, sort, projection, int64(cfg.MaxListMarkers)+1)
+		}
 		if err != nil {
 			c.Logger().Error(err)
 			return c.JSON(http.StatusServiceUnavailable, Error{err})
@@ -47,21 +413,234 @@ func main() {
 			return c.JSON(http.StatusServiceUnavailable, Error{err})
 		}
 
-		return c.JSON(http.StatusOK, results)
-	})
-	group.POST("/", func(c echo.Context) error {
-		var body Marker
-		if err := c.Bind(&body); err != nil {
+		if len(results) > cfg.MaxListMarkers {
+			results = results[:cfg.MaxListMarkers]
+			c.Response().Header().Set("X-Truncated", "true")
+		}
+
+		if results, err = privacy.view(c).redact(c.Request().Context(), results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if fields == nil {
+			if annotate {
+				return c.JSON(http.StatusOK, withDistances(results, origin))
+			}
+
+			return c.JSON(http.StatusOK, results)
+		}
+
+		selected := make([]interface{}, 0, len(results))
+		for _, marker := range results {
+			v, err := selectFields(marker.Normalize(), fields)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusInternalServerError, Error{err})
+			}
+
+			if annotate {
+				v["distanceMeters"], _ = json.Marshal(haversine(origin, marker.Location))
+			}
+
+			selected = append(selected, v)
+		}
+
+		return c.JSON(http.StatusOK, selected)
+	}, cache.middleware())
+	group.GET("/:id", func(c echo.Context) error {
+		fields, projection, err := parseFields(c)
+		if err != nil {
 			c.Logger().Info(err)
 			return c.JSON(http.StatusBadRequest, Error{err})
 		}
 
-		if err := body.Validate(); err != nil {
+		archived, err := includeArchived(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		asOf, past, err := parseAsOf(c, cfg.HistoryRetention)
+		if err != nil {
 			c.Logger().Info(err)
 			return c.JSON(http.StatusBadRequest, Error{err})
 		}
 
-		if _, err := db.Collection("markers").InsertOne(c.Request().Context(), body.Normalize()); err != nil {
+		var marker Marker
+		id := c.Param("id")
+		if past {
+			marker, err = markerAsOf(c.Request().Context(), db, asOf, archived, id, visibleMarker(c, id), projection)
+		} else {
+			err = db.Collection("markers").FindOne(c.Request().Context(), visibleMarker(c, id), options.FindOne().SetProjection(projection)).Decode(&marker)
+			if errors.Is(err, mongo.ErrNoDocuments) && archived {
+				err = db.Collection(archiveCollection).FindOne(c.Request().Context(), visibleMarker(c, id), options.FindOne().SetProjection(projection)).Decode(&marker)
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "marker not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// Past states aren't in the marker store, there's nothing to compare them with.
+		if migration != nil && fields == nil && marker.ArchivedAt == nil && !past {
+			migration.shadowRead(marker)
+		}
+
+		visible, err := privacy.view(c).redactMarker(c.Request().Context(), &marker)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if fields == nil {
+			return c.JSON(http.StatusOK, marker.Normalize())
+		}
+
+		v, err := selectFields(marker.Normalize(), fields)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, v)
+	}, cache.middleware())
+	group.GET("/stream", func(c echo.Context) error {
+		// Markers are written one per line as they are read from the cursor, so exports
+		// don't have to fit in memory. Every batch gets HTTP_WRITE_TIMEOUT of its own, only
+		// a stalled client cuts a long export short.
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		archived, err := includeArchived(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		cursor, err := findMarkers(c.Request().Context(), db, archived, filter, nil, nil, 0)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+		defer cursor.Close(context.Background())
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		if err := extendWriteDeadline(c, cfg.WriteTimeout); err != nil {
+			c.Logger().Error(err)
+		}
+		res.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(res)
+		view := privacy.view(c)
+		for n := 1; cursor.Next(c.Request().Context()); n++ {
+			var marker Marker
+			if err := cursor.Decode(&marker); err != nil {
+				c.Logger().Error(err)
+				return nil
+			}
+
+			visible, err := view.redactMarker(c.Request().Context(), &marker)
+			if err != nil {
+				c.Logger().Error(err)
+				return nil
+			}
+
+			if !visible {
+				continue
+			}
+
+			if err := enc.Encode(marker.Normalize()); err != nil {
+				c.Logger().Info(err)
+				return nil
+			}
+
+			if n%100 == 0 {
+				res.Flush()
+				if err := extendWriteDeadline(c, cfg.WriteTimeout); err != nil {
+					c.Logger().Info(err)
+					return nil
+				}
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			c.Logger().Error(err)
+		}
+
+		res.Flush()
+		return nil
+	})
+	group.POST("/", func(c echo.Context) error {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		var body Marker
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		user, _ := currentUser(c)
+		marker := body.Normalize().created(user.ID)
+
+		if marker.Private && marker.OwnerID == "" {
+			s := "private markers require authentication"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		if err := checkQuotas(c.Request().Context(), db, cfg.Quotas, marker.OwnerID, marker); err != nil {
+			var quotaErr QuotaError
+			if errors.As(err, &quotaErr) {
+				c.Logger().Info(err)
+				return c.JSON(http.StatusForbidden, Error{err})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if dryRun {
+			_, found, err := storedMarker(c.Request().Context(), db, marker.ID)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if found {
+				s := "duplicated id"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusBadRequest, ErrorString{s})
+			}
+
+			return c.JSON(http.StatusOK, DryRunResult{DryRun: true, Action: "create", Marker: &marker})
+		}
+
+		if err := insertMarker(c.Request().Context(), db, marker); err != nil {
 			var mongoErr mongo.WriteException
 			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
 				s := "duplicated id"
@@ -73,11 +652,48 @@ func main() {
 			return c.JSON(http.StatusServiceUnavailable, Error{err})
 		}
 
+		geocoding.enqueue(marker.ID)
+		notifications.markerCreated(marker)
+
 		return c.NoContent(http.StatusCreated)
 	})
 	group.DELETE("/:id", func(c echo.Context) error {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
 		id := c.Param("id")
-		if _, err := db.Collection("markers").DeleteOne(c.Request().Context(), bson.M{"_id": id}); err != nil {
+		stored, found, err := storedMarker(c.Request().Context(), db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !found {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if !canModify(c, stored.OwnerID) {
+			s := "only the owner can delete this marker"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+
+		if dryRun {
+			removed, err := markerReferences(c.Request().Context(), db, id)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			return c.JSON(http.StatusOK, DryRunResult{DryRun: true, Action: "delete", Removed: removed})
+		}
+
+		if err := deleteMarker(c.Request().Context(), db, id); err != nil {
 			c.Logger().Error(err)
 			return c.JSON(http.StatusServiceUnavailable, Error{err})
 		}
@@ -85,12 +701,26 @@ func main() {
 		return c.NoContent(http.StatusOK)
 	})
 	group.PUT("/:id", func(c echo.Context) error {
-		var body Marker
-		if err := c.Bind(&body); err != nil {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
 			c.Logger().Info(err)
 			return c.JSON(http.StatusBadRequest, Error{err})
 		}
 
+		upsert := false
+		if param := c.QueryParam("upsert"); param != "" {
+			if upsert, err = strconv.ParseBool(param); err != nil {
+				s := "upsert must be true or false"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusBadRequest, ErrorString{s})
+			}
+		}
+
+		var body Marker
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
 		id := c.Param("id")
 		if body.ID != id {
 			s := "id in path and body doesn't match"
@@ -98,103 +728,555 @@ func main() {
 			return c.JSON(http.StatusBadRequest, ErrorString{s})
 		}
 
-		if err := body.Validate(); err != nil {
-			c.Logger().Info(err)
-			return c.JSON(http.StatusBadRequest, Error{err})
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		stored, found, err := storedMarker(c.Request().Context(), db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !found && !upsert {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if found && !canModify(c, stored.OwnerID) {
+			s := "only the owner can modify this marker"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusForbidden, ErrorString{s})
+		}
+
+		// Markers created by an upsert belong to the current user like markers created with POST.
+		ownerID := stored.OwnerID
+		if !found {
+			user, _ := currentUser(c)
+			ownerID = user.ID
+		}
+
+		if body.Private && ownerID == "" {
+			s := "markers without an owner can't be private"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		marker := body.Normalize()
+		if err := checkQuotas(c.Request().Context(), db, cfg.Quotas, ownerID, marker); err != nil {
+			var quotaErr QuotaError
+			if errors.As(err, &quotaErr) {
+				c.Logger().Info(err)
+				return c.JSON(http.StatusForbidden, Error{err})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !found {
+			marker = marker.created(ownerID)
+			if dryRun {
+				return c.JSON(http.StatusOK, DryRunResult{DryRun: true, Action: "create", Marker: &marker})
+			}
+
+			if err := insertMarker(c.Request().Context(), db, marker); err != nil {
+				var mongoErr mongo.WriteException
+				if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+					s := "marker was created concurrently, try again"
+					c.Logger().Info(s)
+					return c.JSON(http.StatusConflict, ErrorString{s})
+				}
+
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			geocoding.enqueue(marker.ID)
+			notifications.markerCreated(marker)
+
+			return c.NoContent(http.StatusCreated)
 		}
 
-		if _, err := db.Collection("markers").ReplaceOne(c.Request().Context(), bson.M{"_id": id}, body.Normalize()); err != nil {
+		if dryRun {
+			return c.JSON(http.StatusOK, DryRunResult{DryRun: true, Action: "update", Marker: &marker})
+		}
+
+		matched, moved, err := updateMarker(c.Request().Context(), db, bson.M{"_id": id}, stored, marker)
+		if err != nil {
 			c.Logger().Error(err)
 			return c.JSON(http.StatusServiceUnavailable, Error{err})
 		}
 
+		if !matched {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if moved {
+			geocoding.enqueue(id)
+		}
+
 		return c.NoContent(http.StatusOK)
 	})
 
-	e.Logger.Fatal(e.Start(":8080"))
+	offline := e.Group("/api/v1/sync",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerSyncRoutes(offline, db, cfg.Quotas, geocoding, notifications, privacy)
+
+	me := e.Group("/api/v1/users",
+		requireUser(),
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+	)
+	registerFavoriteRoutes(me, db, privacy)
+	registerUsageRoutes(me, db, cfg.Quotas)
+	registerNotificationRoutes(me, db)
+
+	// Settings change what other users see, cached responses are dropped.
+	settings := e.Group("/api/v1/users",
+		requireUser(),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerSettingsRoutes(settings, db)
+
+	exports := newDataExports(db, cfg, e.Logger)
+	go exports.run(ctx)
+	scheduler.add("expire-exports", every(10*time.Minute), exports.expire)
+	registerDataExportRoutes(e, me, db, exports, cfg)
+
+	export := e.Group("/api/v1/export",
+		requireUser(),
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+	)
+
+	bundles := newOfflineBundles(db, cfg, privacy, e.Logger)
+	go bundles.run(ctx)
+	scheduler.add("expire-bundles", every(10*time.Minute), bundles.expire)
+	registerBundleRoutes(export, db, bundles, cfg)
+
+	tilesets := newMarkerTilesets(db, cfg, privacy, e.Logger)
+	go tilesets.run(ctx)
+	scheduler.add("expire-tilesets", every(10*time.Minute), tilesets.expire)
+	registerTilesetRoutes(export, db, tilesets, cfg)
+
+	sinks, err := newEventSinks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if migration != nil {
+		sinks[migrationSink] = migration
+	}
+
+	dispatcher := newEventDispatcher(db, sinks, cfg, e.Logger)
+	if len(sinks) > 0 {
+		scheduler.add("deliver-events", every(cfg.EventDispatchInterval), dispatcher.dispatch)
+	}
+
+	scheduler.add("erase-users", every(10*time.Minute), newErasures(db, exports, cache, e.Logger).eraseDue)
+	registerErasureRoutes(me, db, cfg)
+
+	admin := e.Group("/api/v1/admin",
+		requireRole(RoleAdmin),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerAdminRoutes(admin, db, users)
+	registerJobRoutes(admin, scheduler)
+	registerDeadLetterRoutes(admin, db, dispatcher)
+	registerMaintenanceRoutes(admin, db, maintenance)
+	if migration != nil {
+		registerMigrationRoutes(admin, db, migration)
+	}
+
+	backups := e.Group("/api/v1/admin",
+		requireRole(RoleAdmin),
+		transferDeadlines(cfg.TransferTimeout),
+		middleware.BodyLimit(cfg.RestoreBodyLimit),
+		scanUploads(scanner, db),
+		cache.invalidate(),
+	)
+	registerBackupRoutes(backups, db, cfg)
+	registerImageBlobRoutes(e, reads)
+	scheduler.add("sweep-image-blobs", every(time.Hour), func(ctx context.Context) error {
+		return sweepImageBlobs(ctx, db)
+	})
+
+	// Collections and routes aren't markers, writing them doesn't record events.
+	albums := e.Group("/api/v1/collections",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerCollectionRoutes(albums, db, privacy)
+
+	geocodeCache := newResponseCache(cfg.GeocoderCacheTTL, cfg.CacheMaxEntries)
+	geocode := e.Group("/api/v1/geocode",
+		middleware.RateLimiter(middleware.NewRateLimiterMemoryStore(rate.Limit(cfg.GeocodeRateLimit))),
+		geocodeCache.middleware(),
+	)
+	registerGeocodeRoutes(geocode, geocoder)
+
+	if cfg.TileUpstreamURL != "" {
+		e.GET("/tiles/:z/:x/:y", newTileProxy(cfg).handle)
+	}
+
+	registerOEmbedRoutes(e, reads, cfg, privacy, cache)
+	registerAtomRoutes(e, reads, cfg, privacy, cache)
+
+	if cfg.PublicURL != "" {
+		sitemaps := newSitemaps(reads, cfg)
+		scheduler.add("build-sitemaps", every(cfg.SitemapInterval), sitemaps.build)
+		registerSitemapRoutes(e, sitemaps, cfg.SitemapInterval)
+	}
+
+	moderation := e.Group("/api/v1/moderation",
+		requireRole(RoleModerator, RoleAdmin),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerModerationRoutes(moderation, db)
+
+	routes := e.Group("/api/v1/routes",
+		concurrencyLimit(cfg.MaxInFlight, cfg.MaxQueued, cfg.QueueTimeout, cfg.RetryAfter),
+		middleware.BodyLimit(cfg.JSONBodyLimit),
+		cache.invalidate(),
+	)
+	registerRouteRoutes(routes, db)
+
+	frontend, err := frontendFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if frontend != nil {
+		registerFrontendRoutes(e, frontend)
+	}
+
+	if err := scheduler.start(ctx); err != nil {
+		return nil, err
+	}
+
+	return e, nil
 }
 
 type Error struct {
 	Error error `json:"error"`
 }
 
+// MarshalJSON renders the error message, most errors have no exported fields.
+func (e Error) MarshalJSON() ([]byte, error) {
+	if e.Error == nil {
+		return json.Marshal(ErrorString{})
+	}
+
+	return json.Marshal(ErrorString{e.Error.Error()})
+}
+
 type ErrorString struct {
 	Error string `json:"error"`
 }
 
 type Marker struct {
-	ID       string  `json:"id" bson:"_id"`
-	Name     string  `json:"name" bson:"name"`
-	Location Coords  `json:"location" bson:"location"`
-	Images   []Image `json:"images" bson:"images"`
+	ID   string `json:"id" bson:"_id" validate:"required"`
+	Name string `json:"name" bson:"name" validate:"required"`
+	// Names are the names in other languages by language tag, Name is the primary one.
+	// Responses carry the name in the viewer's language as LocalizedName, picked by
+	// Accept-Language and falling back to Name.
+	Names         map[string]string `json:"names,omitempty" bson:"names,omitempty" validate:"max=20,dive,keys,language,endkeys,notblank"`
+	LocalizedName string            `json:"localizedName,omitempty" bson:"-"`
+	// LocalNames are the values of Names for the text index.
+	LocalNames []string `json:"-" bson:"localNames,omitempty"`
+	// NameLower is the folded name matched by autocomplete.
+	NameLower string    `json:"-" bson:"nameLower,omitempty"`
+	Location  Coords    `json:"location" bson:"location"`
+	Geo       *GeoPoint `json:"-" bson:"geo,omitempty"`
+	// Geohash is derived from the location, prefixes of it name larger cells.
+	Geohash string  `json:"geohash,omitempty" bson:"geohash,omitempty"`
+	Images  []Image `json:"images" bson:"images" validate:"dive"`
+	// Limits match maxTags and maxTagLength.
+	Tags []string `json:"tags" bson:"tags" validate:"max=20,dive,notblank,max=32"`
+
+	// The limit matches maxDescriptionLength.
+	Description       string `json:"description" bson:"description" validate:"max=4000"`
+	DescriptionFormat string `json:"descriptionFormat" bson:"descriptionFormat" validate:"omitempty,oneof=plain markdown"`
+
+	// Icon, Color and Emoji tell clients how to draw the marker. Icons and colors are
+	// named, so every client can map them to its own artwork and palette.
+	Icon  string `json:"icon,omitempty" bson:"icon,omitempty" validate:"omitempty,oneof=pin camera landmark mountain tree water beach building food cafe bar shop park museum viewpoint campsite parking star heart flag"`
+	Color string `json:"color,omitempty" bson:"color,omitempty" validate:"omitempty,oneof=red orange amber yellow lime green teal cyan blue indigo purple pink brown gray black white"`
+	Emoji string `json:"emoji,omitempty" bson:"emoji,omitempty" validate:"omitempty,emoji"`
+
+	// Properties are custom fields of the deployment, checked by validateProperties and
+	// matched by ?prop.<key>= filters.
+	Properties map[string]interface{} `json:"properties,omitempty" bson:"properties,omitempty"`
+
+	OwnerID string `json:"ownerId" bson:"ownerId"`
+	Private bool   `json:"private" bson:"private"`
+
+	LikeCount int `json:"likeCount" bson:"likeCount"`
+
+	// Moderation is ModerationPending while the marker is hidden after being flagged.
+	Moderation string `json:"moderation,omitempty" bson:"moderation,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+
+	// ExpiresAt is set for temporary markers, e.g. events. Expired markers are hidden
+	// and deleted shortly after.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty" validate:"omitempty,future"`
+
+	// PublishAt hides the marker from everybody but its owner until then. It's cleared
+	// once the marker is published.
+	PublishAt *time.Time `json:"publishAt,omitempty" bson:"publishAt,omitempty"`
+
+	// ArchivedAt is set on markers moved to the archive.
+	ArchivedAt *time.Time `json:"archivedAt,omitempty" bson:"archivedAt,omitempty"`
+
+	// Revision grows with every change of the content, sync clients send it back to
+	// detect conflicting edits. Markers created before revisions were added have none.
+	Revision int64 `json:"revision" bson:"revision"`
+
+	// Address is resolved from the location in the background and may be missing.
+	Address *Address `json:"address,omitempty" bson:"address,omitempty"`
+
+	// PrivacyZone is the mode of the owner's privacy zone containing the marker, if any.
+	// It's kept up to date by the server, see zoneMarkers.
+	PrivacyZone string `json:"-" bson:"privacyZone,omitempty"`
+}
+
+// scheduled reports whether the marker waits to be published.
+func (m Marker) scheduled() bool {
+	return m.PublishAt != nil && m.PublishAt.After(time.Now())
+}
+
+// created sets the server-managed fields of a marker that is about to be stored for the
+// first time. Anonymous markers have an empty owner.
+func (m Marker) created(ownerID string) Marker {
+	m.LikeCount = 0
+	m.Moderation = ""
+	m.CreatedAt = time.Now().UTC()
+	m.UpdatedAt = m.CreatedAt
+	m.Revision = 1
+	m.OwnerID = ownerID
+	return m
 }
 
+// editableFields returns the fields clients may change with PUT. Server-managed fields
+// such as the like count are left as they are.
+func (m Marker) editableFields() bson.M {
+	return bson.M{
+		"name":              m.Name,
+		"location":          m.Location,
+		"geo":               m.Location.point(),
+		"geohash":           encodeGeohash(m.Location, geohashPrecision),
+		"nameLower":         foldName(m.Name),
+		"names":             m.Names,
+		"localNames":        localNames(m),
+		"images":            m.Images,
+		"tags":              m.Tags,
+		"description":       m.Description,
+		"descriptionFormat": m.DescriptionFormat,
+		"icon":              m.Icon,
+		"color":             m.Color,
+		"emoji":             m.Emoji,
+		"properties":        m.Properties,
+		"private":           m.Private,
+		"expiresAt":         m.ExpiresAt,
+		"publishAt":         m.PublishAt,
+	}
+}
+
+const (
+	maxTags      = 20
+	maxTagLength = 32
+
+	maxDescriptionLength = 4000
+)
+
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+)
+
 func (m Marker) Normalize() Marker {
-	if m.Images == nil {
-		m.Images = []Image{}
+	m.Images = normalizeImages(m.Images)
+	m.Tags = normalizeTags(m.Tags)
+
+	m.Description = sanitizeText(m.Description)
+	if m.DescriptionFormat == "" {
+		m.DescriptionFormat = FormatPlain
 	}
 
 	return m
 }
 
-func (m Marker) Validate() error {
-	if m.ID == "" {
-		return fmt.Errorf("empty id")
+// sanitizeText drops invalid UTF-8 and control characters other than newlines and tabs.
+func sanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+
+		return -1
+	}, s)
+
+	return strings.TrimSpace(s)
+}
+
+// normalizeImages orders images by position and numbers them from 0 without gaps.
+func normalizeImages(images []Image) []Image {
+	normalized := append([]Image{}, images...)
+	sort.SliceStable(normalized, func(i, j int) bool {
+		return normalized[i].Position < normalized[j].Position
+	})
+
+	for i := range normalized {
+		normalized[i].Position = i
+		normalized[i].Caption = sanitizeText(normalized[i].Caption)
+		normalized[i].AltText = sanitizeText(normalized[i].AltText)
+
+		if exif := normalized[i].Exif; exif != nil {
+			exif := *exif
+			exif.CameraMake = sanitizeText(exif.CameraMake)
+			exif.CameraModel = sanitizeText(exif.CameraModel)
+			if exif.CapturedAt != nil {
+				capturedAt := exif.CapturedAt.UTC()
+				exif.CapturedAt = &capturedAt
+			}
+
+			normalized[i].Exif = &exif
+		}
 	}
 
-	if m.Name == "" {
-		return fmt.Errorf("empty name")
+	return normalized
+}
+
+// normalizeTags trims and lowercases tags and removes duplicates, keeping the original order.
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		normalized = append(normalized, tag)
 	}
 
-	if err := m.Location.Validate(); err != nil {
-		return fmt.Errorf("invalid location: %w", err)
+	return normalized
+}
+
+// Validate checks the marker and reports every invalid field as ValidationErrors.
+func (m Marker) Validate() error {
+	err := validateStruct(m)
+
+	var fields ValidationErrors
+	if err != nil && !errors.As(err, &fields) {
+		return err
 	}
 
+	// Images sent without positions all have position 0 and keep their order.
+	positions := map[int]bool{}
+	ordered := false
 	for _, image := range m.Images {
-		if err := image.Validate(); err != nil {
-			return fmt.Errorf("invalid image %s: %w", image.ID, err)
+		ordered = ordered || image.Position != 0
+	}
+
+	for i, image := range m.Images {
+		if ordered && positions[image.Position] {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("images[%d].position", i),
+				Code:    "unique",
+				Message: "must be unique",
+			})
 		}
+
+		positions[image.Position] = true
+	}
+
+	fields = append(fields, validateProperties(m.Properties)...)
+
+	if len(fields) == 0 {
+		return nil
 	}
 
-	return nil
+	return fields
 }
 
-type Coords struct {
-	Latitude  float64 `json:"latitude" bson:"latitude"`
-	Longitude float64 `json:"longitude" bson:"longitude"`
+// GeoPoint is a GeoJSON point, kept next to the location for geospatial indexes.
+type GeoPoint struct {
+	Type        string    `bson:"type"`
+	Coordinates []float64 `bson:"coordinates"`
 }
 
-func (c Coords) Validate() error {
-	if c.Latitude < -180 || c.Latitude > 180 {
-		return fmt.Errorf("invalid latitude")
-	}
+func (c Coords) point() *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{c.Longitude, c.Latitude}}
+}
 
-	if c.Longitude < -90 || c.Longitude > 90 {
-		return fmt.Errorf("invalid longitude")
-	}
+type Coords struct {
+	Latitude  float64 `json:"latitude" bson:"latitude" validate:"gte=-90,lte=90"`
+	Longitude float64 `json:"longitude" bson:"longitude" validate:"gte=-180,lte=180"`
 
-	return nil
+	// Altitude is in meters above sea level, Accuracy is the horizontal accuracy in
+	// meters as reported by the device. Both are optional.
+	Altitude *float64 `json:"altitude,omitempty" bson:"altitude,omitempty" validate:"omitempty,gte=-1000,lte=10000"`
+	Accuracy *float64 `json:"accuracy,omitempty" bson:"accuracy,omitempty" validate:"omitempty,gte=0"`
 }
 
-type Image struct {
-	ID     string `json:"id" bson:"_id"`
-	URI    string `json:"uri" bson:"uri"`
-	Width  int    `json:"width" bson:"width"`
-	Height int    `json:"height" bson:"height"`
+// samePlace reports whether both coordinates point at the same place, regardless of
+// altitude and accuracy.
+func (c Coords) samePlace(other Coords) bool {
+	return c.Latitude == other.Latitude && c.Longitude == other.Longitude
 }
 
-func (i Image) Validate() error {
-	if i.ID == "" {
-		return fmt.Errorf("empty id")
-	}
+func (c Coords) Validate() error {
+	return validateStruct(c)
+}
 
-	if i.URI == "" {
-		return fmt.Errorf("empty uri")
-	}
+type Image struct {
+	ID     string `json:"id" bson:"_id" validate:"required"`
+	URI    string `json:"uri" bson:"uri" validate:"required"`
+	Width  int    `json:"width" bson:"width" validate:"gt=0"`
+	Height int    `json:"height" bson:"height" validate:"gt=0"`
+	Size   int64  `json:"size" bson:"size" validate:"gte=0"`
 
-	if i.Width <= 0 || i.Height <= 0 {
-		return fmt.Errorf("invalid dimensions")
-	}
+	Caption string `json:"caption,omitempty" bson:"caption,omitempty" validate:"max=500"`
+	AltText string `json:"altText,omitempty" bson:"altText,omitempty" validate:"max=1000"`
+	// Position orders the images of a marker starting at 0. Images without positions
+	// keep the order they were sent in.
+	Position int `json:"position" bson:"position" validate:"gte=0"`
+
+	Exif *ImageExif `json:"exif,omitempty" bson:"exif,omitempty"`
+	// Location is where the photo was taken when it differs from the marker's location,
+	// such as a viewpoint across the valley from the subject.
+	Location *Coords `json:"location,omitempty" bson:"location,omitempty"`
+}
 
-	return nil
+// ImageExif is the EXIF metadata of an image. Image files are stored by clients, so
+// clients read the metadata when uploading and send it along with the image.
+type ImageExif struct {
+	// Orientation is the EXIF orientation tag, 1 to 8. Width and height are of the image
+	// as stored, clients rotate it for display.
+	Orientation int `json:"orientation,omitempty" bson:"orientation,omitempty" validate:"omitempty,min=1,max=8"`
+	// CapturedAt is the time the photo was taken as recorded by the camera. Cameras
+	// rarely record a time zone, such times are taken as UTC.
+	CapturedAt  *time.Time `json:"capturedAt,omitempty" bson:"capturedAt,omitempty"`
+	CameraMake  string     `json:"cameraMake,omitempty" bson:"cameraMake,omitempty" validate:"max=100"`
+	CameraModel string     `json:"cameraModel,omitempty" bson:"cameraModel,omitempty" validate:"max=100"`
+	FocalLength *float64   `json:"focalLength,omitempty" bson:"focalLength,omitempty" validate:"omitempty,gt=0"`
+}
+
+func (i Image) Validate() error {
+	return validateStruct(i)
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultMaintenanceMessage = "the server is in maintenance and read-only, retry later"
+
+	// maintenanceTTL is how long instances take to see a change of the mode.
+	maintenanceTTL = 5 * time.Second
+)
+
+// maintenanceRoutes keep working in read-only mode, so admins can leave it and run the
+// restores it's meant for.
+var maintenanceRoutes = []string{"/api/v1/admin/maintenance", "/api/v1/admin/backup", "/api/v1/admin/restore"}
+
+// Maintenance is the read-only mode of a tenant. It's stored in the database, so every
+// instance serving the tenant applies it.
+type Maintenance struct {
+	ReadOnly bool   `json:"readOnly" bson:"readOnly"`
+	Message  string `json:"message,omitempty" bson:"message,omitempty" validate:"max=500"`
+	// Forced is set when MAINTENANCE_MODE makes the deployment read-only whatever the
+	// stored mode is.
+	Forced    bool       `json:"forced" bson:"-"`
+	UpdatedBy string     `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+// maintenanceMode rejects writes while the tenant is read-only. Reads keep working.
+type maintenanceMode struct {
+	db      *mongo.Database
+	forced  bool
+	message string
+
+	mu        sync.Mutex
+	current   Maintenance
+	checkedAt time.Time
+}
+
+func newMaintenanceMode(db *mongo.Database, cfg Config) *maintenanceMode {
+	return &maintenanceMode{db: db, forced: cfg.MaintenanceMode, message: cfg.MaintenanceMessage}
+}
+
+// get returns the mode, reading it at most once per maintenanceTTL. When the database
+// can't be read the last known mode applies.
+func (m *maintenanceMode) get(ctx context.Context) (Maintenance, error) {
+	m.mu.Lock()
+	current, checkedAt := m.current, m.checkedAt
+	m.mu.Unlock()
+
+	if time.Since(checkedAt) >= maintenanceTTL {
+		var stored Maintenance
+		err := m.db.Collection("settings").FindOne(ctx, bson.M{"_id": "maintenance"}).Decode(&stored)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return m.resolve(current), err
+		}
+
+		current = stored
+		m.mu.Lock()
+		m.current, m.checkedAt = stored, time.Now()
+		m.mu.Unlock()
+	}
+
+	return m.resolve(current), nil
+}
+
+func (m *maintenanceMode) resolve(stored Maintenance) Maintenance {
+	if m.forced {
+		stored.ReadOnly, stored.Forced = true, true
+	}
+
+	if stored.ReadOnly && stored.Message == "" {
+		stored.Message = m.message
+	}
+
+	return stored
+}
+
+func (m *maintenanceMode) set(ctx context.Context, mode Maintenance) error {
+	if _, err := m.db.Collection("settings").ReplaceOne(ctx, bson.M{"_id": "maintenance"}, mode, options.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.current, m.checkedAt = mode, time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// middleware rejects writes and uploads with 503 while the tenant is read-only.
+func (m *maintenanceMode) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if requestClass(c) == RateRead {
+				return next(c)
+			}
+
+			for _, route := range maintenanceRoutes {
+				if strings.HasPrefix(c.Path(), route) {
+					return next(c)
+				}
+			}
+
+			mode, err := m.get(c.Request().Context())
+			if err != nil {
+				c.Logger().Error(err)
+			}
+
+			if mode.ReadOnly {
+				c.Logger().Info(mode.Message)
+				return c.JSON(http.StatusServiceUnavailable, ErrorString{mode.Message})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// registerMaintenanceRoutes lets admins make the tenant read-only, e.g. for migrations,
+// restores and moving images to another storage backend.
+func registerMaintenanceRoutes(group *echo.Group, db *mongo.Database, m *maintenanceMode) {
+	group.GET("/maintenance", func(c echo.Context) error {
+		mode, err := m.get(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, mode)
+	})
+	group.PUT("/maintenance", func(c echo.Context) error {
+		var body Maintenance
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		ctx := c.Request().Context()
+		admin, _ := currentUser(c)
+		now := time.Now().UTC()
+		mode := Maintenance{ReadOnly: body.ReadOnly, Message: strings.TrimSpace(body.Message), UpdatedBy: admin.ID, UpdatedAt: &now}
+		if err := m.set(ctx, mode); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if err := recordAudit(ctx, db, admin.ID, "maintenance.update", nil, bson.M{"readOnly": mode.ReadOnly, "message": mode.Message}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.JSON(http.StatusOK, m.resolve(mode))
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// markerTileClusterZoom is the zoom from which tiles return markers instead of clusters.
+	markerTileClusterZoom = 14
+	maxTileMarkers        = 500
+)
+
+// MarkerTile holds the markers or, at low zoom levels, the clusters within an XYZ tile.
+type MarkerTile struct {
+	Z        int              `json:"z"`
+	X        int              `json:"x"`
+	Y        int              `json:"y"`
+	Bounds   Bounds           `json:"bounds"`
+	Markers  []Marker         `json:"markers,omitempty"`
+	Clusters []GeohashCluster `json:"clusters,omitempty"`
+}
+
+// tileBounds returns the area covered by a Web Mercator tile.
+func tileBounds(z, x, y int) Bounds {
+	n := float64(int(1) << z)
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+
+	return Bounds{
+		MinLatitude:  lat(y + 1),
+		MaxLatitude:  lat(y),
+		MinLongitude: float64(x)/n*360 - 180,
+		MaxLongitude: float64(x+1)/n*360 - 180,
+	}
+}
+
+// tilePrecision picks the geohash precision splitting a tile of the zoom level into
+// about eight clusters across.
+func tilePrecision(z int) int {
+	for precision := 1; precision < geohashPrecision; precision++ {
+		if lonBits := (5*precision + 1) / 2; lonBits >= z+3 {
+			return precision
+		}
+	}
+
+	return geohashPrecision
+}
+
+func registerMarkerTileRoutes(group *echo.Group, db *mongo.Database, cache *responseCache, maxAge time.Duration, privacy *markerPrivacy) {
+	group.GET("/tile/:z/:x/:y", markerTileHandler(db, privacy, ".png", func(c echo.Context, tile MarkerTile) error {
+		return c.JSON(http.StatusOK, tile)
+	}), tileCacheControl(maxAge), cache.middleware())
+}
+
+// registerVectorTileRoutes serves the same tiles as Mapbox Vector Tiles, which MapLibre
+// and Mapbox clients render far more efficiently than GeoJSON.
+func registerVectorTileRoutes(group *echo.Group, db *mongo.Database, cache *responseCache, maxAge time.Duration, privacy *markerPrivacy) {
+	group.GET("/:z/:x/:y", markerTileHandler(db, privacy, ".mvt", func(c echo.Context, tile MarkerTile) error {
+		return c.Blob(http.StatusOK, mvtContentType, encodeMarkerTile(tile))
+	}), tileCacheControl(maxAge), cache.middleware())
+}
+
+// markerTileHandler reads the tile addressed by the request, optionally ending with ext,
+// and hands it to write.
+func markerTileHandler(db *mongo.Database, privacy *markerPrivacy, ext string, write func(echo.Context, MarkerTile) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		z, x, y, err := parseTile(c, ext)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		tile := MarkerTile{Z: z, X: x, Y: y, Bounds: tileBounds(z, x, y)}
+		filter = and(filter, tile.Bounds.filter(), outsideZones(c))
+
+		if z < markerTileClusterZoom {
+			tile.Clusters, err = geohashClusters(c.Request().Context(), db, filter, tilePrecision(z))
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+		} else {
+			cursor, err := db.Collection("markers").Find(c.Request().Context(), filter, options.Find().
+				SetSort(bson.D{{Key: "likeCount", Value: -1}, {Key: "_id", Value: 1}}).
+				SetLimit(maxTileMarkers))
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			tile.Markers = []Marker{}
+			if err := cursor.All(context.Background(), &tile.Markers); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if tile.Markers, err = privacy.view(c).redact(c.Request().Context(), tile.Markers); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			for i := range tile.Markers {
+				tile.Markers[i] = tile.Markers[i].Normalize()
+			}
+		}
+
+		return write(c, tile)
+	}
+}
+
+// tileCacheControl lets browsers and CDNs keep successful tile responses, including the
+// ones served from the response cache. Tiles of signed in users include their private
+// markers and must not be shared.
+func tileCacheControl(maxAge time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			scope := "public"
+			if _, ok := currentUser(c); ok {
+				scope = "private"
+			}
+
+			res := c.Response()
+			res.Before(func() {
+				if res.Status == http.StatusOK {
+					res.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, stale-while-revalidate=%d", scope, int(maxAge.Seconds()), int(maxAge.Seconds())))
+					res.Header().Add("Vary", echo.HeaderAuthorization)
+					res.Header().Add("Vary", "Accept-Language")
+				}
+			})
+
+			return next(c)
+		}
+	}
+}
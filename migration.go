@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MigrationMongoDB   = "mongodb"
+	MigrationPostgREST = "postgrest"
+
+	// migrationSink is the name of the outbox sink writing to the migration target.
+	migrationSink = "migration"
+	// migrationSamples caps the divergent markers listed in a report.
+	migrationSamples = 50
+)
+
+// MarkerStore is a backend markers are migrated to.
+type MarkerStore interface {
+	Put(ctx context.Context, m Marker) error
+	Delete(ctx context.Context, id string) error
+	// Get returns nil for markers the store doesn't have.
+	Get(ctx context.Context, id string) (*Marker, error)
+	Count(ctx context.Context) (int64, error)
+}
+
+// newMarkerStore returns the migration target of the database, nil if MIGRATION_TARGET
+// isn't set. Every tenant database is migrated separately.
+func newMarkerStore(ctx context.Context, cfg Config, db *mongo.Database) (MarkerStore, error) {
+	switch cfg.MigrationTarget {
+	case "":
+		return nil, nil
+	case MigrationMongoDB:
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MigrationTargetURL).SetAppName("images-on-map-server"))
+		if err != nil {
+			return nil, fmt.Errorf("can't connect to the migration target: %w", err)
+		}
+
+		go func() {
+			<-ctx.Done()
+			_ = client.Disconnect(context.Background())
+		}()
+
+		return mongoMarkerStore{client.Database(db.Name()).Collection(cfg.MigrationTargetTable)}, nil
+	case MigrationPostgREST:
+		return postgrestMarkerStore{
+			client:   &http.Client{Timeout: cfg.MigrationTimeout},
+			url:      strings.TrimSuffix(cfg.MigrationTargetURL, "/") + "/" + url.PathEscape(cfg.MigrationTargetTable),
+			token:    cfg.MigrationTargetToken,
+			database: db.Name(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MIGRATION_TARGET %q, expected mongodb or postgrest", cfg.MigrationTarget)
+	}
+}
+
+// mongoMarkerStore writes markers to another MongoDB deployment, e.g. a new cluster.
+type mongoMarkerStore struct {
+	coll *mongo.Collection
+}
+
+func (s mongoMarkerStore) Put(ctx context.Context, m Marker) error {
+	_, err := s.coll.ReplaceOne(ctx, bson.M{"_id": m.ID}, m, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s mongoMarkerStore) Delete(ctx context.Context, id string) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s mongoMarkerStore) Get(ctx context.Context, id string) (*Marker, error) {
+	var m Marker
+	if err := s.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&m); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (s mongoMarkerStore) Count(ctx context.Context) (int64, error) {
+	return s.coll.EstimatedDocumentCount(ctx)
+}
+
+// postgrestMarkerStore writes markers to PostGIS through PostgREST. The table needs
+//
+//	database text, id text, document jsonb, location geometry(Point, 4326),
+//	updated_at timestamptz, primary key (database, id)
+//
+// document holds the marker as returned by the API, location makes it queryable with
+// PostGIS.
+type postgrestMarkerStore struct {
+	client   *http.Client
+	url      string
+	token    string
+	database string
+}
+
+type postgrestRow struct {
+	Database  string    `json:"database"`
+	ID        string    `json:"id"`
+	Document  Marker    `json:"document"`
+	Location  string    `json:"location"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s postgrestMarkerStore) Put(ctx context.Context, m Marker) error {
+	row := postgrestRow{
+		Database:  s.database,
+		ID:        m.ID,
+		Document:  m,
+		Location:  fmt.Sprintf("SRID=4326;POINT(%v %v)", m.Location.Longitude, m.Location.Latitude),
+		UpdatedAt: m.UpdatedAt,
+	}
+
+	body, err := json.Marshal([]postgrestRow{row})
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(ctx, http.MethodPost, "on_conflict=database,id", bytes.NewReader(body), "resolution=merge-duplicates,return=minimal")
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (s postgrestMarkerStore) Delete(ctx context.Context, id string) error {
+	res, err := s.do(ctx, http.MethodDelete, s.filter(id), nil, "return=minimal")
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (s postgrestMarkerStore) Get(ctx context.Context, id string) (*Marker, error) {
+	res, err := s.do(ctx, http.MethodGet, s.filter(id)+"&select=document", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var rows []struct {
+		Document Marker `json:"document"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("postgrest: can't read response: %w", err)
+	}
+
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return &rows[0].Document, nil
+}
+
+// Count reads the total PostgREST reports in Content-Range, e.g. */1024.
+func (s postgrestMarkerStore) Count(ctx context.Context) (int64, error) {
+	res, err := s.do(ctx, http.MethodHead, "database=eq."+url.QueryEscape(s.database)+"&select=id&limit=0", nil, "count=exact")
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	contentRange := res.Header.Get("Content-Range")
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return 0, fmt.Errorf("postgrest: unexpected Content-Range %q", contentRange)
+	}
+
+	n, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("postgrest: unexpected Content-Range %q", contentRange)
+	}
+
+	return n, nil
+}
+
+func (s postgrestMarkerStore) filter(id string) string {
+	return "database=eq." + url.QueryEscape(s.database) + "&id=eq." + url.QueryEscape(id)
+}
+
+func (s postgrestMarkerStore) do(ctx context.Context, method, query string, body io.Reader, prefer string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+"?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", echo.MIMEApplicationJSON)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+
+	if prefer != "" {
+		req.Header.Set("Prefer", prefer)
+	}
+
+	if s.token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("postgrest: %w", err)
+	}
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("postgrest: responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return res, nil
+}
+
+// MigrationReport compares the markers in MongoDB with the migration target.
+type MigrationReport struct {
+	ID         string    `json:"id" bson:"_id"`
+	Target     string    `json:"target" bson:"target"`
+	StartedAt  time.Time `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt" bson:"finishedAt"`
+	// Checked counts the markers in MongoDB, Missing and Different the ones the target
+	// lacks or has in another state.
+	Checked   int64 `json:"checked" bson:"checked"`
+	Missing   int64 `json:"missing" bson:"missing"`
+	Different int64 `json:"different" bson:"different"`
+	// Extra counts markers only the target has. It's approximate while markers change.
+	Extra    int64                 `json:"extra" bson:"extra"`
+	Repaired int64                 `json:"repaired" bson:"repaired"`
+	Samples  []MigrationDivergence `json:"samples" bson:"samples"`
+}
+
+// MigrationStatus shows the migration target, the shadow reads of the instance since it
+// started and the last verification.
+type MigrationStatus struct {
+	Target           string           `json:"target"`
+	ShadowRate       float64          `json:"shadowRate"`
+	ShadowCompared   int64            `json:"shadowCompared"`
+	ShadowMismatched int64            `json:"shadowMismatched"`
+	LastReport       *MigrationReport `json:"lastReport"`
+}
+
+type MigrationDivergence struct {
+	MarkerID string `json:"markerId" bson:"markerId"`
+	// Kind is missing or different.
+	Kind string `json:"kind" bson:"kind"`
+}
+
+// markerMigration mirrors marker changes to a new backend while MongoDB stays the one
+// markers are read from. Changes reach the target through the outbox, so they're
+// retried until the target takes them. Reads can be compared with the target, and a
+// verification job reports and repairs markers that diverge. The first verification
+// copies the markers that existed before the migration started.
+type markerMigration struct {
+	db         *mongo.Database
+	store      MarkerStore
+	target     string
+	repair     bool
+	shadowRate float64
+	logger     echo.Logger
+
+	shadowCompared   int64
+	shadowMismatched int64
+}
+
+func newMarkerMigration(db *mongo.Database, store MarkerStore, cfg Config, logger echo.Logger) *markerMigration {
+	return &markerMigration{
+		db:         db,
+		store:      store,
+		target:     cfg.MigrationTarget,
+		repair:     cfg.MigrationRepair,
+		shadowRate: cfg.MigrationShadowReads,
+		logger:     logger,
+	}
+}
+
+// Deliver applies a marker event to the target. Archived markers leave the markers
+// collection, so they're removed from the target as well.
+func (m *markerMigration) Deliver(ctx context.Context, event Event) error {
+	switch event.Type {
+	case EventMarkerCreated, EventMarkerUpdated:
+		if event.Marker == nil {
+			return nil
+		}
+
+		return m.store.Put(ctx, *event.Marker)
+	case EventMarkerDeleted, EventMarkerArchived:
+		return m.store.Delete(ctx, event.MarkerID)
+	default:
+		return nil
+	}
+}
+
+// shadowRead compares a share of the markers read from MongoDB with the target in the
+// background. Mismatches are logged and counted, the response is never affected.
+func (m *markerMigration) shadowRead(marker Marker) {
+	if m.shadowRate <= 0 || rand.Float64() >= m.shadowRate {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		other, err := m.store.Get(ctx, marker.ID)
+		if err != nil {
+			m.logger.Warnf("can't shadow read marker %s: %v", marker.ID, err)
+			return
+		}
+
+		atomic.AddInt64(&m.shadowCompared, 1)
+		if same, err := sameMarker(marker, other); err != nil || !same {
+			atomic.AddInt64(&m.shadowMismatched, 1)
+			m.logger.Warnf("marker %s differs in the %s migration target", marker.ID, m.target)
+		}
+	}()
+}
+
+// verify compares every marker with the target and stores the report. With
+// MIGRATION_REPAIR the target gets the current state of divergent markers.
+func (m *markerMigration) verify(ctx context.Context) error {
+	report := MigrationReport{
+		ID:        primitive.NewObjectID().Hex(),
+		Target:    m.target,
+		StartedAt: time.Now().UTC(),
+		Samples:   []MigrationDivergence{},
+	}
+
+	cursor, err := m.db.Collection("markers").Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var repairedMissing int64
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		report.Checked++
+		other, err := m.store.Get(ctx, marker.ID)
+		if err != nil {
+			return err
+		}
+
+		kind := ""
+		if other == nil {
+			kind = "missing"
+			report.Missing++
+		} else if same, err := sameMarker(marker, other); err != nil {
+			return err
+		} else if !same {
+			kind = "different"
+			report.Different++
+		}
+
+		if kind == "" {
+			continue
+		}
+
+		if len(report.Samples) < migrationSamples {
+			report.Samples = append(report.Samples, MigrationDivergence{MarkerID: marker.ID, Kind: kind})
+		}
+
+		if m.repair {
+			if err := m.store.Put(ctx, marker); err != nil {
+				return err
+			}
+
+			report.Repaired++
+			if other == nil {
+				repairedMissing++
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	total, err := m.store.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	if extra := total - (report.Checked - report.Missing + repairedMissing); extra > 0 {
+		report.Extra = extra
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	_, err = m.db.Collection("migrationReports").InsertOne(ctx, report)
+	return err
+}
+
+// sameMarker compares markers as they're stored, ignoring like counts. They're derived
+// from likes, which the migration doesn't mirror.
+func sameMarker(a Marker, b *Marker) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+
+	ca, err := canonicalMarker(a)
+	if err != nil {
+		return false, err
+	}
+
+	cb, err := canonicalMarker(*b)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(ca, cb), nil
+}
+
+// canonicalMarker renders the marker after a trip through BSON, which rounds times to
+// milliseconds like MongoDB does.
+func canonicalMarker(m Marker) ([]byte, error) {
+	m.LikeCount = 0
+	data, err := bson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored Marker
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(stored)
+}
+
+// registerMigrationRoutes shows admins how far the migration target is from MongoDB.
+// Verification runs as the verify-migration job, POST /jobs/verify-migration/run starts
+// it right away.
+func registerMigrationRoutes(group *echo.Group, db *mongo.Database, m *markerMigration) {
+	group.GET("/migration", func(c echo.Context) error {
+		var last *MigrationReport
+		var report MigrationReport
+		err := db.Collection("migrationReports").FindOne(c.Request().Context(), bson.M{},
+			options.FindOne().SetSort(bson.D{{Key: "startedAt", Value: -1}})).Decode(&report)
+		if err == nil {
+			last = &report
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, MigrationStatus{
+			Target:           m.target,
+			ShadowRate:       m.shadowRate,
+			ShadowCompared:   atomic.LoadInt64(&m.shadowCompared),
+			ShadowMismatched: atomic.LoadInt64(&m.shadowMismatched),
+			LastReport:       last,
+		})
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration is a versioned change of the stored documents. Collections and indexes are
+// created by ensureCollections, migrations rewrite the data that is already there.
+type migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations are applied in order, versions must increase and never be reused.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "start marker revisions at 1",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"revision": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"revision": 1}})
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"revision": 1}, bson.M{"$unset": bson.M{"revision": ""}})
+		},
+	},
+	{
+		Version:     2,
+		Description: "store marker locations as GeoJSON points",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Locations outside of the valid ranges were accepted before and can't be indexed.
+			filter := bson.M{
+				"geo":                bson.M{"$exists": false},
+				"location.latitude":  bson.M{"$gte": -90, "$lte": 90},
+				"location.longitude": bson.M{"$gte": -180, "$lte": 180},
+			}
+			return updateMarkers(ctx, db, filter, bson.A{bson.M{"$set": bson.M{"geo": bson.M{
+				"type":        "Point",
+				"coordinates": bson.A{"$location.longitude", "$location.latitude"},
+			}}}})
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"geo": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"geo": ""}})
+		},
+	},
+	{
+		Version:     3,
+		Description: "record the size of images uploaded before sizes were tracked",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"images": bson.M{"$elemMatch": bson.M{"size": bson.M{"$exists": false}}}}, bson.A{bson.M{"$set": bson.M{"images": bson.M{
+				"$map": bson.M{
+					"input": "$images",
+					"in":    bson.M{"$mergeObjects": bson.A{bson.M{"size": 0}, "$$this"}},
+				},
+			}}}})
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "compute marker geohashes",
+		Up:          backfillGeohashes,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"geohash": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"geohash": ""}})
+		},
+	},
+	{
+		Version:     5,
+		Description: "store case-folded marker names for autocomplete",
+		Up:          backfillNameLower,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"nameLower": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"nameLower": ""}})
+		},
+	},
+	{
+		Version:     6,
+		Description: "validate markers with a JSON schema",
+		Up:          applyMarkerSchema,
+		Down:        dropMarkerSchema,
+	},
+	{
+		Version:     7,
+		Description: "seed marker history with the current markers",
+		Up:          seedHistory,
+		Down:        unseedHistory,
+	},
+	{
+		Version:     8,
+		Description: "start the changes feed with the current markers",
+		Up:          seedChanges,
+		Down:        unseedChanges,
+	},
+	{
+		Version:     9,
+		Description: "flag markers in privacy zones",
+		Up:          backfillPrivacyZones,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return updateMarkers(ctx, db, bson.M{"privacyZone": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"privacyZone": ""}})
+		},
+	},
+}
+
+// AppliedMigration records a migration applied to the database.
+type AppliedMigration struct {
+	Version     int       `json:"version" bson:"_id"`
+	Description string    `json:"description" bson:"description"`
+	AppliedAt   time.Time `json:"appliedAt" bson:"appliedAt"`
+}
+
+const migrationLockTimeout = 10 * time.Minute
+
+// updateMarkers applies the update to live and archived markers.
+func updateMarkers(ctx context.Context, db *mongo.Database, filter bson.M, update interface{}) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		if _, err := db.Collection(name).UpdateMany(ctx, filter, update); err != nil {
+			return fmt.Errorf("can't update %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func latestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// schemaVersion returns the version of the last migration applied to the database.
+func schemaVersion(ctx context.Context, db *mongo.Database) (int, error) {
+	var applied AppliedMigration
+	err := db.Collection("migrations").FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&applied)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+
+	return applied.Version, err
+}
+
+// migrate applies or reverts migrations until the database is at the target version.
+// Every step is recorded on its own, so a failed run continues where it stopped. Servers
+// starting at the same time wait for each other.
+func migrate(ctx context.Context, db *mongo.Database, target int, log func(string)) error {
+	if err := lockMigrations(ctx, db); err != nil {
+		return err
+	}
+	defer db.Collection("locks").DeleteOne(context.Background(), bson.M{"_id": "migrations"})
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("can't read schema version: %w", err)
+	}
+
+	if current > latestMigration() {
+		return fmt.Errorf("database %s is at schema version %d, newer than this server knows (%d)", db.Name(), current, latestMigration())
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+
+		log(fmt.Sprintf("%s: applying migration %d, %s", db.Name(), m.Version, m.Description))
+		if err := m.Up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d failed: %w", m.Version, err)
+		}
+
+		if _, err := db.Collection("migrations").InsertOne(ctx, AppliedMigration{m.Version, m.Description, time.Now().UTC()}); err != nil {
+			return fmt.Errorf("can't record migration %d: %w", m.Version, err)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+
+		log(fmt.Sprintf("%s: reverting migration %d, %s", db.Name(), m.Version, m.Description))
+		if err := m.Down(ctx, db); err != nil {
+			return fmt.Errorf("reverting migration %d failed: %w", m.Version, err)
+		}
+
+		if _, err := db.Collection("migrations").DeleteOne(ctx, bson.M{"_id": m.Version}); err != nil {
+			return fmt.Errorf("can't record reverting migration %d: %w", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// lockMigrations takes the migration lock of the database. A lock older than
+// migrationLockTimeout is left over from a crashed run and is taken over.
+func lockMigrations(ctx context.Context, db *mongo.Database) error {
+	locks := db.Collection("locks")
+
+	for {
+		_, err := locks.InsertOne(ctx, bson.M{"_id": "migrations", "lockedAt": time.Now().UTC()})
+		if err == nil {
+			return nil
+		}
+
+		var writeErr mongo.WriteException
+		if !errors.As(err, &writeErr) || !writeErr.HasErrorCode(11000) {
+			return fmt.Errorf("can't lock migrations: %w", err)
+		}
+
+		stale := bson.M{"_id": "migrations", "lockedAt": bson.M{"$lt": time.Now().UTC().Add(-migrationLockTimeout)}}
+		if _, err := locks.DeleteOne(ctx, stale); err != nil {
+			return fmt.Errorf("can't lock migrations: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for migrations running elsewhere: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ModerationPending = "pending"
+
+const (
+	FlagOpen     = "open"
+	FlagApproved = "approved"
+	FlagRemoved  = "removed"
+)
+
+const (
+	maxFlagReasonLength = 500
+
+	defaultFlagsLimit = 50
+	maxFlagsLimit     = 200
+)
+
+// Flag is a report of abusive content on a marker or one of its images.
+type Flag struct {
+	ID         string    `json:"id" bson:"_id"`
+	MarkerID   string    `json:"markerId" bson:"markerId"`
+	ImageID    string    `json:"imageId,omitempty" bson:"imageId,omitempty"`
+	Reason     string    `json:"reason" bson:"reason"`
+	ReporterID string    `json:"reporterId" bson:"reporterId"`
+	Status     string    `json:"status" bson:"status"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func (f Flag) Validate() error {
+	if f.Reason == "" {
+		return fmt.Errorf("empty reason")
+	}
+
+	if utf8.RuneCountInString(f.Reason) > maxFlagReasonLength {
+		return fmt.Errorf("reason is longer than %d characters", maxFlagReasonLength)
+	}
+
+	return nil
+}
+
+// registerFlagRoutes lets users report markers. Once threshold different users have
+// open reports on a marker, it's hidden until a moderator reviews it.
+func registerFlagRoutes(group *echo.Group, db *mongo.Database, threshold int) {
+	group.POST("/:id/flag", func(c echo.Context) error {
+		var body Flag
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		user, _ := currentUser(c)
+		flag := Flag{
+			ID:         primitive.NewObjectID().Hex(),
+			MarkerID:   c.Param("id"),
+			ImageID:    body.ImageID,
+			Reason:     sanitizeText(body.Reason),
+			ReporterID: user.ID,
+			Status:     FlagOpen,
+			CreatedAt:  time.Now().UTC(),
+		}
+
+		if err := flag.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		ctx := c.Request().Context()
+		filter := visibleMarker(c, flag.MarkerID)
+		if flag.ImageID != "" {
+			filter = and(filter, bson.M{"images._id": flag.ImageID})
+		}
+
+		if err := db.Collection("markers").FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Err(); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "marker or image not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// Repeated reports of the same content by the same user only update the reason.
+		if _, err := db.Collection("flags").UpdateOne(ctx,
+			bson.M{"markerId": flag.MarkerID, "imageId": flag.ImageID, "reporterId": flag.ReporterID, "status": FlagOpen},
+			bson.M{"$set": bson.M{"reason": flag.Reason}, "$setOnInsert": bson.M{"_id": flag.ID, "createdAt": flag.CreatedAt}},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		reporters, err := db.Collection("flags").Distinct(ctx, "reporterId", bson.M{"markerId": flag.MarkerID, "status": FlagOpen})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(reporters) >= threshold {
+			if _, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": flag.MarkerID}, bson.M{"$set": bson.M{"moderation": ModerationPending}}); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if err := appendUpdateEvent(ctx, db, flag.MarkerID); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}, requireUser())
+}
+
+// resolveFlags closes open flags of a marker, or of a single image when imageID is set.
+func resolveFlags(ctx context.Context, db *mongo.Database, markerID, imageID, status string) error {
+	filter := bson.M{"markerId": markerID, "status": FlagOpen}
+	if imageID != "" {
+		filter["imageId"] = imageID
+	}
+
+	_, err := db.Collection("flags").UpdateMany(ctx, filter, bson.M{"$set": bson.M{"status": status}})
+	return err
+}
+
+func registerModerationRoutes(group *echo.Group, db *mongo.Database) {
+	group.GET("/flags", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultFlagsLimit, maxFlagsLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		status := c.QueryParam("status")
+		if status == "" {
+			status = FlagOpen
+		}
+
+		cursor, err := db.Collection("flags").Find(c.Request().Context(), bson.M{"status": status}, options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Flag{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.GET("/markers", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultFlagsLimit, maxFlagsLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), bson.M{"moderation": ModerationPending}, options.Find().
+			SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Marker{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		for i := range results {
+			results[i] = results[i].Normalize()
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("/markers/:id/approve", func(c echo.Context) error {
+		id := c.Param("id")
+		ctx := c.Request().Context()
+		res, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"moderation": ""}})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if err := appendUpdateEvent(ctx, db, id); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if err := resolveFlags(ctx, db, id, "", FlagApproved); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if err := recordAudit(ctx, db, user.ID, "moderation.approve", []string{id}, nil); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+	group.POST("/markers/:id/remove", func(c echo.Context) error {
+		id := c.Param("id")
+		ctx := c.Request().Context()
+		if err := deleteMarker(ctx, db, id); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if err := recordAudit(ctx, db, user.ID, "moderation.remove", []string{id}, nil); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+	group.POST("/markers/:id/images/:imageID/remove", func(c echo.Context) error {
+		id, imageID := c.Param("id"), c.Param("imageID")
+		ctx := c.Request().Context()
+		res, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+			"$pull": bson.M{"images": bson.M{"_id": imageID}},
+			"$set":  bson.M{"updatedAt": time.Now().UTC()},
+			"$inc":  bson.M{"revision": 1},
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		if err := resolveFlags(ctx, db, id, imageID, FlagRemoved); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// The marker becomes visible again once nothing else on it awaits review.
+		open, err := db.Collection("flags").CountDocuments(ctx, bson.M{"markerId": id, "status": FlagOpen})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if open == 0 {
+			if _, err := db.Collection("markers").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"moderation": ""}}); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+		}
+
+		if err := appendUpdateEvent(ctx, db, id); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		if err := recordAudit(ctx, db, user.ID, "moderation.remove-image", []string{id}, bson.M{"imageId": imageID}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
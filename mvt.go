@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// mvtExtent is the size of the grid point coordinates in vector tiles snap to.
+	mvtExtent      = 4096
+	mvtLayerName   = "markers"
+	mvtContentType = "application/vnd.mapbox-vector-tile"
+)
+
+// mvtFields describes the properties of features in the markers layer for the metadata
+// of archives.
+var mvtFields = map[string]string{
+	"id":        "String",
+	"name":      "String",
+	"tags":      "String",
+	"likeCount": "Number",
+	"image":     "String",
+	"icon":      "String",
+	"color":     "String",
+	"emoji":     "String",
+	"cluster":   "Boolean",
+	"count":     "Number",
+	"geohash":   "String",
+}
+
+// encodeMarkerTile encodes the markers or clusters of a tile as a Mapbox Vector Tile with
+// a single layer of points. Tags are joined with commas, as vector tiles have no lists.
+func encodeMarkerTile(tile MarkerTile) []byte {
+	layer := newMVTLayer(mvtLayerName)
+
+	for _, cluster := range tile.Clusters {
+		layer.addPoint(tile, cluster.Location, []mvtProperty{
+			{"cluster", true},
+			{"count", cluster.Count},
+			{"geohash", cluster.Geohash},
+		})
+	}
+
+	for _, m := range tile.Markers {
+		name := m.LocalizedName
+		if name == "" {
+			name = m.Name
+		}
+
+		props := []mvtProperty{
+			{"id", m.ID},
+			{"name", name},
+			{"likeCount", m.LikeCount},
+		}
+
+		// Styles pick names in other languages from name:<tag> like in OpenStreetMap
+		// based tiles.
+		for _, tag := range nameLanguages(m) {
+			props = append(props, mvtProperty{"name:" + tag, m.Names[tag]})
+		}
+
+		if len(m.Tags) > 0 {
+			props = append(props, mvtProperty{"tags", strings.Join(m.Tags, ",")})
+		}
+
+		if len(m.Images) > 0 {
+			props = append(props, mvtProperty{"image", m.Images[0].URI})
+		}
+
+		for _, p := range []mvtProperty{{"icon", m.Icon}, {"color", m.Color}, {"emoji", m.Emoji}} {
+			if p.value != "" {
+				props = append(props, p)
+			}
+		}
+
+		layer.addPoint(tile, m.Location, props)
+	}
+
+	return appendBytes(nil, 3, layer.encode())
+}
+
+type mvtProperty struct {
+	key   string
+	value interface{}
+}
+
+// mvtLayer collects the features of a layer. Keys and values are shared by features and
+// stored once.
+type mvtLayer struct {
+	name     string
+	keys     []string
+	values   [][]byte
+	indices  map[string]uint64
+	features [][]byte
+}
+
+func newMVTLayer(name string) *mvtLayer {
+	return &mvtLayer{name: name, indices: map[string]uint64{}}
+}
+
+func (l *mvtLayer) addPoint(tile MarkerTile, at Coords, props []mvtProperty) {
+	x, y := tilePixel(tile.Z, tile.X, tile.Y, at)
+
+	var tags []byte
+	for _, p := range props {
+		tags = appendVarint(tags, l.key(p.key))
+		tags = appendVarint(tags, l.value(p.value))
+	}
+
+	// A single MoveTo command with a count of 1 draws a point.
+	var geometry []byte
+	geometry = appendVarint(geometry, 1|1<<3)
+	geometry = appendVarint(geometry, zigzag(x))
+	geometry = appendVarint(geometry, zigzag(y))
+
+	var feature []byte
+	feature = appendBytes(feature, 2, tags)
+	feature = appendTag(feature, 3, 0)
+	feature = appendVarint(feature, 1)
+	feature = appendBytes(feature, 4, geometry)
+	l.features = append(l.features, feature)
+}
+
+func (l *mvtLayer) key(k string) uint64 {
+	if i, ok := l.indices["k:"+k]; ok {
+		return i
+	}
+
+	i := uint64(len(l.keys))
+	l.indices["k:"+k] = i
+	l.keys = append(l.keys, k)
+	return i
+}
+
+func (l *mvtLayer) value(v interface{}) uint64 {
+	id := fmt.Sprintf("v:%T:%v", v, v)
+	if i, ok := l.indices[id]; ok {
+		return i
+	}
+
+	var value []byte
+	switch v := v.(type) {
+	case string:
+		value = appendBytes(value, 1, []byte(v))
+	case bool:
+		value = appendTag(value, 7, 0)
+		if v {
+			value = appendVarint(value, 1)
+		} else {
+			value = appendVarint(value, 0)
+		}
+	case int:
+		value = appendTag(value, 6, 0)
+		value = appendVarint(value, uint64(v<<1)^uint64(v>>63))
+	}
+
+	i := uint64(len(l.values))
+	l.indices[id] = i
+	l.values = append(l.values, value)
+	return i
+}
+
+func (l *mvtLayer) encode() []byte {
+	var b []byte
+	b = appendTag(b, 15, 0)
+	b = appendVarint(b, 2)
+	b = appendBytes(b, 1, []byte(l.name))
+
+	for _, f := range l.features {
+		b = appendBytes(b, 2, f)
+	}
+
+	for _, k := range l.keys {
+		b = appendBytes(b, 3, []byte(k))
+	}
+
+	for _, v := range l.values {
+		b = appendBytes(b, 4, v)
+	}
+
+	b = appendTag(b, 5, 0)
+	return appendVarint(b, mvtExtent)
+}
+
+// tilePixel projects a location to Web Mercator and returns its position on the grid of
+// the tile.
+func tilePixel(z, x, y int, at Coords) (int32, int32) {
+	n := float64(int(1) << z)
+	lat := at.Latitude * math.Pi / 180
+	wx := (at.Longitude + 180) / 360 * n
+	wy := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+
+	return int32(math.Round((wx - float64(x)) * mvtExtent)), int32(math.Round((wy - float64(y)) * mvtExtent))
+}
+
+func zigzag(v int32) uint64 {
+	return uint64(uint32((v << 1) ^ (v >> 31)))
+}
+
+// The helpers below write the protobuf wire format, which is all vector tiles need.
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZigzag(t *testing.T) {
+	tests := []struct {
+		in   int32
+		want uint64
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{-2, 3},
+		{2048, 4096},
+		{2147483647, 4294967294},
+		{-2147483648, 4294967295},
+	}
+
+	for _, tt := range tests {
+		if got := zigzag(tt.in); got != tt.want {
+			t.Errorf("zigzag(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAppendVarint(t *testing.T) {
+	tests := []struct {
+		in   uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+		{4096, []byte{0x80, 0x20}},
+	}
+
+	for _, tt := range tests {
+		if got := appendVarint(nil, tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("appendVarint(%d) = % x, want % x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTilePixel(t *testing.T) {
+	tests := []struct {
+		name    string
+		z, x, y int
+		at      Coords
+		wantX   int32
+		wantY   int32
+	}{
+		{"center of the world", 0, 0, 0, Coords{}, 2048, 2048},
+		{"top left of a tile", 1, 1, 1, Coords{}, 0, 0},
+		{"outside the tile", 1, 0, 0, Coords{}, 4096, 4096},
+		{"west edge", 0, 0, 0, Coords{Longitude: -180}, 0, 2048},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y := tilePixel(tt.z, tt.x, tt.y, tt.at)
+			if x != tt.wantX || y != tt.wantY {
+				t.Errorf("tilePixel() = (%d, %d), want (%d, %d)", x, y, tt.wantX, tt.wantY)
+			}
+		})
+	}
+}
+
+func TestEncodeMarkerTile(t *testing.T) {
+	// A point at the center of the tile: MoveTo (id 1) with a count of 1, then
+	// zigzag(2048) twice.
+	geometry := []byte{0x09, 0x80, 0x20, 0x80, 0x20}
+
+	tests := []struct {
+		name string
+		tile MarkerTile
+		want [][]byte
+	}{
+		{
+			name: "empty",
+			tile: MarkerTile{},
+			want: [][]byte{
+				{0x1a, 0x0e},                    // tile.layers
+				{0x78, 0x02},                    // layer.version = 2
+				{0x0a, 0x07}, []byte("markers"), // layer.name
+				{0x28, 0x80, 0x20}, // layer.extent = 4096
+			},
+		},
+		{
+			name: "cluster",
+			tile: MarkerTile{Clusters: []GeohashCluster{{Geohash: "s", Count: 3}}},
+			want: [][]byte{
+				{0x1a, 0x47},
+				{0x78, 0x02},
+				{0x0a, 0x07}, []byte("markers"),
+				// layer.features: tags, type = POINT, geometry.
+				{0x12, 0x11},
+				{0x12, 0x06, 0x00, 0x00, 0x01, 0x01, 0x02, 0x02},
+				{0x18, 0x01},
+				{0x22, 0x05}, geometry,
+				// layer.keys
+				{0x1a, 0x07}, []byte("cluster"),
+				{0x1a, 0x05}, []byte("count"),
+				{0x1a, 0x07}, []byte("geohash"),
+				// layer.values: bool_value, sint_value, string_value.
+				{0x22, 0x02, 0x38, 0x01},
+				{0x22, 0x02, 0x30, 0x06},
+				{0x22, 0x03, 0x0a, 0x01, 's'},
+				{0x28, 0x80, 0x20},
+			},
+		},
+		{
+			name: "markers share keys and values",
+			tile: MarkerTile{Markers: []Marker{{Name: "a"}, {Name: "a"}}},
+			want: [][]byte{
+				{0x1a, 0x56},
+				{0x78, 0x02},
+				{0x0a, 0x07}, []byte("markers"),
+				{0x12, 0x11},
+				{0x12, 0x06, 0x00, 0x00, 0x01, 0x01, 0x02, 0x02},
+				{0x18, 0x01},
+				{0x22, 0x05}, geometry,
+				{0x12, 0x11},
+				{0x12, 0x06, 0x00, 0x00, 0x01, 0x01, 0x02, 0x02},
+				{0x18, 0x01},
+				{0x22, 0x05}, geometry,
+				{0x1a, 0x02}, []byte("id"),
+				{0x1a, 0x04}, []byte("name"),
+				{0x1a, 0x09}, []byte("likeCount"),
+				{0x22, 0x02, 0x0a, 0x00},
+				{0x22, 0x03, 0x0a, 0x01, 'a'},
+				{0x22, 0x02, 0x30, 0x00},
+				{0x28, 0x80, 0x20},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := bytes.Join(tt.want, nil)
+			if got := encodeMarkerTile(tt.tile); !bytes.Equal(got, want) {
+				t.Errorf("encodeMarkerTile() =\n% x\nwant\n% x", got, want)
+			}
+		})
+	}
+}
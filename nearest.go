@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultNearestCount = 10
+	maxNearestCount     = 100
+)
+
+// NearbyMarker is a marker with its distance in meters from the queried location.
+type NearbyMarker struct {
+	Marker         `bson:",inline"`
+	DistanceMeters float64 `json:"distanceMeters" bson:"distanceMeters"`
+}
+
+// parseLocation reads the required ?lat= and ?lon= parameters.
+func parseLocation(c echo.Context) (Coords, error) {
+	lat, err := strconv.ParseFloat(c.QueryParam("lat"), 64)
+	if err != nil {
+		return Coords{}, fmt.Errorf("invalid lat, expected a number")
+	}
+
+	lon, err := strconv.ParseFloat(c.QueryParam("lon"), 64)
+	if err != nil {
+		return Coords{}, fmt.Errorf("invalid lon, expected a number")
+	}
+
+	location := Coords{Latitude: lat, Longitude: lon}
+	if err := location.Validate(); err != nil {
+		return Coords{}, err
+	}
+
+	return location, nil
+}
+
+// parseOrigin reads the optional ?lat= and ?lon= parameters distances are measured
+// from, ok is false if there are none.
+func parseOrigin(c echo.Context) (Coords, bool, error) {
+	if c.QueryParam("lat") == "" && c.QueryParam("lon") == "" {
+		return Coords{}, false, nil
+	}
+
+	origin, err := parseLocation(c)
+	return origin, err == nil, err
+}
+
+// withDistances annotates markers with their distances from the origin.
+func withDistances(markers []Marker, origin Coords) []NearbyMarker {
+	nearby := make([]NearbyMarker, 0, len(markers))
+	for _, m := range markers {
+		nearby = append(nearby, NearbyMarker{Marker: m, DistanceMeters: haversine(origin, m.Location)})
+	}
+
+	return nearby
+}
+
+func registerNearestRoutes(group *echo.Group, db *mongo.Database, cache *responseCache, privacy *markerPrivacy) {
+	group.GET("/nearest", func(c echo.Context) error {
+		location, err := parseLocation(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		k, err := parseIntParam(c, "k", defaultNearestCount, 1, maxNearestCount)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		cursor, err := db.Collection("markers").Aggregate(c.Request().Context(), mongo.Pipeline{
+			{{Key: "$geoNear", Value: bson.M{
+				"near":          location.point(),
+				"key":           "geo",
+				"distanceField": "distanceMeters",
+				"spherical":     true,
+				"query":         and(filter, outsideZones(c)),
+			}}},
+			{{Key: "$limit", Value: k}},
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []NearbyMarker{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		view := privacy.view(c)
+		visible := results[:0]
+		for _, result := range results {
+			exact := result.Marker.Location
+			ok, err := view.redactMarker(c.Request().Context(), &result.Marker)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if ok {
+				if result.Marker.Location != exact {
+					result.DistanceMeters = haversine(location, result.Marker.Location)
+				}
+
+				result.Marker = result.Marker.Normalize()
+				visible = append(visible, result)
+			}
+		}
+		results = visible
+
+		return c.JSON(http.StatusOK, results)
+	}, cache.middleware())
+}
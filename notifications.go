@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxGeofences      = 20
+	minGeofenceRadius = 100.0
+	maxGeofenceRadius = 50000.0
+	maxDeviceToken    = 4096
+)
+
+// Device is a registered push token of a user's app installation.
+type Device struct {
+	Token     string    `json:"token" bson:"_id"`
+	UserID    string    `json:"-" bson:"userId"`
+	Platform  string    `json:"platform" bson:"platform"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+type DeviceRequest struct {
+	Platform string `json:"platform"`
+}
+
+func (r DeviceRequest) Validate() error {
+	if r.Platform != PlatformFCM && r.Platform != PlatformAPNs {
+		return fmt.Errorf("unknown platform, expected %s or %s", PlatformFCM, PlatformAPNs)
+	}
+
+	return nil
+}
+
+// Bounds is a latitude and longitude range used to find geofences with range queries.
+type Bounds struct {
+	MinLatitude  float64 `json:"minLatitude" bson:"minLatitude"`
+	MaxLatitude  float64 `json:"maxLatitude" bson:"maxLatitude"`
+	MinLongitude float64 `json:"minLongitude" bson:"minLongitude"`
+	MaxLongitude float64 `json:"maxLongitude" bson:"maxLongitude"`
+}
+
+// Geofence is an area a user wants to hear about new markers in.
+type Geofence struct {
+	ID        string    `json:"id" bson:"_id"`
+	UserID    string    `json:"-" bson:"userId"`
+	Name      string    `json:"name" bson:"name"`
+	Center    Coords    `json:"center" bson:"center"`
+	Radius    float64   `json:"radius" bson:"radius"`
+	Bounds    Bounds    `json:"-" bson:"bounds"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func (g Geofence) Validate() error {
+	if err := g.Center.Validate(); err != nil {
+		return fmt.Errorf("invalid center: %w", err)
+	}
+
+	if g.Radius < minGeofenceRadius || g.Radius > maxGeofenceRadius {
+		return fmt.Errorf("invalid radius, expected %g to %g meters", minGeofenceRadius, maxGeofenceRadius)
+	}
+
+	return nil
+}
+
+// bounds returns the square around the geofence circle.
+func (g Geofence) bounds() Bounds {
+	dLat := g.Radius / metersPerDegree
+	dLon := dLat / math.Cos(g.Center.Latitude*math.Pi/180)
+	return Bounds{
+		MinLatitude:  g.Center.Latitude - dLat,
+		MaxLatitude:  g.Center.Latitude + dLat,
+		MinLongitude: g.Center.Longitude - dLon,
+		MaxLongitude: g.Center.Longitude + dLon,
+	}
+}
+
+// notifier tells users about new public markers inside their geofences. Deliveries
+// happen in the background so creating markers doesn't wait for push services.
+type notifier struct {
+	db      *mongo.Database
+	pushers map[string]Pusher
+	logger  echo.Logger
+	queue   chan Marker
+}
+
+func newNotifier(db *mongo.Database, pushers map[string]Pusher, logger echo.Logger) *notifier {
+	return &notifier{
+		db:      db,
+		pushers: pushers,
+		logger:  logger,
+		queue:   make(chan Marker, 1000),
+	}
+}
+
+// markerCreated schedules notifications about the marker. Private markers are skipped,
+// scheduled ones are announced once they are published.
+func (n *notifier) markerCreated(m Marker) {
+	if len(n.pushers) == 0 || m.Private || m.scheduled() {
+		return
+	}
+
+	select {
+	case n.queue <- m:
+	default:
+		n.logger.Warnf("notification queue is full, nobody is notified about marker %s", m.ID)
+	}
+}
+
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case marker := <-n.queue:
+			if err := n.notify(ctx, marker); err != nil {
+				n.logger.Error(err)
+			}
+		}
+	}
+}
+
+// watchers returns the users with a geofence containing the location.
+func (n *notifier) watchers(ctx context.Context, location Coords) (map[string]bool, error) {
+	cursor, err := n.db.Collection("geofences").Find(ctx, bson.M{
+		"bounds.minLatitude":  bson.M{"$lte": location.Latitude},
+		"bounds.maxLatitude":  bson.M{"$gte": location.Latitude},
+		"bounds.minLongitude": bson.M{"$lte": location.Longitude},
+		"bounds.maxLongitude": bson.M{"$gte": location.Longitude},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var geofences []Geofence
+	if err := cursor.All(context.Background(), &geofences); err != nil {
+		return nil, err
+	}
+
+	users := map[string]bool{}
+	for _, geofence := range geofences {
+		if haversine(geofence.Center, location) <= geofence.Radius {
+			users[geofence.UserID] = true
+		}
+	}
+
+	return users, nil
+}
+
+func (n *notifier) notify(ctx context.Context, m Marker) error {
+	// Geofences would tell watchers where markers in privacy zones are.
+	zone, err := ownerZone(ctx, n.db, m.OwnerID, m.Location)
+	if err != nil || zone != "" {
+		return err
+	}
+
+	users, err := n.watchers(ctx, m.Location)
+	if err != nil {
+		return err
+	}
+
+	// Nobody needs to hear about their own markers.
+	delete(users, m.OwnerID)
+	if len(users) == 0 {
+		return nil
+	}
+
+	ids := make(bson.A, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+
+	cursor, err := n.db.Collection("devices").Find(ctx, bson.M{"userId": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+
+	var devices []Device
+	if err := cursor.All(context.Background(), &devices); err != nil {
+		return err
+	}
+
+	notification := Notification{
+		Title: "New place nearby",
+		Body:  m.Name,
+		Data:  map[string]string{"markerId": m.ID},
+	}
+	for _, device := range devices {
+		pusher, ok := n.pushers[device.Platform]
+		if !ok {
+			continue
+		}
+
+		err := pusher.Push(ctx, device.Token, notification)
+		if errors.Is(err, errDeviceGone) {
+			if _, err := n.db.Collection("devices").DeleteOne(ctx, bson.M{"_id": device.Token}); err != nil {
+				n.logger.Error(err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			n.logger.Warnf("can't push to device of user %s: %v", device.UserID, err)
+		}
+	}
+
+	return nil
+}
+
+// registerNotificationRoutes adds push devices and geofences of the current user under
+// /users/me.
+func registerNotificationRoutes(group *echo.Group, db *mongo.Database) {
+	group.PUT("/me/devices/:token", func(c echo.Context) error {
+		var body DeviceRequest
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		token := strings.TrimSpace(c.Param("token"))
+		if token == "" || len(token) > maxDeviceToken {
+			s := "invalid device token"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		// A device moves to the user who signed in on it last.
+		user, _ := currentUser(c)
+		now := time.Now().UTC()
+		if _, err := db.Collection("devices").UpdateOne(c.Request().Context(),
+			bson.M{"_id": token},
+			bson.M{
+				"$set":         bson.M{"userId": user.ID, "platform": body.Platform, "updatedAt": now},
+				"$setOnInsert": bson.M{"createdAt": now},
+			},
+			options.Update().SetUpsert(true),
+		); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+	group.DELETE("/me/devices/:token", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		if _, err := db.Collection("devices").DeleteOne(c.Request().Context(), bson.M{"_id": c.Param("token"), "userId": user.ID}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+	group.GET("/me/geofences", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		cursor, err := db.Collection("geofences").Find(c.Request().Context(), bson.M{"userId": user.ID}, options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Geofence{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("/me/geofences", func(c echo.Context) error {
+		var body Geofence
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		user, _ := currentUser(c)
+		count, err := db.Collection("geofences").CountDocuments(c.Request().Context(), bson.M{"userId": user.ID})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if count >= maxGeofences {
+			s := fmt.Sprintf("at most %d geofences per user", maxGeofences)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		body.ID = primitive.NewObjectID().Hex()
+		body.UserID = user.ID
+		body.Name = strings.TrimSpace(body.Name)
+		body.Bounds = body.bounds()
+		body.CreatedAt = time.Now().UTC()
+
+		if _, err := db.Collection("geofences").InsertOne(c.Request().Context(), body); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusCreated, body)
+	})
+	group.DELETE("/me/geofences/:id", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		if _, err := db.Collection("geofences").DeleteOne(c.Request().Context(), bson.M{"_id": c.Param("id"), "userId": user.ID}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	providerName = "Images on Map"
+	// oembedMapZoom shows the streets around a marker.
+	oembedMapZoom = 15
+	// oembedMapSize is the width and height of the map unless the consumer asks for less.
+	oembedMapSize  = 256
+	minOEmbedSize  = 64
+	oembedTileSize = 256
+)
+
+// OEmbed is a rich oEmbed response, see https://oembed.com.
+type OEmbed struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// oembedTile is a map tile of the embed placed relative to its top left corner.
+type oembedTile struct {
+	URL       string
+	Left, Top int
+}
+
+// oembedTemplate draws the marker as a pin in the middle of the map tiles around it,
+// with its name below. Consumers embed the snippet as it is, styles are inline.
+var oembedTemplate = template.Must(template.New("oembed").Parse(
+	`<div style="width:{{.Size}}px;font-family:sans-serif">` +
+		`<a href="{{.URL}}" target="_blank" rel="noopener" style="color:inherit;text-decoration:none">` +
+		`<div style="position:relative;width:{{.Size}}px;height:{{.Size}}px;overflow:hidden;background:#e5e3df">` +
+		`{{range .Tiles}}<img src="{{.URL}}" alt="" width="256" height="256" style="position:absolute;left:{{.Left}}px;top:{{.Top}}px">{{end}}` +
+		`<span style="position:absolute;left:{{.Center}}px;top:{{.Center}}px;transform:translate(-50%,-100%);font-size:24px">📍</span>` +
+		`</div>` +
+		`<strong style="display:block;padding:4px 0">{{.Name}}</strong>` +
+		`</a></div>`))
+
+// oembedMarkerID finds the marker a URL of the server links to: a share link, or the
+// API or app URL of a marker. shared tells share links apart, they show the marker
+// whether or not it's private.
+func oembedMarkerID(ctx context.Context, db *mongo.Database, base, link string, secret []byte) (id string, shared bool, err error) {
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasPrefix(link, base+"/") {
+		return "", false, fmt.Errorf("invalid url, expected a marker url of %s", base)
+	}
+
+	path := strings.TrimPrefix(u.Path, strings.TrimPrefix(base, u.Scheme+"://"+u.Host))
+	for _, prefix := range []string{"/share/", "/api/v1/markers/", "/markers/"} {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(path, prefix)
+		if rest == "" || strings.Contains(rest, "/") {
+			break
+		}
+
+		if prefix != "/share/" {
+			return rest, false, nil
+		}
+
+		if secret == nil {
+			return "", false, errors.New("sharing is not configured")
+		}
+
+		id, ok, err := sharedMarkerID(ctx, db, secret, rest)
+		if err != nil {
+			return "", false, err
+		}
+
+		if !ok {
+			return "", false, errors.New("invalid or expired share link")
+		}
+
+		return id, true, nil
+	}
+
+	return "", false, fmt.Errorf("invalid url, expected a marker url of %s", base)
+}
+
+// oembedTiles returns the tiles covering a size by size map centered on the location.
+func oembedTiles(base string, at Coords, size int) []oembedTile {
+	// World pixels are tile pixels of tile 0/0 at the zoom level.
+	wx, wy := tilePixel(oembedMapZoom, 0, 0, at)
+	px := float64(wx) * oembedTileSize / mvtExtent
+	py := float64(wy) * oembedTileSize / mvtExtent
+
+	left := px - float64(size)/2
+	top := py - float64(size)/2
+	n := 1 << oembedMapZoom
+
+	var tiles []oembedTile
+	for y := int(math.Floor(top / oembedTileSize)); float64(y*oembedTileSize) < top+float64(size); y++ {
+		if y < 0 || y >= n {
+			continue
+		}
+
+		for x := int(math.Floor(left / oembedTileSize)); float64(x*oembedTileSize) < left+float64(size); x++ {
+			tiles = append(tiles, oembedTile{
+				URL:  fmt.Sprintf("%s/tiles/%d/%d/%d", base, oembedMapZoom, (x%n+n)%n, y),
+				Left: int(math.Round(float64(x*oembedTileSize) - left)),
+				Top:  int(math.Round(float64(y*oembedTileSize) - top)),
+			})
+		}
+	}
+
+	return tiles
+}
+
+// registerOEmbedRoutes serves GET /oembed?url= for markers anyone may see and share
+// links. The map is left out without a tile proxy to draw it from.
+func registerOEmbedRoutes(e *echo.Echo, db *mongo.Database, cfg Config, privacy *markerPrivacy, cache *responseCache) {
+	secret := shareSecret(cfg)
+
+	e.GET("/oembed", func(c echo.Context) error {
+		if format := c.QueryParam("format"); format != "" && format != "json" {
+			s := "only the json format is supported"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotImplemented, ErrorString{s})
+		}
+
+		size := oembedMapSize
+		for _, name := range []string{"maxwidth", "maxheight"} {
+			param := c.QueryParam(name)
+			if param == "" {
+				continue
+			}
+
+			v, err := strconv.Atoi(param)
+			if err != nil || v < minOEmbedSize {
+				err := fmt.Errorf("invalid %s, expected a number of at least %d", name, minOEmbedSize)
+				c.Logger().Info(err)
+				return c.JSON(http.StatusBadRequest, Error{err})
+			}
+
+			if v < size {
+				size = v
+			}
+		}
+
+		base := publicURL(c, cfg)
+		link := c.QueryParam("url")
+		id, shared, err := oembedMarkerID(c.Request().Context(), db, base, link, secret)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusNotFound, Error{err})
+		}
+
+		// Embeds are seen by anybody, so markers are only shown as they are to the public.
+		// Share links show private markers too, like GET /share/:token.
+		filter := and(bson.M{"_id": id}, visibilityFor(User{}, false))
+		if shared {
+			filter = and(bson.M{"_id": id}, sharedVisibility())
+		}
+
+		var marker Marker
+		if err := db.Collection("markers").FindOne(c.Request().Context(), filter).Decode(&marker); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "marker not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		visible, err := privacy.view(c).redactMarker(c.Request().Context(), &marker)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		marker = marker.Normalize()
+		title := marker.Name
+		if marker.LocalizedName != "" {
+			title = marker.LocalizedName
+		}
+
+		var tiles []oembedTile
+		if cfg.TileUpstreamURL != "" {
+			tiles = oembedTiles(base, marker.Location, size)
+		}
+
+		var html bytes.Buffer
+		if err := oembedTemplate.Execute(&html, map[string]interface{}{
+			"URL":    link,
+			"Size":   size,
+			"Center": size / 2,
+			"Tiles":  tiles,
+			"Name":   title,
+		}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		response := OEmbed{
+			Type:         "rich",
+			Version:      "1.0",
+			Title:        title,
+			ProviderName: providerName,
+			ProviderURL:  base,
+			HTML:         html.String(),
+			Width:        size,
+			// The name takes a line below the map.
+			Height: size + 32,
+		}
+		if len(marker.Images) > 0 {
+			image := marker.Images[0]
+			response.ThumbnailURL, response.ThumbnailWidth, response.ThumbnailHeight = image.URI, image.Width, image.Height
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}, cache.middleware())
+}
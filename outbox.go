@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	EventMarkerCreated  = "marker.created"
+	EventMarkerUpdated  = "marker.updated"
+	EventMarkerDeleted  = "marker.deleted"
+	EventMarkerArchived = "marker.archived"
+
+	// eventRetention is how long events are kept for sinks to catch up.
+	eventRetention = 7 * 24 * time.Hour
+	eventBatchSize = 100
+	// eventMaxBackoff caps the delay between attempts to deliver an event.
+	eventMaxBackoff = time.Hour
+)
+
+// Event is a change to a marker recorded in the outbox by the write that made it.
+type Event struct {
+	ID       string `json:"id" bson:"_id"`
+	Type     string `json:"type" bson:"type"`
+	MarkerID string `json:"markerId" bson:"markerId"`
+	// Marker is the marker after the change, it's missing for deletions.
+	Marker    *Marker   `json:"marker,omitempty" bson:"marker,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	// Seq is the number of the event in the changes feed once sequenceChanges got to it.
+	Seq int64 `json:"-" bson:"seq,omitempty"`
+
+	// Done lists the sinks the event was delivered to or dead-lettered for.
+	Done     []string             `json:"-" bson:"done,omitempty"`
+	Attempts map[string]int       `json:"-" bson:"attempts,omitempty"`
+	RetryAt  map[string]time.Time `json:"-" bson:"retryAt,omitempty"`
+}
+
+// DeadLetter is an event a sink didn't accept after all attempts.
+type DeadLetter struct {
+	ID       string    `json:"id" bson:"_id"`
+	Sink     string    `json:"sink" bson:"sink"`
+	Event    Event     `json:"event" bson:"event"`
+	Attempts int       `json:"attempts" bson:"attempts"`
+	Error    string    `json:"error" bson:"error"`
+	FailedAt time.Time `json:"failedAt" bson:"failedAt"`
+}
+
+// appendEvent records a change to the marker in the outbox and its history, the changes
+// feed picks it up from the outbox. It's called by the write right after the change, in
+// its transaction if it has one. Cached responses are dropped once the change is
+// committed.
+func appendEvent(ctx context.Context, db *mongo.Database, eventType, markerID string, marker *Marker) error {
+	if marker != nil {
+		m := *marker
+		marker = &m
+	}
+
+	now := time.Now().UTC()
+	_, err := db.Collection("events").InsertOne(ctx, Event{
+		ID:        primitive.NewObjectID().Hex(),
+		Type:      eventType,
+		MarkerID:  markerID,
+		Marker:    marker,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	clearCaches(ctx, db)
+	return recordState(ctx, db, eventType, markerID, marker, now)
+}
+
+// appendUpdateEvent records the current state of a marker changed without going through
+// updateMarker.
+func appendUpdateEvent(ctx context.Context, db *mongo.Database, markerID string) error {
+	var marker Marker
+	err := db.Collection("markers").FindOne(ctx, bson.M{"_id": markerID}).Decode(&marker)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// The deletion records its own event.
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return appendEvent(ctx, db, EventMarkerUpdated, markerID, &marker)
+}
+
+// EventSink delivers events to a consumer outside the server.
+type EventSink interface {
+	Deliver(ctx context.Context, event Event) error
+}
+
+// newEventSinks returns the sinks configured in cfg by name. Names are stored with
+// events, they must stay the same across restarts.
+func newEventSinks(cfg Config) (map[string]EventSink, error) {
+	client := &http.Client{Timeout: cfg.WebhookTimeout}
+	sinks := map[string]EventSink{}
+
+	for _, url := range cfg.WebhookURLs {
+		sum := sha256.Sum256([]byte(url))
+		sinks["webhook-"+hex.EncodeToString(sum[:4])] = webhookSink{client: client, url: url, secret: cfg.WebhookSecret}
+	}
+
+	bus, err := newBusSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if bus != nil {
+		sinks[cfg.EventBus] = bus
+	}
+
+	return sinks, nil
+}
+
+// webhookSink posts events as JSON. With a secret the body is signed with HMAC-SHA256
+// in the X-Signature header, so receivers can check it came from the server.
+type webhookSink struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (s webhookSink) Deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Event-Id", event.ID)
+	req.Header.Set("X-Event-Type", event.Type)
+	if s.secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// eventDispatcher delivers outbox events to every sink. Failed deliveries are retried
+// with exponential backoff, events a sink keeps refusing go to the dead letters so the
+// other events aren't held up. Events may reach a sink out of order after retries.
+type eventDispatcher struct {
+	db          *mongo.Database
+	sinks       map[string]EventSink
+	maxAttempts int
+	logger      echo.Logger
+}
+
+func newEventDispatcher(db *mongo.Database, sinks map[string]EventSink, cfg Config, logger echo.Logger) *eventDispatcher {
+	return &eventDispatcher{db: db, sinks: sinks, maxAttempts: cfg.EventMaxAttempts, logger: logger}
+}
+
+// dispatch delivers pending events, it runs as the deliver-events job.
+func (d *eventDispatcher) dispatch(ctx context.Context) error {
+	for name, sink := range d.sinks {
+		if err := d.drain(ctx, name, sink); err != nil {
+			return fmt.Errorf("sink %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// drain delivers events to the sink until none are due. A failed delivery stops the
+// sink for this run, the consumer is likely down.
+func (d *eventDispatcher) drain(ctx context.Context, name string, sink EventSink) error {
+	for {
+		now := time.Now().UTC()
+		retryAt := "retryAt." + name
+		cursor, err := d.db.Collection("events").Find(ctx,
+			bson.M{
+				"done": bson.M{"$ne": name},
+				"$or":  bson.A{bson.M{retryAt: bson.M{"$exists": false}}, bson.M{retryAt: bson.M{"$lte": now}}},
+			},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(eventBatchSize),
+		)
+		if err != nil {
+			return err
+		}
+
+		var events []Event
+		if err := cursor.All(context.Background(), &events); err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := sink.Deliver(ctx, event); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				return d.failed(ctx, name, event, err)
+			}
+
+			if _, err := d.db.Collection("events").UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{
+				"$addToSet": bson.M{"done": name},
+				"$unset":    bson.M{"attempts." + name: "", retryAt: ""},
+			}); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < eventBatchSize {
+			return nil
+		}
+	}
+}
+
+// failed schedules the next attempt to deliver the event or moves it to the dead letters.
+func (d *eventDispatcher) failed(ctx context.Context, name string, event Event, deliveryErr error) error {
+	attempts := event.Attempts[name] + 1
+	d.logger.Warnf("can't deliver event %s to %s (attempt %d of %d): %v", event.ID, name, attempts, d.maxAttempts, deliveryErr)
+
+	if attempts < d.maxAttempts {
+		backoff := time.Minute << (attempts - 1)
+		if backoff > eventMaxBackoff || backoff <= 0 {
+			backoff = eventMaxBackoff
+		}
+
+		_, err := d.db.Collection("events").UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{"$set": bson.M{
+			"attempts." + name: attempts,
+			"retryAt." + name:  time.Now().UTC().Add(backoff),
+		}})
+		return err
+	}
+
+	event.Done, event.Attempts, event.RetryAt = nil, nil, nil
+	letter := DeadLetter{
+		ID:       event.ID + ":" + name,
+		Sink:     name,
+		Event:    event,
+		Attempts: attempts,
+		Error:    deliveryErr.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+	if _, err := d.db.Collection("deadLetters").ReplaceOne(ctx, bson.M{"_id": letter.ID}, letter, options.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	_, err := d.db.Collection("events").UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{
+		"$addToSet": bson.M{"done": name},
+		"$unset":    bson.M{"attempts." + name: "", "retryAt." + name: ""},
+	})
+	return err
+}
+
+const (
+	defaultDeadLettersLimit = 50
+	maxDeadLettersLimit     = 500
+)
+
+// registerDeadLetterRoutes lets admins look at events sinks refused and deliver them
+// again once the consumer is fixed.
+func registerDeadLetterRoutes(group *echo.Group, db *mongo.Database, dispatcher *eventDispatcher) {
+	group.GET("/dead-letters", func(c echo.Context) error {
+		limit := defaultDeadLettersLimit
+		if v := c.QueryParam("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDeadLettersLimit {
+				s := fmt.Sprintf("limit must be between 1 and %d", maxDeadLettersLimit)
+				c.Logger().Info(s)
+				return c.JSON(http.StatusBadRequest, ErrorString{s})
+			}
+
+			limit = n
+		}
+
+		filter := bson.M{}
+		if sink := c.QueryParam("sink"); sink != "" {
+			filter["sink"] = sink
+		}
+
+		cursor, err := db.Collection("deadLetters").Find(c.Request().Context(), filter,
+			options.Find().SetSort(bson.D{{Key: "failedAt", Value: -1}}).SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		letters := []DeadLetter{}
+		if err := cursor.All(context.Background(), &letters); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, letters)
+	})
+	group.POST("/dead-letters/:id/retry", func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		var letter DeadLetter
+		if err := db.Collection("deadLetters").FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&letter); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "dead letter not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		sink, ok := dispatcher.sinks[letter.Sink]
+		if !ok {
+			s := fmt.Sprintf("sink %s is no longer configured", letter.Sink)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusConflict, ErrorString{s})
+		}
+
+		if err := sink.Deliver(ctx, letter.Event); err != nil {
+			c.Logger().Warn(err)
+			return c.JSON(http.StatusBadGateway, Error{err})
+		}
+
+		if _, err := db.Collection("deadLetters").DeleteOne(ctx, bson.M{"_id": letter.ID}); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+}
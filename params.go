@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// parseLimit reads ?limit= and checks that it's within (0, max].
+func parseLimit(c echo.Context, fallback, max int) (int, error) {
+	param := c.QueryParam("limit")
+	if param == "" {
+		return fallback, nil
+	}
+
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit <= 0 || limit > max {
+		return 0, fmt.Errorf("invalid limit, expected a number between 1 and %d", max)
+	}
+
+	return limit, nil
+}
+
+// parseOffset reads ?offset= used together with ?limit= for paging.
+func parseOffset(c echo.Context) (int, error) {
+	param := c.QueryParam("offset")
+	if param == "" {
+		return 0, nil
+	}
+
+	offset, err := strconv.Atoi(param)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset, expected a non-negative number")
+	}
+
+	return offset, nil
+}
+
+func parseIntParam(c echo.Context, name string, fallback, min, max int) (int, error) {
+	param := c.QueryParam(name)
+	if param == "" {
+		return fallback, nil
+	}
+
+	v, err := strconv.Atoi(param)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid %s, expected a number between %d and %d", name, min, max)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	pmtilesHeaderSize = 127
+	// pmtilesRootSize is how much of the start of an archive clients read at once, the
+	// header and root directory have to fit into it.
+	pmtilesRootSize = 16384
+
+	pmtilesGzip = 2
+	pmtilesMVT  = 1
+)
+
+// pmtilesEntry points to a tile, or with a run length of 0 to a leaf directory.
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// pmtilesWriter writes a PMTiles v3 archive of gzipped vector tiles. Tiles are appended
+// to a temporary file in any order and the directories are built when the archive is
+// finished, so archives don't have to fit in memory; only the entries do.
+type pmtilesWriter struct {
+	data    *os.File
+	entries []pmtilesEntry
+	offset  uint64
+	minZoom int
+	maxZoom int
+}
+
+func newPMTilesWriter(dir string) (*pmtilesWriter, error) {
+	data, err := os.CreateTemp(dir, "tiles-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &pmtilesWriter{data: data, minZoom: math.MaxInt}, nil
+}
+
+// close removes the temporary tile data.
+func (w *pmtilesWriter) close() {
+	w.data.Close()
+	os.Remove(w.data.Name())
+}
+
+// add appends a tile, data is the uncompressed vector tile.
+func (w *pmtilesWriter) add(z, x, y int, data []byte) error {
+	compressed, err := gzipped(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.data.Write(compressed); err != nil {
+		return err
+	}
+
+	w.entries = append(w.entries, pmtilesEntry{TileID: pmtilesTileID(z, x, y), Offset: w.offset, Length: uint32(len(compressed)), RunLength: 1})
+	w.offset += uint64(len(compressed))
+
+	if z < w.minZoom {
+		w.minZoom = z
+	}
+
+	if z > w.maxZoom {
+		w.maxZoom = z
+	}
+
+	return nil
+}
+
+// finish writes the archive covering bounds to out. metadata is stored as JSON.
+func (w *pmtilesWriter) finish(out io.Writer, bounds Bounds, metadata interface{}) error {
+	sort.Slice(w.entries, func(i, j int) bool { return w.entries[i].TileID < w.entries[j].TileID })
+
+	root, leaves, err := pmtilesDirectories(w.entries)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	if meta, err = gzipped(meta); err != nil {
+		return err
+	}
+
+	if len(w.entries) == 0 {
+		w.minZoom = 0
+	}
+
+	header := make([]byte, pmtilesHeaderSize)
+	copy(header, "PMTiles")
+	header[7] = 3
+
+	rootOffset := uint64(pmtilesHeaderSize)
+	metaOffset := rootOffset + uint64(len(root))
+	leavesOffset := metaOffset + uint64(len(meta))
+	dataOffset := leavesOffset + uint64(len(leaves))
+	for i, v := range []uint64{
+		rootOffset, uint64(len(root)),
+		metaOffset, uint64(len(meta)),
+		leavesOffset, uint64(len(leaves)),
+		dataOffset, w.offset,
+		// Addressed tiles, tile entries and tile contents, every tile is stored once.
+		uint64(len(w.entries)), uint64(len(w.entries)), uint64(len(w.entries)),
+	} {
+		binary.LittleEndian.PutUint64(header[8+8*i:], v)
+	}
+
+	// Tile data follows the order tiles were rendered in, not their ids.
+	header[96] = 0
+	header[97] = pmtilesGzip
+	header[98] = pmtilesGzip
+	header[99] = pmtilesMVT
+	header[100] = byte(w.minZoom)
+	header[101] = byte(w.maxZoom)
+
+	e7 := func(deg float64) uint32 { return uint32(int32(math.Round(deg * 1e7))) }
+	binary.LittleEndian.PutUint32(header[102:], e7(bounds.MinLongitude))
+	binary.LittleEndian.PutUint32(header[106:], e7(bounds.MinLatitude))
+	binary.LittleEndian.PutUint32(header[110:], e7(bounds.MaxLongitude))
+	binary.LittleEndian.PutUint32(header[114:], e7(bounds.MaxLatitude))
+	header[118] = byte(w.minZoom)
+	binary.LittleEndian.PutUint32(header[119:], e7((bounds.MinLongitude+bounds.MaxLongitude)/2))
+	binary.LittleEndian.PutUint32(header[123:], e7((bounds.MinLatitude+bounds.MaxLatitude)/2))
+
+	for _, part := range [][]byte{header, root, meta, leaves} {
+		if _, err := out.Write(part); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, w.data)
+	return err
+}
+
+// pmtilesDirectories returns the root directory and the leaf directories of the sorted
+// entries. Leaves are only used when the root wouldn't fit next to the header, and get
+// larger until the root directory pointing to them does.
+func pmtilesDirectories(entries []pmtilesEntry) (root, leaves []byte, err error) {
+	if root, err = pmtilesDirectory(entries); err != nil {
+		return nil, nil, err
+	}
+
+	if len(root) <= pmtilesRootSize-pmtilesHeaderSize {
+		return root, nil, nil
+	}
+
+	for size := 4096; ; size *= 2 {
+		var rootEntries []pmtilesEntry
+		var buf bytes.Buffer
+		for start := 0; start < len(entries); start += size {
+			end := start + size
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			leaf, err := pmtilesDirectory(entries[start:end])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rootEntries = append(rootEntries, pmtilesEntry{TileID: entries[start].TileID, Offset: uint64(buf.Len()), Length: uint32(len(leaf))})
+			buf.Write(leaf)
+		}
+
+		if root, err = pmtilesDirectory(rootEntries); err != nil {
+			return nil, nil, err
+		}
+
+		if len(root) <= pmtilesRootSize-pmtilesHeaderSize {
+			return root, buf.Bytes(), nil
+		}
+	}
+}
+
+// pmtilesDirectory encodes entries column by column as varints, which gzip compresses
+// well: deltas of tile ids, run lengths, lengths and offsets, where 0 stands for the
+// offset right after the previous tile.
+func pmtilesDirectory(entries []pmtilesEntry) ([]byte, error) {
+	b := appendVarint(nil, uint64(len(entries)))
+
+	var last uint64
+	for _, e := range entries {
+		b = appendVarint(b, e.TileID-last)
+		last = e.TileID
+	}
+
+	for _, e := range entries {
+		b = appendVarint(b, uint64(e.RunLength))
+	}
+
+	for _, e := range entries {
+		b = appendVarint(b, uint64(e.Length))
+	}
+
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			b = appendVarint(b, 0)
+		} else {
+			b = appendVarint(b, e.Offset+1)
+		}
+	}
+
+	return gzipped(b)
+}
+
+// pmtilesTileID numbers tiles by zoom level and along a Hilbert curve within a level, so
+// tiles close to each other get close ids.
+func pmtilesTileID(z, x, y int) uint64 {
+	var id uint64
+	for i := 0; i < z; i++ {
+		id += uint64(1) << (2 * i)
+	}
+
+	tx, ty := uint64(x), uint64(y)
+	for s := uint64(1) << z / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s > 0 {
+			rx = 1
+		}
+
+		if ty&s > 0 {
+			ry = 1
+		}
+
+		id += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				tx, ty = s-1-tx, s-1-ty
+			}
+
+			tx, ty = ty, tx
+		}
+	}
+
+	return id
+}
+
+func gzipped(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// MarkerQuery selects markers located within a GeoJSON Polygon or MultiPolygon.
+type MarkerQuery struct {
+	Geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// geometry checks the GeoJSON geometry and returns it as a $geometry document.
+func (q MarkerQuery) geometry() (bson.M, error) {
+	var polygons [][][][]float64
+	switch q.Geometry.Type {
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(q.Geometry.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("invalid polygon coordinates")
+		}
+
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(q.Geometry.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid multipolygon coordinates")
+		}
+	default:
+		return nil, fmt.Errorf("invalid geometry type %q, expected Polygon or MultiPolygon", q.Geometry.Type)
+	}
+
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("empty geometry")
+	}
+
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return nil, fmt.Errorf("polygon without rings")
+		}
+
+		for _, ring := range polygon {
+			if err := validateRing(ring); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if q.Geometry.Type == "Polygon" {
+		return bson.M{"type": "Polygon", "coordinates": polygons[0]}, nil
+	}
+
+	return bson.M{"type": "MultiPolygon", "coordinates": polygons}, nil
+}
+
+// validateRing checks a linear ring: closed, with at least four positions in range.
+func validateRing(ring [][]float64) error {
+	if len(ring) < 4 {
+		return fmt.Errorf("polygon rings need at least four positions")
+	}
+
+	for _, position := range ring {
+		if len(position) < 2 {
+			return fmt.Errorf("positions need a longitude and a latitude")
+		}
+
+		if err := (Coords{Latitude: position[1], Longitude: position[0]}).Validate(); err != nil {
+			return fmt.Errorf("invalid position: %w", err)
+		}
+	}
+
+	first, last := ring[0], ring[len(ring)-1]
+	if first[0] != last[0] || first[1] != last[1] {
+		return fmt.Errorf("polygon rings must end where they start")
+	}
+
+	return nil
+}
+
+// registerQueryRoutes adds POST /api/v1/markers/query. It only reads, so it lives
+// outside the markers group that clears the response cache on POST.
+func registerQueryRoutes(group *echo.Group, db *mongo.Database, privacy *markerPrivacy) {
+	group.POST("", func(c echo.Context) error {
+		var body MarkerQuery
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		geometry, err := body.geometry()
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		limit, err := parseLimit(c, defaultQueryLimit, maxQueryLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		within := bson.M{"geo": bson.M{"$geoWithin": bson.M{"$geometry": geometry}}}
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), and(filter, within, outsideZones(c)), options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: 1}}).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Marker{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if results, err = privacy.view(c).redact(c.Request().Context(), results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		for i := range results {
+			results[i] = results[i].Normalize()
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+}
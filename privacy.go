@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserSettings are privacy preferences users choose for their own markers.
+type UserSettings struct {
+	// StripImageMetadata hides EXIF data and image locations from everybody but the owner.
+	StripImageMetadata bool `json:"stripImageMetadata" bson:"stripImageMetadata"`
+
+	PrivacyZones []PrivacyZone `json:"privacyZones,omitempty" bson:"privacyZones,omitempty" validate:"max=10,dive"`
+}
+
+const (
+	// ZoneHide leaves markers in the zone out of what other users see.
+	ZoneHide = "hide"
+	// ZoneFuzz shows markers in the zone at the center of a coarse grid cell.
+	ZoneFuzz = "fuzz"
+)
+
+// PrivacyZone is an area around a sensitive place such as a user's home.
+type PrivacyZone struct {
+	Center       Coords  `json:"center" bson:"center"`
+	RadiusMeters float64 `json:"radiusMeters" bson:"radiusMeters" validate:"gt=0,lte=50000"`
+	Mode         string  `json:"mode" bson:"mode" validate:"oneof=hide fuzz"`
+}
+
+// zone returns the zone of the owner containing the location, the first one if several do.
+func (s UserSettings) zone(location Coords) (PrivacyZone, bool) {
+	for _, zone := range s.PrivacyZones {
+		if haversine(zone.Center, location) <= zone.RadiusMeters {
+			return zone, true
+		}
+	}
+
+	return PrivacyZone{}, false
+}
+
+// ownerZone returns the mode of the owner's privacy zone containing the location, or
+// an empty string if the location is in none of them.
+func ownerZone(ctx context.Context, db *mongo.Database, ownerID string, location Coords) (string, error) {
+	if ownerID == "" {
+		return "", nil
+	}
+
+	var record UserRecord
+	err := db.Collection("users").FindOne(ctx, bson.M{"_id": ownerID}, options.FindOne().SetProjection(bson.M{"settings.privacyZones": 1})).Decode(&record)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	zone, ok := record.Settings.zone(location)
+	if !ok {
+		return "", nil
+	}
+
+	return zone.Mode, nil
+}
+
+// zoneMarkers flags the live and archived markers of the owner with the mode of the
+// zone containing them, so geo queries of other users can leave them out. Zones are
+// applied in order, the first one containing a marker wins as in UserSettings.zone.
+func zoneMarkers(ctx context.Context, db *mongo.Database, ownerID string, settings UserSettings) error {
+	return inTransaction(ctx, db, func(ctx context.Context) error {
+		if err := updateMarkers(ctx, db, bson.M{"ownerId": ownerID, "privacyZone": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"privacyZone": ""}}); err != nil {
+			return err
+		}
+
+		for _, zone := range settings.PrivacyZones {
+			within := bson.M{"$centerSphere": bson.A{
+				bson.A{zone.Center.Longitude, zone.Center.Latitude},
+				zone.RadiusMeters / earthRadiusMeters,
+			}}
+			filter := bson.M{"ownerId": ownerID, "privacyZone": bson.M{"$exists": false}, "geo": bson.M{"$geoWithin": within}}
+			if err := updateMarkers(ctx, db, filter, bson.M{"$set": bson.M{"privacyZone": zone.Mode}}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// backfillPrivacyZones flags the markers in the zones users set up before markers
+// were flagged.
+func backfillPrivacyZones(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("users").Find(ctx, bson.M{"settings.privacyZones.0": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"settings": 1}))
+	if err != nil {
+		return err
+	}
+
+	var records []UserRecord
+	if err := cursor.All(context.Background(), &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := zoneMarkers(ctx, db, record.ID, record.Settings); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapToGrid returns the center of the grid cell containing the location, rounded to
+// micro degrees.
+func snapToGrid(location Coords, size float64) Coords {
+	center := func(v float64) float64 {
+		return math.Round((math.Floor(v/size)*size+size/2)*1e6) / 1e6
+	}
+
+	return Coords{
+		Latitude:  math.Max(-90, math.Min(90, center(location.Latitude))),
+		Longitude: wrapLongitude(center(location.Longitude)),
+	}
+}
+
+// markerPrivacy removes what owners keep to themselves from markers shown to other
+// users. Stored markers are left untouched, owners and admins see everything. Markers in
+// privacy zones are also left out of geo queries of other users, see outsideZones.
+type markerPrivacy struct {
+	db *mongo.Database
+	// stripImageMetadata applies to every owner, whatever their settings.
+	stripImageMetadata bool
+	// gridSize is the size of cells in degrees markers in fuzzing zones are snapped to.
+	gridSize float64
+}
+
+func newMarkerPrivacy(db *mongo.Database, cfg Config) *markerPrivacy {
+	return &markerPrivacy{db: db, stripImageMetadata: cfg.StripImageMetadata, gridSize: cfg.PrivacyGridSize}
+}
+
+// privacyView redacts markers for one viewer and picks their names in the viewer's
+// languages. Settings of owners are loaded once.
+type privacyView struct {
+	privacy       *markerPrivacy
+	user          User
+	authenticated bool
+	languages     []string
+	owners        map[string]UserSettings
+}
+
+func (p *markerPrivacy) view(c echo.Context) *privacyView {
+	user, ok := currentUser(c)
+	return &privacyView{privacy: p, user: user, authenticated: ok, languages: acceptedLanguages(c), owners: map[string]UserSettings{}}
+}
+
+// anonymous returns a view for work done outside of requests that ends up public.
+func (p *markerPrivacy) anonymous() *privacyView {
+	return &privacyView{privacy: p, owners: map[string]UserSettings{}}
+}
+
+// redact changes the markers in place and returns the ones the viewer may see, in the
+// same order. Markers read with a projection need their ownerId and location for owner
+// settings to apply.
+func (v *privacyView) redact(ctx context.Context, markers []Marker) ([]Marker, error) {
+	owners := make([]string, 0, len(markers))
+	for _, m := range markers {
+		owners = append(owners, m.OwnerID)
+	}
+
+	if err := v.load(ctx, owners); err != nil {
+		return nil, err
+	}
+
+	visible := markers[:0]
+	for _, m := range markers {
+		m.LocalizedName = localizedName(m, v.languages)
+		if !v.foreign(m.OwnerID) {
+			visible = append(visible, m)
+			continue
+		}
+
+		if v.stripsImageMetadata(m.OwnerID) {
+			m.Images = withoutImageMetadata(m.Images)
+		}
+
+		if zone, ok := v.zone(m.OwnerID, m.Location); ok {
+			if zone.Mode == ZoneHide {
+				continue
+			}
+
+			// Addresses and image locations would give the exact place away.
+			m.Location = snapToGrid(m.Location, v.privacy.gridSize)
+			m.Geohash = encodeGeohash(m.Location, geohashPrecision)
+			m.Address = nil
+			m.Images = withoutImageMetadata(m.Images)
+		}
+
+		visible = append(visible, m)
+	}
+
+	return visible, nil
+}
+
+// redactMarker is redact for a single marker, visible is false if it's hidden.
+func (v *privacyView) redactMarker(ctx context.Context, m *Marker) (visible bool, err error) {
+	markers, err := v.redact(ctx, []Marker{*m})
+	if err != nil || len(markers) == 0 {
+		return false, err
+	}
+
+	*m = markers[0]
+	return true, nil
+}
+
+// stripsImageMetadata reports whether image metadata of the owner's markers is hidden
+// from the viewer. Settings of the owner must be loaded first.
+func (v *privacyView) stripsImageMetadata(ownerID string) bool {
+	if !v.foreign(ownerID) {
+		return false
+	}
+
+	return v.privacy.stripImageMetadata || v.owners[ownerID].StripImageMetadata
+}
+
+// zone returns the privacy zone of the owner the viewer sees the location through.
+// Settings of the owner must be loaded first.
+func (v *privacyView) zone(ownerID string, location Coords) (PrivacyZone, bool) {
+	if !v.foreign(ownerID) {
+		return PrivacyZone{}, false
+	}
+
+	return v.owners[ownerID].zone(location)
+}
+
+// foreign reports whether markers of the owner are shown to somebody else.
+func (v *privacyView) foreign(ownerID string) bool {
+	if v.user.HasRole(RoleAdmin) {
+		return false
+	}
+
+	return !v.authenticated || ownerID != v.user.ID
+}
+
+// load reads the settings of owners that aren't known yet.
+func (v *privacyView) load(ctx context.Context, owners []string) error {
+	var ids []string
+	for _, id := range owners {
+		if _, ok := v.owners[id]; ok || id == "" || !v.foreign(id) {
+			continue
+		}
+
+		v.owners[id] = UserSettings{}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cursor, err := v.privacy.db.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"settings": 1}))
+	if err != nil {
+		return err
+	}
+
+	var records []UserRecord
+	if err := cursor.All(context.Background(), &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		v.owners[record.ID] = record.Settings
+	}
+
+	return nil
+}
+
+func hasImageMetadata(images []Image) bool {
+	for _, image := range images {
+		if image.Exif != nil || image.Location != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutImageMetadata returns a copy of the images without EXIF data and locations.
+func withoutImageMetadata(images []Image) []Image {
+	if !hasImageMetadata(images) {
+		return images
+	}
+
+	stripped := make([]Image, len(images))
+	for i, image := range images {
+		image.Exif, image.Location = nil, nil
+		stripped[i] = image
+	}
+
+	return stripped
+}
+
+// registerSettingsRoutes adds the privacy settings of the current user under /users/me.
+func registerSettingsRoutes(group *echo.Group, db *mongo.Database) {
+	group.GET("/me/settings", func(c echo.Context) error {
+		user, _ := currentUser(c)
+
+		var record UserRecord
+		err := db.Collection("users").FindOne(c.Request().Context(), bson.M{"_id": user.ID}, options.FindOne().SetProjection(bson.M{"settings": 1})).Decode(&record)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, record.Settings)
+	})
+	group.PUT("/me/settings", func(c echo.Context) error {
+		var body UserSettings
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := c.Validate(&body); err != nil {
+			return validationFailed(c, err)
+		}
+
+		user, _ := currentUser(c)
+		if _, err := db.Collection("users").UpdateOne(c.Request().Context(),
+			bson.M{"_id": user.ID},
+			bson.M{"$set": bson.M{"settings": body}},
+		); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if err := zoneMarkers(c.Request().Context(), db, user.ID, body); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, body)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// maxProperties counts keys at every level, nested objects included.
+	maxProperties       = 50
+	maxPropertyDepth    = 3
+	maxPropertyLength   = 1000
+	maxPropertyListSize = 50
+
+	propertyParamPrefix = "prop."
+)
+
+// propertyKeyPattern keeps keys usable as parts of document paths and query parameters.
+var propertyKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+
+// validateProperties checks the custom properties of a marker: values are strings,
+// numbers, booleans, nulls, lists of those or objects nested up to maxPropertyDepth
+// levels.
+func validateProperties(properties map[string]interface{}) []FieldError {
+	var fields []FieldError
+	count := 0
+
+	var check func(path string, value interface{}, depth int)
+	check = func(path string, value interface{}, depth int) {
+		switch v := value.(type) {
+		case nil, bool, float64, int, int32, int64:
+		case string:
+			if len([]rune(v)) > maxPropertyLength {
+				fields = append(fields, FieldError{Field: path, Code: "max", Message: fmt.Sprintf("must be at most %d characters long", maxPropertyLength)})
+			}
+		case []interface{}:
+			if len(v) > maxPropertyListSize {
+				fields = append(fields, FieldError{Field: path, Code: "max", Message: fmt.Sprintf("must have at most %d items", maxPropertyListSize)})
+				return
+			}
+
+			for i, item := range v {
+				if _, ok := item.(map[string]interface{}); ok {
+					fields = append(fields, FieldError{Field: fmt.Sprintf("%s[%d]", path, i), Code: "type", Message: "must not be an object"})
+					continue
+				}
+
+				if _, ok := item.([]interface{}); ok {
+					fields = append(fields, FieldError{Field: fmt.Sprintf("%s[%d]", path, i), Code: "type", Message: "must not be a list"})
+					continue
+				}
+
+				check(fmt.Sprintf("%s[%d]", path, i), item, depth)
+			}
+		case map[string]interface{}:
+			if depth >= maxPropertyDepth {
+				fields = append(fields, FieldError{Field: path, Code: "depth", Message: fmt.Sprintf("must not nest objects deeper than %d levels", maxPropertyDepth)})
+				return
+			}
+
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+
+			// Sorted keys report errors in the same order every time.
+			sort.Strings(keys)
+			for _, key := range keys {
+				count++
+				if !propertyKeyPattern.MatchString(key) {
+					fields = append(fields, FieldError{Field: path + "." + key, Code: "key", Message: "must be up to 64 letters, digits and underscores"})
+					continue
+				}
+
+				check(path+"."+key, v[key], depth+1)
+			}
+		default:
+			fields = append(fields, FieldError{Field: path, Code: "type", Message: "must be a string, number, boolean, list or object"})
+		}
+	}
+
+	check("properties", properties, 0)
+
+	if count > maxProperties {
+		fields = append(fields, FieldError{Field: "properties", Code: "max", Message: fmt.Sprintf("must have at most %d keys", maxProperties)})
+	}
+
+	return fields
+}
+
+// propertyFilter handles ?prop.<key>=<value> matching custom properties, nested keys are
+// separated by dots. Values are typed: true and false match booleans, numbers match
+// numbers and anything else, or a value in double quotes, matches strings. Numbers
+// prefixed with <, <=, > or >= match ranges, repeating the parameter combines them.
+func propertyFilter(c echo.Context) (bson.M, error) {
+	var conditions []bson.M
+	for param, values := range c.QueryParams() {
+		if !strings.HasPrefix(param, propertyParamPrefix) {
+			continue
+		}
+
+		keys := strings.Split(strings.TrimPrefix(param, propertyParamPrefix), ".")
+		if len(keys) > maxPropertyDepth {
+			return nil, fmt.Errorf("invalid %s, properties nest up to %d levels", param, maxPropertyDepth)
+		}
+
+		for _, key := range keys {
+			if !propertyKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("invalid %s, expected keys of letters, digits and underscores", param)
+			}
+		}
+
+		path := "properties." + strings.Join(keys, ".")
+		for _, v := range values {
+			condition, err := propertyCondition(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", param, err)
+			}
+
+			conditions = append(conditions, bson.M{path: condition})
+		}
+	}
+
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	// Parameters come from a map, sorting keeps filters and the queries they make stable.
+	sort.Slice(conditions, func(i, j int) bool { return fmt.Sprint(conditions[i]) < fmt.Sprint(conditions[j]) })
+	return and(conditions...), nil
+}
+
+func propertyCondition(v string) (interface{}, error) {
+	for _, op := range []struct{ prefix, operator string }{{"<=", "$lte"}, {">=", "$gte"}, {"<", "$lt"}, {">", "$gt"}} {
+		if !strings.HasPrefix(v, op.prefix) {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimPrefix(v, op.prefix), 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number after %s", op.prefix)
+		}
+
+		return bson.M{op.operator: n}, nil
+	}
+
+	switch {
+	case v == "true":
+		return true, nil
+	case v == "false":
+		return false, nil
+	case len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`):
+		return v[1 : len(v)-1], nil
+	}
+
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n, nil
+	}
+
+	return v, nil
+}
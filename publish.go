@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// publishDue publishes markers past their publishAt, it runs as the publish-markers job.
+// Queries hide scheduled markers on their own, publishing bumps updatedAt so sync clients
+// and the search index pick the markers up, and announces them to watchers.
+func publishDue(ctx context.Context, db *mongo.Database, notifications *notifier) error {
+	for {
+		now := time.Now().UTC()
+
+		var marker Marker
+		err := db.Collection("markers").FindOneAndUpdate(ctx,
+			bson.M{"publishAt": bson.M{"$lte": now}},
+			bson.M{"$unset": bson.M{"publishAt": ""}, "$set": bson.M{"updatedAt": now}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&marker)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := appendEvent(ctx, db, EventMarkerUpdated, marker.ID, &marker); err != nil {
+			return err
+		}
+
+		notifications.markerCreated(marker)
+	}
+}
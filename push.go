@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+)
+
+// errDeviceGone is returned by pushers when the push service no longer accepts the
+// device token, e.g. because the app was uninstalled.
+var errDeviceGone = errors.New("device token is no longer valid")
+
+type Notification struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+// Pusher delivers notifications to devices of a single platform.
+type Pusher interface {
+	Push(ctx context.Context, token string, n Notification) error
+}
+
+// newPushers returns pushers for the platforms configured in cfg.
+func newPushers(cfg Config) (map[string]Pusher, error) {
+	client := &http.Client{Timeout: cfg.PushTimeout}
+	pushers := map[string]Pusher{}
+
+	if cfg.FCMCredentialsFile != "" {
+		p, err := newFCMPusher(client, cfg.FCMCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pushers[PlatformFCM] = p
+	}
+
+	if cfg.APNsKeyFile != "" {
+		p, err := newAPNsPusher(client, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		pushers[PlatformAPNs] = p
+	}
+
+	return pushers, nil
+}
+
+// fcmPusher sends notifications with the Firebase Cloud Messaging HTTP v1 API,
+// authenticating as a service account.
+type fcmPusher struct {
+	client    *http.Client
+	projectID string
+	email     string
+	key       *rsa.PrivateKey
+	tokenURI  string
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMPusher(client *http.Client, credentialsFile string) (*fcmPusher, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read PUSH_FCM_CREDENTIALS_FILE: %w", err)
+	}
+
+	var credentials struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("invalid PUSH_FCM_CREDENTIALS_FILE: %w", err)
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(credentials.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in PUSH_FCM_CREDENTIALS_FILE: %w", err)
+	}
+
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &fcmPusher{
+		client:    client,
+		projectID: credentials.ProjectID,
+		email:     credentials.ClientEmail,
+		key:       key,
+		tokenURI:  credentials.TokenURI,
+	}, nil
+}
+
+// token exchanges a signed assertion for an OAuth access token and reuses it until
+// shortly before it expires.
+func (p *fcmPusher) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.accessToken != "" && time.Until(p.expiresAt) > time.Minute {
+		return p.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   p.email,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   p.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fcm token exchange responded with %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	p.accessToken = body.AccessToken
+	p.expiresAt = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	return p.accessToken, nil
+}
+
+func (p *fcmPusher) Push(ctx context.Context, token string, n Notification) error {
+	accessToken, err := p.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"message": map[string]interface{}{
+		"token":        token,
+		"notification": map[string]interface{}{"title": n.Title, "body": n.Body},
+		"data":         n.Data,
+	}})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", url.PathEscape(p.projectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errDeviceGone
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("fcm responded with %s: %s", resp.Status, message)
+	}
+}
+
+// apnsPusher sends notifications to Apple devices with token-based authentication.
+type apnsPusher struct {
+	client *http.Client
+	host   string
+	topic  string
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func newAPNsPusher(client *http.Client, cfg Config) (*apnsPusher, error) {
+	data, err := os.ReadFile(cfg.APNsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read PUSH_APNS_KEY_FILE: %w", err)
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PUSH_APNS_KEY_FILE: %w", err)
+	}
+
+	host := "https://api.push.apple.com"
+	if cfg.APNsSandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+
+	return &apnsPusher{
+		client: client,
+		host:   host,
+		topic:  cfg.APNsTopic,
+		keyID:  cfg.APNsKeyID,
+		teamID: cfg.APNsTeamID,
+		key:    key,
+	}, nil
+}
+
+// token returns the provider token. Apple rejects tokens older than an hour and
+// throttles ones refreshed too often, so it's renewed every 50 minutes.
+func (p *apnsPusher) token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.jwt != "" && time.Since(p.issuedAt) < 50*time.Minute {
+		return p.jwt, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": p.teamID, "iat": now.Unix()})
+	token.Header["kid"] = p.keyID
+
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+
+	p.jwt, p.issuedAt = signed, now
+	return p.jwt, nil
+}
+
+func (p *apnsPusher) Push(ctx context.Context, token string, n Notification) error {
+	providerToken, err := p.token()
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{"aps": map[string]interface{}{"alert": map[string]interface{}{"title": n.Title, "body": n.Body}}}
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.host+"/3/device/"+url.PathEscape(token), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", p.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1024)).Decode(&body)
+
+	if resp.StatusCode == http.StatusGone || body.Reason == "BadDeviceToken" || body.Reason == "DeviceTokenNotForTopic" {
+		return errDeviceGone
+	}
+
+	return fmt.Errorf("apns responded with %s: %s", resp.Status, body.Reason)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Quotas limit how much content a single user can own. Zero means unlimited.
+type Quotas struct {
+	MaxMarkers      int64 `json:"maxMarkers,omitempty"`
+	MaxImages       int64 `json:"maxImages,omitempty"`
+	MaxStorageBytes int64 `json:"maxStorageBytes,omitempty"`
+}
+
+// Usage summarizes the content a user owns.
+type Usage struct {
+	Markers      int64 `json:"markers" bson:"markers"`
+	Images       int64 `json:"images" bson:"images"`
+	StorageBytes int64 `json:"storageBytes" bson:"storageBytes"`
+}
+
+type UsageReport struct {
+	Usage  Usage  `json:"usage"`
+	Limits Quotas `json:"limits"`
+}
+
+// markerUsage is what a single marker adds to its owner's usage.
+func markerUsage(m Marker) Usage {
+	usage := Usage{Markers: 1, Images: int64(len(m.Images))}
+	for _, image := range m.Images {
+		usage.StorageBytes += image.Size
+	}
+
+	return usage
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{
+		Markers:      u.Markers + other.Markers,
+		Images:       u.Images + other.Images,
+		StorageBytes: u.StorageBytes + other.StorageBytes,
+	}
+}
+
+// check returns a QuotaError for the first limit the usage goes over.
+func (q Quotas) check(u Usage) error {
+	if q.MaxMarkers > 0 && u.Markers > q.MaxMarkers {
+		return QuotaError{fmt.Sprintf("quota exceeded: at most %d markers per user", q.MaxMarkers)}
+	}
+
+	if q.MaxImages > 0 && u.Images > q.MaxImages {
+		return QuotaError{fmt.Sprintf("quota exceeded: at most %d images per user", q.MaxImages)}
+	}
+
+	if q.MaxStorageBytes > 0 && u.StorageBytes > q.MaxStorageBytes {
+		return QuotaError{fmt.Sprintf("quota exceeded: at most %d bytes of images per user", q.MaxStorageBytes)}
+	}
+
+	return nil
+}
+
+func (q Quotas) unlimited() bool {
+	return q == Quotas{}
+}
+
+// userUsage sums up markers owned by the user. The except marker is left out,
+// which is used to check an update against the usage without the old version.
+func userUsage(ctx context.Context, db *mongo.Database, id string, except string) (Usage, error) {
+	match := bson.M{"ownerId": id}
+	if except != "" {
+		match["_id"] = bson.M{"$ne": except}
+	}
+
+	cursor, err := db.Collection("markers").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          nil,
+			"markers":      bson.M{"$sum": 1},
+			"images":       bson.M{"$sum": bson.M{"$size": bson.M{"$ifNull": bson.A{"$images", bson.A{}}}}},
+			"storageBytes": bson.M{"$sum": bson.M{"$sum": "$images.size"}},
+		}}},
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var results []Usage
+	if err := cursor.All(context.Background(), &results); err != nil {
+		return Usage{}, err
+	}
+
+	if len(results) == 0 {
+		return Usage{}, nil
+	}
+
+	return results[0], nil
+}
+
+// QuotaError reports which limit a user went over.
+type QuotaError struct {
+	msg string
+}
+
+func (e QuotaError) Error() string {
+	return e.msg
+}
+
+// checkQuotas checks that the owner stays within quotas after storing the marker.
+// Markers without an owner can't be attributed to anyone and aren't limited.
+func checkQuotas(ctx context.Context, db *mongo.Database, quotas Quotas, ownerID string, m Marker) error {
+	if ownerID == "" || quotas.unlimited() {
+		return nil
+	}
+
+	usage, err := userUsage(ctx, db, ownerID, m.ID)
+	if err != nil {
+		return err
+	}
+
+	return quotas.check(usage.add(markerUsage(m)))
+}
+
+// registerUsageRoutes adds the current user's usage under /users/me/usage.
+func registerUsageRoutes(group *echo.Group, db *mongo.Database, quotas Quotas) {
+	group.GET("/me/usage", func(c echo.Context) error {
+		user, _ := currentUser(c)
+		usage, err := userUsage(c.Request().Context(), db, user.ID, "")
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, UsageReport{Usage: usage, Limits: quotas})
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
+)
+
+const (
+	RateRead   = "read"
+	RateWrite  = "write"
+	RateUpload = "upload"
+
+	defaultPlan = "default"
+
+	visitorIdleTimeout = 3 * time.Minute
+	// rateLimitsTTL is how long instances take to see plans changed by admins.
+	rateLimitsTTL = 5 * time.Second
+)
+
+// uploadRoutes lists routes limited as uploads rather than writes.
+var uploadRoutes = []string{"/api/v1/markers/import"}
+
+// readRoutes lists routes that take POST bodies but only read.
+var readRoutes = []string{"/api/v1/markers/query", "/api/v1/markers/exists"}
+
+// RateLimit allows Rate requests per second per client with bursts of up to Burst.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l RateLimit) Validate() error {
+	if l.Rate <= 0 || l.Burst <= 0 {
+		return fmt.Errorf("rate and burst must be positive")
+	}
+
+	return nil
+}
+
+// Plan holds limits for the read, write and upload classes of requests.
+type Plan map[string]RateLimit
+
+func (p Plan) Validate() error {
+	for _, class := range []string{RateRead, RateWrite, RateUpload} {
+		limit, ok := p[class]
+		if !ok {
+			return fmt.Errorf("missing %s limit", class)
+		}
+
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("invalid %s limit: %w", class, err)
+		}
+	}
+
+	if len(p) != 3 {
+		return fmt.Errorf("unknown request class, expected %s, %s or %s", RateRead, RateWrite, RateUpload)
+	}
+
+	return nil
+}
+
+// StoredPlan is a plan changed by an admin. Stored plans are kept in the database of the
+// default tenant and replace the configured plan of the same name on every instance.
+type StoredPlan struct {
+	Name      string    `json:"name" bson:"_id"`
+	Limits    Plan      `json:"limits" bson:"limits"`
+	UpdatedBy string    `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+type visitorKey struct {
+	tenant, class, ip string
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimits limits requests per client IP. Tenants share plans but each tenant gets its
+// own budget. Plans changed by admins are stored and picked up by every instance, a
+// change resets all clients.
+type rateLimits struct {
+	defaults map[string]Plan
+
+	mu          sync.Mutex
+	plans       map[string]Plan
+	visitors    map[visitorKey]*visitor
+	lastCleanup time.Time
+}
+
+func newRateLimits(plans map[string]Plan) *rateLimits {
+	current := make(map[string]Plan, len(plans))
+	for name, plan := range plans {
+		current[name] = plan
+	}
+
+	return &rateLimits{defaults: plans, plans: current, visitors: map[visitorKey]*visitor{}, lastCleanup: time.Now()}
+}
+
+// load applies the stored plans over the configured ones.
+func (l *rateLimits) load(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection("rateLimits").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	var stored []StoredPlan
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+
+	plans := make(map[string]Plan, len(l.defaults)+len(stored))
+	for name, plan := range l.defaults {
+		plans[name] = plan
+	}
+
+	for _, plan := range stored {
+		plans[plan.Name] = plan.Limits
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !reflect.DeepEqual(plans, l.plans) {
+		l.plans = plans
+		l.visitors = map[visitorKey]*visitor{}
+	}
+
+	return nil
+}
+
+// watch loads the stored plans every rateLimitsTTL until ctx is done. When the database
+// can't be read the last known plans apply.
+func (l *rateLimits) watch(ctx context.Context, db *mongo.Database, logger echo.Logger) {
+	ticker := time.NewTicker(rateLimitsTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.load(ctx, db); err != nil {
+				logger.Warnf("can't load rate limit plans: %v", err)
+			}
+		}
+	}
+}
+
+func (l *rateLimits) hasPlan(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.plans[name]
+	return ok
+}
+
+func (l *rateLimits) snapshot() map[string]Plan {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	plans := make(map[string]Plan, len(l.plans))
+	for name, plan := range l.plans {
+		plans[name] = plan
+	}
+
+	return plans
+}
+
+func (l *rateLimits) setPlan(name string, plan Plan) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.plans[name] = plan
+	// Limiters are created from the plan on the next request.
+	l.visitors = map[visitorKey]*visitor{}
+}
+
+func (l *rateLimits) allow(key visitorKey, plan string) (bool, RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > visitorIdleTimeout {
+		for k, v := range l.visitors {
+			if now.Sub(v.lastSeen) > visitorIdleTimeout {
+				delete(l.visitors, k)
+			}
+		}
+
+		l.lastCleanup = now
+	}
+
+	p, ok := l.plans[plan]
+	if !ok {
+		p = l.plans[defaultPlan]
+	}
+
+	limit := p[key.class]
+	v, ok := l.visitors[key]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.visitors[key] = v
+	}
+
+	v.lastSeen = now
+	return v.limiter.Allow(), limit
+}
+
+// requestClass tells reads, writes and uploads apart. It runs after routing, so the
+// route of the request is known.
+func requestClass(c echo.Context) string {
+	for _, route := range uploadRoutes {
+		if strings.HasPrefix(c.Path(), route) {
+			return RateUpload
+		}
+	}
+
+	for _, route := range readRoutes {
+		if strings.HasPrefix(c.Path(), route) {
+			return RateRead
+		}
+	}
+
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RateRead
+	default:
+		return RateWrite
+	}
+}
+
+// middleware limits requests to a tenant with the plan of the tenant.
+func (l *rateLimits) middleware(tenant Tenant) echo.MiddlewareFunc {
+	plan := tenant.Plan
+	if plan == "" {
+		plan = defaultPlan
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := visitorKey{tenant: tenant.ID, class: requestClass(c), ip: c.RealIP()}
+			if ok, limit := l.allow(key, plan); !ok {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/limit.Rate))))
+				return c.JSON(http.StatusTooManyRequests, ErrorString{"rate limit exceeded"})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// registerRateLimitRoutes lets admins of the deployment inspect and change plans.
+func registerRateLimitRoutes(group *echo.Group, db *mongo.Database, limits *rateLimits) {
+	group.GET("", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, limits.snapshot())
+	})
+	group.PUT("/:plan", func(c echo.Context) error {
+		var body Plan
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		ctx := c.Request().Context()
+		name := c.Param("plan")
+		admin, _ := currentUser(c)
+		stored := StoredPlan{Name: name, Limits: body, UpdatedBy: admin.ID, UpdatedAt: time.Now().UTC()}
+		if _, err := db.Collection("rateLimits").ReplaceOne(ctx, bson.M{"_id": name}, stored, options.Replace().SetUpsert(true)); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// Other instances pick the plan up within rateLimitsTTL.
+		limits.setPlan(name, body)
+
+		if err := recordAudit(ctx, db, admin.ID, "rate-limits.update", nil, bson.M{"plan": name, "limits": body}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.JSON(http.StatusOK, body)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// requestIDPattern limits request ids taken from gateways to ones safe to log.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the id of the request the context belongs to, empty outside of
+// requests.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDs keeps the X-Request-ID of the gateway or assigns a new one. The id is
+// returned in the response header, added to log lines of the request and to the
+// context, so database commands can be traced back to the request.
+func requestIDs(logger echo.Logger) echo.MiddlewareFunc {
+	assign := middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+			c.SetLogger(requestLogger(logger, id))
+		},
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		handler := assign(next)
+		return func(c echo.Context) error {
+			header := c.Request().Header
+			if id := header.Get(echo.HeaderXRequestID); id != "" && !requestIDPattern.MatchString(id) {
+				header.Del(echo.HeaderXRequestID)
+			}
+
+			return handler(c)
+		}
+	}
+}
+
+// requestLogger returns a logger writing like logger with the request id in every line.
+func requestLogger(logger echo.Logger, id string) echo.Logger {
+	l := log.New(logger.Prefix())
+	l.SetOutput(logger.Output())
+	l.SetLevel(logger.Level())
+	l.SetHeader(fmt.Sprintf(`{"time":"${time_rfc3339_nano}","level":"${level}","id":%q,"prefix":"${prefix}","file":"${short_file}","line":"${line}"}`, id))
+	return l
+}
+
+// requestIDSerializer adds the request id to JSON objects of error responses, so a user
+// reporting an error can give the id to find it in the logs.
+type requestIDSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s requestIDSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if c.Response().Status < 400 || id == "" {
+		return s.DefaultJSONSerializer.Serialize(c, i, indent)
+	}
+
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	if len(data) >= 2 && data[0] == '{' {
+		field, _ := json.Marshal(id)
+		field = append([]byte(`{"requestId":`), field...)
+		if data[1] != '}' {
+			field = append(field, ',')
+		}
+
+		data = append(field, data[1:]...)
+	}
+
+	if indent != "" {
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", indent); err != nil {
+			return err
+		}
+
+		data = out.Bytes()
+	}
+
+	_, err = c.Response().Write(append(data, '\n'))
+	return err
+}
+
+// commandMonitor logs failed database commands and ones slower than slow, with the id of
+// the request that ran them. Zero slow only logs failures.
+func commandMonitor(slow time.Duration) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			duration := time.Duration(e.DurationNanos)
+			if slow > 0 && duration >= slow {
+				log.Warnj(log.JSON{
+					"message":  "slow database command",
+					"id":       requestIDFrom(ctx),
+					"command":  e.CommandName,
+					"duration": duration.String(),
+				})
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			log.Warnj(log.JSON{
+				"message":  "database command failed",
+				"id":       requestIDFrom(ctx),
+				"command":  e.CommandName,
+				"duration": time.Duration(e.DurationNanos).String(),
+				"error":    e.Failure,
+			})
+		},
+	}
+}
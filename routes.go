@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxRouteNameLength = 100
+	maxRouteMarkers    = 1000
+
+	defaultRoutesLimit = 50
+	maxRoutesLimit     = 200
+
+	earthRadiusMeters = 6371008.8
+)
+
+// Route is a trip visiting markers in order.
+type Route struct {
+	ID             string    `json:"id" bson:"_id"`
+	OwnerID        string    `json:"ownerId" bson:"ownerId"`
+	Name           string    `json:"name" bson:"name"`
+	Public         bool      `json:"public" bson:"public"`
+	MarkerIDs      []string  `json:"markerIds" bson:"markerIds"`
+	DistanceMeters float64   `json:"distanceMeters" bson:"distanceMeters"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (r Route) Normalize() Route {
+	if r.MarkerIDs == nil {
+		r.MarkerIDs = []string{}
+	}
+
+	return r
+}
+
+func (r Route) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("empty name")
+	}
+
+	if utf8.RuneCountInString(r.Name) > maxRouteNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxRouteNameLength)
+	}
+
+	if len(r.MarkerIDs) > maxRouteMarkers {
+		return fmt.Errorf("too many markers, at most %d allowed", maxRouteMarkers)
+	}
+
+	for _, id := range r.MarkerIDs {
+		if id == "" {
+			return fmt.Errorf("empty marker id")
+		}
+	}
+
+	return nil
+}
+
+type LineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+type RouteFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   LineString             `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// haversine returns the great-circle distance between two points in meters.
+func haversine(a, b Coords) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func routeDistance(markers []Marker) float64 {
+	var total float64
+	for i := 1; i < len(markers); i++ {
+		total += haversine(markers[i-1].Location, markers[i].Location)
+	}
+
+	return total
+}
+
+func registerRouteRoutes(group *echo.Group, db *mongo.Database) {
+	findRoute := func(c echo.Context) (Route, error) {
+		var route Route
+		err := db.Collection("routes").FindOne(c.Request().Context(), and(bson.M{"_id": c.Param("id")}, publicOrOwned(c))).Decode(&route)
+		return route.Normalize(), err
+	}
+
+	group.GET("/", func(c echo.Context) error {
+		limit, err := parseLimit(c, defaultRoutesLimit, maxRoutesLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		offset, err := parseOffset(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		cursor, err := db.Collection("routes").Find(c.Request().Context(), and(publicOrOwned(c)), options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetSkip(int64(offset)).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Route{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("/", func(c echo.Context) error {
+		var body Route
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		route := body.Normalize()
+		if err := route.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		markers, err := markersByIDs(c, db, route.MarkerIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(markers) != len(route.MarkerIDs) {
+			s := "route references unknown markers"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		user, _ := currentUser(c)
+		now := time.Now().UTC()
+		route.ID = primitive.NewObjectID().Hex()
+		route.OwnerID = user.ID
+		route.DistanceMeters = routeDistance(markers)
+		route.CreatedAt = now
+		route.UpdatedAt = now
+
+		if _, err := db.Collection("routes").InsertOne(c.Request().Context(), route); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusCreated, route)
+	}, requireUser())
+	group.GET("/:id", func(c echo.Context) error {
+		route, err := findRoute(c)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "route not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, route)
+	})
+	group.PUT("/:id", func(c echo.Context) error {
+		var body Route
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		route := body.Normalize()
+		if err := route.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		markers, err := markersByIDs(c, db, route.MarkerIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if len(markers) != len(route.MarkerIDs) {
+			s := "route references unknown markers"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		res, err := db.Collection("routes").UpdateOne(c.Request().Context(), ownedDocument(c, c.Param("id")), bson.M{"$set": bson.M{
+			"name":           route.Name,
+			"public":         route.Public,
+			"markerIds":      route.MarkerIDs,
+			"distanceMeters": routeDistance(markers),
+			"updatedAt":      time.Now().UTC(),
+		}})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.MatchedCount == 0 {
+			s := "route not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+	group.DELETE("/:id", func(c echo.Context) error {
+		res, err := db.Collection("routes").DeleteOne(c.Request().Context(), ownedDocument(c, c.Param("id")))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "route not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+	group.GET("/:id/geojson", func(c echo.Context) error {
+		route, err := findRoute(c)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "route not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		markers, err := markersByIDs(c, db, route.MarkerIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		coordinates := make([][]float64, 0, len(markers))
+		for _, marker := range markers {
+			coordinates = append(coordinates, []float64{marker.Location.Longitude, marker.Location.Latitude})
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/geo+json")
+		return c.JSON(http.StatusOK, RouteFeature{
+			Type:     "Feature",
+			Geometry: LineString{Type: "LineString", Coordinates: coordinates},
+			Properties: map[string]interface{}{
+				"id":             route.ID,
+				"name":           route.Name,
+				"markerIds":      route.MarkerIDs,
+				"distanceMeters": routeDistance(markers),
+			},
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// markerSchema is the $jsonSchema validator of live and archived markers. It checks what
+// the model requires, so documents written by other tools, e.g. scripts or restores from
+// elsewhere, can't break the server, and leaves derived and newer fields alone. Changes
+// of the model that the validator has to know about come with a migration applying it
+// again.
+func markerSchema() bson.M {
+	optional := func(schema bson.M) bson.M {
+		types := schema["bsonType"]
+		schema["bsonType"] = bson.A{types, "null"}
+		return schema
+	}
+
+	stringEnum := func(field string) bson.A {
+		values := bson.A{""}
+		for _, v := range oneOfValues(reflect.TypeOf(Marker{}), field) {
+			values = append(values, v)
+		}
+
+		return values
+	}
+
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"_id", "name", "location"},
+		"properties": bson.M{
+			"_id":  bson.M{"bsonType": "string", "minLength": 1},
+			"name": bson.M{"bsonType": "string", "minLength": 1},
+			"location": bson.M{
+				"bsonType": "object",
+				"required": bson.A{"latitude", "longitude"},
+				"properties": bson.M{
+					"latitude":  bson.M{"bsonType": "number", "minimum": -90, "maximum": 90},
+					"longitude": bson.M{"bsonType": "number", "minimum": -180, "maximum": 180},
+					"altitude":  optional(bson.M{"bsonType": "number", "minimum": -1000, "maximum": 10000}),
+					"accuracy":  optional(bson.M{"bsonType": "number", "minimum": 0}),
+				},
+			},
+			"geo": bson.M{
+				"bsonType": "object",
+				"required": bson.A{"type", "coordinates"},
+				"properties": bson.M{
+					"type":        bson.M{"enum": bson.A{"Point"}},
+					"coordinates": bson.M{"bsonType": "array", "minItems": 2, "maxItems": 3, "items": bson.M{"bsonType": "number"}},
+				},
+			},
+			"images": optional(bson.M{
+				"bsonType": "array",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": bson.A{"_id", "uri"},
+					"properties": bson.M{
+						"_id":      bson.M{"bsonType": "string", "minLength": 1},
+						"uri":      bson.M{"bsonType": "string", "minLength": 1},
+						"width":    bson.M{"bsonType": "number", "minimum": 0},
+						"height":   bson.M{"bsonType": "number", "minimum": 0},
+						"size":     bson.M{"bsonType": "number", "minimum": 0},
+						"position": bson.M{"bsonType": "number", "minimum": 0},
+						"caption":  bson.M{"bsonType": "string", "maxLength": 500},
+						"altText":  bson.M{"bsonType": "string", "maxLength": 1000},
+					},
+				},
+			}),
+			"tags": optional(bson.M{
+				"bsonType": "array",
+				"maxItems": maxTags,
+				"items":    bson.M{"bsonType": "string", "maxLength": maxTagLength},
+			}),
+			"description":       bson.M{"bsonType": "string", "maxLength": maxDescriptionLength},
+			"descriptionFormat": bson.M{"enum": bson.A{"", FormatPlain, FormatMarkdown}},
+			"icon":              bson.M{"enum": stringEnum("Icon")},
+			"color":             bson.M{"enum": stringEnum("Color")},
+			"emoji":             bson.M{"bsonType": "string", "maxLength": maxEmojiRunes},
+			"properties":        optional(bson.M{"bsonType": "object"}),
+			"ownerId":           bson.M{"bsonType": "string"},
+			"private":           bson.M{"bsonType": "bool"},
+			"likeCount":         bson.M{"bsonType": "number", "minimum": 0},
+			"revision":          bson.M{"bsonType": "number", "minimum": 0},
+			"createdAt":         bson.M{"bsonType": "date"},
+			"updatedAt":         bson.M{"bsonType": "date"},
+			"expiresAt":         optional(bson.M{"bsonType": "date"}),
+			"publishAt":         optional(bson.M{"bsonType": "date"}),
+			"archivedAt":        optional(bson.M{"bsonType": "date"}),
+		},
+	}
+}
+
+// oneOfValues returns the values the oneof validation of a struct field allows, so the
+// schema can't drift from the model.
+func oneOfValues(t reflect.Type, field string) []string {
+	f, ok := t.FieldByName(field)
+	if !ok {
+		panic(fmt.Sprintf("%s has no field %s", t.Name(), field))
+	}
+
+	for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+		if strings.HasPrefix(rule, "oneof=") {
+			return strings.Fields(strings.TrimPrefix(rule, "oneof="))
+		}
+	}
+
+	panic(fmt.Sprintf("%s.%s has no oneof validation", t.Name(), field))
+}
+
+// applyMarkerSchema sets the validator of the marker collections. Documents already
+// stored that don't match can still be changed, only inserts and updates of valid ones
+// are checked, so old data doesn't block writes until it's fixed.
+func applyMarkerSchema(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "validator", Value: bson.M{"$jsonSchema": markerSchema()}},
+			{Key: "validationLevel", Value: "moderate"},
+			{Key: "validationAction", Value: "error"},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("can't set the validator of %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// dropMarkerSchema removes the validator of the marker collections.
+func dropMarkerSchema(ctx context.Context, db *mongo.Database) error {
+	for _, name := range []string{"markers", archiveCollection} {
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "validator", Value: bson.M{}},
+			{Key: "validationLevel", Value: "off"},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("can't remove the validator of %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
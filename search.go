@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+func registerSearchRoutes(group *echo.Group, db *mongo.Database, cache *responseCache, index SearchIndex, privacy *markerPrivacy) {
+	group.GET("/search", func(c echo.Context) error {
+		q := c.QueryParam("q")
+		if q == "" {
+			s := "empty query"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		limit, err := parseLimit(c, defaultSearchLimit, maxSearchLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		filter, err := markerFilter(c)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		// Typo-tolerant search is used when configured, MongoDB text search stands in while
+		// the index is unavailable.
+		if index != nil {
+			results, err := fuzzySearch(c.Request().Context(), db, index, q, filter, limit)
+			if err == nil {
+				results, err = privacy.view(c).redact(c.Request().Context(), results)
+			}
+
+			if err == nil {
+				for i := range results {
+					results[i] = results[i].Normalize()
+				}
+
+				return c.JSON(http.StatusOK, results)
+			}
+
+			c.Logger().Warn(err)
+		}
+
+		query := and(bson.M{"$text": bson.M{"$search": q}}, filter)
+		score := bson.M{"score": bson.M{"$meta": "textScore"}}
+		cursor, err := db.Collection("markers").Find(c.Request().Context(), query, options.Find().
+			SetProjection(score).
+			SetSort(score).
+			SetLimit(int64(limit)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		results := []Marker{}
+		if err := cursor.All(context.Background(), &results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if results, err = privacy.view(c).redact(c.Request().Context(), results); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		for i := range results {
+			results[i] = results[i].Normalize()
+		}
+
+		return c.JSON(http.StatusOK, results)
+	}, cache.middleware())
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// demoLandmarks are world landmarks loaded by SEED_DATA or the seed command, so
+// frontends have something to show against a fresh database.
+//
+//go:embed seed/landmarks.geojson
+var demoLandmarks []byte
+
+func demoMarkers() ([]Marker, error) {
+	return decodeMarkers("geojson", bytes.NewReader(demoLandmarks))
+}
+
+// seedMarkers loads the markers if the database has none yet, seeded is false if it
+// already had markers.
+func seedMarkers(ctx context.Context, db *mongo.Database, markers []Marker) (summary ImportSummary, seeded bool, err error) {
+	count, err := db.Collection("markers").EstimatedDocumentCount(ctx)
+	if err != nil || count > 0 {
+		return ImportSummary{}, false, err
+	}
+
+	summary, err = restoreMarkers(ctx, db, markers, "")
+	return summary, err == nil, err
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const shareAudience = "share"
+
+const (
+	defaultQRCodeSize = 256
+	minQRCodeSize     = 64
+	maxQRCodeSize     = 1024
+)
+
+type ShareRequest struct {
+	// ExpiresIn is a duration such as 24h, links without it never expire.
+	ExpiresIn string `json:"expiresIn"`
+}
+
+type ShareLink struct {
+	ID        string     `json:"id"`
+	Token     string     `json:"token"`
+	URL       string     `json:"url"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Share is an issued share link, its id is the jti of the token. Links are only
+// accepted while their share exists, deleting it revokes the link. QRCode marks the
+// standing link of printed QR codes.
+type Share struct {
+	ID        string     `json:"id" bson:"_id"`
+	MarkerID  string     `json:"markerId" bson:"markerId"`
+	CreatedBy string     `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	QRCode    bool       `json:"qrCode,omitempty" bson:"qrCode,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// shareSecret returns the key used to sign share tokens. Without an explicit
+// SHARE_TOKEN_SECRET it's derived from AUTH_JWT_SECRET.
+func shareSecret(cfg Config) []byte {
+	if cfg.ShareTokenSecret != "" {
+		return []byte(cfg.ShareTokenSecret)
+	}
+
+	return deriveSecret(cfg, "share-tokens")
+}
+
+// deriveSecret derives the signing key of tokens with the given purpose from
+// AUTH_JWT_SECRET, so they can never be accepted as bearer tokens or tokens of another
+// purpose and vice versa. It's nil without AUTH_JWT_SECRET.
+func deriveSecret(cfg Config, purpose string) []byte {
+	if cfg.AuthJWTSecret == "" {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.AuthJWTSecret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// publicURL returns the base URL clients use to reach the server.
+func publicURL(c echo.Context, cfg Config) string {
+	if cfg.PublicURL != "" {
+		return strings.TrimSuffix(cfg.PublicURL, "/")
+	}
+
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// sharedMarkerID returns the marker a share token links to, ok is false for invalid,
+// expired or revoked tokens.
+func sharedMarkerID(ctx context.Context, db *mongo.Database, secret []byte, token string) (id string, ok bool, err error) {
+	var claims jwt.StandardClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+
+		return secret, nil
+	}); err != nil || !claims.VerifyAudience(shareAudience, true) || claims.Id == "" {
+		return "", false, nil
+	}
+
+	err = db.Collection("shares").FindOne(ctx, bson.M{"_id": claims.Id, "markerId": claims.Subject}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return claims.Subject, true, nil
+}
+
+// parseExpiresIn reads a positive duration such as 24h, zero means the link never expires.
+func parseExpiresIn(expiresIn string) (time.Duration, error) {
+	if expiresIn == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(expiresIn)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expiresIn, expected a positive duration such as 24h")
+	}
+
+	return d, nil
+}
+
+// shareLink signs the token of a share and returns its link.
+func shareLink(c echo.Context, cfg Config, secret []byte, share Share) (ShareLink, error) {
+	claims := jwt.StandardClaims{
+		Id:       share.ID,
+		Subject:  share.MarkerID,
+		Audience: shareAudience,
+		IssuedAt: share.CreatedAt.Unix(),
+	}
+	if share.ExpiresAt != nil {
+		claims.ExpiresAt = share.ExpiresAt.Unix()
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	return ShareLink{
+		ID:        share.ID,
+		Token:     token,
+		URL:       publicURL(c, cfg) + "/share/" + token,
+		ExpiresAt: share.ExpiresAt,
+	}, nil
+}
+
+// newShare records a share of the marker by the current user, expiring after d unless
+// it's zero.
+func newShare(c echo.Context, db *mongo.Database, markerID string, d time.Duration, qrCode bool) (Share, error) {
+	user, _ := currentUser(c)
+	share := Share{
+		ID:        primitive.NewObjectID().Hex(),
+		MarkerID:  markerID,
+		CreatedBy: user.ID,
+		QRCode:    qrCode,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if d > 0 {
+		expiresAt := share.CreatedAt.Add(d)
+		share.ExpiresAt = &expiresAt
+	}
+
+	_, err := db.Collection("shares").InsertOne(c.Request().Context(), share)
+	return share, err
+}
+
+// qrCodeShare returns the standing share of the marker's QR codes, so a marker always
+// gets the same code until it's revoked.
+func qrCodeShare(c echo.Context, db *mongo.Database, markerID string) (Share, error) {
+	var share Share
+	err := db.Collection("shares").FindOne(c.Request().Context(),
+		bson.M{"markerId": markerID, "qrCode": true, "expiresAt": bson.M{"$exists": false}},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	).Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return newShare(c, db, markerID, 0, true)
+	}
+
+	return share, err
+}
+
+// modifiableMarker finds the marker if the current user may see and change it. It
+// responds itself and returns false otherwise.
+func modifiableMarker(c echo.Context, db *mongo.Database, id string) (bool, error) {
+	var stored Marker
+	if err := db.Collection("markers").FindOne(c.Request().Context(), visibleMarker(c, id), options.FindOne().SetProjection(bson.M{"ownerId": 1})).Decode(&stored); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return false, c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		c.Logger().Error(err)
+		return false, c.JSON(http.StatusServiceUnavailable, Error{err})
+	}
+
+	if !canModify(c, stored.OwnerID) {
+		s := "only the owner can manage share links of this marker"
+		c.Logger().Info(s)
+		return false, c.JSON(http.StatusForbidden, ErrorString{s})
+	}
+
+	return true, nil
+}
+
+func registerShareRoutes(e *echo.Echo, group *echo.Group, db *mongo.Database, cfg Config, privacy *markerPrivacy) {
+	secret := shareSecret(cfg)
+
+	group.POST("/:id/share", func(c echo.Context) error {
+		if secret == nil {
+			s := "sharing is not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		var body ShareRequest
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		id := c.Param("id")
+		visible, err := markerVisible(c, db, id)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		d, err := parseExpiresIn(body.ExpiresIn)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		share, err := newShare(c, db, id, d, false)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		link, err := shareLink(c, cfg, secret, share)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		return c.JSON(http.StatusCreated, link)
+	}, requireUser())
+
+	// QR codes are for signs put up by the owner. Without expiresIn they encode the
+	// marker's standing QR code link, so signs can be reprinted until it's revoked.
+	group.GET("/:id/qr.png", func(c echo.Context) error {
+		if secret == nil {
+			s := "sharing is not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		size, err := parseIntParam(c, "size", defaultQRCodeSize, minQRCodeSize, maxQRCodeSize)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		d, err := parseExpiresIn(c.QueryParam("expiresIn"))
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		id := c.Param("id")
+		if ok, err := modifiableMarker(c, db, id); !ok {
+			return err
+		}
+
+		var share Share
+		if d > 0 {
+			share, err = newShare(c, db, id, d, true)
+		} else {
+			share, err = qrCodeShare(c, db, id)
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		link, err := shareLink(c, cfg, secret, share)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		png, err := qrcode.Encode(link.URL, qrcode.Medium, size)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusInternalServerError, Error{err})
+		}
+
+		c.Response().Header().Set("Cache-Control", "private, no-cache")
+		return c.Blob(http.StatusOK, "image/png", png)
+	}, requireUser())
+
+	group.GET("/:id/shares", func(c echo.Context) error {
+		id := c.Param("id")
+		if ok, err := modifiableMarker(c, db, id); !ok {
+			return err
+		}
+
+		cursor, err := db.Collection("shares").Find(c.Request().Context(), bson.M{"markerId": id}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		shares := []Share{}
+		if err := cursor.All(context.Background(), &shares); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, shares)
+	}, requireUser())
+
+	// Revoking a share ends its link right away, printed QR codes included.
+	group.DELETE("/:id/shares/:shareID", func(c echo.Context) error {
+		id := c.Param("id")
+		if ok, err := modifiableMarker(c, db, id); !ok {
+			return err
+		}
+
+		res, err := db.Collection("shares").DeleteOne(c.Request().Context(), bson.M{"_id": c.Param("shareID"), "markerId": id})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "share not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return c.NoContent(http.StatusOK)
+	}, requireUser())
+
+	e.GET("/share/:token", func(c echo.Context) error {
+		if secret == nil {
+			s := "sharing is not configured"
+			c.Logger().Error(s)
+			return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+		}
+
+		id, ok, err := sharedMarkerID(c.Request().Context(), db, secret, c.Param("token"))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !ok {
+			s := "invalid or expired share link"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		var marker Marker
+		if err := db.Collection("markers").FindOne(c.Request().Context(), and(bson.M{"_id": id}, sharedVisibility())).Decode(&marker); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "marker not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		visible, err := privacy.view(c).redactMarker(c.Request().Context(), &marker)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if !visible {
+			s := "marker not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		// Shared views are read-only and don't reveal who owns the marker.
+		marker.OwnerID = ""
+		return c.JSON(http.StatusOK, marker.Normalize())
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// concurrencyLimit caps the number of requests handled at once. Up to maxQueue extra
+// requests wait for a free slot for at most queueTimeout, everything above is rejected
+// right away so spikes don't pile onto the database.
+func concurrencyLimit(maxInFlight, maxQueue int, queueTimeout, retryAfter time.Duration) echo.MiddlewareFunc {
+	slots := make(chan struct{}, maxInFlight)
+	var queued int64
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if maxInFlight == 0 {
+				return next(c)
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				if atomic.AddInt64(&queued, 1) > int64(maxQueue) {
+					atomic.AddInt64(&queued, -1)
+					return overloaded(c, retryAfter)
+				}
+
+				timer := time.NewTimer(queueTimeout)
+				select {
+				case slots <- struct{}{}:
+					timer.Stop()
+					atomic.AddInt64(&queued, -1)
+				case <-timer.C:
+					atomic.AddInt64(&queued, -1)
+					return overloaded(c, retryAfter)
+				case <-c.Request().Context().Done():
+					timer.Stop()
+					atomic.AddInt64(&queued, -1)
+					return c.Request().Context().Err()
+				}
+			}
+			defer func() { <-slots }()
+
+			return next(c)
+		}
+	}
+}
+
+func overloaded(c echo.Context, retryAfter time.Duration) error {
+	s := "server is overloaded, retry later"
+	c.Logger().Warn(s)
+	setRetryAfter(c, retryAfter)
+	return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+}
+
+// setRetryAfter tells clients to come back after d, rounded up to whole seconds.
+func setRetryAfter(c echo.Context, d time.Duration) {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	// sitemapSize is the most URLs a sitemap may list.
+	sitemapSize = 50000
+)
+
+var sitemapPattern = regexp.MustCompile(`^sitemap-[0-9]+\.xml$`)
+
+// SitemapIndex lists the sitemaps of the markers, see https://www.sitemaps.org.
+type SitemapIndex struct {
+	XMLName  xml.Name      `xml:"sitemapindex"`
+	XMLNS    string        `xml:"xmlns,attr"`
+	Sitemaps []SitemapFile `xml:"sitemap"`
+}
+
+type SitemapFile struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Sitemap lists the pages of up to sitemapSize markers.
+type Sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []SitemapURL `xml:"url"`
+}
+
+type SitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemaps builds the sitemaps of public markers in EXPORT_DIR, a job rebuilds them
+// every SITEMAP_INTERVAL. Crawlers need absolute URLs, so there are none without
+// PUBLIC_URL.
+type sitemaps struct {
+	db   *mongo.Database
+	dir  string
+	base string
+}
+
+func newSitemaps(db *mongo.Database, cfg Config) *sitemaps {
+	return &sitemaps{
+		db:   db,
+		dir:  filepath.Join(cfg.ExportDir, db.Name(), "sitemaps"),
+		base: strings.TrimSuffix(cfg.PublicURL, "/"),
+	}
+}
+
+// build writes a sitemap for every sitemapSize markers and the index listing them, it
+// runs as the build-sitemaps job. Sitemaps of an earlier build past the new ones are
+// removed once the index doesn't list them anymore.
+func (s *sitemaps) build(ctx context.Context) error {
+	cursor, err := s.db.Collection("markers").Find(ctx, visibilityFor(User{}, false), options.Find().
+		SetProjection(bson.M{"_id": 1, "updatedAt": 1}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetBatchSize(1000))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	index := SitemapIndex{XMLNS: sitemapNamespace}
+	sitemap := Sitemap{XMLNS: sitemapNamespace}
+	var lastMod time.Time
+
+	flush := func() error {
+		name := fmt.Sprintf("sitemap-%d.xml", len(index.Sitemaps)+1)
+		if err := writeXML(filepath.Join(s.dir, name), sitemap); err != nil {
+			return err
+		}
+
+		file := SitemapFile{Loc: s.base + "/sitemaps/" + name}
+		if !lastMod.IsZero() {
+			file.LastMod = lastMod.UTC().Format(time.RFC3339)
+		}
+
+		index.Sitemaps = append(index.Sitemaps, file)
+		sitemap.URLs, lastMod = sitemap.URLs[:0], time.Time{}
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return err
+		}
+
+		sitemap.URLs = append(sitemap.URLs, SitemapURL{Loc: s.base + "/markers/" + marker.ID, LastMod: marker.UpdatedAt.UTC().Format(time.RFC3339)})
+		if marker.UpdatedAt.After(lastMod) {
+			lastMod = marker.UpdatedAt
+		}
+
+		if len(sitemap.URLs) == sitemapSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	// An index needs at least one sitemap, even an empty one.
+	if len(sitemap.URLs) > 0 || len(index.Sitemaps) == 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := writeXML(filepath.Join(s.dir, "sitemap.xml"), index); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !sitemapPattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "sitemap-"), ".xml"))
+		if n > len(index.Sitemaps) {
+			if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeXML(path string, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append([]byte(xml.Header), body...))
+}
+
+// registerSitemapRoutes serves /sitemap.xml and the sitemaps it lists. Both are missing
+// until the first build finished.
+func registerSitemapRoutes(e *echo.Echo, sm *sitemaps, maxAge time.Duration) {
+	serve := func(c echo.Context, name string) error {
+		path := filepath.Join(sm.dir, name)
+		if _, err := os.Stat(path); err != nil {
+			s := "sitemap not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		c.Response().Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+		return c.File(path)
+	}
+
+	e.GET("/sitemap.xml", func(c echo.Context) error {
+		return serve(c, "sitemap.xml")
+	})
+	e.GET("/sitemaps/:name", func(c echo.Context) error {
+		name := c.Param("name")
+		if !sitemapPattern.MatchString(name) {
+			s := "sitemap not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		return serve(c, name)
+	})
+}
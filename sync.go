@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSyncLimit = 500
+	maxSyncLimit     = 1000
+	maxSyncChanges   = 500
+
+	// tombstoneRetention is how long deletions are remembered. Clients that didn't sync
+	// for longer have to download everything again.
+	tombstoneRetention = 30 * 24 * time.Hour
+
+	// syncSettleTime keeps the newest changes out of responses, so writes that started
+	// before a sync but finished after it aren't skipped by the next one.
+	syncSettleTime = 2 * time.Second
+)
+
+// Tombstone remembers a deleted marker for clients that synced before the deletion.
+type Tombstone struct {
+	ID        string    `json:"id" bson:"_id"`
+	DeletedAt time.Time `json:"deletedAt" bson:"deletedAt"`
+}
+
+// syncPosition is where a client stopped in each of the change streams.
+type syncPosition struct {
+	UpdatedAt time.Time `json:"u"`
+	MarkerID  string    `json:"m,omitempty"`
+	DeletedAt time.Time `json:"d"`
+	DeletedID string    `json:"t,omitempty"`
+}
+
+func (p syncPosition) token() string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseSyncToken(token string) (syncPosition, error) {
+	var p syncPosition
+	if token == "" {
+		return p, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return p, fmt.Errorf("invalid sync token")
+	}
+
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("invalid sync token")
+	}
+
+	return p, nil
+}
+
+type SyncResponse struct {
+	Markers []Marker    `json:"markers"`
+	Deleted []Tombstone `json:"deleted"`
+	// Next is passed as ?since= in the next request. More is true when there are changes
+	// left that didn't fit into this response.
+	Next string `json:"next"`
+	More bool   `json:"more"`
+}
+
+const (
+	SyncUpsert = "upsert"
+	SyncDelete = "delete"
+)
+
+// SyncChange is an edit made on a client while offline. BaseRevision is the revision
+// of the marker the edit was made on, 0 for markers created on the client.
+type SyncChange struct {
+	Op           string  `json:"op"`
+	ID           string  `json:"id"`
+	BaseRevision int64   `json:"baseRevision"`
+	Marker       *Marker `json:"marker,omitempty"`
+}
+
+type SyncUpload struct {
+	Changes []SyncChange `json:"changes"`
+}
+
+func (u SyncUpload) Validate() error {
+	if len(u.Changes) == 0 {
+		return fmt.Errorf("no changes")
+	}
+
+	if len(u.Changes) > maxSyncChanges {
+		return fmt.Errorf("too many changes, at most %d can be uploaded at once", maxSyncChanges)
+	}
+
+	seen := map[string]bool{}
+	for _, change := range u.Changes {
+		if change.ID == "" || seen[change.ID] {
+			return fmt.Errorf("invalid or repeated change id %q", change.ID)
+		}
+
+		seen[change.ID] = true
+
+		switch change.Op {
+		case SyncUpsert:
+			if change.Marker == nil || change.Marker.ID != change.ID {
+				return fmt.Errorf("change %s: marker is missing or has a different id", change.ID)
+			}
+		case SyncDelete:
+		default:
+			return fmt.Errorf("change %s: unknown op %q, expected %s or %s", change.ID, change.Op, SyncUpsert, SyncDelete)
+		}
+	}
+
+	return nil
+}
+
+type SyncApplied struct {
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// Revision is the new revision the client should keep as the base of later edits.
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// SyncConflict is a change made on a version the server no longer has. Server is nil
+// when the marker was deleted on the server.
+type SyncConflict struct {
+	ID     string  `json:"id"`
+	Server *Marker `json:"server"`
+	Client *Marker `json:"client"`
+}
+
+type SyncRejected struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+type SyncUploadResult struct {
+	Applied   []SyncApplied  `json:"applied"`
+	Conflicts []SyncConflict `json:"conflicts"`
+	Rejected  []SyncRejected `json:"rejected"`
+}
+
+// revisionIs matches markers with the given revision, markers without one count as 0.
+func revisionIs(revision int64) interface{} {
+	if revision == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+
+	return revision
+}
+
+// syncUploader applies offline changes one by one. Database errors abort the batch,
+// everything else only affects the change that caused it.
+type syncUploader struct {
+	c             echo.Context
+	db            *mongo.Database
+	quotas        Quotas
+	geocoding     *geocodingWorker
+	notifications *notifier
+	result        SyncUploadResult
+}
+
+func (u *syncUploader) reject(id string, format string, args ...interface{}) {
+	u.result.Rejected = append(u.result.Rejected, SyncRejected{ID: id, Error: fmt.Sprintf(format, args...)})
+}
+
+// conflict reports the current server version of the marker next to the client one.
+func (u *syncUploader) conflict(change SyncChange) error {
+	conflict := SyncConflict{ID: change.ID, Client: change.Marker}
+
+	var server Marker
+	err := u.db.Collection("markers").FindOne(u.c.Request().Context(), bson.M{"_id": change.ID}).Decode(&server)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	if err == nil {
+		server = server.Normalize()
+		conflict.Server = &server
+	}
+
+	u.result.Conflicts = append(u.result.Conflicts, conflict)
+	return nil
+}
+
+func (u *syncUploader) apply(change SyncChange) error {
+	ctx := u.c.Request().Context()
+	stored, found, err := storedMarker(ctx, u.db, change.ID)
+	if err != nil {
+		return err
+	}
+
+	if found && !canModify(u.c, stored.OwnerID) {
+		u.reject(change.ID, "only the owner can modify this marker")
+		return nil
+	}
+
+	if found && stored.Revision != change.BaseRevision || !found && change.BaseRevision != 0 {
+		return u.conflict(change)
+	}
+
+	if change.Op == SyncDelete {
+		// Deleting a marker that is already gone is a no-op.
+		if found {
+			if err := deleteMarker(ctx, u.db, change.ID); err != nil {
+				return err
+			}
+		}
+
+		u.result.Applied = append(u.result.Applied, SyncApplied{ID: change.ID, Deleted: true})
+		return nil
+	}
+
+	if err := change.Marker.Validate(); err != nil {
+		u.reject(change.ID, "%v", err)
+		return nil
+	}
+
+	marker := change.Marker.Normalize()
+	ownerID := stored.OwnerID
+	if !found {
+		user, _ := currentUser(u.c)
+		ownerID = user.ID
+	}
+
+	if marker.Private && ownerID == "" {
+		u.reject(change.ID, "markers without an owner can't be private")
+		return nil
+	}
+
+	if err := checkQuotas(ctx, u.db, u.quotas, ownerID, marker); err != nil {
+		var quotaErr QuotaError
+		if errors.As(err, &quotaErr) {
+			u.reject(change.ID, "%v", err)
+			return nil
+		}
+
+		return err
+	}
+
+	if !found {
+		marker = marker.created(ownerID)
+		if err := insertMarker(ctx, u.db, marker); err != nil {
+			// Somebody created a marker with the same id in the meantime.
+			var mongoErr mongo.WriteException
+			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+				return u.conflict(change)
+			}
+
+			return err
+		}
+
+		u.geocoding.enqueue(marker.ID)
+		u.notifications.markerCreated(marker)
+		u.result.Applied = append(u.result.Applied, SyncApplied{ID: change.ID, Revision: marker.Revision})
+		return nil
+	}
+
+	// The revision is checked again by the update, so edits made since loading the
+	// marker are reported as conflicts too.
+	matched, moved, err := updateMarker(ctx, u.db, bson.M{"_id": change.ID, "revision": revisionIs(change.BaseRevision)}, stored, marker)
+	if err != nil {
+		return err
+	}
+
+	if !matched {
+		return u.conflict(change)
+	}
+
+	if moved {
+		u.geocoding.enqueue(change.ID)
+	}
+
+	u.result.Applied = append(u.result.Applied, SyncApplied{ID: change.ID, Revision: change.BaseRevision + 1})
+	return nil
+}
+
+// after matches documents that come after the given position in (field, _id) order.
+func after(field string, at time.Time, id string, until time.Time) bson.M {
+	filter := bson.M{field: bson.M{"$gt": at, "$lte": until}}
+	if id != "" {
+		filter = bson.M{"$or": bson.A{
+			filter,
+			bson.M{field: at, "_id": bson.M{"$gt": id}},
+		}}
+	}
+
+	return filter
+}
+
+// FeedPosition is how far a background consumer, such as the search indexer, got in
+// the feeds of changed markers and tombstones.
+type FeedPosition struct {
+	ID       string       `bson:"_id"`
+	Position syncPosition `bson:"position"`
+}
+
+func loadFeedPosition(ctx context.Context, db *mongo.Database, consumer string) (syncPosition, error) {
+	var feed FeedPosition
+	err := db.Collection("feeds").FindOne(ctx, bson.M{"_id": consumer}).Decode(&feed)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return syncPosition{}, nil
+	}
+
+	return feed.Position, err
+}
+
+func saveFeedPosition(ctx context.Context, db *mongo.Database, consumer string, position syncPosition) error {
+	_, err := db.Collection("feeds").UpdateOne(ctx,
+		bson.M{"_id": consumer},
+		bson.M{"$set": bson.M{"position": position}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// recordTombstone marks the marker as deleted for sync clients.
+func recordTombstone(ctx context.Context, db *mongo.Database, id string) error {
+	_, err := db.Collection("tombstones").UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func registerSyncRoutes(group *echo.Group, db *mongo.Database, quotas Quotas, geocoding *geocodingWorker, notifications *notifier, privacy *markerPrivacy) {
+	group.GET("", func(c echo.Context) error {
+		position, err := parseSyncToken(c.QueryParam("since"))
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if !position.DeletedAt.IsZero() && time.Since(position.DeletedAt) > tombstoneRetention {
+			s := "sync token expired, sync again without ?since="
+			c.Logger().Info(s)
+			return c.JSON(http.StatusGone, ErrorString{s})
+		}
+
+		limit, err := parseLimit(c, defaultSyncLimit, maxSyncLimit)
+		if err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		until := time.Now().UTC().Add(-syncSettleTime)
+
+		cursor, err := db.Collection("markers").Find(c.Request().Context(),
+			and(after("updatedAt", position.UpdatedAt, position.MarkerID, until), visibilityFilter(c)),
+			options.Find().
+				SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}}).
+				SetLimit(int64(limit+1)))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		response := SyncResponse{Markers: []Marker{}, Deleted: []Tombstone{}}
+		if err := cursor.All(context.Background(), &response.Markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		// A full sync has nothing to delete on the client.
+		if !position.DeletedAt.IsZero() {
+			cursor, err = db.Collection("tombstones").Find(c.Request().Context(),
+				after("deletedAt", position.DeletedAt, position.DeletedID, until),
+				options.Find().
+					SetSort(bson.D{{Key: "deletedAt", Value: 1}, {Key: "_id", Value: 1}}).
+					SetLimit(int64(limit+1)))
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if err := cursor.All(context.Background(), &response.Deleted); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+		}
+
+		if len(response.Markers) > limit {
+			response.Markers, response.More = response.Markers[:limit], true
+		}
+
+		if len(response.Deleted) > limit {
+			response.Deleted, response.More = response.Deleted[:limit], true
+		}
+
+		next := syncPosition{UpdatedAt: until, DeletedAt: until}
+		if response.More {
+			// Stop at the last returned change of each stream, the rest comes next time.
+			// Deletions during a full sync are tracked from its first response on.
+			next = position
+			if next.DeletedAt.IsZero() {
+				next.DeletedAt = until
+			}
+
+			if n := len(response.Markers); n > 0 {
+				next.UpdatedAt, next.MarkerID = response.Markers[n-1].UpdatedAt, response.Markers[n-1].ID
+			}
+
+			if n := len(response.Deleted); n > 0 {
+				next.DeletedAt, next.DeletedID = response.Deleted[n-1].DeletedAt, response.Deleted[n-1].ID
+			}
+		}
+
+		response.Next = next.token()
+		if response.Markers, err = privacy.view(c).redact(c.Request().Context(), response.Markers); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		for i := range response.Markers {
+			response.Markers[i] = response.Markers[i].Normalize()
+		}
+
+		return c.JSON(http.StatusOK, response)
+	})
+	group.POST("", func(c echo.Context) error {
+		var body SyncUpload
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		uploader := syncUploader{
+			c:             c,
+			db:            db,
+			quotas:        quotas,
+			geocoding:     geocoding,
+			notifications: notifications,
+			result:        SyncUploadResult{Applied: []SyncApplied{}, Conflicts: []SyncConflict{}, Rejected: []SyncRejected{}},
+		}
+		for _, change := range body.Changes {
+			if err := uploader.apply(change); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+		}
+
+		return c.JSON(http.StatusOK, uploader.result)
+	})
+}
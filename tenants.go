@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const tenantHeader = "X-Tenant"
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Tenant is a separate map hosted by the deployment, e.g. for a club. Every tenant has
+// its own database, the default tenant uses MONGODB_DATABASE.
+type Tenant struct {
+	ID        string    `json:"id" bson:"_id"`
+	Name      string    `json:"name" bson:"name"`
+	Plan      string    `json:"plan" bson:"plan"`
+	Database  string    `json:"database" bson:"database"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+func (t Tenant) Validate() error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("invalid tenant id, expected up to 32 lowercase letters, digits and dashes")
+	}
+
+	if strings.TrimSpace(t.Name) == "" {
+		return fmt.Errorf("empty name")
+	}
+
+	return nil
+}
+
+// unknownTenantTTL is how long a tenant that isn't provisioned is remembered, so
+// requests naming it don't each look it up again.
+const unknownTenantTTL = 30 * time.Second
+
+// tenantServer is the server of a tenant, started by the first request for it while
+// others for the same tenant wait. A tenant that isn't provisioned has no server and
+// expires, errors aren't kept and the next request tries again.
+type tenantServer struct {
+	once    sync.Once
+	e       *echo.Echo
+	cancel  context.CancelFunc
+	err     error
+	expires time.Time
+}
+
+// tenancy routes requests to the server of the tenant named in the X-Tenant header or
+// the subdomain of TENANT_DOMAIN. Requests without a tenant go to the default server,
+// which also keeps the tenant registry. Servers of other tenants start on first use.
+type tenancy struct {
+	cfg    Config
+	client *mongo.Client
+	db     *mongo.Database
+	root   *echo.Echo
+	limits *rateLimits
+	flags  *featureFlags
+
+	mu      sync.Mutex
+	servers map[string]*tenantServer
+	swept   time.Time
+}
+
+func newTenancy(cfg Config, client *mongo.Client, db *mongo.Database, root *echo.Echo, limits *rateLimits, flags *featureFlags) *tenancy {
+	return &tenancy{cfg: cfg, client: client, db: db, root: root, limits: limits, flags: flags, servers: map[string]*tenantServer{}}
+}
+
+// resolve returns the tenant id of the request, empty for the default tenant.
+func (t *tenancy) resolve(r *http.Request) (string, error) {
+	id := strings.ToLower(strings.TrimSpace(r.Header.Get(tenantHeader)))
+	if id == "" && t.cfg.TenantDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		sub := strings.TrimSuffix(strings.ToLower(host), "."+t.cfg.TenantDomain)
+		if sub != strings.ToLower(host) && !strings.Contains(sub, ".") {
+			id = sub
+		}
+	}
+
+	if id != "" && !tenantIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid tenant")
+	}
+
+	return id, nil
+}
+
+// server returns the server of the tenant, starting it if it's the first request. Only
+// finding and publishing the server holds mu, tenants start without blocking others.
+func (t *tenancy) server(ctx context.Context, id string) (*echo.Echo, bool, error) {
+	t.mu.Lock()
+	now := time.Now()
+	s, ok := t.servers[id]
+	if !ok || !s.expires.IsZero() && now.After(s.expires) {
+		s = &tenantServer{}
+		t.servers[id] = s
+	}
+
+	// Unknown tenants nobody asks for again are dropped now and then.
+	if now.Sub(t.swept) > unknownTenantTTL {
+		for other, unknown := range t.servers {
+			if !unknown.expires.IsZero() && now.After(unknown.expires) {
+				delete(t.servers, other)
+			}
+		}
+
+		t.swept = now
+	}
+	t.mu.Unlock()
+
+	s.once.Do(func() {
+		t.start(ctx, id, s)
+	})
+
+	return s.e, s.e != nil, s.err
+}
+
+func (t *tenancy) start(ctx context.Context, id string, s *tenantServer) {
+	var tenant Tenant
+	if err := t.db.Collection("tenants").FindOne(ctx, bson.M{"_id": id}).Decode(&tenant); err != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			s.expires = time.Now().Add(unknownTenantTTL)
+			return
+		}
+
+		s.err = err
+		t.forget(id, s)
+		return
+	}
+
+	serverCtx, cancel := context.WithCancel(context.Background())
+	e, err := newServer(serverCtx, t.cfg, t.client.Database(tenant.Database), t.limits, t.flags, tenant)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		cancel()
+		s.err = err
+		t.forget(id, s)
+		return
+	}
+
+	if t.servers[id] != s {
+		// The tenant was removed while it started.
+		cancel()
+		return
+	}
+
+	s.e, s.cancel = e, cancel
+}
+
+// forget drops the server of the tenant unless it was replaced already. mu must be held.
+func (t *tenancy) forget(id string, s *tenantServer) {
+	if t.servers[id] == s {
+		delete(t.servers, id)
+	}
+}
+
+// stop shuts down background work of a removed tenant and stops serving it. A tenant
+// remembered as unknown is forgotten, so one that was just provisioned is served.
+func (t *tenancy) stop(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.servers[id]; ok {
+		if s.cancel != nil {
+			s.cancel()
+		}
+
+		delete(t.servers, id)
+	}
+}
+
+func (t *tenancy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := t.resolve(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{err})
+		return
+	}
+
+	if id == "" {
+		t.root.ServeHTTP(w, r)
+		return
+	}
+
+	e, found, err := t.server(r.Context(), id)
+	if err != nil {
+		t.root.Logger.Error(err)
+		writeJSON(w, http.StatusServiceUnavailable, Error{err})
+		return
+	}
+
+	if !found {
+		writeJSON(w, http.StatusNotFound, ErrorString{"unknown tenant"})
+		return
+	}
+
+	e.ServeHTTP(w, r)
+}
+
+// writeJSON is used where no echo context exists yet.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// listTenants returns the provisioned tenants ordered by id.
+func listTenants(ctx context.Context, db *mongo.Database) ([]Tenant, error) {
+	cursor, err := db.Collection("tenants").Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Tenant{}
+	if err := cursor.All(context.Background(), &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// registerTenantRoutes adds tenant provisioning for admins of the default tenant.
+func registerTenantRoutes(group *echo.Group, tenants *tenancy) {
+	db := tenants.db
+
+	group.GET("", func(c echo.Context) error {
+		results, err := listTenants(c.Request().Context(), db)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	})
+	group.POST("", func(c echo.Context) error {
+		var body Tenant
+		if err := c.Bind(&body); err != nil {
+			return bindFailed(c, err)
+		}
+
+		if err := body.Validate(); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		}
+
+		if body.Plan == "" {
+			body.Plan = defaultPlan
+		}
+
+		if !tenants.limits.hasPlan(body.Plan) {
+			s := fmt.Sprintf("unknown plan %q", body.Plan)
+			c.Logger().Info(s)
+			return c.JSON(http.StatusBadRequest, ErrorString{s})
+		}
+
+		body.Name = strings.TrimSpace(body.Name)
+		body.Database = tenants.cfg.MongoDatabase + "-" + body.ID
+		body.CreatedAt = time.Now().UTC()
+
+		ctx := c.Request().Context()
+		if err := ensureCollections(ctx, tenants.client.Database(body.Database)); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if _, err := db.Collection("tenants").InsertOne(ctx, body); err != nil {
+			var mongoErr mongo.WriteException
+			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+				s := "tenant already exists"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusConflict, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		tenants.stop(body.ID)
+		return c.JSON(http.StatusCreated, body)
+	})
+	// Removing a tenant stops serving it, the database is kept and has to be dropped
+	// separately once its data is no longer needed.
+	group.DELETE("/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		res, err := db.Collection("tenants").DeleteOne(c.Request().Context(), bson.M{"_id": id})
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		if res.DeletedCount == 0 {
+			s := "tenant not found"
+			c.Logger().Info(s)
+			return c.JSON(http.StatusNotFound, ErrorString{s})
+		}
+
+		tenants.stop(id)
+
+		admin, _ := currentUser(c)
+		if err := recordAudit(c.Request().Context(), db, admin.ID, "tenants.delete", nil, bson.M{"tenantId": id}); err != nil {
+			c.Logger().Error(err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const maxTileZoom = 22
+
+// tileProxy serves raster tiles from an upstream provider and keeps them on disk, so API
+// keys stay on the server and repeated requests don't reach the provider.
+type tileProxy struct {
+	upstream  string
+	userAgent string
+	dir       string
+	ttl       time.Duration
+	maxAge    time.Duration
+	client    *http.Client
+}
+
+func newTileProxy(cfg Config) *tileProxy {
+	return &tileProxy{
+		upstream:  cfg.TileUpstreamURL,
+		userAgent: cfg.TileUserAgent,
+		dir:       cfg.TileCacheDir,
+		ttl:       cfg.TileCacheTTL,
+		maxAge:    cfg.TileMaxAge,
+		client:    &http.Client{Timeout: cfg.TileTimeout},
+	}
+}
+
+// parseTile reads z, x and y path parameters and checks they address an existing tile.
+// y may end with the extension ext.
+func parseTile(c echo.Context, ext string) (int, int, int, error) {
+	z, err := strconv.Atoi(c.Param("z"))
+	if err != nil || z < 0 || z > maxTileZoom {
+		return 0, 0, 0, fmt.Errorf("invalid zoom, expected 0 to %d", maxTileZoom)
+	}
+
+	// Maps repeat the world to the east and west, x wraps around at the antimeridian.
+	n := 1 << z
+	x, err := strconv.Atoi(c.Param("x"))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid x for zoom %d", z)
+	}
+	x = (x%n + n) % n
+
+	y, err := strconv.Atoi(strings.TrimSuffix(c.Param("y"), ext))
+	if err != nil || y < 0 || y >= n {
+		return 0, 0, 0, fmt.Errorf("invalid y for zoom %d", z)
+	}
+
+	return z, x, y, nil
+}
+
+func (p *tileProxy) handle(c echo.Context) error {
+	z, x, y, err := parseTile(c, ".png")
+	if err != nil {
+		c.Logger().Info(err)
+		return c.JSON(http.StatusBadRequest, Error{err})
+	}
+
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(p.maxAge.Seconds())))
+
+	path := filepath.Join(p.dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+	if p.dir != "" {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < p.ttl {
+			c.Response().Header().Set("X-Cache", "HIT")
+			return c.File(path)
+		}
+	}
+
+	r := strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y))
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, r.Replace(p.upstream), nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Error{err})
+	}
+
+	req.Header.Set("User-Agent", p.userAgent)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadGateway, ErrorString{"tile provider is unavailable"})
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return c.JSON(http.StatusNotFound, ErrorString{"tile not found"})
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.Logger().Errorf("tile provider responded with %s", resp.Status)
+		return c.JSON(http.StatusBadGateway, ErrorString{"tile provider is unavailable"})
+	}
+
+	tile, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadGateway, ErrorString{"tile provider is unavailable"})
+	}
+
+	if p.dir != "" {
+		if err := writeFileAtomic(path, tile); err != nil {
+			c.Logger().Warn(err)
+		}
+	}
+
+	contentType := resp.Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = "image/png"
+	}
+
+	c.Response().Header().Set("X-Cache", "MISS")
+	return c.Blob(http.StatusOK, contentType, tile)
+}
+
+// writeFileAtomic writes to a temporary file first so readers never see partial files.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tileset is a PMTiles archive of vector tiles of the public markers of an area, for
+// serving them from a CDN or using them offline in MapLibre. Tiles below
+// markerTileClusterZoom hold clusters like the JSON tiles, the ones above and at MaxZoom
+// hold every marker. Tilesets are shared like bundles and rebuilt once older than
+// TILESET_MAX_AGE.
+type Tileset struct {
+	ID string `json:"id" bson:"_id"`
+	// BBox is the area covered as minLon,minLat,maxLon,maxLat, empty for everywhere.
+	BBox    string `json:"bbox,omitempty" bson:"bbox"`
+	MaxZoom int    `json:"maxZoom" bson:"maxZoom"`
+	Status  string `json:"status" bson:"status"`
+	Error   string `json:"error,omitempty" bson:"error,omitempty"`
+
+	Tiles int   `json:"tiles" bson:"tiles"`
+	Size  int64 `json:"size,omitempty" bson:"size,omitempty"`
+
+	// URL downloads the archive of a completed tileset. It supports range requests, so
+	// MapLibre can read tiles straight from it with the PMTiles protocol.
+	URL string `json:"url,omitempty" bson:"-"`
+
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+	// ExpiresAt is when the archive of a completed tileset is removed.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// tilesetMetadata is the TileJSON like metadata stored in archives.
+type tilesetMetadata struct {
+	Name         string               `json:"name"`
+	Format       string               `json:"format"`
+	Type         string               `json:"type"`
+	VectorLayers []tilesetVectorLayer `json:"vector_layers"`
+}
+
+type tilesetVectorLayer struct {
+	ID      string            `json:"id"`
+	Fields  map[string]string `json:"fields"`
+	MinZoom int               `json:"minzoom"`
+	MaxZoom int               `json:"maxzoom"`
+}
+
+// worldBounds is the area Web Mercator tiles cover.
+var worldBounds = Bounds{MinLatitude: -85.05112878, MaxLatitude: 85.05112878, MinLongitude: -180, MaxLongitude: 180}
+
+// markerTilesets builds tilesets one at a time. Only tiles with markers are rendered, and
+// children of empty tiles are skipped, so the work grows with the markers rather than
+// with the area. Interrupted builds start over.
+type markerTilesets struct {
+	db        *mongo.Database
+	dir       string
+	retention time.Duration
+	privacy   *markerPrivacy
+	logger    echo.Logger
+	queue     chan string
+}
+
+func newMarkerTilesets(db *mongo.Database, cfg Config, privacy *markerPrivacy, logger echo.Logger) *markerTilesets {
+	return &markerTilesets{
+		db:        db,
+		dir:       filepath.Join(cfg.ExportDir, db.Name(), "tilesets"),
+		retention: cfg.ExportRetention,
+		privacy:   privacy,
+		logger:    logger,
+		queue:     make(chan string, 100),
+	}
+}
+
+func (t *markerTilesets) path(id string) string {
+	return filepath.Join(t.dir, id+".pmtiles")
+}
+
+// enqueue schedules the tileset. When the queue is full the tileset is picked up on the
+// next resume pass.
+func (t *markerTilesets) enqueue(id string) {
+	select {
+	case t.queue <- id:
+	default:
+		t.logger.Warnf("tileset queue is full, tileset %s will run later", id)
+	}
+}
+
+func (t *markerTilesets) run(ctx context.Context) {
+	resume := time.NewTicker(10 * time.Minute)
+	defer resume.Stop()
+
+	t.resume(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-resume.C:
+			t.resume(ctx)
+		case id := <-t.queue:
+			t.process(ctx, id)
+		}
+	}
+}
+
+// resume queues tilesets that didn't finish, e.g. because the server was restarted.
+func (t *markerTilesets) resume(ctx context.Context) {
+	cursor, err := t.db.Collection("tilesets").Find(ctx, bson.M{"status": bson.M{"$in": bson.A{ExportQueued, ExportRunning}}})
+	if err != nil {
+		t.logger.Error(err)
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var tileset Tileset
+		if err := cursor.Decode(&tileset); err != nil {
+			t.logger.Error(err)
+			return
+		}
+
+		select {
+		case t.queue <- tileset.ID:
+		default:
+			return
+		}
+	}
+}
+
+// expire removes archives past their retention, it runs as the expire-tilesets job.
+func (t *markerTilesets) expire(ctx context.Context) error {
+	cursor, err := t.db.Collection("tilesets").Find(ctx, bson.M{"status": ExportCompleted, "expiresAt": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+
+	var expired []Tileset
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		return err
+	}
+
+	for _, tileset := range expired {
+		if err := os.Remove(t.path(tileset.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.logger.Error(err)
+			continue
+		}
+
+		if err := t.update(ctx, tileset.ID, bson.M{"status": ExportExpired}); err != nil {
+			t.logger.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (t *markerTilesets) update(ctx context.Context, id string, set bson.M) error {
+	set["updatedAt"] = time.Now().UTC()
+	_, err := t.db.Collection("tilesets").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+func (t *markerTilesets) process(ctx context.Context, id string) {
+	var tileset Tileset
+	if err := t.db.Collection("tilesets").FindOne(ctx, bson.M{"_id": id}).Decode(&tileset); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			t.logger.Error(err)
+		}
+
+		return
+	}
+
+	if tileset.Status != ExportQueued && tileset.Status != ExportRunning {
+		return
+	}
+
+	if err := t.update(ctx, id, bson.M{"status": ExportRunning}); err != nil {
+		t.logger.Error(err)
+		return
+	}
+
+	size, err := t.build(ctx, &tileset)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		t.logger.Warnf("tileset %s failed: %v", id, err)
+		if err := t.update(ctx, id, bson.M{"status": ExportFailed, "error": err.Error()}); err != nil {
+			t.logger.Error(err)
+		}
+
+		return
+	}
+
+	if err := t.update(ctx, id, bson.M{
+		"status":    ExportCompleted,
+		"size":      size,
+		"tiles":     tileset.Tiles,
+		"expiresAt": time.Now().UTC().Add(t.retention),
+	}); err != nil {
+		t.logger.Error(err)
+	}
+}
+
+// build renders the tiles of the tileset, writes the archive and returns its size.
+func (t *markerTilesets) build(ctx context.Context, tileset *Tileset) (int64, error) {
+	filter := and(visibilityFor(User{}, false), outsideZonesFor(User{}, false))
+	bounds := worldBounds
+	if tileset.BBox != "" {
+		bbox, err := parseBounds(tileset.BBox)
+		if err != nil {
+			return 0, err
+		}
+
+		filter, bounds = and(filter, bbox.filter()), bbox
+	}
+
+	if err := os.MkdirAll(t.dir, 0o700); err != nil {
+		return 0, err
+	}
+
+	w, err := newPMTilesWriter(t.dir)
+	if err != nil {
+		return 0, err
+	}
+	defer w.close()
+
+	tileset.Tiles = 0
+	if err := t.render(ctx, w, tileset, filter, 0, 0, 0); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(t.dir, "tileset-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	metadata := tilesetMetadata{
+		Name:   "markers",
+		Format: "pbf",
+		Type:   "overlay",
+		VectorLayers: []tilesetVectorLayer{
+			{ID: mvtLayerName, Fields: mvtFields, MinZoom: 0, MaxZoom: tileset.MaxZoom},
+		},
+	}
+
+	if err := w.finish(f, bounds, metadata); err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(f.Name(), t.path(tileset.ID))
+}
+
+// render adds the tile and, unless it's empty or at the maximum zoom, its children.
+func (t *markerTilesets) render(ctx context.Context, w *pmtilesWriter, tileset *Tileset, filter bson.M, z, x, y int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tile := MarkerTile{Z: z, X: x, Y: y, Bounds: tileBounds(z, x, y)}
+	tileFilter := and(filter, tile.Bounds.filter())
+
+	if z < markerTileClusterZoom && z < tileset.MaxZoom {
+		clusters, err := geohashClusters(ctx, t.db, tileFilter, tilePrecision(z))
+		if err != nil {
+			return err
+		}
+
+		if len(clusters) == 0 {
+			return nil
+		}
+
+		tile.Clusters = clusters
+	} else {
+		cursor, err := t.db.Collection("markers").Find(ctx, tileFilter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return err
+		}
+
+		var markers []Marker
+		if err := cursor.All(context.Background(), &markers); err != nil {
+			return err
+		}
+
+		if markers, err = t.privacy.anonymous().redact(ctx, markers); err != nil {
+			return err
+		}
+
+		if len(markers) == 0 {
+			return nil
+		}
+
+		for i := range markers {
+			markers[i] = markers[i].Normalize()
+		}
+
+		tile.Markers = markers
+	}
+
+	if err := w.add(z, x, y, encodeMarkerTile(tile)); err != nil {
+		return err
+	}
+
+	tileset.Tiles++
+	if z == tileset.MaxZoom {
+		return nil
+	}
+
+	for _, child := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		if err := t.render(ctx, w, tileset, filter, z+1, 2*x+child[0], 2*y+child[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerTilesetRoutes lets clients ask for the tileset of an area and download it once
+// it's built.
+func registerTilesetRoutes(group *echo.Group, db *mongo.Database, tilesets *markerTilesets, cfg Config) {
+	group.GET("/tileset", func(c echo.Context) error {
+		area := ""
+		if bbox, ok, err := parseBBox(c); err != nil {
+			c.Logger().Info(err)
+			return c.JSON(http.StatusBadRequest, Error{err})
+		} else if ok {
+			area = bbox.String()
+		}
+
+		ctx := c.Request().Context()
+		location := "/api/v1/export/tileset"
+		if area != "" {
+			location += "?bbox=" + url.QueryEscape(area)
+		}
+
+		var tileset Tileset
+		err := db.Collection("tilesets").FindOne(ctx, bson.M{
+			"bbox":      area,
+			"maxZoom":   cfg.TilesetMaxZoom,
+			"status":    bson.M{"$in": bson.A{ExportQueued, ExportRunning, ExportCompleted}},
+			"createdAt": bson.M{"$gt": time.Now().UTC().Add(-cfg.TilesetMaxAge)},
+		}, options.FindOne().SetSort(bson.M{"createdAt": -1})).Decode(&tileset)
+		if err == nil {
+			if tileset.Status != ExportCompleted {
+				c.Response().Header().Set(echo.HeaderLocation, location)
+				return c.JSON(http.StatusAccepted, tileset)
+			}
+
+			tileset.URL = publicURL(c, cfg) + "/api/v1/export/tilesets/" + tileset.ID + "/archive"
+			return c.JSON(http.StatusOK, tileset)
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		now := time.Now().UTC()
+		tileset = Tileset{
+			ID:        primitive.NewObjectID().Hex(),
+			BBox:      area,
+			MaxZoom:   cfg.TilesetMaxZoom,
+			Status:    ExportQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		if _, err := db.Collection("tilesets").InsertOne(ctx, tileset); err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		tilesets.enqueue(tileset.ID)
+
+		c.Response().Header().Set(echo.HeaderLocation, location)
+		return c.JSON(http.StatusAccepted, tileset)
+	})
+	group.GET("/tilesets/:id/archive", func(c echo.Context) error {
+		var tileset Tileset
+		if err := db.Collection("tilesets").FindOne(c.Request().Context(), bson.M{"_id": c.Param("id"), "status": ExportCompleted}).Decode(&tileset); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				s := "tileset not found"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusNotFound, ErrorString{s})
+			}
+
+			c.Logger().Error(err)
+			return c.JSON(http.StatusServiceUnavailable, Error{err})
+		}
+
+		name := fmt.Sprintf("images-on-map-markers-%s.pmtiles", tileset.CreatedAt.Format("20060102"))
+		return c.Attachment(tilesets.path(tileset.ID), name)
+	})
+}
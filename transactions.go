@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errNoTransactions is returned for operations that must be atomic on deployments
+// without transactions.
+var errNoTransactions = errors.New("transactions need a replica set or a sharded cluster")
+
+// errRolledBack is returned by transaction functions to roll back without a failure of
+// the database.
+var errRolledBack = errors.New("rolled back")
+
+// transactionSupport remembers per client whether the deployment has transactions.
+var transactionSupport sync.Map
+
+// supportsTransactions reports whether the deployment behind db is a replica set or a
+// sharded cluster. Standalone servers refuse transactions.
+func supportsTransactions(ctx context.Context, db *mongo.Database) (bool, error) {
+	client := db.Client()
+	if v, ok := transactionSupport.Load(client); ok {
+		return v.(bool), nil
+	}
+
+	var reply struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply); err != nil {
+		return false, err
+	}
+
+	supported := reply.SetName != "" || reply.Msg == "isdbgrid"
+	transactionSupport.Store(client, supported)
+	return supported, nil
+}
+
+// inTransaction runs fn in a transaction, so either all of its writes happen or none
+// do. On standalone servers fn runs without one like before transactions were used, use
+// inRequiredTransaction when that isn't acceptable. Inside a transaction fn runs as part
+// of it. fn is retried on transient errors and must only have effects on the database,
+// e.g. notifications are sent once it returned.
+func inTransaction(ctx context.Context, db *mongo.Database, fn func(ctx context.Context) error) error {
+	return transaction(ctx, db, false, fn)
+}
+
+// inRequiredTransaction is inTransaction failing with errNoTransactions on standalone
+// servers.
+func inRequiredTransaction(ctx context.Context, db *mongo.Database, fn func(ctx context.Context) error) error {
+	return transaction(ctx, db, true, fn)
+}
+
+func transaction(ctx context.Context, db *mongo.Database, required bool, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	supported, err := supportsTransactions(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if !supported {
+		if required {
+			return errNoTransactions
+		}
+
+		return fn(ctx)
+	}
+
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	hooks := &commitHooks{}
+	_, err = session.WithTransaction(context.WithValue(ctx, commitHooksKey{}, hooks), func(sc mongo.SessionContext) (interface{}, error) {
+		// Hooks of attempts that were retried are dropped.
+		hooks.fns = nil
+		return nil, fn(sc)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range hooks.fns {
+		fn()
+	}
+
+	return nil
+}
+
+type commitHooksKey struct{}
+
+type commitHooks struct {
+	fns []func()
+}
+
+// afterCommit runs fn once the transaction of ctx is committed, it isn't run if the
+// transaction is aborted. Outside of transactions fn runs right away.
+func afterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(commitHooksKey{}).(*commitHooks); ok {
+		hooks.fns = append(hooks.fns, fn)
+		return
+	}
+
+	fn()
+}
+
+// parseAtomic reads the atomic query parameter of operations that can be all or nothing.
+func parseAtomic(c echo.Context) (bool, error) {
+	param := c.QueryParam("atomic")
+	if param == "" {
+		return false, nil
+	}
+
+	atomic, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, fmt.Errorf("atomic must be true or false")
+	}
+
+	return atomic, nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// csvColumns are the columns of CSV exports. Tags are separated by semicolons and
+// images are stored as JSON.
+var csvColumns = []string{
+	"id", "name", "latitude", "longitude", "tags", "description", "descriptionFormat",
+	"ownerId", "private", "expiresAt", "createdAt", "updatedAt", "images",
+	"altitude", "accuracy",
+}
+
+type markerFeature struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Geometry struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// feature converts the marker to a GeoJSON point with the rest of the marker as properties.
+func feature(m Marker) (markerFeature, error) {
+	f := markerFeature{Type: "Feature", ID: m.ID}
+	f.Geometry.Type = "Point"
+	f.Geometry.Coordinates = []float64{m.Location.Longitude, m.Location.Latitude}
+	if m.Location.Altitude != nil {
+		f.Geometry.Coordinates = append(f.Geometry.Coordinates, *m.Location.Altitude)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return f, err
+	}
+
+	var properties map[string]json.RawMessage
+	if err := json.Unmarshal(data, &properties); err != nil {
+		return f, err
+	}
+
+	delete(properties, "id")
+	delete(properties, "location")
+	if m.Location.Accuracy != nil {
+		if properties["accuracy"], err = json.Marshal(*m.Location.Accuracy); err != nil {
+			return f, err
+		}
+	}
+
+	f.Properties, err = json.Marshal(properties)
+	return f, err
+}
+
+func csvRecord(m Marker) ([]string, error) {
+	images, err := json.Marshal(m.Images)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := ""
+	if m.ExpiresAt != nil {
+		expiresAt = m.ExpiresAt.Format(time.RFC3339)
+	}
+
+	return []string{
+		m.ID,
+		m.Name,
+		strconv.FormatFloat(m.Location.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(m.Location.Longitude, 'f', -1, 64),
+		strings.Join(m.Tags, ";"),
+		m.Description,
+		m.DescriptionFormat,
+		m.OwnerID,
+		strconv.FormatBool(m.Private),
+		expiresAt,
+		m.CreatedAt.Format(time.RFC3339),
+		m.UpdatedAt.Format(time.RFC3339),
+		string(images),
+		formatOptional(m.Location.Altitude),
+		formatOptional(m.Location.Accuracy),
+	}, nil
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return ""
+	}
+
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// exportMarkers streams the markers of the collection matching the filter to w and
+// returns how many were written.
+func exportMarkers(ctx context.Context, markers *mongo.Collection, filter bson.M, format string, w io.Writer) (int, error) {
+	if format != "geojson" && format != "csv" {
+		return 0, fmt.Errorf("unsupported export format %q, expected geojson or csv", format)
+	}
+
+	cursor, err := markers.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetBatchSize(1000))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return 0, err
+		}
+	} else if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for cursor.Next(ctx) {
+		var marker Marker
+		if err := cursor.Decode(&marker); err != nil {
+			return count, err
+		}
+
+		marker = marker.Normalize()
+		if cw != nil {
+			record, err := csvRecord(marker)
+			if err != nil {
+				return count, err
+			}
+
+			if err := cw.Write(record); err != nil {
+				return count, err
+			}
+		} else {
+			f, err := feature(marker)
+			if err != nil {
+				return count, err
+			}
+
+			data, err := json.Marshal(f)
+			if err != nil {
+				return count, err
+			}
+
+			if count > 0 {
+				data = append([]byte{','}, data...)
+			}
+
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return count, err
+			}
+		}
+
+		count++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+
+	if cw != nil {
+		cw.Flush()
+		return count, cw.Error()
+	}
+
+	_, err = io.WriteString(w, "]}\n")
+	return count, err
+}
+
+// decodeMarkers reads markers written by exportMarkers.
+func decodeMarkers(format string, r io.Reader) ([]Marker, error) {
+	switch format {
+	case "geojson":
+		var collection struct {
+			Features []markerFeature `json:"features"`
+		}
+		if err := json.NewDecoder(r).Decode(&collection); err != nil {
+			return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+		}
+
+		markers := make([]Marker, 0, len(collection.Features))
+		for i, f := range collection.Features {
+			var marker Marker
+			if len(f.Properties) > 0 {
+				if err := json.Unmarshal(f.Properties, &marker); err != nil {
+					return nil, fmt.Errorf("feature %d: invalid properties: %w", i, err)
+				}
+			}
+
+			if len(f.Geometry.Coordinates) < 2 {
+				return nil, fmt.Errorf("feature %d: expected a point", i)
+			}
+
+			var extra struct {
+				Accuracy *float64 `json:"accuracy"`
+			}
+			if len(f.Properties) > 0 {
+				if err := json.Unmarshal(f.Properties, &extra); err != nil {
+					return nil, fmt.Errorf("feature %d: invalid properties: %w", i, err)
+				}
+			}
+
+			marker.ID = f.ID
+			marker.Location = Coords{Latitude: f.Geometry.Coordinates[1], Longitude: f.Geometry.Coordinates[0], Accuracy: extra.Accuracy}
+			if len(f.Geometry.Coordinates) > 2 {
+				marker.Location.Altitude = &f.Geometry.Coordinates[2]
+			}
+			markers = append(markers, marker)
+		}
+
+		return markers, nil
+	case "csv":
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[name] = i
+		}
+
+		for _, name := range []string{"name", "latitude", "longitude"} {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("invalid CSV: missing %s column", name)
+			}
+		}
+
+		var markers []Marker
+		for line := 2; ; line++ {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return markers, nil
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid CSV: %w", err)
+			}
+
+			marker, err := csvMarker(columns, record)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			markers = append(markers, marker)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format %q, expected geojson, csv or google-takeout", format)
+	}
+}
+
+func csvMarker(columns map[string]int, record []string) (Marker, error) {
+	get := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+
+		return ""
+	}
+
+	var m Marker
+	var err error
+	m.ID, m.Name = get("id"), get("name")
+	m.Description, m.DescriptionFormat, m.OwnerID = get("description"), get("descriptionFormat"), get("ownerId")
+
+	if m.Location.Latitude, err = strconv.ParseFloat(get("latitude"), 64); err != nil {
+		return m, fmt.Errorf("invalid latitude")
+	}
+
+	if m.Location.Longitude, err = strconv.ParseFloat(get("longitude"), 64); err != nil {
+		return m, fmt.Errorf("invalid longitude")
+	}
+
+	for name, field := range map[string]**float64{"altitude": &m.Location.Altitude, "accuracy": &m.Location.Accuracy} {
+		if v := get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return m, fmt.Errorf("invalid %s", name)
+			}
+
+			*field = &f
+		}
+	}
+
+	if tags := get("tags"); tags != "" {
+		m.Tags = strings.Split(tags, ";")
+	}
+
+	if v := get("private"); v != "" {
+		if m.Private, err = strconv.ParseBool(v); err != nil {
+			return m, fmt.Errorf("invalid private")
+		}
+	}
+
+	for name, t := range map[string]*time.Time{"createdAt": &m.CreatedAt, "updatedAt": &m.UpdatedAt} {
+		if v := get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return m, fmt.Errorf("invalid %s", name)
+			}
+		}
+	}
+
+	if v := get("expiresAt"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return m, fmt.Errorf("invalid expiresAt")
+		}
+
+		m.ExpiresAt = &expiresAt
+	}
+
+	if v := get("images"); v != "" {
+		if err := json.Unmarshal([]byte(v), &m.Images); err != nil {
+			return m, fmt.Errorf("invalid images: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// restoreMarkers stores exported markers keeping their ids and timestamps. Markers
+// whose id is taken are counted as duplicates. A non-empty owner replaces the owners
+// from the file.
+func restoreMarkers(ctx context.Context, db *mongo.Database, markers []Marker, owner string) (ImportSummary, error) {
+	summary := ImportSummary{}
+	for _, m := range markers {
+		summary.Total++
+
+		if m.ID == "" {
+			m.ID = primitive.NewObjectID().Hex()
+		}
+
+		if err := m.Validate(); err != nil {
+			summary.reject("%s: %v", m.ID, err)
+			continue
+		}
+
+		if owner != "" {
+			m.OwnerID = owner
+		}
+
+		restored := m.Normalize().created(m.OwnerID)
+		if !m.CreatedAt.IsZero() {
+			restored.CreatedAt, restored.UpdatedAt = m.CreatedAt, m.UpdatedAt
+		}
+
+		if restored.UpdatedAt.Before(restored.CreatedAt) {
+			restored.UpdatedAt = restored.CreatedAt
+		}
+
+		if err := insertMarker(ctx, db, restored); err != nil {
+			var mongoErr mongo.WriteException
+			if errors.As(err, &mongoErr) && mongoErr.HasErrorCode(11000) {
+				summary.Duplicates++
+				continue
+			}
+
+			return summary, err
+		}
+
+		summary.Created++
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserRecord is what the server knows about a user. Identities come from bearer tokens,
+// records are created the first time a user makes an authenticated request.
+type UserRecord struct {
+	ID         string    `json:"id" bson:"_id"`
+	Name       string    `json:"name" bson:"name"`
+	Email      string    `json:"email" bson:"email"`
+	Disabled   bool      `json:"disabled" bson:"disabled"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt" bson:"lastSeenAt"`
+
+	Settings UserSettings `json:"settings" bson:"settings"`
+}
+
+// userDirectory keeps user records up to date and remembers for a short while whether
+// an account is disabled, so authenticated requests don't each hit the database.
+type userDirectory struct {
+	db  *mongo.Database
+	ttl time.Duration
+
+	mu   sync.Mutex
+	seen map[string]userStatus
+}
+
+type userStatus struct {
+	disabled  bool
+	checkedAt time.Time
+}
+
+func newUserDirectory(db *mongo.Database, ttl time.Duration) *userDirectory {
+	return &userDirectory{db: db, ttl: ttl, seen: map[string]userStatus{}}
+}
+
+func (d *userDirectory) disabled(ctx context.Context, user User) (bool, error) {
+	d.mu.Lock()
+	status, ok := d.seen[user.ID]
+	d.mu.Unlock()
+
+	if ok && time.Since(status.checkedAt) < d.ttl {
+		return status.disabled, nil
+	}
+
+	now := time.Now().UTC()
+	var record UserRecord
+	if err := d.db.Collection("users").FindOneAndUpdate(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{
+			"$set":         bson.M{"name": user.Name, "email": user.Email, "lastSeenAt": now},
+			"$setOnInsert": bson.M{"disabled": false, "createdAt": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&record); err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	d.seen[user.ID] = userStatus{disabled: record.Disabled, checkedAt: time.Now()}
+	d.mu.Unlock()
+
+	return record.Disabled, nil
+}
+
+// forget drops the cached status so changes made by admins apply right away.
+func (d *userDirectory) forget(id string) {
+	d.mu.Lock()
+	delete(d.seen, id)
+	d.mu.Unlock()
+}
+
+// rejectDisabled records authenticated users and rejects requests of disabled accounts.
+func (d *userDirectory) rejectDisabled() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, ok := currentUser(c)
+			if !ok {
+				return next(c)
+			}
+
+			disabled, err := d.disabled(c.Request().Context(), user)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusServiceUnavailable, Error{err})
+			}
+
+			if disabled {
+				s := "account is disabled"
+				c.Logger().Info(s)
+				return c.JSON(http.StatusForbidden, ErrorString{s})
+			}
+
+			return next(c)
+		}
+	}
+}
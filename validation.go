@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+// FieldError describes a single failing field. Field is the JSON path of the field,
+// such as images[0].uri, and Code is the name of the failed rule.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every failing field of a request body.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, f := range e {
+		messages = append(messages, f.Field+": "+f.Message)
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// ValidationFailed is the response to a request body with invalid fields.
+type ValidationFailed struct {
+	Error  string           `json:"error"`
+	Fields ValidationErrors `json:"fields"`
+}
+
+var validate = newValidate()
+
+func newValidate() *validator.Validate {
+	v := validator.New()
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+
+		return name
+	})
+
+	v.RegisterValidation("notblank", func(fl validator.FieldLevel) bool {
+		return strings.TrimSpace(fl.Field().String()) != ""
+	})
+	v.RegisterValidation("future", func(fl validator.FieldLevel) bool {
+		t, ok := fl.Field().Interface().(time.Time)
+		return ok && t.After(time.Now())
+	})
+	v.RegisterValidation("language", func(fl validator.FieldLevel) bool {
+		return languagePattern.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("emoji", func(fl validator.FieldLevel) bool {
+		return isEmoji(fl.Field().String())
+	})
+
+	return v
+}
+
+// maxEmojiRunes fits the longest emoji sequences, e.g. families with skin tones.
+const maxEmojiRunes = 10
+
+// isEmoji reports whether s is a single emoji: a pictograph, optionally followed by
+// skin tones, variation selectors and keycaps, or pictographs joined by zero width
+// joiners. Flags are pairs of regional indicators or tag sequences.
+func isEmoji(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 || len(runes) > maxEmojiRunes || !unicode.Is(unicode.So, runes[0]) {
+		return false
+	}
+
+	for i, r := range runes[1:] {
+		switch {
+		case r == 0x200d:
+			// A joiner has to be followed by another pictograph.
+			if i+2 >= len(runes) || !unicode.Is(unicode.So, runes[i+2]) {
+				return false
+			}
+		case r == 0xfe0f, r == 0x20e3, r >= 0x1f3fb && r <= 0x1f3ff, r >= 0xe0020 && r <= 0xe007f:
+		case unicode.Is(unicode.So, r) && (runes[i] == 0x200d || isRegionalIndicator(r) && isRegionalIndicator(runes[i])):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// validateStruct checks the validate tags of s and reports all failing fields.
+func validateStruct(s interface{}) error {
+	return validationErrors(validate.Struct(s))
+}
+
+// validatePartial is validateStruct limited to the named struct fields.
+func validatePartial(s interface{}, fields ...string) error {
+	return validationErrors(validate.StructPartial(s, fields...))
+}
+
+func validationErrors(err error) error {
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return err
+	}
+
+	fields := make(ValidationErrors, 0, len(invalid))
+	for _, f := range invalid {
+		fields = append(fields, FieldError{
+			Field:   fieldPath(f.Namespace()),
+			Code:    f.Tag(),
+			Message: fieldMessage(f),
+		})
+	}
+
+	return fields
+}
+
+// fieldPath drops the struct name the validator puts in front of the JSON path.
+func fieldPath(namespace string) string {
+	if i := strings.IndexByte(namespace, '.'); i >= 0 {
+		return namespace[i+1:]
+	}
+
+	return namespace
+}
+
+func fieldMessage(f validator.FieldError) string {
+	switch f.Tag() {
+	case "required":
+		return "is required"
+	case "notblank":
+		return "must not be blank"
+	case "future":
+		return "must be in the future"
+	case "emoji":
+		return "must be a single emoji"
+	case "language":
+		return "must be a language tag such as en or pt-BR"
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", strings.ReplaceAll(f.Param(), " ", ", "))
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", f.Param())
+	case "gte", "min":
+		return boundMessage(f, "at least")
+	case "lte", "max":
+		return boundMessage(f, "at most")
+	}
+
+	return fmt.Sprintf("failed %s validation", f.Tag())
+}
+
+func boundMessage(f validator.FieldError, bound string) string {
+	switch f.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("must be %s %s characters long", bound, f.Param())
+	case reflect.Slice:
+		return fmt.Sprintf("must have %s %s items", bound, f.Param())
+	}
+
+	return fmt.Sprintf("must be %s %s", bound, f.Param())
+}
+
+// structValidator is the echo validator. Types with their own Validate method keep
+// using it, others are checked by their validate tags.
+type structValidator struct{}
+
+func (structValidator) Validate(i interface{}) error {
+	if v, ok := i.(interface{ Validate() error }); ok {
+		return v.Validate()
+	}
+
+	return validateStruct(i)
+}
+
+// validationFailed responds to a request body that didn't pass validation, listing
+// the failing fields if there are any.
+func validationFailed(c echo.Context, err error) error {
+	c.Logger().Info(err)
+
+	var fields ValidationErrors
+	if errors.As(err, &fields) {
+		return c.JSON(http.StatusBadRequest, ValidationFailed{Error: "invalid request body", Fields: fields})
+	}
+
+	return c.JSON(http.StatusBadRequest, Error{err})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const clamdChunkSize = 64 * 1024
+
+// clamd scans files with the ClamAV daemon over its INSTREAM protocol.
+type clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// newClamd returns nil if CLAMD_ADDRESS isn't set. Addresses starting with / are unix
+// sockets, anything else is host:port.
+func newClamd(cfg Config) *clamd {
+	if cfg.ClamdAddress == "" {
+		return nil
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(cfg.ClamdAddress, "/") {
+		network = "unix"
+	}
+
+	return &clamd{network: network, address: cfg.ClamdAddress, timeout: cfg.ClamdTimeout}
+}
+
+// scan streams the file to clamd and returns the name of the signature it matched, empty
+// if the file is clean.
+func (s *clamd) scan(ctx context.Context, r io.Reader) (signature string, err error) {
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", fmt.Errorf("can't connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("can't send file to clamd: %w", err)
+	}
+
+	// The file is sent in chunks prefixed with their length, an empty chunk ends it.
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", fmt.Errorf("can't send file to clamd: %w", err)
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("can't send file to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("can't read clamd reply: %w", err)
+	}
+
+	// Replies are "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+	reply = strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// InfectedUpload is the error returned for uploads rejected by the virus scanner.
+type InfectedUpload struct {
+	Error     string `json:"error"`
+	Signature string `json:"signature"`
+}
+
+// scanUploads rejects request bodies clamd finds infected before they reach the handler.
+// Uploads are refused while clamd is unreachable, deployments that configure it can't
+// accept unscanned files. Nothing is scanned when clamd isn't configured.
+func scanUploads(scanner *clamd, db *mongo.Database) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if scanner == nil || req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+				return next(c)
+			}
+
+			// The body is spooled to disk, it's read twice.
+			f, err := os.CreateTemp("", "upload-*")
+			if err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusInternalServerError, Error{err})
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			size, err := io.Copy(f, req.Body)
+			if err != nil {
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					return httpErr
+				}
+
+				c.Logger().Info(err)
+				return c.JSON(http.StatusBadRequest, Error{err})
+			}
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusInternalServerError, Error{err})
+			}
+
+			signature, err := scanner.scan(req.Context(), f)
+			if err != nil {
+				c.Logger().Error(err)
+				s := "uploads can't be scanned for viruses, retry later"
+				return c.JSON(http.StatusServiceUnavailable, ErrorString{s})
+			}
+
+			if signature != "" {
+				user, _ := currentUser(c)
+				details := bson.M{"path": req.URL.Path, "size": size, "signature": signature}
+				if err := recordAudit(req.Context(), db, user.ID, "upload.infected", nil, details); err != nil {
+					c.Logger().Error(err)
+				}
+
+				s := "upload rejected, file is infected"
+				c.Logger().Warn(fmt.Sprintf("%s: %s", s, signature))
+				return c.JSON(http.StatusUnprocessableEntity, InfectedUpload{s, signature})
+			}
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				c.Logger().Error(err)
+				return c.JSON(http.StatusInternalServerError, Error{err})
+			}
+
+			req.Body = io.NopCloser(f)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// visibilityFilter restricts marker queries to markers the current user may see:
+// public, published markers that aren't hidden pending review or in a hiding privacy
+// zone and their own ones. Moderators also see hidden markers, admins see everything.
+// Expired markers are hidden from everybody.
+func visibilityFilter(c echo.Context) bson.M {
+	user, ok := currentUser(c)
+	return visibilityFor(user, ok)
+}
+
+// visibilityFor is visibilityFilter for work done outside of a request, authenticated
+// is false for anonymous users.
+func visibilityFor(user User, authenticated bool) bson.M {
+	now := time.Now().UTC()
+	unexpired := notExpired(now)
+
+	if !authenticated {
+		return and(unexpired, published(now), bson.M{
+			"private":     bson.M{"$ne": true},
+			"moderation":  bson.M{"$ne": ModerationPending},
+			"privacyZone": bson.M{"$ne": ZoneHide},
+		})
+	}
+
+	if user.HasRole(RoleAdmin) {
+		return unexpired
+	}
+
+	private := bson.M{"$or": bson.A{
+		bson.M{"private": bson.M{"$ne": true}},
+		bson.M{"ownerId": user.ID},
+	}}
+	scheduled := bson.M{"$or": bson.A{published(now), bson.M{"ownerId": user.ID}}}
+	hidden := bson.M{"$or": bson.A{
+		bson.M{"privacyZone": bson.M{"$ne": ZoneHide}},
+		bson.M{"ownerId": user.ID},
+	}}
+	if user.HasRole(RoleModerator) {
+		return and(unexpired, private, scheduled, hidden)
+	}
+
+	return and(unexpired, private, scheduled, hidden, bson.M{"$or": bson.A{
+		bson.M{"moderation": bson.M{"$ne": ModerationPending}},
+		bson.M{"ownerId": user.ID},
+	}})
+}
+
+// outsideZones leaves markers in privacy zones out of geo queries, such as bounds,
+// distances and cells, for everybody but their owners and admins. Listings show fuzzed
+// markers snapped to the grid, but matching their stored locations would give the exact
+// place away.
+func outsideZones(c echo.Context) bson.M {
+	user, ok := currentUser(c)
+	return outsideZonesFor(user, ok)
+}
+
+// outsideZonesFor is outsideZones for work done outside of a request.
+func outsideZonesFor(user User, authenticated bool) bson.M {
+	outside := bson.M{"privacyZone": bson.M{"$exists": false}}
+	if !authenticated {
+		return outside
+	}
+
+	if user.HasRole(RoleAdmin) {
+		return nil
+	}
+
+	return bson.M{"$or": bson.A{outside, bson.M{"ownerId": user.ID}}}
+}
+
+// sharedVisibility restricts markers shown through share links the way visibilityFor
+// does for anonymous users, except that private markers are shown.
+func sharedVisibility() bson.M {
+	now := time.Now().UTC()
+	return and(notExpired(now), published(now), bson.M{"moderation": bson.M{"$ne": ModerationPending}})
+}
+
+func notExpired(now time.Time) bson.M {
+	return bson.M{"expiresAt": bson.M{"$not": bson.M{"$lte": now}}}
+}
+
+// published matches markers that aren't waiting for their publishAt. The scheduler
+// clears publishAt shortly after it passes, until then queries check the time.
+func published(now time.Time) bson.M {
+	return bson.M{"publishAt": bson.M{"$not": bson.M{"$gt": now}}}
+}
+
+// visibleMarker returns a filter matching the marker with the given id if the current
+// user may see it.
+func visibleMarker(c echo.Context, id string) bson.M {
+	return and(bson.M{"_id": id}, visibilityFilter(c))
+}
+
+// markerVisible reports whether the marker exists and the current user may see it.
+func markerVisible(c echo.Context, db *mongo.Database, id string) (bool, error) {
+	err := db.Collection("markers").FindOne(c.Request().Context(), visibleMarker(c, id), options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// storedMarker returns the owner, location and revision of a stored marker, found is
+// false if there is no such marker.
+func storedMarker(ctx context.Context, db *mongo.Database, id string) (Marker, bool, error) {
+	var marker Marker
+	err := db.Collection("markers").FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"ownerId": 1, "location": 1, "revision": 1})).Decode(&marker)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Marker{}, false, nil
+	}
+
+	if err != nil {
+		return Marker{}, false, err
+	}
+
+	return marker, true, nil
+}
+
+// canModify reports whether the current user may change a marker with the given owner.
+// Markers created anonymously have no owner and stay editable by everyone.
+func canModify(c echo.Context, ownerID string) bool {
+	if ownerID == "" {
+		return true
+	}
+
+	user, ok := currentUser(c)
+	return ok && (user.ID == ownerID || user.HasRole(RoleAdmin))
+}
+
+// publicOrOwned restricts queries on user documents such as collections and routes to
+// public ones and the current user's own ones.
+func publicOrOwned(c echo.Context) bson.M {
+	user, ok := currentUser(c)
+	if !ok {
+		return bson.M{"public": true}
+	}
+
+	if user.HasRole(RoleAdmin) {
+		return nil
+	}
+
+	return bson.M{"$or": bson.A{bson.M{"public": true}, bson.M{"ownerId": user.ID}}}
+}
+
+// ownedDocument matches the user document with the given id if the current user may change it.
+func ownedDocument(c echo.Context, id string) bson.M {
+	user, _ := currentUser(c)
+	if user.HasRole(RoleAdmin) {
+		return bson.M{"_id": id}
+	}
+
+	return bson.M{"_id": id, "ownerId": user.ID}
+}
+
+// markersByIDs loads markers keeping the order of ids. Markers the user can't see or
+// that were deleted are skipped.
+func markersByIDs(c echo.Context, db *mongo.Database, ids []string) ([]Marker, error) {
+	cursor, err := db.Collection("markers").Find(c.Request().Context(), and(bson.M{"_id": bson.M{"$in": ids}}, visibilityFilter(c)))
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []Marker
+	if err := cursor.All(context.Background(), &markers); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Marker, len(markers))
+	for _, marker := range markers {
+		byID[marker.ID] = marker
+	}
+
+	results := make([]Marker, 0, len(ids))
+	for _, id := range ids {
+		if marker, ok := byID[id]; ok {
+			results = append(results, marker.Normalize())
+		}
+	}
+
+	return results, nil
+}